@@ -13,10 +13,10 @@ var db string
 var hdl1 = konfig.ConfigUpdateHandler{
 	Name: "database",
 	Handle: func(prev, cur interface{}) error {
-		fmt.Printf("* previous config: %+v\n", prev)
-		fmt.Printf("* current config: %+v\n", cur)
 		pc, _ := prev.(config.Sample)
 		cc, _ := cur.(config.Sample)
+		// Only fields in use are printed, full config may contain secrets (e.g. database password)
+		fmt.Printf("* previous database address: %v, current database address: %v\n", pc.DB.Address, cc.DB.Address)
 
 		if cc.DB.Address != pc.DB.Address {
 			if pc.DB.Address == "" {
@@ -9,10 +9,13 @@ import (
 )
 
 func main() {
-	_, err := konfig.New(config.Proxy, hdl1, hdl2)
+	opt := konfig.NewBootstrapOptionFromEnvFlag().WithSensitive("db.password")
+	m, err := konfig.NewWithOption(config.Proxy, opt, hdl1, hdl2)
 	if err != nil {
 		log.Fatalf("failed to create new config manager: %v", err)
 	}
+	// Secrets are masked in redacted snapshot, which is safe for logging
+	fmt.Printf("* loaded config: %+v\n", m.RedactedSnapshot())
 
 	for {
 		time.Sleep(5 * time.Second)
@@ -3,9 +3,9 @@ module github.com/mykube-run/kindling
 go 1.16
 
 require (
-	github.com/emirpasic/gods v1.18.1 // indirect
+	github.com/emirpasic/gods v1.18.1
 	github.com/fsnotify/fsnotify v1.5.1
-	github.com/go-resty/resty/v2 v2.7.0 // indirect
+	github.com/go-resty/resty/v2 v2.7.0
 	github.com/google/btree v1.0.0 // indirect
 	github.com/hashicorp/consul/api v1.11.0
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
@@ -16,9 +16,10 @@ require (
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mitchellh/mapstructure v1.4.3
 	github.com/nacos-group/nacos-sdk-go v1.1.0
-	github.com/panjf2000/ants/v2 v2.7.5 // indirect
-	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/panjf2000/ants/v2 v2.7.5
+	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/rs/zerolog v1.26.0
+	github.com/stretchr/testify v1.8.1
 	go.etcd.io/etcd/client/v3 v3.5.1
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.7.0 // indirect
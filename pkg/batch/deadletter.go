@@ -0,0 +1,22 @@
+package batch
+
+// DeadLetterHandler receives tasks failed permanently, i.e. timed out in queue (ErrorTimedOut), failed to be
+// dispatched to the goroutine pool, or abandoned by CloseAndWait, e.g. to persist them for later inspection or replay.
+// Tasks are passed after their errors are set, see QueueTask.GetError
+type DeadLetterHandler func([]QueueTask)
+
+// WithDeadLetterHandler sets the handler receiving tasks failed permanently, see DeadLetterHandler. The handler is
+// called synchronously by queue goroutines, it should return quickly, e.g. by sending tasks to a channel.
+// Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithDeadLetterHandler(hdl DeadLetterHandler) *MemoryBatchQueue {
+	q.dlh = hdl
+	return q
+}
+
+// deadLetter passes failed tasks to the dead letter handler when it's set
+func (q *MemoryBatchQueue) deadLetter(tasks []QueueTask) {
+	if q.dlh == nil || len(tasks) == 0 {
+		return
+	}
+	q.dlh(tasks)
+}
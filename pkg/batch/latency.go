@@ -0,0 +1,108 @@
+package batch
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	// latencySubBuckets is the number of linear sub-buckets in each power of 2 range of latencyHistogram,
+	// values are recorded with a relative error of at most 1/latencySubBuckets
+	latencySubBuckets = 16
+	latencySubBits    = 4 // log2(latencySubBuckets)
+)
+
+// Percentiles latency percentiles of handled batches
+type Percentiles struct {
+	Count int64         // Number of handled batches
+	P50   time.Duration // Median latency
+	P95   time.Duration // 95th percentile latency
+	P99   time.Duration // 99th percentile latency
+	Max   time.Duration // Maximum latency
+}
+
+// latencyHistogram is a log-linear bucketed histogram of latencies in microseconds, similar to HDR histogram,
+// it takes constant memory regardless of the number of recorded values
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []int64 // Number of values recorded in each bucket, see latencyBucket
+	total  int64   // Number of recorded values
+	max    int64   // Maximum recorded value
+}
+
+// record records a latency
+func (h *latencyHistogram) record(d time.Duration) {
+	v := d.Microseconds()
+	if v < 0 {
+		v = 0
+	}
+	idx := latencyBucket(v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if idx >= len(h.counts) {
+		counts := make([]int64, idx+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[idx]++
+	h.total++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// percentiles computes latency percentiles from recorded values
+func (h *latencyHistogram) percentiles() Percentiles {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return Percentiles{
+		Count: h.total,
+		P50:   h.percentile(50),
+		P95:   h.percentile(95),
+		P99:   h.percentile(99),
+		Max:   time.Duration(h.max) * time.Microsecond,
+	}
+}
+
+// percentile returns the highest value equivalent to the bucket which the p-th percentile falls in,
+// must be called with h.mu held
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.total)))
+	var n int64
+	for idx, cnt := range h.counts {
+		if n += cnt; n >= rank {
+			v := latencyBucketMax(idx)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+// latencyBucket returns bucket index of value v. Values less than latencySubBuckets have their own buckets,
+// larger values are divided into power of 2 ranges, each of which is split into latencySubBuckets buckets
+func latencyBucket(v int64) int {
+	if v < latencySubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - latencySubBits - 1
+	return latencySubBuckets*(shift+1) + int(v>>uint(shift)) - latencySubBuckets
+}
+
+// latencyBucketMax returns the highest value of bucket idx
+func latencyBucketMax(idx int) int64 {
+	if idx < latencySubBuckets {
+		return int64(idx)
+	}
+	shift := uint(idx/latencySubBuckets - 1)
+	m := int64(idx%latencySubBuckets + latencySubBuckets)
+	return (m+1)<<shift - 1
+}
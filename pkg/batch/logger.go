@@ -0,0 +1,60 @@
+package batch
+
+import (
+	"fmt"
+	"github.com/mykube-run/kindling/pkg/log"
+)
+
+// TracedQueueTask is an optional interface of QueueTask, the trace id is attached to messages logged by
+// the logger returned from MemoryBatchQueue.TaskLogger
+type TracedQueueTask interface {
+	QueueTask
+
+	// GetTraceId returns trace id of the task, e.g. the request id that the task was created for
+	GetTraceId() string
+}
+
+// TaskLogger returns the queue logger (see WithLogger) enriched with partition and trace id (when t implements
+// TracedQueueTask) of t, which is meant to be used by QueueTaskHandler when logging about specific tasks
+func (q *MemoryBatchQueue) TaskLogger(t QueueTask) log.Logger {
+	fields := fmt.Sprintf("module: BatchQueue, partition: %v", t.GetPartition())
+	if tt, ok := t.(TracedQueueTask); ok && tt.GetTraceId() != "" {
+		fields += fmt.Sprintf(", traceId: %v", tt.GetTraceId())
+	}
+	return &fieldLogger{lg: q.lg, fields: fields}
+}
+
+// partitionLogger returns the queue logger enriched with partition
+func (q *MemoryBatchQueue) partitionLogger(partition string) log.Logger {
+	return &fieldLogger{lg: q.lg, fields: fmt.Sprintf("module: BatchQueue, partition: %v", partition)}
+}
+
+// fieldLogger appends fields to every message before passing it to the underlying logger
+type fieldLogger struct {
+	lg     log.Logger
+	fields string
+}
+
+func (fl *fieldLogger) Trace(msg string) {
+	fl.lg.Trace(fl.with(msg))
+}
+
+func (fl *fieldLogger) Debug(msg string) {
+	fl.lg.Debug(fl.with(msg))
+}
+
+func (fl *fieldLogger) Info(msg string) {
+	fl.lg.Info(fl.with(msg))
+}
+
+func (fl *fieldLogger) Warn(msg string) {
+	fl.lg.Warn(fl.with(msg))
+}
+
+func (fl *fieldLogger) Error(msg string) {
+	fl.lg.Error(fl.with(msg))
+}
+
+func (fl *fieldLogger) with(msg string) string {
+	return msg + ", " + fl.fields
+}
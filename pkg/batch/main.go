@@ -1,10 +1,12 @@
 package batch
 
+import "time"
+
 // Queue consistently accepts and buffers incoming tasks in underlying queue,
 // reorganizes buffered tasks in batches, finally processes task batches in parallel.
 // There are 2 circumstances in which tasks are processed - when the number of buffered
 // tasks is greater than batch size, or the very first queued task has been waiting for a
-// time longer than DefaultTaskWaitDuration.
+// time longer than QueueOptions.TaskWaitDuration (DefaultTaskWaitDuration by default).
 // The size of a batch is provided by BatchSizeProvider and queued tasks are partitioned
 // accordingly, e.g. by model id.
 type Queue interface {
@@ -18,6 +20,15 @@ type Queue interface {
 	Closed() bool
 }
 
+// GracefulQueue is a Queue that can be drained on shutdown, implemented by MemoryBatchQueue and RedisBatchQueue
+type GracefulQueue interface {
+	Queue
+
+	// CloseAndWait closes the queue and blocks until queued tasks are finished or timeout elapses, tasks not
+	// finished by then are finished with context.DeadlineExceeded and an error is returned
+	CloseAndWait(timeout time.Duration) error
+}
+
 // QueueTask defines required methods for a request that can be processed by Queue.
 // The QueueTask must be able to know when all tasks that are originally queued together are finished,
 // e.g. keeping a finished task counter.
@@ -63,6 +74,13 @@ func (qt QueueTasks) Payload() []interface{} {
 	return ret
 }
 
+// PushAndWait pushes tasks in q and blocks until all of them are finished (with results or errors set), without the
+// caller managing the channel returned by Queue.Push. Returns the number sent to the channel, i.e. 0 when tasks are
+// rejected (e.g. the queue is closing). Waiting is bound to this push, the same tasks can be pushed and waited again
+func (qt QueueTasks) PushAndWait(q Queue) int64 {
+	return <-q.Push(qt...)
+}
+
 // BatchSizeProvider provides a reasonable batch size for queued tasks for specified partition name
 type BatchSizeProvider interface {
 	Get(string) int
@@ -1,17 +1,21 @@
 package batch
 
 import (
+	"context"
 	"fmt"
 	llq "github.com/emirpasic/gods/queues/linkedlistqueue"
+	"github.com/mykube-run/kindling/pkg/log"
 	"github.com/panjf2000/ants/v2"
-	"github.com/rs/zerolog/log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Package level defaults of QueueOptions, changes take effect on queues created afterwards
 var (
 	DefaultTaskWaitDuration int64 = 50
 	DefaultQueueConsumeRate       = 100
+	DefaultDrainTimeout           = time.Second * 30
 	ErrorTimedOut                 = fmt.Errorf("task timed out in queue")
 )
 
@@ -19,39 +23,122 @@ const (
 	FlagAboutToClose = iota + 1
 	FlagClosing
 	FlagClosed
-	ConsumerInterval = 10
+	ConsumerInterval = 10 // Default interval in milliseconds of iterating partitions, see QueueOptions
+	ProducerInterval = 10 // Default interval in milliseconds of moving tasks into partition queues, see QueueOptions
 )
 
+// taskBuffer is a FIFO buffer of tasks, backing both the main queue and partition queues of MemoryBatchQueue
+// (partition queues switch to priorityBuffer once a PriorityQueueTask is pushed, see PriorityQueueTask).
+// Implementations are not required to be thread-safe, callers hold the corresponding lock
+type taskBuffer interface {
+	Enqueue(v interface{})
+	Dequeue() (interface{}, bool)
+	Size() int
+	Clear()
+	Values() []interface{}
+}
+
+// newTaskBuffer creates task buffers of MemoryBatchQueue, defaults to a linked list queue. It's a seam for
+// experimenting with alternative buffering strategies, e.g. ring buffer
+var newTaskBuffer = func() taskBuffer {
+	return llq.New()
+}
+
 // MemoryBatchQueue implements Queue. All tasks are stored in memory
 type MemoryBatchQueue struct {
-	q          *llq.Queue         // The underlying single linked queue, incoming requests are first stored in here
+	// Counters are accessed atomically, placed first to ensure 64-bit alignment, see Stats
+	enqueued  int64 // Number of tasks pushed
+	processed int64 // Number of tasks finished
+	handling  int64 // Number of tasks in batches being handled
+
+	q          taskBuffer         // The underlying task buffer, incoming requests are first stored in here
 	mu         sync.Mutex         // Protects q
 	bsp        BatchSizeProvider  // Batch size provider, provides batch size for specified partition
 	hdl        QueueTaskHandler   // Queue task handler, user business
+	handlers   sync.Map           // A map of partition and partition specific QueueTaskHandler, overrides hdl
+	limits     sync.Map           // A map of partition and semaphore limiting its batches being handled, see SetPartitionConcurrency
+	limit      int                // Default concurrency limit of partitions without a specific one, see WithPartitionConcurrency
 	pool       *ants.PoolWithFunc // Goroutine pool
 	partitions sync.Map           // A map of partition and temporary task queue
-	flag       int                // Queue flag indicates whether the queue is closing
+	flag       int32              // Queue flag (accessed atomically) indicates whether the queue is closing
 	triggerC   chan struct{}      // Channel to trigger partition iteration
+	inflight   chan struct{}      // Semaphore limiting the number of batches being handled at the same time, nil means no limit
+	maxLatency time.Duration      // Queue level latency ceiling, overrides QueueOptions.TaskWaitDuration when shorter
+	latency    sync.Map           // A map of partition and handler latency histogram, see WithLatencyStats
+	latStats   bool               // Whether to collect handler latency of every batch
+	lg         log.Logger         // Logger used when processing batches, see WithLogger
+	opt        QueueOptions       // Queue options with defaults resolved
+
+	taskTimings bool     // Whether to record timings of every task
+	timings     sync.Map // A map of task and its timings record, see WithTaskTimings
+
+	retry  RetryPolicy // Retry policy of tasks failed with ErrRetryable, see WithRetryPolicy
+	tracer Tracer      // Tracer starting a span around every batch handled, see WithTracer
+
+	onFinish  func(QueueTask) // Called once a task is finished, e.g. to remove it from persistent storage, see RedisBatchQueue
+	unhandled sync.Map        // Tasks finished on shutdown without being handled, onFinish is skipped for them, see finishUnhandled
+
+	draining int32    // Set to 1 (atomically) once CloseAndWait is called, new tasks are rejected then
+	batches  sync.Map // A map of batches being handled (*[]QueueTask => []QueueTask), see CloseAndWait
+
+	weights PartitionWeightProvider // Partition weights for weighted fair queuing, see WithPartitionWeights
+	dlh     DeadLetterHandler       // Handler receiving tasks failed permanently, see WithDeadLetterHandler
+
+	done chan struct{} // Closed once background goroutines exit, see Done
+}
+
+// NewMemoryBatchQueue initializes a MemoryBatchQueue. poolSize is the size of goroutine pool. opt is optional, only
+// the first one is used, package level defaults are used when it's omitted, see QueueOptions
+func NewMemoryBatchQueue(bsp BatchSizeProvider, hdl QueueTaskHandler, poolSize int, opt ...QueueOptions) *MemoryBatchQueue {
+	return NewMemoryBatchQueueContext(context.Background(), bsp, hdl, poolSize, opt...)
 }
 
-// NewMemoryBatchQueue initializes a MemoryBatchQueue. poolSize is the size of goroutine pool
-func NewMemoryBatchQueue(bsp BatchSizeProvider, hdl QueueTaskHandler, poolSize int) *MemoryBatchQueue {
+// NewMemoryBatchQueueContext is like NewMemoryBatchQueue, but ties the queue lifecycle to ctx, e.g. the root context
+// of a service: once ctx is done, the queue is closed and drained like CloseAndWait, waiting at most
+// QueueOptions.DrainTimeout. Use Done to wait for background goroutines to exit
+func NewMemoryBatchQueueContext(ctx context.Context, bsp BatchSizeProvider, hdl QueueTaskHandler, poolSize int, opt ...QueueOptions) *MemoryBatchQueue {
 	q := &MemoryBatchQueue{
-		q:        llq.New(),
+		q:        newTaskBuffer(),
 		bsp:      bsp,
 		hdl:      hdl,
 		triggerC: make(chan struct{}),
+		lg:       log.DefaultLogger,
+		done:     make(chan struct{}),
 	}
+	if len(opt) > 0 {
+		q.opt = opt[0]
+	}
+	q.opt = q.opt.withDefaults()
 	fn := func(i interface{}) {
 		tasks, ok := i.([]QueueTask)
 		if !ok || len(tasks) == 0 {
 			return
 		}
 		// Tasks are ensured that all tasks share the same partition name
-		hdl(tasks[0].GetPartition(), tasks)
+		defer q.release()
+		p := tasks[0].GetPartition()
+		defer q.releasePartition(p)
+		var start time.Time
+		if q.latStats {
+			start = time.Now()
+		}
+		for _, t := range tasks {
+			q.recordTiming(t, func(tm *Timings, now time.Time) { tm.Started = now })
+		}
+		q.batches.Store(&tasks, tasks)
+		atomic.AddInt64(&q.handling, int64(len(tasks)))
+		end := q.startBatchSpan(p, tasks)
+		q.handler(p)(p, tasks)
+		end()
+		q.batches.Delete(&tasks)
+		atomic.AddInt64(&q.handling, -int64(len(tasks)))
+		if q.latStats {
+			q.histogram(p).record(time.Since(start))
+		}
 	}
 	q.pool, _ = ants.NewPoolWithFunc(poolSize, fn, ants.WithExpiryDuration(time.Second*10))
 	q.start()
+	q.watch(ctx)
 	return q
 }
 
@@ -61,51 +148,260 @@ func NewMemoryBatchQueue(bsp BatchSizeProvider, hdl QueueTaskHandler, poolSize i
 // When the queue is closing, or tasks is empty, a buffered channel is returned
 // so that caller can go ahead without blocking.
 func (q *MemoryBatchQueue) Push(tasks ...QueueTask) chan int64 {
-	if q.flag > FlagAboutToClose || len(tasks) == 0 {
+	return q.PushContext(context.Background(), tasks...)
+}
+
+// PushContext is like Push, but stops waiting when ctx is done, e.g. the caller's request is abandoned: tasks that
+// are not finished yet are marked with ctx.Err() via SetError, so that the finish number is sent right away.
+// When the queue is full (see QueueOptions.MaxQueueSize), tasks are rejected with ErrQueueFull, or ctx.Err() when ctx
+// is done while blocking for space, 0 is sent to the channel then.
+// The channel is buffered and closed after the finish number is sent, nothing is leaked when caller stops
+// listening on it. A task is finished only once, i.e. handling results of cancelled tasks are not counted.
+// NOTE: Cancelled tasks that are already buffered are still handled
+func (q *MemoryBatchQueue) PushContext(ctx context.Context, tasks ...QueueTask) chan int64 {
+	if q.rejecting() || len(tasks) == 0 {
 		// If the queue was closed, or tasks is empty, return a buffered
 		// channel to avoid blocking on this call
 		finishC := make(chan int64, 1)
 		finishC <- 0
+		close(finishC)
 		return finishC
 	}
 
-	q.mu.Lock()
+	if err := q.admit(ctx, len(tasks)); err != nil {
+		for _, t := range tasks {
+			t.WithFinishFunc(func() {})
+			t.SetError(err)
+		}
+		finishC := make(chan int64, 1)
+		finishC <- 0
+		close(finishC)
+		return finishC
+	}
 	defer q.mu.Unlock()
 
 	var (
-		mu       sync.Mutex         // Mutex lock to protect the counter
-		n        = len(tasks)       // Number of tasks
-		finished = 0                // Finished task counter
-		finishC  = make(chan int64) // Must be blocking
+		mu       sync.Mutex            // Mutex lock to protect the counter
+		n        = len(tasks)          // Number of tasks
+		finished = 0                   // Finished task counter
+		fins     = make([]bool, n)     // Whether each task is finished, a task is counted only once
+		attempts = make([]int, n)      // Number of attempts of each task, see WithRetryPolicy
+		finishC  = make(chan int64, 1) // Buffered, so that callers can stop listening on it
+		done     = make(chan struct{}) // Closed when all tasks are finished
 	)
+	atomic.AddInt64(&q.enqueued, int64(n))
 
 	for i := range tasks {
+		i, t := i, tasks[i]
+		q.recordTiming(t, func(tm *Timings, now time.Time) { tm.Pushed = now })
 
 		// Closure function to notify whether tasks are processed
-		fn := func() {
+		var fn func()
+		fn = func() {
 			mu.Lock()
+			if fins[i] {
+				mu.Unlock()
+				return
+			}
+			if attempts[i]++; q.maybeRetry(t, attempts[i], fn) {
+				mu.Unlock()
+				return
+			}
+			fins[i] = true
 			finished++
+			all := finished == n
 			mu.Unlock()
 
-			if finished == n /* All task finished */ {
-				finishC <- int64(finished)
+			q.recordTiming(t, func(tm *Timings, now time.Time) { tm.Finished = now })
+			atomic.AddInt64(&q.processed, 1)
+			if q.onFinish != nil {
+				if _, unhandled := q.unhandled.LoadAndDelete(t); !unhandled {
+					q.onFinish(t)
+				}
+			}
+			if all /* All task finished */ {
+				close(done)
+				finishC <- int64(n)
+				close(finishC)
 			}
 		}
 		tasks[i].WithFinishFunc(fn)
 		q.q.Enqueue(tasks[i])
 	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				mu.Lock()
+				pending := make([]QueueTask, 0)
+				for i, t := range tasks {
+					if !fins[i] {
+						pending = append(pending, t)
+					}
+				}
+				mu.Unlock()
+				for _, t := range pending {
+					t.SetError(ctx.Err())
+				}
+			case <-done:
+			}
+		}()
+	}
 	return finishC
 }
 
-func (q *MemoryBatchQueue) Close() error {
-	if q.flag == 0 {
-		q.flag = FlagAboutToClose
+// finishUnhandled finishes t with err on shutdown, without t being handled. onFinish is skipped for such tasks,
+// e.g. so that RedisBatchQueue keeps them persisted and restores them next time
+func (q *MemoryBatchQueue) finishUnhandled(t QueueTask, err error) {
+	if q.onFinish != nil /* Tasks are comparable then, see NewRedisBatchQueue */ {
+		q.unhandled.Store(t, struct{}{})
+	}
+	t.SetError(err)
+}
+
+// admit locks q.mu once there is enough space for n tasks, see QueueOptions.MaxQueueSize. Returns ErrQueueFull when
+// tasks are rejected, or ctx.Err() when ctx is done while waiting for space, q.mu is not locked then
+func (q *MemoryBatchQueue) admit(ctx context.Context, n int) error {
+	max := int64(q.opt.MaxQueueSize)
+	for {
+		q.mu.Lock()
+		if max <= 0 || q.Depth()+int64(n) <= max {
+			return nil
+		}
+		q.mu.Unlock()
+		if q.opt.DropPolicy == DropPolicyReject || int64(n) > max {
+			return ErrQueueFull
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(q.opt.ProducerInterval):
+		}
+	}
+}
+
+// PushCollect pushes QueueTasks in queue like Push, returns a channel delivering the pushed tasks
+// (with results or errors set) once all of them are processed. The channel is buffered and receives
+// exactly one value, so that the caller is free to stop listening on it.
+// When the queue is closing, or tasks is empty, tasks are delivered right away without being processed.
+func (q *MemoryBatchQueue) PushCollect(tasks ...QueueTask) <-chan []QueueTask {
+	resultC := make(chan []QueueTask, 1)
+	finishC := q.Push(tasks...)
+	go func() {
+		<-finishC
+		resultC <- tasks
+	}()
+	return resultC
+}
+
+// SetPartitionHandler registers a QueueTaskHandler for specified partition, e.g. for tenant specific logic.
+// Batches of partitions without a registered handler are handled by the default handler passed to
+// NewMemoryBatchQueue. Setting a nil handler removes the partition handler.
+func (q *MemoryBatchQueue) SetPartitionHandler(partition string, hdl QueueTaskHandler) {
+	if hdl == nil {
+		q.handlers.Delete(partition)
+		return
 	}
+	q.handlers.Store(partition, hdl)
+}
+
+// WithMaxInFlightBatches limits the number of batches being handled at the same time to n regardless of
+// pool size, e.g. to protect downstream services. Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithMaxInFlightBatches(n int) *MemoryBatchQueue {
+	if n > 0 {
+		q.inflight = make(chan struct{}, n)
+	}
+	return q
+}
+
+// WithPartitionConcurrency limits the number of batches of every single partition being handled at the same time to
+// n, so that a partition with a large backlog does not monopolize the goroutine pool. Partitions having reached the
+// limit are not popped until their batches finish. Limits set by SetPartitionConcurrency take precedence.
+// Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithPartitionConcurrency(n int) *MemoryBatchQueue {
+	q.limit = n
+	return q
+}
+
+// SetPartitionConcurrency limits the number of batches of specified partition being handled at the same time to n,
+// see WithPartitionConcurrency. Setting n <= 0 removes the partition limit. Batches being handled are not affected,
+// i.e. the new limit applies to batches handled later
+func (q *MemoryBatchQueue) SetPartitionConcurrency(partition string, n int) {
+	if n <= 0 {
+		q.limits.Delete(partition)
+		return
+	}
+	q.limits.Store(partition, make(chan struct{}, n))
+}
+
+// WithMaxLatency sets a queue level latency ceiling, any buffered task is ensured to be processed within d
+// regardless of partition fill. It takes effect only when d is shorter than QueueOptions.TaskWaitDuration.
+// Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithMaxLatency(d time.Duration) *MemoryBatchQueue {
+	q.maxLatency = d
+	return q
+}
+
+// WithLatencyStats enables collecting handler latency of every batch per partition, see LatencyStats.
+// Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithLatencyStats() *MemoryBatchQueue {
+	q.latStats = true
+	return q
+}
+
+// WithLogger sets the logger used when processing batches, defaults to log.DefaultLogger, see also TaskLogger.
+// Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithLogger(lg log.Logger) *MemoryBatchQueue {
+	if lg != nil {
+		q.lg = lg
+	}
+	return q
+}
+
+// LatencyStats returns handler latency percentiles of specified partition, a zero Percentiles is returned
+// when latency stats is not enabled or no batch of the partition has been handled
+func (q *MemoryBatchQueue) LatencyStats(partition string) Percentiles {
+	if h, ok := q.latency.Load(partition); ok {
+		return h.(*latencyHistogram).percentiles()
+	}
+	return Percentiles{}
+}
+
+// Snapshot returns all tasks currently buffered in the queue (including partition queues) without processing them,
+// e.g. for inspecting queue contents in tests or admin endpoints. Tasks being handled are not included, neither are
+// tasks in transit from the queue to partition queues at the moment
+func (q *MemoryBatchQueue) Snapshot() []QueueTask {
+	q.mu.Lock()
+	vals := q.q.Values()
+	q.mu.Unlock()
+
+	tasks := make([]QueueTask, 0, len(vals))
+	for i := range vals {
+		tasks = append(tasks, vals[i].(QueueTask))
+	}
+	q.partitions.Range(func(_, v interface{}) bool {
+		pq := v.(*partitionQueue)
+		pq.mu.Lock()
+		tasks = append(tasks, pq.tasks()...)
+		pq.mu.Unlock()
+		return true
+	})
+	return tasks
+}
+
+func (q *MemoryBatchQueue) Close() error {
+	atomic.CompareAndSwapInt32(&q.flag, 0, FlagAboutToClose)
 	return nil
 }
 
 func (q *MemoryBatchQueue) Closed() bool {
-	return q.flag == FlagClosed
+	return q.loadFlag() == FlagClosed
+}
+
+// loadFlag returns the queue flag atomically
+func (q *MemoryBatchQueue) loadFlag() int32 {
+	return atomic.LoadInt32(&q.flag)
 }
 
 // popN removes n QueueTasks from memory queue and returns them
@@ -124,6 +420,23 @@ func (q *MemoryBatchQueue) popN(n int) []QueueTask {
 	return tasks
 }
 
+// handler returns QueueTaskHandler for given partition name, falls back to the default handler
+func (q *MemoryBatchQueue) handler(v string) QueueTaskHandler {
+	if hdl, ok := q.handlers.Load(v); ok {
+		return hdl.(QueueTaskHandler)
+	}
+	return q.hdl
+}
+
+// histogram returns handler latency histogram of given partition name
+func (q *MemoryBatchQueue) histogram(v string) *latencyHistogram {
+	if h, ok := q.latency.Load(v); ok {
+		return h.(*latencyHistogram)
+	}
+	h, _ := q.latency.LoadOrStore(v, new(latencyHistogram))
+	return h.(*latencyHistogram)
+}
+
 // partitionBatchSize returns partition batch size for given partition name
 func (q *MemoryBatchQueue) partitionBatchSize(v string) int {
 	return q.bsp.Get(v)
@@ -131,6 +444,7 @@ func (q *MemoryBatchQueue) partitionBatchSize(v string) int {
 
 // pushPartitionQueue pushes a QueueTask into temporary partition queue
 func (q *MemoryBatchQueue) pushPartitionQueue(v QueueTask) {
+	q.recordTiming(v, func(tm *Timings, now time.Time) { tm.Partitioned = now })
 	s, ok := q.partitions.Load(v.GetPartition())
 	if ok {
 		s.(*partitionQueue).push(v)
@@ -149,6 +463,7 @@ func (q *MemoryBatchQueue) pushPartitionQueue(v QueueTask) {
 // process splits multiple QueueTasks into batches, invoke them within the goroutine pool
 func (q *MemoryBatchQueue) process(tasks []QueueTask, batchSize int) {
 	l := len(tasks)
+	lg := q.partitionLogger(tasks[0].GetPartition())
 	ns := l / batchSize
 	if ns*batchSize < l {
 		ns += 1
@@ -161,24 +476,109 @@ func (q *MemoryBatchQueue) process(tasks []QueueTask, batchSize int) {
 			hi = l
 		}
 		tmp := tasks[lo:hi]
+		q.acquire()
+		q.acquirePartition(tmp[0].GetPartition())
 		if err := q.pool.Invoke(tmp); err != nil {
-			log.Err(err).Msg("failed to invoke pool function")
+			q.release()
+			q.releasePartition(tmp[0].GetPartition())
+			lg.Error(fmt.Sprintf("failed to invoke pool function: %v", err))
 			for _, t := range tmp {
 				t.SetError(err)
 			}
+			q.deadLetter(tmp)
 		}
-		log.Trace().Int("batch", i).Int("batchSize", len(tmp)).Int("total", l).
-			Msg("processed batch")
+		lg.Trace(fmt.Sprintf("processed batch, batch: %v, batchSize: %v, total: %v", i, len(tmp), l))
+	}
+}
+
+// acquire blocks until the number of in-flight batches is below the limit
+func (q *MemoryBatchQueue) acquire() {
+	if q.inflight != nil {
+		q.inflight <- struct{}{}
 	}
 }
 
+// release marks an in-flight batch as finished
+func (q *MemoryBatchQueue) release() {
+	if q.inflight != nil {
+		<-q.inflight
+	}
+}
+
+// partitionSemaphore returns the semaphore limiting batches of given partition being handled, nil means no limit
+func (q *MemoryBatchQueue) partitionSemaphore(v string) chan struct{} {
+	if sem, ok := q.limits.Load(v); ok {
+		return sem.(chan struct{})
+	}
+	if q.limit <= 0 {
+		return nil
+	}
+	sem, _ := q.limits.LoadOrStore(v, make(chan struct{}, q.limit))
+	return sem.(chan struct{})
+}
+
+// acquirePartition blocks until the number of batches of given partition being handled is below the limit
+func (q *MemoryBatchQueue) acquirePartition(v string) {
+	if sem := q.partitionSemaphore(v); sem != nil {
+		sem <- struct{}{}
+	}
+}
+
+// releasePartition marks a batch of given partition as finished
+func (q *MemoryBatchQueue) releasePartition(v string) {
+	if sem := q.partitionSemaphore(v); sem != nil {
+		select {
+		case <-sem:
+		default: // The limit was replaced by SetPartitionConcurrency after the batch was started, which may
+			// briefly allow more batches than the new limit
+		}
+	}
+}
+
+// partitionCapacity returns the maximum number of tasks of given partition that can be handled right now without
+// exceeding its concurrency limit, -1 means no limit
+func (q *MemoryBatchQueue) partitionCapacity(v string, size int) int {
+	sem := q.partitionSemaphore(v)
+	if sem == nil {
+		return -1
+	}
+	return (cap(sem) - len(sem)) * size
+}
+
+// taskWaitDuration returns the maximum duration in milliseconds that the first task in partition can wait
+func (q *MemoryBatchQueue) taskWaitDuration() int64 {
+	wait := q.opt.TaskWaitDuration.Milliseconds()
+	if q.maxLatency > 0 {
+		// Tasks may wait for another producer & consumer interval before being popped
+		ml := (q.maxLatency - q.opt.ProducerInterval - q.opt.ConsumerInterval).Milliseconds()
+		if ml < 0 {
+			ml = 0
+		}
+		if ml < wait {
+			wait = ml
+		}
+	}
+	return wait
+}
+
 func (q *MemoryBatchQueue) iteratePartitions() {
+	wait := q.taskWaitDuration()
+	if atomic.LoadInt32(&q.draining) == 1 /* Pop partitions right away, see CloseAndWait */ {
+		wait = -1
+	}
+	if q.weights != nil {
+		q.iterateWeightedPartitions(wait)
+		return
+	}
 	q.partitions.Range(func(k, v interface{}) bool {
 		size := q.partitionBatchSize(k.(string))
-		tasks := v.(*partitionQueue).maybePop(size)
+		max := q.partitionCapacity(k.(string), size)
+		if max == 0 /* Partition is at its concurrency limit */ {
+			return true
+		}
+		tasks := v.(*partitionQueue).maybePop(size, wait, max)
 		if len(tasks) != 0 {
-			log.Trace().Str("module", "BatchQueue").Int("tasks", len(tasks)).
-				Str("partition", k.(string)).Msg("popped tasks")
+			q.partitionLogger(k.(string)).Trace(fmt.Sprintf("popped tasks, tasks: %v", len(tasks)))
 			q.process(tasks, size)
 		}
 		return true
@@ -188,9 +588,18 @@ func (q *MemoryBatchQueue) iteratePartitions() {
 // start starts 2 goroutines in background, one pulls from memory and pushes tasks into partitionQueue,
 // while the other one loops over all partitions, fetch task batches and process them
 func (q *MemoryBatchQueue) start() {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		wg.Wait()
+		close(q.done)
+	}()
+
 	// task partition consumer
 	go func() {
-		ticker := time.NewTicker(time.Millisecond * ConsumerInterval)
+		defer wg.Done()
+		ticker := time.NewTicker(q.opt.ConsumerInterval)
+		defer ticker.Stop()
 
 		for {
 			select {
@@ -202,44 +611,48 @@ func (q *MemoryBatchQueue) start() {
 			case <-q.triggerC:
 				{
 					// log.Trace().Msg("by triggerC")
-					ticker.Reset(time.Millisecond * ConsumerInterval)
+					ticker.Reset(q.opt.ConsumerInterval)
 					q.iteratePartitions()
 				}
 			}
 			// Double check to avoid leaking tasks
-			if q.flag == FlagClosed {
+			if q.loadFlag() == FlagClosed {
 				break
 			}
-			if q.flag == FlagClosing {
+			if q.loadFlag() == FlagClosing && (atomic.LoadInt32(&q.draining) == 0 || q.partitionsEmpty()) {
 				// Will exit the for loop after next iteration
-				q.flag = FlagClosed
+				atomic.StoreInt32(&q.flag, FlagClosed)
 			}
 		}
 	}()
 
 	// task partition producer
 	go func() {
+		defer wg.Done()
 		for {
-			if q.flag == FlagClosing {
+			if q.loadFlag() >= FlagClosing /* The consumer may have marked the queue closed already */ {
 				break
 			}
-			tasks := q.popN(DefaultQueueConsumeRate)
-			if q.flag == FlagAboutToClose && len(tasks) == 0 {
-				q.flag = FlagClosing
+			tasks := q.popN(q.opt.ConsumeRate)
+			if len(tasks) == 0 {
+				atomic.CompareAndSwapInt32(&q.flag, FlagAboutToClose, FlagClosing)
 			}
 
+			var timedOut []QueueTask
 			for i, t := range tasks {
 				if t.IsTimeout() {
 					t.SetError(ErrorTimedOut)
+					timedOut = append(timedOut, t)
 				} else {
 					q.pushPartitionQueue(tasks[i])
 				}
 			}
+			q.deadLetter(timedOut)
 
 			if len(tasks) > 0 {
 				q.triggerC <- struct{}{}
 			}
-			time.Sleep(time.Millisecond * 10)
+			time.Sleep(q.opt.ProducerInterval)
 		}
 	}()
 }
@@ -247,13 +660,13 @@ func (q *MemoryBatchQueue) start() {
 // partitionQueue is a temporary queue for partition, does not hold tasks too long
 type partitionQueue struct {
 	mu          sync.Mutex
-	q           *llq.Queue
+	q           taskBuffer
 	firstQueued int64 // Timestamp in milliseconds when the first task is pushed into the partitionQueue
 }
 
 func newPartitionQueue() *partitionQueue {
 	return &partitionQueue{
-		q: llq.New(),
+		q: newTaskBuffer(),
 	}
 }
 
@@ -262,6 +675,9 @@ func (pq *partitionQueue) push(v QueueTask) {
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
 
+	if _, ok := v.(PriorityQueueTask); ok {
+		pq.prioritize()
+	}
 	pq.q.Enqueue(v)
 	pq.maybeFirstTaskQueued()
 }
@@ -282,13 +698,22 @@ func (pq *partitionQueue) tasks() []QueueTask {
 	return tasks
 }
 
-// maybePop checks whether there are enough tasks to form a batch, or first queued is ready to go.
-// When condition is met, returns tasks and reset itself
-func (pq *partitionQueue) maybePop(n int) []QueueTask {
+// maybePop checks whether there are enough tasks to form a batch, or first queued has waited longer than wait
+// (in milliseconds). When condition is met, returns tasks and reset itself. At most max tasks are returned when
+// max is positive, the rest are kept (and are ready to be popped next time)
+func (pq *partitionQueue) maybePop(n int, wait int64, max int) []QueueTask {
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
 
-	if pq.q.Size() >= n || pq.isFirstTaskReady() {
+	if pq.q.Size() >= n || pq.isFirstTaskReady(wait) {
+		if max > 0 && pq.q.Size() > max {
+			tasks := make([]QueueTask, 0, max)
+			for len(tasks) < max {
+				v, _ := pq.q.Dequeue()
+				tasks = append(tasks, v.(QueueTask))
+			}
+			return tasks
+		}
 		tasks := pq.tasks()
 		pq.reset()
 		return tasks
@@ -297,8 +722,8 @@ func (pq *partitionQueue) maybePop(n int) []QueueTask {
 }
 
 // isFirstTaskReady compares the firstQueued with current timestamp
-func (pq *partitionQueue) isFirstTaskReady() bool {
-	return time.Now().UnixNano()/1e6-pq.firstQueued > DefaultTaskWaitDuration
+func (pq *partitionQueue) isFirstTaskReady(wait int64) bool {
+	return time.Now().UnixNano()/1e6-pq.firstQueued > wait
 }
 
 // maybeFirstTaskQueued when first task is queued (after creation or reset), updates the firstQueued timestamp
@@ -310,5 +735,5 @@ func (pq *partitionQueue) maybeFirstTaskQueued() {
 
 // isEmpty returns whether partition queue is empty
 func (pq *partitionQueue) isEmpty() bool {
-	return pq.q.Empty()
+	return pq.q.Size() == 0
 }
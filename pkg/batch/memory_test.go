@@ -1,9 +1,16 @@
 package batch
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	llq "github.com/emirpasic/gods/queues/linkedlistqueue"
 	"github.com/rs/zerolog"
 	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -120,3 +127,1116 @@ func TestMemoryBatchTaskQueue(t *testing.T) {
 		fmt.Println("batch finished")
 	}
 }
+
+func TestMemoryBatchQueue_WithMaxInFlightBatches(t *testing.T) {
+	var (
+		bsp     = new(TestBatchSizeProvider)
+		k       = 2
+		running int64
+		max     int64
+	)
+	var hdl = func(pid string, tasks []QueueTask) {
+		cur := atomic.AddInt64(&running, 1)
+		for {
+			prev := atomic.LoadInt64(&max)
+			if cur <= prev || atomic.CompareAndSwapInt64(&max, prev, cur) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt64(&running, -1)
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithMaxInFlightBatches(k)
+
+	tasks := NewTestQueueTasks(80)
+	<-q.Push(tasks...)
+
+	if max > int64(k) {
+		t.Fatalf("expecting at most %v batches running simultaneously, got %v", k, max)
+	}
+	if max == 0 {
+		t.Fatalf("expecting batches to be handled")
+	}
+}
+
+func TestMemoryBatchQueue_WithMaxLatency(t *testing.T) {
+	DefaultTaskWaitDuration = 1000
+	defer func() { DefaultTaskWaitDuration = 50 }()
+
+	var (
+		bsp        = new(TestBatchSizeProvider)
+		maxLatency = 100 * time.Millisecond
+	)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithMaxLatency(maxLatency)
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		<-q.Push(NewTestQueueTasks(1)...)
+		if elapsed := time.Since(start); elapsed > maxLatency {
+			t.Fatalf("expecting task to be processed within %v, took %v", maxLatency, elapsed)
+		}
+	}
+}
+
+func TestMemoryBatchQueue_PushCollect(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			if v.(*TestQueueTask).Index%2 == 0 {
+				v.SetResult(v.GetPayload().(string))
+			} else {
+				v.SetError(fmt.Errorf("error %v", v.GetPayload()))
+			}
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10)
+
+	n := 20
+	var results []QueueTask
+	select {
+	case results = <-q.PushCollect(NewTestQueueTasks(n)...):
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting collected tasks to be delivered")
+	}
+	if len(results) != n {
+		t.Fatalf("expecting %v tasks, got %v", n, len(results))
+	}
+	for _, v := range results {
+		task := v.(*TestQueueTask)
+		if task.Index%2 == 0 && task.GetResult() != task.Payload {
+			t.Fatalf("expecting task %v result to be set, got %v", task.Index, task.GetResult())
+		}
+		if task.Index%2 == 1 && task.GetError() == nil {
+			t.Fatalf("expecting task %v error to be set", task.Index)
+		}
+	}
+
+	if results = <-q.PushCollect(); len(results) != 0 {
+		t.Fatalf("expecting no task, got %v", len(results))
+	}
+}
+
+func TestQueueTasks_PushAndWait(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		time.Sleep(time.Duration(rand.Int63n(100)) * time.Millisecond)
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10)
+
+	tasks := QueueTasks(NewTestQueueTasks(20))
+	if n := tasks.PushAndWait(q); n != 20 {
+		t.Fatalf("expecting 20 tasks to be finished, got %v", n)
+	}
+	for _, v := range tasks {
+		if v.GetResult() != "partition" {
+			t.Fatalf("expecting task %v to be finished", v.(*TestQueueTask).Index)
+		}
+	}
+
+	// Waiting is bound to a push, the same tasks can be pushed and waited again
+	for _, v := range tasks {
+		v.(*TestQueueTask).Result = ""
+	}
+	if n := tasks.PushAndWait(q); n != 20 {
+		t.Fatalf("expecting 20 tasks to be finished again, got %v", n)
+	}
+	for _, v := range tasks {
+		if v.GetResult() != "partition" {
+			t.Fatalf("expecting task %v to be finished again", v.(*TestQueueTask).Index)
+		}
+	}
+}
+
+func TestMemoryBatchQueue_SetPartitionHandler(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(name string) QueueTaskHandler {
+		return func(pid string, tasks []QueueTask) {
+			for _, v := range tasks {
+				v.SetResult(name + "/" + pid)
+			}
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl("default"), 10)
+	q.SetPartitionHandler("tenant-a", hdl("a"))
+	q.SetPartitionHandler("tenant-b", hdl("b"))
+	q.SetPartitionHandler("tenant-c", hdl("c"))
+	q.SetPartitionHandler("tenant-c", nil)
+
+	tasks := make(QueueTasks, 0)
+	for _, p := range []string{"tenant-a", "tenant-b", "tenant-c"} {
+		for _, v := range NewTestQueueTasks(10) {
+			v.(*TestQueueTask).Partition = p
+			tasks = append(tasks, v)
+		}
+	}
+	tasks.PushAndWait(q)
+
+	expected := map[string]string{
+		"tenant-a": "a/tenant-a",
+		"tenant-b": "b/tenant-b",
+		"tenant-c": "default/tenant-c",
+	}
+	for _, v := range tasks {
+		if p := v.GetPartition(); v.GetResult() != expected[p] {
+			t.Fatalf("expecting task of partition %v to be handled as %v, got %v", p, expected[p], v.GetResult())
+		}
+	}
+}
+
+func TestMemoryBatchQueue_LatencyStats(t *testing.T) {
+	h := new(latencyHistogram)
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	ps := h.percentiles()
+	expected := map[time.Duration]time.Duration{
+		ps.P50: 50 * time.Millisecond,
+		ps.P95: 95 * time.Millisecond,
+		ps.P99: 99 * time.Millisecond,
+		ps.Max: 100 * time.Millisecond,
+	}
+	for got, want := range expected {
+		// Values are recorded with a relative error of at most 1/latencySubBuckets
+		if got < want || got > want+want/latencySubBuckets {
+			t.Fatalf("expecting percentile around %v, got %v", want, got)
+		}
+	}
+	if ps.Count != 100 {
+		t.Fatalf("expecting 100 recorded latencies, got %v", ps.Count)
+	}
+
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		time.Sleep(time.Millisecond * 20)
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithLatencyStats()
+	tasks := QueueTasks(NewTestQueueTasks(16))
+	tasks.PushAndWait(q)
+	// Latency is recorded after handler returns, which may be slightly later than tasks are finished
+	for i := 0; i < 100 && q.LatencyStats("partition").Count == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	ps = q.LatencyStats("partition")
+	if ps.Count == 0 || ps.P50 < time.Millisecond*20 {
+		t.Fatalf("expecting handler latency to be collected, got %+v", ps)
+	}
+	if ps = q.LatencyStats("not-exist"); ps.Count != 0 {
+		t.Fatalf("expecting no latency of unknown partition, got %+v", ps)
+	}
+}
+
+func TestMemoryBatchQueue_Snapshot(t *testing.T) {
+	DefaultTaskWaitDuration = 1000
+	defer func() { DefaultTaskWaitDuration = 50 }()
+
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10)
+
+	// Less tasks than batch size, tasks are buffered until DefaultTaskWaitDuration elapses
+	tasks := NewTestQueueTasks(5)
+	finishC := q.Push(tasks...)
+	var snapshot []QueueTask
+	for i := 0; i < 50 && len(snapshot) != len(tasks); i++ {
+		snapshot = q.Snapshot()
+		time.Sleep(time.Millisecond * 5)
+	}
+	if len(snapshot) != len(tasks) {
+		t.Fatalf("expecting %v tasks in snapshot, got %v", len(tasks), len(snapshot))
+	}
+	seen := make(map[int]bool)
+	for _, v := range snapshot {
+		seen[v.(*TestQueueTask).Index] = true
+	}
+	if len(seen) != len(tasks) {
+		t.Fatalf("expecting all tasks in snapshot, got %v", seen)
+	}
+
+	// Tasks are read after they are finished, handler sets results concurrently before that
+	<-finishC
+	for _, v := range tasks {
+		if v.GetResult() != "partition" {
+			t.Fatalf("expecting tasks to be processed by handler rather than Snapshot, got result %v", v.GetResult())
+		}
+	}
+	if n := len(q.Snapshot()); n != 0 {
+		t.Fatalf("expecting empty snapshot after tasks are processed, got %v", n)
+	}
+}
+
+// ringBuffer a growable ring buffer implementing taskBuffer
+type ringBuffer struct {
+	vals  []interface{}
+	head  int
+	size  int
+	total *int32 // Number of tasks enqueued into all ring buffers
+}
+
+func (b *ringBuffer) Enqueue(v interface{}) {
+	if b.size == len(b.vals) {
+		vals := make([]interface{}, len(b.vals)*2+1)
+		copy(vals, b.Values())
+		b.vals, b.head = vals, 0
+	}
+	b.vals[(b.head+b.size)%len(b.vals)] = v
+	b.size++
+	atomic.AddInt32(b.total, 1)
+}
+
+func (b *ringBuffer) Dequeue() (interface{}, bool) {
+	if b.size == 0 {
+		return nil, false
+	}
+	v := b.vals[b.head]
+	b.vals[b.head] = nil
+	b.head = (b.head + 1) % len(b.vals)
+	b.size--
+	return v, true
+}
+
+func (b *ringBuffer) Size() int {
+	return b.size
+}
+
+func (b *ringBuffer) Clear() {
+	b.vals, b.head, b.size = nil, 0, 0
+}
+
+func (b *ringBuffer) Values() []interface{} {
+	vals := make([]interface{}, 0, b.size)
+	for i := 0; i < b.size; i++ {
+		vals = append(vals, b.vals[(b.head+i)%len(b.vals)])
+	}
+	return vals
+}
+
+func TestMemoryBatchQueue_TaskBuffer(t *testing.T) {
+	var (
+		buffers int32
+		total   int32
+	)
+	newTaskBuffer = func() taskBuffer {
+		atomic.AddInt32(&buffers, 1)
+		return &ringBuffer{total: &total}
+	}
+	defer func() {
+		newTaskBuffer = func() taskBuffer { return llq.New() }
+	}()
+
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(v.GetPayload().(string))
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10)
+
+	n := 20
+	tasks := NewTestQueueTasks(n)
+	select {
+	case <-q.Push(tasks...):
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting tasks to be processed")
+	}
+	for _, v := range tasks {
+		if v.GetResult() != v.GetPayload() {
+			t.Fatalf("expecting task %v result to be set, got %v", v.(*TestQueueTask).Index, v.GetResult())
+		}
+	}
+	// Every task goes through the main buffer and its partition buffer
+	if b, tot := atomic.LoadInt32(&buffers), atomic.LoadInt32(&total); b < 2 || tot != int32(n*2) {
+		t.Fatalf("expecting tasks to be buffered by ring buffers, buffers: %v, enqueued: %v", b, tot)
+	}
+}
+
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (lg *recordingLogger) record(msg string) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.msgs = append(lg.msgs, msg)
+}
+
+func (lg *recordingLogger) messages(prefix string) (out []string) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	for _, v := range lg.msgs {
+		if strings.HasPrefix(v, prefix) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (lg *recordingLogger) Trace(msg string) { lg.record(msg) }
+func (lg *recordingLogger) Debug(msg string) { lg.record(msg) }
+func (lg *recordingLogger) Info(msg string)  { lg.record(msg) }
+func (lg *recordingLogger) Warn(msg string)  { lg.record(msg) }
+func (lg *recordingLogger) Error(msg string) { lg.record(msg) }
+
+type tracedTestQueueTask struct {
+	*TestQueueTask
+	traceId string
+}
+
+func (t *tracedTestQueueTask) GetTraceId() string {
+	return t.traceId
+}
+
+func TestMemoryBatchQueue_WithLogger(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	lg := new(recordingLogger)
+	var q *MemoryBatchQueue
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			q.TaskLogger(v).Info("handling task")
+			v.SetResult(pid)
+		}
+	}
+	q = NewMemoryBatchQueue(bsp, hdl, 10).WithLogger(lg)
+
+	tasks := make(QueueTasks, 0)
+	for i, v := range NewTestQueueTasks(20) {
+		tasks = append(tasks, &tracedTestQueueTask{TestQueueTask: v.(*TestQueueTask), traceId: fmt.Sprintf("trace-%v", i)})
+	}
+	tasks.PushAndWait(q)
+
+	// Batches are logged after being dispatched, which may happen after tasks are finished
+	var (
+		processed []string
+		n         int
+		deadline  = time.Now().Add(time.Second)
+	)
+	for n != 20 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		processed, n = lg.messages("processed batch"), 0
+		for _, v := range processed {
+			if !strings.Contains(v, "partition: partition") {
+				t.Fatalf("expecting partition in message: %v", v)
+			}
+			var i, size int
+			if _, err := fmt.Sscanf(v, "processed batch, batch: %d, batchSize: %d", &i, &size); err != nil {
+				t.Fatalf("unexpected message: %v", v)
+			}
+			n += size
+		}
+	}
+	if n != 20 {
+		t.Fatalf("expecting 20 tasks in processed batch messages, got %v: %v", n, processed)
+	}
+	handled := lg.messages("handling task")
+	if len(handled) != 20 {
+		t.Fatalf("expecting 20 task messages, got %v", len(handled))
+	}
+	for _, v := range handled {
+		if !strings.Contains(v, "partition: partition, traceId: trace-") {
+			t.Fatalf("expecting partition and trace id in message: %v", v)
+		}
+	}
+}
+
+func TestMemoryBatchQueue_TaskTimings(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		time.Sleep(time.Millisecond * 5)
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithTaskTimings()
+	tasks := QueueTasks(NewTestQueueTasks(20))
+	tasks.PushAndWait(q)
+
+	for _, v := range tasks {
+		tm := q.TaskTimings(v)
+		if tm.Pushed.IsZero() || tm.Partitioned.Before(tm.Pushed) || tm.Started.Before(tm.Partitioned) ||
+			tm.Finished.Sub(tm.Started) < time.Millisecond*5 {
+			t.Fatalf("expecting timings to be populated and ordered, got %+v", tm)
+		}
+		if tm = q.TaskTimings(v); !tm.Pushed.IsZero() {
+			t.Fatalf("expecting timings of finished task to be removed once retrieved")
+		}
+	}
+
+	q = NewMemoryBatchQueue(bsp, hdl, 10)
+	tasks = NewTestQueueTasks(1)
+	tasks.PushAndWait(q)
+	if tm := q.TaskTimings(tasks[0]); tm != (Timings{}) {
+		t.Fatalf("expecting no timings when disabled, got %+v", tm)
+	}
+}
+
+func TestMemoryBatchQueue_Stats(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	block := make(chan struct{})
+	var hdl = func(pid string, tasks []QueueTask) {
+		<-block
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10)
+	finishC := q.Push(NewTestQueueTasks(8)...)
+
+	// The first batch is blocked in handler
+	deadline := time.Now().Add(time.Second)
+	for q.Stats().InFlight != 8 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	st := q.Stats()
+	if st.TotalEnqueued != 8 || st.TotalProcessed != 0 || st.InFlight != 8 || st.Backlog() != 8 {
+		t.Fatalf("unexpected stats while handling: %+v", st)
+	}
+	close(block)
+	<-finishC
+
+	st = q.Stats()
+	if st.TotalEnqueued != 8 || st.TotalProcessed != 8 || st.Backlog() != 0 || st.Partitions["partition"] != 0 {
+		t.Fatalf("unexpected stats after handling: %+v", st)
+	}
+	// InFlight is decreased after handler returns
+	for q.Stats().InFlight != 0 && time.Now().Before(deadline.Add(time.Second)) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if n := q.Stats().InFlight; n != 0 {
+		t.Fatalf("expecting no task in flight, got %v", n)
+	}
+}
+
+func TestMemoryBatchQueue_PushContext(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	block := make(chan struct{})
+	var hdl = func(pid string, tasks []QueueTask) {
+		<-block
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10)
+	defer close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	tasks := NewTestQueueTasks(10)
+	finishC := q.PushContext(ctx, tasks...)
+	select {
+	case n := <-finishC:
+		if n != 10 {
+			t.Fatalf("expecting 10 finished tasks, got %v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting to stop waiting once context is done")
+	}
+	for _, v := range tasks {
+		if err := v.GetError(); err != context.DeadlineExceeded {
+			t.Fatalf("expecting pending task to be marked with context error, got %v", err)
+		}
+	}
+	if _, ok := <-finishC; ok {
+		t.Fatalf("expecting finish channel to be closed")
+	}
+}
+
+func TestMemoryBatchQueue_AbandonedPush(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10)
+	before := runtime.NumGoroutine()
+
+	// Finish channels are discarded without being read
+	for i := 0; i < 50; i++ {
+		_ = q.Push(NewTestQueueTasks(8)...)
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for q.Stats().TotalProcessed != 400 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if n := q.Stats().TotalProcessed; n != 400 {
+		t.Fatalf("expecting all abandoned tasks to be processed, got %v", n)
+	}
+	// Idle pool workers (at most pool size) may still be alive, while a goroutine per abandoned batch must not
+	for runtime.NumGoroutine() > before+10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if n := runtime.NumGoroutine(); n > before+10 {
+		t.Fatalf("expecting no goroutine to be leaked by abandoned pushes, got %v goroutines (%v before)", n, before)
+	}
+}
+
+func TestMemoryBatchQueue_WithRetryPolicy(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var (
+		mu    sync.Mutex
+		calls = make(map[string]int) // Number of handler calls of every task payload
+	)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			task := v.(*TestQueueTask)
+			mu.Lock()
+			calls[task.Payload]++
+			n := calls[task.Payload]
+			mu.Unlock()
+			switch {
+			case pid == "flaky" && n < 3, pid == "blip" && n < 2:
+				v.SetError(fmt.Errorf("downstream unavailable: %w", ErrRetryable))
+			case pid == "down":
+				v.SetError(fmt.Errorf("downstream unavailable: %w", ErrRetryable))
+			case pid == "slow":
+				time.Sleep(time.Until(task.Until) + time.Millisecond*10)
+				v.SetError(fmt.Errorf("downstream unavailable: %w", ErrRetryable))
+			case pid == "fatal":
+				v.SetError(fmt.Errorf("bad request"))
+			default:
+				v.SetResult(pid)
+			}
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond * 10})
+
+	push := func(partition string) []QueueTask {
+		tasks := NewTestQueueTasks(4)
+		for i, v := range tasks {
+			v.(*TestQueueTask).Partition = partition
+			v.(*TestQueueTask).Payload = fmt.Sprintf("%s-%v", partition, i)
+		}
+		select {
+		case <-q.Push(tasks...):
+		case <-time.After(time.Second * 3):
+			t.Fatalf("expecting tasks of partition %v to be finished", partition)
+		}
+		return tasks
+	}
+	expect := func(tasks []QueueTask, n int, fn func(task *TestQueueTask) bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range tasks {
+			task := v.(*TestQueueTask)
+			if calls[task.Payload] != n || !fn(task) {
+				t.Fatalf("unexpected task %v after %v attempts, result: %v, error: %v", task.Payload, calls[task.Payload], task.Result, task.Error)
+			}
+		}
+	}
+
+	// Transient errors are retried until tasks succeed
+	expect(push("flaky"), 3, func(task *TestQueueTask) bool { return task.Result == "flaky" && task.Error == nil })
+	// Error of a failed attempt is cleared, an attempt succeeding with SetResult only is not retried again
+	expect(push("blip"), 2, func(task *TestQueueTask) bool { return task.Result == "blip" && task.Error == nil })
+	// The last error is kept when retries are exhausted
+	expect(push("down"), 3, func(task *TestQueueTask) bool { return errors.Is(task.Error, ErrRetryable) })
+	// Timed out tasks and fatal errors are never retried
+	expect(push("slow"), 1, func(task *TestQueueTask) bool { return errors.Is(task.Error, ErrRetryable) })
+	expect(push("fatal"), 1, func(task *TestQueueTask) bool { return task.Error != nil && task.Result == "" })
+}
+
+// contextTestQueueTask is a TestQueueTask carrying the context it was created in
+type contextTestQueueTask struct {
+	TestQueueTask
+	ctx context.Context
+}
+
+func (t *contextTestQueueTask) GetContext() context.Context {
+	return t.ctx
+}
+
+// mockTracer records spans started by the queue
+type mockTracer struct {
+	mu    sync.Mutex
+	spans []mockSpan
+}
+
+type mockSpan struct {
+	partition string
+	size      int
+	origins   []context.Context
+	ended     bool
+}
+
+func (mt *mockTracer) StartBatch(partition string, size int, origins []context.Context) func() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.spans = append(mt.spans, mockSpan{partition: partition, size: size, origins: origins})
+	i := len(mt.spans) - 1
+	return func() {
+		mt.mu.Lock()
+		mt.spans[i].ended = true
+		mt.mu.Unlock()
+	}
+}
+
+func TestMemoryBatchQueue_WithTracer(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	mt := new(mockTracer)
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithTracer(mt)
+
+	type key struct{}
+	tasks := make([]QueueTask, 0)
+	for i, v := range NewTestQueueTasks(16) {
+		ctx := context.WithValue(context.Background(), key{}, i)
+		tasks = append(tasks, &contextTestQueueTask{TestQueueTask: *v.(*TestQueueTask), ctx: ctx})
+	}
+	<-q.Push(tasks...)
+	// Batches of tasks without context are not traced
+	<-q.Push(NewTestQueueTasks(8)...)
+
+	// Spans are ended after handler returns, which may be later than tasks are finished
+	ended := func() bool {
+		mt.mu.Lock()
+		defer mt.mu.Unlock()
+		for _, s := range mt.spans {
+			if !s.ended {
+				return false
+			}
+		}
+		return true
+	}
+	for deadline := time.Now().Add(time.Second); !ended() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 5)
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if len(mt.spans) != 2 {
+		t.Fatalf("expecting a span per batch (2), got %v", len(mt.spans))
+	}
+	seen := make(map[interface{}]bool)
+	for _, s := range mt.spans {
+		if s.partition != "partition" || s.size != 8 || len(s.origins) != 8 || !s.ended {
+			t.Fatalf("unexpected span: %+v", s)
+		}
+		for _, ctx := range s.origins {
+			seen[ctx.Value(key{})] = true
+		}
+	}
+	if len(seen) != 16 {
+		t.Fatalf("expecting spans to be linked to all 16 originating contexts, got %v", len(seen))
+	}
+}
+
+func TestMemoryBatchQueue_SetPartitionConcurrency(t *testing.T) {
+	var (
+		bsp     = new(TestBatchSizeProvider)
+		mu      sync.Mutex
+		running = make(map[string]int)
+		max     = make(map[string]int)
+	)
+	var hdl = func(pid string, tasks []QueueTask) {
+		mu.Lock()
+		running[pid]++
+		if running[pid] > max[pid] {
+			max[pid] = running[pid]
+		}
+		mu.Unlock()
+		time.Sleep(30 * time.Millisecond)
+		mu.Lock()
+		running[pid]--
+		mu.Unlock()
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithPartitionConcurrency(4)
+	q.SetPartitionConcurrency("noisy", 2)
+
+	partition := func(tasks []QueueTask, p string) []QueueTask {
+		for _, v := range tasks {
+			v.(*TestQueueTask).Partition = p
+		}
+		return tasks
+	}
+	noisyC := q.Push(partition(NewTestQueueTasks(80), "noisy")...)
+	time.Sleep(10 * time.Millisecond)
+	quietC := q.Push(partition(NewTestQueueTasks(40), "quiet")...)
+
+	// The quiet partition is not starved by the backlog of the noisy one
+	select {
+	case <-quietC:
+	case <-noisyC:
+		t.Fatalf("expecting the quiet partition to finish before the noisy one")
+	}
+	<-noisyC
+	mu.Lock()
+	defer mu.Unlock()
+	if max["noisy"] != 2 {
+		t.Fatalf("expecting at most 2 (and at least 2) noisy batches running simultaneously, got %v", max["noisy"])
+	}
+	if max["quiet"] > 4 {
+		t.Fatalf("expecting at most 4 quiet batches running simultaneously, got %v", max["quiet"])
+	}
+}
+
+func TestMemoryBatchQueue_QueueOptions(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+
+	// Defaults are resolved from package level values
+	def := NewMemoryBatchQueue(bsp, hdl, 10)
+	defer def.Close()
+	if def.opt.ConsumerInterval != 10*time.Millisecond || def.opt.ProducerInterval != 10*time.Millisecond ||
+		def.opt.TaskWaitDuration != 50*time.Millisecond || def.opt.ConsumeRate != DefaultQueueConsumeRate {
+		t.Fatalf("unexpected default queue options: %+v", def.opt)
+	}
+
+	// Less tasks than batch size, a low latency queue pops them well before the default wait duration elapses
+	fast := NewMemoryBatchQueue(bsp, hdl, 10, QueueOptions{
+		ConsumerInterval: time.Millisecond,
+		ProducerInterval: time.Millisecond,
+		TaskWaitDuration: -1,
+	})
+	defer fast.Close()
+	start := time.Now()
+	<-fast.Push(NewTestQueueTasks(3)...)
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Fatalf("expecting tasks to be handled without waiting, took %v", d)
+	}
+
+	// A high throughput queue waits longer for batches to be filled
+	slow := NewMemoryBatchQueue(bsp, hdl, 10, QueueOptions{TaskWaitDuration: 200 * time.Millisecond})
+	defer slow.Close()
+	start = time.Now()
+	<-slow.Push(NewTestQueueTasks(3)...)
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("expecting tasks to wait for the configured duration, took %v", d)
+	}
+}
+
+var _ GracefulQueue = (*MemoryBatchQueue)(nil)
+
+func TestMemoryBatchQueue_CloseAndWait(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		time.Sleep(50 * time.Millisecond)
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+
+	// Buffered tasks are handled without waiting for batches to be filled
+	q := NewMemoryBatchQueue(bsp, hdl, 10, QueueOptions{TaskWaitDuration: 10 * time.Second})
+	tasks := NewTestQueueTasks(3)
+	q.Push(tasks...)
+	start := time.Now()
+	if err := q.CloseAndWait(time.Second); err != nil {
+		t.Fatalf("expecting queue to be drained, got error: %v", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("expecting partition queues to be drained right away, took %v", d)
+	}
+	for _, v := range tasks {
+		if v.GetResult() != "partition" {
+			t.Fatalf("expecting task %v to be handled, got %v", v.(*TestQueueTask).Index, v.GetResult())
+		}
+	}
+	select {
+	case n := <-q.Push(NewTestQueueTasks(1)...):
+		if n != 0 {
+			t.Fatalf("expecting new tasks to be rejected, got %v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting new tasks to be rejected right away")
+	}
+
+	// Tasks not finished in time are finished with context.DeadlineExceeded
+	block := make(chan struct{})
+	defer close(block)
+	var blocking = func(pid string, tasks []QueueTask) {
+		<-block
+	}
+	q = NewMemoryBatchQueue(bsp, blocking, 10)
+	tasks = NewTestQueueTasks(30)
+	finishC := q.Push(tasks...)
+	time.Sleep(100 * time.Millisecond)
+	err := q.CloseAndWait(100 * time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting context.DeadlineExceeded, got %v", err)
+	}
+	select {
+	case <-finishC:
+	case <-time.After(time.Second):
+		t.Fatalf("expecting tasks to be finished on timeout")
+	}
+	for _, v := range tasks {
+		if !errors.Is(v.GetError(), context.DeadlineExceeded) {
+			t.Fatalf("expecting task %v to fail with context.DeadlineExceeded, got %v", v.(*TestQueueTask).Index, v.GetError())
+		}
+	}
+}
+
+func TestMemoryBatchQueue_WithPartitionWeights(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var (
+		mu      sync.Mutex
+		handled = make([]string, 0)
+	)
+	var hdl = func(pid string, tasks []QueueTask) {
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		handled = append(handled, pid)
+		mu.Unlock()
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	weights := PartitionWeightFunc(func(p string) int {
+		if p == "premium" {
+			return 3
+		}
+		return 1
+	})
+	// The goroutine pool is saturated by a single worker, all tasks are moved into partition queues at once
+	q := NewMemoryBatchQueue(bsp, hdl, 1, QueueOptions{ConsumeRate: 1000}).WithPartitionWeights(weights)
+
+	tasks := make([]QueueTask, 0)
+	until := time.Now().Add(time.Minute)
+	for _, p := range []string{"free", "premium"} {
+		for _, v := range NewTestQueueTasks(160) {
+			v.(*TestQueueTask).Partition, v.(*TestQueueTask).Until = p, until
+			tasks = append(tasks, v)
+		}
+	}
+	<-q.Push(tasks...)
+
+	// Under contention, premium partition gets 3 times as many batches as free partition
+	mu.Lock()
+	defer mu.Unlock()
+	counts := make(map[string]int)
+	for _, p := range handled[:16] {
+		counts[p]++
+	}
+	if counts["premium"] < 2*counts["free"] || counts["free"] == 0 {
+		t.Fatalf("expecting premium to get about 3 times as many batches as free, got %v", counts)
+	}
+}
+
+type prioritizedTestQueueTask struct {
+	*TestQueueTask
+	priority int
+}
+
+func (t *prioritizedTestQueueTask) Priority() int {
+	return t.priority
+}
+
+func TestPartitionQueue_Priority(t *testing.T) {
+	pq := newPartitionQueue()
+	tasks := NewTestQueueTasks(8)
+	for _, v := range tasks[:5] /* Bulk tasks without priority */ {
+		pq.push(v)
+	}
+	for i, v := range tasks[5:] /* Urgent tasks */ {
+		pq.push(&prioritizedTestQueueTask{TestQueueTask: v.(*TestQueueTask), priority: 1 + i%2})
+	}
+
+	// Batch size is respected, urgent tasks jump the batch while tasks with the same priority are FIFO
+	if popped := pq.maybePop(10, 1000, 4); popped != nil {
+		t.Fatalf("expecting no tasks before batch is filled or wait duration elapses, got %v", len(popped))
+	}
+	expected := [][]int{{6, 5, 7, 0}, {1, 2, 3, 4}}
+	for _, indexes := range expected {
+		popped := pq.maybePop(4, 1000, 4)
+		if len(popped) != len(indexes) {
+			t.Fatalf("expecting %v tasks, got %v", len(indexes), len(popped))
+		}
+		for i, v := range popped {
+			if v.GetPayload() != fmt.Sprintf("payload %v", indexes[i]) {
+				t.Fatalf("expecting task %v at %v, got %v", indexes[i], i, v.GetPayload())
+			}
+		}
+	}
+	if !pq.isEmpty() {
+		t.Fatalf("expecting partition queue to be empty")
+	}
+}
+
+func TestMemoryBatchQueue_WithDeadLetterHandler(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	var (
+		mu   sync.Mutex
+		dead = make([]QueueTask, 0)
+	)
+	var dlh = func(tasks []QueueTask) {
+		mu.Lock()
+		dead = append(dead, tasks...)
+		mu.Unlock()
+	}
+	// Tasks are dead lettered right after being finished, which may happen after finish number is sent
+	var waitDead = func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			l := len(dead)
+			mu.Unlock()
+			if l >= n {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	q := NewMemoryBatchQueue(bsp, hdl, 10).WithDeadLetterHandler(dlh)
+
+	// Timed out tasks are dead lettered, the others are handled as usual
+	tasks := NewTestQueueTasks(10)
+	for _, v := range tasks[:4] {
+		v.(*TestQueueTask).Until = time.Now().Add(-time.Second)
+	}
+	<-q.Push(tasks...)
+	waitDead(4)
+	mu.Lock()
+	if len(dead) != 4 {
+		t.Fatalf("expecting 4 timed out tasks to be dead lettered, got %v", len(dead))
+	}
+	for _, v := range dead {
+		if !errors.Is(v.GetError(), ErrorTimedOut) || v.(*TestQueueTask).Index >= 4 {
+			t.Fatalf("unexpected dead lettered task %v: %v", v.(*TestQueueTask).Index, v.GetError())
+		}
+	}
+	dead = dead[:0]
+	mu.Unlock()
+
+	// Tasks failed to be dispatched are dead lettered with the error
+	q.pool.Release()
+	tasks = NewTestQueueTasks(3)
+	<-q.Push(tasks...)
+	waitDead(3)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dead) != 3 || dead[0].GetError() == nil {
+		t.Fatalf("expecting 3 tasks failed to be dispatched to be dead lettered, got %v", dead)
+	}
+}
+
+func TestMemoryBatchQueue_MaxQueueSize(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	block := make(chan struct{})
+	var hdl = func(pid string, tasks []QueueTask) {
+		<-block
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+
+	// Tasks pushed into a full queue are rejected right away
+	q := NewMemoryBatchQueue(bsp, hdl, 10, QueueOptions{MaxQueueSize: 10, DropPolicy: DropPolicyReject})
+	finishC := q.Push(NewTestQueueTasks(8)...)
+	rejected := NewTestQueueTasks(3)
+	if n := <-q.Push(rejected...); n != 0 || !errors.Is(rejected[0].GetError(), ErrQueueFull) {
+		t.Fatalf("expecting tasks to be rejected, got %v, %v", n, rejected[0].GetError())
+	}
+	if d := q.Depth(); d != 8 {
+		t.Fatalf("expecting depth to be 8, got %v", d)
+	}
+
+	// Push blocks until there is enough space, or ctx is done
+	q2 := NewMemoryBatchQueue(bsp, hdl, 10, QueueOptions{MaxQueueSize: 10})
+	q2.Push(NewTestQueueTasks(8)...)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cancelled := NewTestQueueTasks(3)
+	if n := <-q2.PushContext(ctx, cancelled...); n != 0 || !errors.Is(cancelled[0].GetError(), context.DeadlineExceeded) {
+		t.Fatalf("expecting push to be cancelled, got %v, %v", n, cancelled[0].GetError())
+	}
+	blockedC := make(chan chan int64)
+	go func() {
+		blockedC <- q2.Push(NewTestQueueTasks(3)...)
+	}()
+	select {
+	case <-blockedC:
+		t.Fatalf("expecting push to block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(block)
+	<-finishC
+	select {
+	case c := <-blockedC:
+		if n := <-c; n != 3 {
+			t.Fatalf("expecting blocked tasks to be handled, got %v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expecting push to proceed once there is enough space")
+	}
+}
+
+// Run with -race, queue state is shared by goroutines of the queue, the context watcher and callers
+func TestMemoryBatchQueue_Context(t *testing.T) {
+	bsp := new(TestBatchSizeProvider)
+	var hdl = func(pid string, tasks []QueueTask) {
+		time.Sleep(20 * time.Millisecond)
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+
+	// Cancelling the context drains buffered tasks without waiting for batches to be filled
+	ctx, cancel := context.WithCancel(context.Background())
+	q := NewMemoryBatchQueueContext(ctx, bsp, hdl, 10, QueueOptions{TaskWaitDuration: 10 * time.Second})
+	tasks := NewTestQueueTasks(3)
+	finishC := q.Push(tasks...)
+	cancel()
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expecting queue goroutines to exit once context is cancelled")
+	}
+	select {
+	case n := <-finishC:
+		if n != 3 {
+			t.Fatalf("expecting all tasks to be finished, got %v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting buffered tasks to be drained once context is cancelled")
+	}
+	for _, v := range tasks {
+		if v.GetResult() != "partition" {
+			t.Fatalf("expecting task %v to be handled, got %v", v.(*TestQueueTask).Index, v.GetResult())
+		}
+	}
+	if n := <-q.Push(NewTestQueueTasks(1)...); n != 0 {
+		t.Fatalf("expecting new tasks to be rejected, got %v", n)
+	}
+
+	// Queues created without context stop on Close
+	q = NewMemoryBatchQueue(bsp, hdl, 10)
+	_ = q.Close()
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expecting queue goroutines to exit once queue is closed")
+	}
+}
@@ -0,0 +1,58 @@
+package batch
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DropPolicyBlock  = iota // Push blocks until the queue has enough space or ctx is done (see PushContext), default value
+	DropPolicyReject        // Push rejects tasks right away, tasks are finished with ErrQueueFull
+)
+
+// ErrQueueFull is set to tasks rejected for the queue being full, see QueueOptions.MaxQueueSize
+var ErrQueueFull = fmt.Errorf("batch queue is full")
+
+// QueueOptions tunes latency & throughput of a MemoryBatchQueue, so that e.g. a low latency queue and a high
+// throughput queue can coexist in one process. Zero values fall back to package level defaults, which are resolved
+// when the queue is created
+type QueueOptions struct {
+	ConsumerInterval time.Duration // Interval of iterating partitions to pop batches, default to ConsumerInterval milliseconds
+	ProducerInterval time.Duration // Interval of moving tasks into partition queues, default to ProducerInterval milliseconds
+	ConsumeRate      int           // Maximum number of tasks moved into partition queues per interval, default to DefaultQueueConsumeRate
+	// TaskWaitDuration is the maximum duration the first task in a partition waits for a batch to be filled, default
+	// to DefaultTaskWaitDuration milliseconds. Set it to a negative value to pop partitions without waiting
+	TaskWaitDuration time.Duration
+	// MaxQueueSize bounds the number of tasks pushed but not finished yet (see MemoryBatchQueue.Depth) to protect
+	// memory under load spikes, default to 0 (unbounded). Tasks exceeding the bound are handled according to
+	// DropPolicy, tasks pushed together are either all accepted or all rejected, i.e. more than MaxQueueSize tasks
+	// pushed at once are always rejected
+	MaxQueueSize int
+	DropPolicy   int // How to handle tasks pushed into a full queue, DropPolicyBlock (default) or DropPolicyReject
+
+	// DrainTimeout is the maximum duration of draining the queue once the context passed to NewMemoryBatchQueueContext
+	// is done, default to DefaultDrainTimeout, see CloseAndWait
+	DrainTimeout time.Duration
+}
+
+// withDefaults returns a copy of opt with zero values replaced by defaults
+func (opt QueueOptions) withDefaults() QueueOptions {
+	if opt.ConsumerInterval <= 0 {
+		opt.ConsumerInterval = time.Millisecond * ConsumerInterval
+	}
+	if opt.ProducerInterval <= 0 {
+		opt.ProducerInterval = time.Millisecond * ProducerInterval
+	}
+	if opt.ConsumeRate <= 0 {
+		opt.ConsumeRate = DefaultQueueConsumeRate
+	}
+	if opt.DrainTimeout <= 0 {
+		opt.DrainTimeout = DefaultDrainTimeout
+	}
+	if opt.TaskWaitDuration == 0 {
+		opt.TaskWaitDuration = time.Millisecond * time.Duration(DefaultTaskWaitDuration)
+	} else if opt.TaskWaitDuration < 0 {
+		opt.TaskWaitDuration = 0
+	}
+	return opt
+}
@@ -0,0 +1,21 @@
+module github.com/mykube-run/kindling/pkg/batch/otel
+
+go 1.17
+
+require (
+	github.com/mykube-run/kindling v0.0.0
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+)
+
+require (
+	github.com/emirpasic/gods v1.18.1 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/panjf2000/ants/v2 v2.7.5 // indirect
+	github.com/rs/zerolog v1.26.0 // indirect
+	golang.org/x/sys v0.0.0-20211210111614-af8b64212486 // indirect
+)
+
+replace github.com/mykube-run/kindling => ../../..
@@ -0,0 +1,46 @@
+// Package otel implements batch.Tracer with OpenTelemetry. It's a separate module requiring go.opentelemetry.io/otel,
+// so that batch itself does not depend on any tracing library
+package otel
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation is the instrumentation name of spans started by Tracer
+const instrumentation = "github.com/mykube-run/kindling/pkg/batch"
+
+// Tracer implements batch.Tracer with OpenTelemetry, spans are linked to spans found in task contexts.
+//
+// Register it on the queue, e.g.:
+//
+//	q := batch.NewMemoryBatchQueue(bsp, hdl, 10).WithTracer(otel.NewTracer(nil))
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a Tracer, the global tracer provider is used when tp is nil
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{tracer: tp.Tracer(instrumentation)}
+}
+
+// StartBatch implements batch.Tracer
+func (t *Tracer) StartBatch(partition string, size int, origins []context.Context) func() {
+	links := make([]trace.Link, 0, len(origins))
+	for _, ctx := range origins {
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	_, span := t.tracer.Start(context.Background(), "batch.handle",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.String("batch.partition", partition), attribute.Int("batch.size", size)),
+	)
+	return func() { span.End() }
+}
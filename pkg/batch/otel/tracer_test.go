@@ -0,0 +1,58 @@
+package otel
+
+import (
+	"context"
+	"github.com/mykube-run/kindling/pkg/batch"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+var _ batch.Tracer = (*Tracer)(nil)
+
+func TestTracer(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	tr := NewTracer(tp)
+
+	// Origins without a span (e.g. context.Background()) are not linked
+	origins := make([]context.Context, 0)
+	for i := 0; i < 3; i++ {
+		ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+		span.End()
+		origins = append(origins, ctx)
+	}
+	origins = append(origins, context.Background())
+
+	end := tr.StartBatch("partition", 4, origins)
+	if n := len(sr.Ended()); n != 3 {
+		t.Fatalf("expecting batch span not to be ended before end is called, got %v spans ended", n)
+	}
+	end()
+
+	spans := sr.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("expecting 4 spans ended, got %v", len(spans))
+	}
+	s := spans[3]
+	if s.Name() != "batch.handle" || s.SpanKind() != trace.SpanKindConsumer {
+		t.Fatalf("unexpected batch span: %v (%v)", s.Name(), s.SpanKind())
+	}
+	if len(s.Links()) != 3 {
+		t.Fatalf("expecting batch span to be linked to 3 origins, got %v", len(s.Links()))
+	}
+	for i, l := range s.Links() {
+		if l.SpanContext.SpanID() != spans[i].SpanContext().SpanID() {
+			t.Fatalf("expecting link %v to origin span %v, got %v", i, spans[i].SpanContext().SpanID(), l.SpanContext.SpanID())
+		}
+	}
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["batch.partition"].AsString() != "partition" || attrs["batch.size"].AsInt64() != 4 {
+		t.Fatalf("unexpected batch span attributes: %v", s.Attributes())
+	}
+}
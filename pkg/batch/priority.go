@@ -0,0 +1,115 @@
+package batch
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// PriorityQueueTask is an optional interface of QueueTask, e.g. for interactive requests sharing partitions with bulk
+// ones: within a partition, tasks with higher priority are batched ahead of tasks with lower priority, while batch
+// size and task wait duration are respected as usual. Tasks not implementing it have priority 0
+type PriorityQueueTask interface {
+	QueueTask
+
+	// Priority returns task priority, the larger the more urgent
+	Priority() int
+}
+
+// taskPriority returns priority of t, 0 when t does not implement PriorityQueueTask
+func taskPriority(t QueueTask) int {
+	if pt, ok := t.(PriorityQueueTask); ok {
+		return pt.Priority()
+	}
+	return 0
+}
+
+// priorityItem a task buffered in priorityBuffer
+type priorityItem struct {
+	v        interface{}
+	priority int
+	seq      int64 // Enqueue sequence, tasks with the same priority are dequeued in FIFO order
+}
+
+// priorityHeap implements heap.Interface, the most urgent item is on top
+type priorityHeap []priorityItem
+
+func (h priorityHeap) Len() int { return len(h) }
+
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap) Push(x interface{}) { *h = append(*h, x.(priorityItem)) }
+
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = priorityItem{}
+	*h = old[:n-1]
+	return item
+}
+
+// priorityBuffer implements taskBuffer with a binary heap ordered by task priority, partition queues switch to it
+// once a PriorityQueueTask is pushed
+type priorityBuffer struct {
+	h   priorityHeap
+	seq int64
+}
+
+func newPriorityBuffer() *priorityBuffer {
+	return &priorityBuffer{h: make(priorityHeap, 0)}
+}
+
+// Enqueue adds a task into buffer
+func (b *priorityBuffer) Enqueue(v interface{}) {
+	b.seq++
+	heap.Push(&b.h, priorityItem{v: v, priority: taskPriority(v.(QueueTask)), seq: b.seq})
+}
+
+// Dequeue removes and returns the most urgent task
+func (b *priorityBuffer) Dequeue() (interface{}, bool) {
+	if len(b.h) == 0 {
+		return nil, false
+	}
+	return heap.Pop(&b.h).(priorityItem).v, true
+}
+
+// Size returns the number of tasks buffered
+func (b *priorityBuffer) Size() int {
+	return len(b.h)
+}
+
+// Clear removes all tasks
+func (b *priorityBuffer) Clear() {
+	b.h = b.h[:0]
+}
+
+// Values returns all tasks in the order they would be dequeued
+func (b *priorityBuffer) Values() []interface{} {
+	items := make(priorityHeap, len(b.h))
+	copy(items, b.h)
+	sort.Sort(items)
+	vals := make([]interface{}, len(items))
+	for i := range items {
+		vals[i] = items[i].v
+	}
+	return vals
+}
+
+// prioritize switches the buffer of partition queue to priorityBuffer, buffered tasks are kept in order
+func (pq *partitionQueue) prioritize() {
+	if _, ok := pq.q.(*priorityBuffer); ok {
+		return
+	}
+	pb := newPriorityBuffer()
+	for _, v := range pq.q.Values() {
+		pb.Enqueue(v)
+	}
+	pq.q = pb
+}
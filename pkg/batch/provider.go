@@ -0,0 +1,53 @@
+package batch
+
+import "sync"
+
+// fixedBatchSizeProvider provides the same batch size for all partitions
+type fixedBatchSizeProvider int
+
+// FixedBatchSizeProvider returns a BatchSizeProvider always providing batch size n regardless of partition,
+// Set is ignored
+func FixedBatchSizeProvider(n int) BatchSizeProvider {
+	return fixedBatchSizeProvider(n)
+}
+
+// Get returns the fixed batch size
+func (f fixedBatchSizeProvider) Get(string) int {
+	return int(f)
+}
+
+// Set does nothing, batch size is fixed
+func (f fixedBatchSizeProvider) Set(string, int) {}
+
+// MapBatchSizeProvider is a thread-safe BatchSizeProvider storing batch sizes by partition,
+// the default batch size is provided for partitions that have not been set
+type MapBatchSizeProvider struct {
+	mu    sync.RWMutex
+	def   int            // Default batch size
+	sizes map[string]int // Batch sizes by partition
+}
+
+// NewMapBatchSizeProvider creates a MapBatchSizeProvider with given default batch size
+func NewMapBatchSizeProvider(def int) *MapBatchSizeProvider {
+	return &MapBatchSizeProvider{
+		def:   def,
+		sizes: make(map[string]int),
+	}
+}
+
+// Get returns batch size of partition p, the default batch size is returned when it has not been set
+func (m *MapBatchSizeProvider) Get(p string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if n, ok := m.sizes[p]; ok {
+		return n
+	}
+	return m.def
+}
+
+// Set sets batch size of partition p
+func (m *MapBatchSizeProvider) Set(p string, n int) {
+	m.mu.Lock()
+	m.sizes[p] = n
+	m.mu.Unlock()
+}
@@ -0,0 +1,48 @@
+package batch
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestFixedBatchSizeProvider(t *testing.T) {
+	bsp := FixedBatchSizeProvider(8)
+	bsp.Set("partition-1", 16)
+	for _, p := range []string{"", "partition-1", "partition-2"} {
+		if n := bsp.Get(p); n != 8 {
+			t.Fatalf("expecting batch size 8 for partition '%v', got %v", p, n)
+		}
+	}
+}
+
+func TestMapBatchSizeProvider(t *testing.T) {
+	bsp := NewMapBatchSizeProvider(8)
+	if n := bsp.Get("partition-1"); n != 8 {
+		t.Fatalf("expecting default batch size 8, got %v", n)
+	}
+	bsp.Set("partition-1", 16)
+	if n := bsp.Get("partition-1"); n != 16 {
+		t.Fatalf("expecting batch size 16, got %v", n)
+	}
+	if n := bsp.Get("partition-2"); n != 8 {
+		t.Fatalf("expecting default batch size 8, got %v", n)
+	}
+
+	// Concurrent Set & Get, should pass with -race
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := fmt.Sprintf("partition-%v", i%4)
+			for j := 0; j < 100; j++ {
+				bsp.Set(p, i+1)
+				if n := bsp.Get(p); n < 1 || n > 16 {
+					t.Errorf("unexpected batch size %v of partition '%v'", n, p)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
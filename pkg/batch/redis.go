@@ -0,0 +1,222 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"github.com/mykube-run/kindling/pkg/log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// RedisClient is the subset of Redis commands used by RedisBatchQueue, so that the batch package does not depend
+// on any Redis client library. It's trivial to implement with common clients, e.g. with go-redis:
+//
+//	func (c *client) RPush(key string, values ...[]byte) error {
+//		args := make([]interface{}, 0, len(values))
+//		for _, v := range values {
+//			args = append(args, v)
+//		}
+//		return c.rdb.RPush(context.Background(), key, args...).Err()
+//	}
+type RedisClient interface {
+	// RPush appends values to the list stored at key
+	RPush(key string, values ...[]byte) error
+	// LRange returns all elements of the list stored at key (LRANGE key 0 -1)
+	LRange(key string) ([][]byte, error)
+	// LRem removes the first occurrence of value from the list stored at key (LREM key 1 value)
+	LRem(key string, value []byte) error
+	// SAdd adds member to the set stored at key
+	SAdd(key string, member string) error
+	// SMembers returns all members of the set stored at key
+	SMembers(key string) ([]string, error)
+}
+
+// TaskSerializer serializes a QueueTask persisted by RedisBatchQueue, only the data required to handle the task
+// again (e.g. partition, payload, deadline) needs to be serialized
+type TaskSerializer func(QueueTask) ([]byte, error)
+
+// TaskDeserializer restores a QueueTask serialized by TaskSerializer
+type TaskDeserializer func([]byte) (QueueTask, error)
+
+// RedisBatchQueue implements Queue with at-least-once processing across restarts: tasks are persisted to a Redis
+// list per partition (<key>:tasks:<partition>) before being queued, and removed once finished (with results or errors
+// set). Tasks left in Redis, e.g. on crash or on shutdown, are restored and handled again on creation.
+// Batching, timeout and other options are the same as the wrapped MemoryBatchQueue.
+// NOTE:
+//  1. Nobody is waiting for results of restored tasks, handlers should deliver results on their own (e.g. by
+//     writing to database), and be idempotent since tasks may be handled more than once
+//  2. Restored tasks that have timed out (see QueueTask.IsTimeout) are finished with ErrorTimedOut and removed
+type RedisBatchQueue struct {
+	mq  *MemoryBatchQueue
+	rc  RedisClient
+	key string // Key prefix of partition lists, partition names are stored in the set <key>:partitions
+	ser TaskSerializer
+	de  TaskDeserializer
+
+	persisted sync.Map // A map of task and its serialized data, which is removed from Redis once the task is finished
+}
+
+// NewRedisBatchQueue wraps mq (fully configured, nothing pushed yet) into a RedisBatchQueue persisting tasks under
+// key, and restores tasks persisted previously. Returns an error when persisted tasks can not be restored.
+// NOTE: Tasks must be comparable (e.g. pointers), so that their serialized data can be located once finished.
+// Tasks must be pushed via RedisBatchQueue, tasks pushed to mq directly are not persisted
+func NewRedisBatchQueue(mq *MemoryBatchQueue, rc RedisClient, key string, ser TaskSerializer, de TaskDeserializer) (*RedisBatchQueue, error) {
+	if mq == nil || rc == nil || ser == nil || de == nil {
+		return nil, fmt.Errorf("memory queue, redis client, task serializer and deserializer must be provided")
+	}
+	q := &RedisBatchQueue{
+		mq:  mq,
+		rc:  rc,
+		key: key,
+		ser: ser,
+		de:  de,
+	}
+	mq.onFinish = q.remove
+	if err := q.restore(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Push persists QueueTasks to Redis and pushes them in queue, see MemoryBatchQueue.Push.
+// When tasks can not be persisted, they are finished right away with the error, 0 is sent to the channel then
+func (q *RedisBatchQueue) Push(tasks ...QueueTask) chan int64 {
+	return q.PushContext(context.Background(), tasks...)
+}
+
+// PushContext is like Push, see MemoryBatchQueue.PushContext. Cancelled tasks are removed from Redis as well
+func (q *RedisBatchQueue) PushContext(ctx context.Context, tasks ...QueueTask) chan int64 {
+	if q.mq.rejecting() || len(tasks) == 0 {
+		return q.mq.PushContext(ctx, tasks...)
+	}
+	if err := q.persist(tasks); err != nil {
+		q.logger().Error(fmt.Sprintf("failed to persist tasks: %v", err))
+		finishC := make(chan int64, 1)
+		for _, t := range tasks {
+			t.WithFinishFunc(func() {})
+			t.SetError(err)
+		}
+		finishC <- 0
+		close(finishC)
+		return finishC
+	}
+	return q.mq.PushContext(ctx, tasks...)
+}
+
+// Close closes the underlying MemoryBatchQueue, tasks not finished yet are kept in Redis and restored next time
+func (q *RedisBatchQueue) Close() error {
+	return q.mq.Close()
+}
+
+// CloseAndWait closes the underlying MemoryBatchQueue and waits for tasks to be finished, see
+// MemoryBatchQueue.CloseAndWait. Tasks finished with context.DeadlineExceeded on timeout are kept in Redis and
+// restored next time
+func (q *RedisBatchQueue) CloseAndWait(timeout time.Duration) error {
+	return q.mq.CloseAndWait(timeout)
+}
+
+// Closed returns whether the underlying MemoryBatchQueue is closed
+func (q *RedisBatchQueue) Closed() bool {
+	return q.mq.Closed()
+}
+
+// persist serializes tasks and appends them to partition lists
+func (q *RedisBatchQueue) persist(tasks []QueueTask) error {
+	data := make([][]byte, len(tasks))
+	lists := make(map[string][][]byte)
+	for i, t := range tasks {
+		if !reflect.TypeOf(t).Comparable() {
+			return fmt.Errorf("task %T is not comparable", t)
+		}
+		byt, err := q.ser(t)
+		if err != nil {
+			return fmt.Errorf("error serializing task: %w", err)
+		}
+		data[i] = byt
+		lists[t.GetPartition()] = append(lists[t.GetPartition()], byt)
+	}
+	saved := make([]string, 0, len(lists))
+	for p, values := range lists {
+		if err := q.rc.SAdd(q.partitionsKey(), p); err != nil {
+			q.rollback(saved, lists)
+			return fmt.Errorf("error saving partition %v: %w", p, err)
+		}
+		if err := q.rc.RPush(q.listKey(p), values...); err != nil {
+			q.rollback(saved, lists)
+			return fmt.Errorf("error saving tasks of partition %v: %w", p, err)
+		}
+		saved = append(saved, p)
+	}
+	for i, t := range tasks {
+		q.persisted.Store(t, data[i])
+	}
+	return nil
+}
+
+// rollback removes tasks of partitions saved by a failed persist call, so that tasks rejected by Push are not
+// restored next time
+func (q *RedisBatchQueue) rollback(partitions []string, lists map[string][][]byte) {
+	for _, p := range partitions {
+		for _, byt := range lists[p] {
+			if err := q.rc.LRem(q.listKey(p), byt); err != nil {
+				q.logger().Error(fmt.Sprintf("failed to roll back persisted task of partition %v: %v", p, err))
+			}
+		}
+	}
+}
+
+// restore reads tasks persisted in Redis and pushes them in queue without persisting them again
+func (q *RedisBatchQueue) restore() error {
+	partitions, err := q.rc.SMembers(q.partitionsKey())
+	if err != nil {
+		return fmt.Errorf("error reading partitions: %w", err)
+	}
+	tasks := make([]QueueTask, 0)
+	for _, p := range partitions {
+		values, err := q.rc.LRange(q.listKey(p))
+		if err != nil {
+			return fmt.Errorf("error reading tasks of partition %v: %w", p, err)
+		}
+		for _, byt := range values {
+			t, err := q.de(byt)
+			if err != nil {
+				return fmt.Errorf("error deserializing task of partition %v: %w", p, err)
+			}
+			q.persisted.Store(t, byt)
+			tasks = append(tasks, t)
+		}
+	}
+	if len(tasks) > 0 {
+		q.logger().Info(fmt.Sprintf("restored tasks: %v", len(tasks)))
+		q.mq.Push(tasks...)
+	}
+	return nil
+}
+
+// remove removes a finished task from Redis
+func (q *RedisBatchQueue) remove(t QueueTask) {
+	v, ok := q.persisted.Load(t)
+	if !ok {
+		return
+	}
+	q.persisted.Delete(t)
+	if err := q.rc.LRem(q.listKey(t.GetPartition()), v.([]byte)); err != nil {
+		q.mq.TaskLogger(t).Error(fmt.Sprintf("failed to remove finished task from redis: %v", err))
+	}
+}
+
+// logger returns the queue logger enriched with module name
+func (q *RedisBatchQueue) logger() log.Logger {
+	return &fieldLogger{lg: q.mq.lg, fields: "module: BatchQueue"}
+}
+
+// partitionsKey returns key of the set storing partition names
+func (q *RedisBatchQueue) partitionsKey() string {
+	return q.key + ":partitions"
+}
+
+// listKey returns key of the list storing tasks of partition
+func (q *RedisBatchQueue) listKey(partition string) string {
+	return q.key + ":tasks:" + partition
+}
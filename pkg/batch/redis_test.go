@@ -0,0 +1,239 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ GracefulQueue = (*RedisBatchQueue)(nil)
+
+// fakeRedis implements RedisClient in memory
+type fakeRedis struct {
+	mu    sync.Mutex
+	lists map[string][][]byte
+	sets  map[string]map[string]bool
+	err   error  // Returned by RPush when not nil, simulates Redis being unavailable
+	errOn string // Only RPush to this key fails when set
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{lists: make(map[string][][]byte), sets: make(map[string]map[string]bool)}
+}
+
+func (r *fakeRedis) RPush(key string, values ...[]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil && (r.errOn == "" || r.errOn == key) {
+		return r.err
+	}
+	r.lists[key] = append(r.lists[key], values...)
+	return nil
+}
+
+func (r *fakeRedis) LRange(key string) ([][]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte{}, r.lists[key]...), nil
+}
+
+func (r *fakeRedis) LRem(key string, value []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, v := range r.lists[key] {
+		if bytes.Equal(v, value) {
+			r.lists[key] = append(r.lists[key][:i], r.lists[key][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *fakeRedis) SAdd(key string, member string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sets[key] == nil {
+		r.sets[key] = make(map[string]bool)
+	}
+	r.sets[key][member] = true
+	return nil
+}
+
+func (r *fakeRedis) SMembers(key string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make([]string, 0)
+	for m := range r.sets[key] {
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (r *fakeRedis) len(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.lists[key])
+}
+
+func serializeTestTask(t QueueTask) ([]byte, error) {
+	return json.Marshal(t)
+}
+
+func deserializeTestTask(byt []byte) (QueueTask, error) {
+	t := new(TestQueueTask)
+	err := json.Unmarshal(byt, t)
+	return t, err
+}
+
+func TestRedisBatchQueue(t *testing.T) {
+	rc := newFakeRedis()
+	key := "batch-test"
+	list := key + ":tasks:partition"
+
+	// The first queue "crashes" while handling tasks, tasks are kept in Redis
+	block := make(chan struct{})
+	defer close(block)
+	var crashing = func(pid string, tasks []QueueTask) {
+		<-block
+	}
+	q1, err := NewRedisBatchQueue(NewMemoryBatchQueue(new(TestBatchSizeProvider), crashing, 10), rc, key, serializeTestTask, deserializeTestTask)
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	_ = q1.Push(NewTestQueueTasks(10)...)
+	if n := rc.len(list); n != 10 {
+		t.Fatalf("expecting 10 tasks to be persisted, got %v", n)
+	}
+	_ = q1.Close()
+
+	// The second queue restores and handles tasks, finished tasks are removed from Redis
+	var (
+		mu      sync.Mutex
+		handled = make(map[string]bool)
+	)
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			mu.Lock()
+			handled[v.GetPayload().(string)] = true
+			mu.Unlock()
+			v.SetResult(pid)
+		}
+	}
+	q2, err := NewRedisBatchQueue(NewMemoryBatchQueue(new(TestBatchSizeProvider), hdl, 10), rc, key, serializeTestTask, deserializeTestTask)
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	tasks := NewTestQueueTasks(3)
+	for i, v := range tasks {
+		v.(*TestQueueTask).Payload = fmt.Sprintf("new payload %v", i)
+	}
+	select {
+	case <-q2.Push(tasks...):
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting new tasks to be finished")
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for rc.len(list) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if n := rc.len(list); n != 0 {
+		t.Fatalf("expecting finished tasks to be removed from redis, got %v left", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 13 {
+		t.Fatalf("expecting 10 restored and 3 new tasks to be handled, got %v", len(handled))
+	}
+}
+
+func TestRedisBatchQueue_PersistFailure(t *testing.T) {
+	rc := newFakeRedis()
+	rc.err = fmt.Errorf("redis unavailable")
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q, err := NewRedisBatchQueue(NewMemoryBatchQueue(new(TestBatchSizeProvider), hdl, 10), rc, "batch-test-failure", serializeTestTask, deserializeTestTask)
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	defer q.Close()
+
+	tasks := NewTestQueueTasks(3)
+	select {
+	case n := <-q.Push(tasks...):
+		if n != 0 {
+			t.Fatalf("expecting 0 to be sent when tasks are not persisted, got %v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting tasks to be finished right away")
+	}
+	for _, v := range tasks {
+		if !errors.Is(v.GetError(), rc.err) {
+			t.Fatalf("expecting task %v to fail with persist error, got %v", v.(*TestQueueTask).Index, v.GetError())
+		}
+	}
+}
+
+func TestRedisBatchQueue_PersistRollback(t *testing.T) {
+	rc := newFakeRedis()
+	key := "batch-test-rollback"
+	rc.err, rc.errOn = fmt.Errorf("redis unavailable"), key+":tasks:b"
+	var hdl = func(pid string, tasks []QueueTask) {
+		for _, v := range tasks {
+			v.SetResult(pid)
+		}
+	}
+	q, err := NewRedisBatchQueue(NewMemoryBatchQueue(new(TestBatchSizeProvider), hdl, 10), rc, key, serializeTestTask, deserializeTestTask)
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	defer q.Close()
+
+	// Tasks of partition a are removed when tasks of partition b can not be persisted
+	tasks := NewTestQueueTasks(4)
+	for i, v := range tasks {
+		v.(*TestQueueTask).Partition = []string{"a", "b"}[i%2]
+	}
+	if n := <-q.Push(tasks...); n != 0 {
+		t.Fatalf("expecting 0 to be sent when tasks are not persisted, got %v", n)
+	}
+	for _, p := range []string{"a", "b"} {
+		if n := rc.len(key + ":tasks:" + p); n != 0 {
+			t.Fatalf("expecting no task of partition %v to be left in redis, got %v", p, n)
+		}
+	}
+}
+
+func TestRedisBatchQueue_CloseAndWaitTimeout(t *testing.T) {
+	rc := newFakeRedis()
+	key := "batch-test-shutdown"
+	list := key + ":tasks:partition"
+
+	block := make(chan struct{})
+	defer close(block)
+	var blocking = func(pid string, tasks []QueueTask) {
+		<-block
+	}
+	q, err := NewRedisBatchQueue(NewMemoryBatchQueue(new(TestBatchSizeProvider), blocking, 10), rc, key, serializeTestTask, deserializeTestTask)
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	tasks := NewTestQueueTasks(10)
+	finishC := q.Push(tasks...)
+	if err = q.CloseAndWait(time.Millisecond * 200); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting CloseAndWait to time out, got %v", err)
+	}
+	<-finishC
+
+	// Tasks abandoned on shutdown are kept in Redis and restored next time
+	if n := rc.len(list); n != 10 {
+		t.Fatalf("expecting 10 abandoned tasks to be kept in redis, got %v", n)
+	}
+}
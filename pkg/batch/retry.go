@@ -0,0 +1,70 @@
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRetryable marks a task error as transient, e.g. downstream service responding 503. Handlers wrap it with the
+// actual error (e.g. fmt.Errorf("downstream unavailable: %w", ErrRetryable)) and set it via QueueTask.SetError, so
+// that the task is retried according to RetryPolicy, see WithRetryPolicy
+var ErrRetryable = fmt.Errorf("retryable task error")
+
+// RetryPolicy describes how tasks failed with ErrRetryable are retried
+type RetryPolicy struct {
+	MaxAttempts int           // Maximum number of attempts including the first one, retry is disabled when less than 2
+	Backoff     time.Duration // Delay before the first retry, doubled on every following retry
+	MaxBackoff  time.Duration // Upper limit of the delay, default to 0 (no limit)
+}
+
+// delay returns the delay before the n-th retry (starting from 1)
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// WithRetryPolicy enables retrying tasks failed with ErrRetryable: instead of being finished, such tasks are
+// re-enqueued after backoff (and batched again with other tasks) until they succeed or MaxAttempts is reached,
+// the last error is kept then. Tasks that have timed out (see QueueTask.IsTimeout) are never retried.
+// Must be called before pushing any task.
+// NOTE: Error of a retried task is cleared (via SetError(nil)) before it's re-enqueued, so that an attempt succeeding
+// with SetResult only is not retried again
+func (q *MemoryBatchQueue) WithRetryPolicy(p RetryPolicy) *MemoryBatchQueue {
+	q.retry = p
+	return q
+}
+
+// maybeRetry re-enqueues t after backoff when it has failed with ErrRetryable and is allowed to be retried,
+// attempt is the number of attempts made so far, fin is the finish function of t restored once its error is cleared.
+// Returns whether t is going to be retried
+func (q *MemoryBatchQueue) maybeRetry(t QueueTask, attempt int, fin func()) bool {
+	if attempt >= q.retry.MaxAttempts || q.loadFlag() > FlagAboutToClose || t.IsTimeout() || !errors.Is(t.GetError(), ErrRetryable) {
+		return false
+	}
+	d := q.retry.delay(attempt)
+	q.TaskLogger(t).Debug(fmt.Sprintf("retrying task, attempt: %v, backoff: %v, error: %v", attempt, d, t.GetError()))
+	time.AfterFunc(d, func() {
+		if q.loadFlag() > FlagAboutToClose /* Queue is closing, the task would never be handled */ {
+			q.finishUnhandled(t, t.GetError())
+			return
+		}
+		// Clear the error of the failed attempt without finishing the task
+		t.WithFinishFunc(func() {})
+		t.SetError(nil)
+		t.WithFinishFunc(fin)
+		q.mu.Lock()
+		q.q.Enqueue(t)
+		q.mu.Unlock()
+	})
+	return true
+}
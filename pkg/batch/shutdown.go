@@ -0,0 +1,107 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// CloseAndWait closes the queue and blocks until buffered tasks are handled and batches being handled are finished,
+// e.g. in service shutdown hooks. New tasks are rejected right away (see Push), tasks waiting in partition queues
+// are handled without waiting for batches to be filled. When timeout elapses, tasks not finished yet are finished
+// with context.DeadlineExceeded via SetError, and an error wrapping context.DeadlineExceeded is returned.
+// NOTE: Handlers of batches being handled are not interrupted on timeout, results they set afterwards are not counted
+func (q *MemoryBatchQueue) CloseAndWait(timeout time.Duration) error {
+	atomic.StoreInt32(&q.draining, 1)
+	_ = q.Close()
+
+	deadline := time.Now().Add(timeout)
+	for !q.drained() {
+		if time.Now().After(deadline) {
+			n := q.Stats().Backlog()
+			q.abandon(context.DeadlineExceeded)
+			return fmt.Errorf("queue was not drained in %v, unfinished tasks: %v: %w", timeout, n, context.DeadlineExceeded)
+		}
+		time.Sleep(q.opt.ConsumerInterval)
+	}
+	q.pool.Release()
+	return nil
+}
+
+// Done returns a channel that is closed once background goroutines of the queue exit, i.e. after the queue is closed
+// (see Close, CloseAndWait and NewMemoryBatchQueueContext) and buffered tasks are moved into partition queues
+func (q *MemoryBatchQueue) Done() <-chan struct{} {
+	return q.done
+}
+
+// watch closes and drains the queue once ctx is done, see NewMemoryBatchQueueContext. It returns right away when ctx
+// is never done
+func (q *MemoryBatchQueue) watch(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := q.CloseAndWait(q.opt.DrainTimeout); err != nil {
+				q.lg.Warn(fmt.Sprintf("module: BatchQueue, failed to drain queue on context done: %v", err))
+			}
+		case <-q.done:
+			// Closed explicitly
+		}
+	}()
+}
+
+// rejecting returns whether new tasks are rejected, i.e. the queue is closing or draining
+func (q *MemoryBatchQueue) rejecting() bool {
+	return q.loadFlag() > FlagAboutToClose || atomic.LoadInt32(&q.draining) == 1
+}
+
+// drained returns whether all tasks pushed are finished and no handler is running
+func (q *MemoryBatchQueue) drained() bool {
+	return atomic.LoadInt64(&q.processed) >= atomic.LoadInt64(&q.enqueued) && atomic.LoadInt64(&q.handling) == 0
+}
+
+// partitionsEmpty returns whether all partition queues are empty
+func (q *MemoryBatchQueue) partitionsEmpty() bool {
+	empty := true
+	q.partitions.Range(func(_, v interface{}) bool {
+		pq := v.(*partitionQueue)
+		pq.mu.Lock()
+		empty = pq.isEmpty()
+		pq.mu.Unlock()
+		return empty
+	})
+	return empty
+}
+
+// abandon removes buffered tasks from the queue and partition queues, finishes them along with tasks being handled
+// with err, and passes them to the dead letter handler
+func (q *MemoryBatchQueue) abandon(err error) {
+	q.mu.Lock()
+	vals := q.q.Values()
+	q.q.Clear()
+	q.mu.Unlock()
+
+	tasks := make([]QueueTask, 0, len(vals))
+	for i := range vals {
+		tasks = append(tasks, vals[i].(QueueTask))
+	}
+	q.partitions.Range(func(_, v interface{}) bool {
+		pq := v.(*partitionQueue)
+		pq.mu.Lock()
+		tasks = append(tasks, pq.tasks()...)
+		pq.reset()
+		pq.mu.Unlock()
+		return true
+	})
+	q.batches.Range(func(_, v interface{}) bool {
+		tasks = append(tasks, v.([]QueueTask)...)
+		return true
+	})
+	for _, t := range tasks {
+		q.finishUnhandled(t, err)
+	}
+	q.deadLetter(tasks)
+}
@@ -0,0 +1,41 @@
+package batch
+
+import "sync/atomic"
+
+// QueueStats statistics of MemoryBatchQueue, see Stats
+type QueueStats struct {
+	TotalEnqueued  int64          // Number of tasks pushed since creation
+	TotalProcessed int64          // Number of tasks finished (with results or errors set) since creation
+	InFlight       int64          // Number of tasks in batches being handled, i.e. handler has not returned yet
+	Partitions     map[string]int // Number of tasks pending in partition queues (waiting to form a batch), keyed by partition
+}
+
+// Backlog returns the number of tasks pushed but not finished yet, including tasks being handled
+func (s QueueStats) Backlog() int64 {
+	return s.TotalEnqueued - s.TotalProcessed
+}
+
+// Stats returns queue statistics, counters are read atomically, so that it's cheap enough to be scraped periodically,
+// e.g. into Prometheus gauges & counters
+func (q *MemoryBatchQueue) Stats() QueueStats {
+	st := QueueStats{
+		TotalEnqueued:  atomic.LoadInt64(&q.enqueued),
+		TotalProcessed: atomic.LoadInt64(&q.processed),
+		InFlight:       atomic.LoadInt64(&q.handling),
+		Partitions:     make(map[string]int),
+	}
+	q.partitions.Range(func(k, v interface{}) bool {
+		pq := v.(*partitionQueue)
+		pq.mu.Lock()
+		st.Partitions[k.(string)] = pq.q.Size()
+		pq.mu.Unlock()
+		return true
+	})
+	return st
+}
+
+// Depth returns the number of tasks pushed but not finished yet, including tasks being handled, which is bounded by
+// QueueOptions.MaxQueueSize, e.g. for callers implementing their own backpressure
+func (q *MemoryBatchQueue) Depth() int64 {
+	return atomic.LoadInt64(&q.enqueued) - atomic.LoadInt64(&q.processed)
+}
@@ -0,0 +1,63 @@
+package batch
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Timings timestamps of a task going through MemoryBatchQueue, revealing where latency accrues, e.g. queue wait
+// (Started - Pushed) vs handler time (Finished - Started). See WithTaskTimings
+type Timings struct {
+	Pushed      time.Time // When the task was pushed, see Push
+	Partitioned time.Time // When the task entered its partition queue
+	Started     time.Time // When handling of the batch containing the task started
+	Finished    time.Time // When the task was finished, i.e. its result or error was set
+}
+
+// timingsRecord timings of a task being recorded
+type timingsRecord struct {
+	mu sync.Mutex
+	t  Timings
+}
+
+// WithTaskTimings enables recording timings of every task, see TaskTimings. It's meant for profiling, timings
+// are recorded only for tasks that can be used as map keys (e.g. pointers).
+// Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithTaskTimings() *MemoryBatchQueue {
+	q.taskTimings = true
+	return q
+}
+
+// TaskTimings returns timings of task, a zero Timings is returned when task timings is not enabled or the task
+// was not pushed. Timings of a finished task are removed once retrieved, retrieve them for every pushed task to
+// avoid keeping them in memory
+func (q *MemoryBatchQueue) TaskTimings(task QueueTask) Timings {
+	v, ok := q.timings.Load(task)
+	if !ok {
+		return Timings{}
+	}
+	r := v.(*timingsRecord)
+	r.mu.Lock()
+	t := r.t
+	r.mu.Unlock()
+	if !t.Finished.IsZero() {
+		q.timings.Delete(task)
+	}
+	return t
+}
+
+// recordTiming sets timing of task with fn, does nothing when task timings is not enabled
+func (q *MemoryBatchQueue) recordTiming(task QueueTask, fn func(t *Timings, now time.Time)) {
+	if !q.taskTimings || task == nil || !reflect.TypeOf(task).Comparable() {
+		return
+	}
+	v, ok := q.timings.Load(task)
+	if !ok {
+		v, _ = q.timings.LoadOrStore(task, new(timingsRecord))
+	}
+	r := v.(*timingsRecord)
+	r.mu.Lock()
+	fn(&r.t, time.Now())
+	r.mu.Unlock()
+}
@@ -0,0 +1,46 @@
+package batch
+
+import "context"
+
+// ContextQueueTask is an optional interface of QueueTask carrying the context it was created in, e.g. the context
+// of an incoming request holding the trace context, see WithTracer
+type ContextQueueTask interface {
+	QueueTask
+
+	// GetContext returns the context the task was created in
+	GetContext() context.Context
+}
+
+// Tracer starts a span around every batch handled, so that batch processing across the async boundary is visible
+// in traces alongside the originating requests. See the pkg/batch/otel module for an OpenTelemetry
+// implementation, the core package does not depend on any tracing library.
+type Tracer interface {
+	// StartBatch starts a span for a batch of size tasks of partition, linked to spans carried by origins
+	// (contexts of tasks implementing ContextQueueTask), returns a function ending the span
+	StartBatch(partition string, size int, origins []context.Context) (end func())
+}
+
+// WithTracer sets the tracer starting a span around the handler of every batch containing at least one task
+// implementing ContextQueueTask, see Tracer. Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithTracer(t Tracer) *MemoryBatchQueue {
+	q.tracer = t
+	return q
+}
+
+// startBatchSpan starts a span for tasks when tracer is set and any of them carries a context, returns a function
+// ending the span
+func (q *MemoryBatchQueue) startBatchSpan(partition string, tasks []QueueTask) func() {
+	if q.tracer == nil {
+		return func() {}
+	}
+	origins := make([]context.Context, 0)
+	for _, t := range tasks {
+		if ct, ok := t.(ContextQueueTask); ok && ct.GetContext() != nil {
+			origins = append(origins, ct.GetContext())
+		}
+	}
+	if len(origins) == 0 {
+		return func() {}
+	}
+	return q.tracer.StartBatch(partition, len(tasks), origins)
+}
@@ -0,0 +1,78 @@
+package batch
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PartitionWeightProvider provides weights of partitions for weighted fair queuing, see WithPartitionWeights
+type PartitionWeightProvider interface {
+	// PartitionWeight returns weight of partition, weights less than 1 are treated as 1
+	PartitionWeight(partition string) int
+}
+
+// PartitionWeightFunc is an adapter allowing ordinary functions to be used as PartitionWeightProvider
+type PartitionWeightFunc func(partition string) int
+
+// PartitionWeight calls f(partition)
+func (f PartitionWeightFunc) PartitionWeight(partition string) int {
+	return f(partition)
+}
+
+// WithPartitionWeights enables weighted fair queuing across partitions, e.g. to prioritize premium tenants over free
+// ones: partitions are serviced in weighted round-robin, every time partitions are iterated a partition having
+// ready batches may start up to its weight batches, one batch per round. Under contention (e.g. the goroutine pool is
+// saturated), partitions get processing throughput proportional to their weights. Works along with partition
+// concurrency limits, see WithPartitionConcurrency. Must be called before pushing any task.
+func (q *MemoryBatchQueue) WithPartitionWeights(wp PartitionWeightProvider) *MemoryBatchQueue {
+	q.weights = wp
+	return q
+}
+
+// partitionWeight returns weight of given partition, at least 1
+func (q *MemoryBatchQueue) partitionWeight(v string) int {
+	if w := q.weights.PartitionWeight(v); w > 1 {
+		return w
+	}
+	return 1
+}
+
+// iterateWeightedPartitions is like iteratePartitions, but pops one batch per partition per round, until partitions
+// run out of ready batches or their weights
+func (q *MemoryBatchQueue) iterateWeightedPartitions(wait int64) {
+	type credit struct {
+		partition string
+		pq        *partitionQueue
+		n         int // Number of batches the partition may still start in this iteration
+	}
+	credits := make([]*credit, 0)
+	q.partitions.Range(func(k, v interface{}) bool {
+		credits = append(credits, &credit{partition: k.(string), pq: v.(*partitionQueue), n: q.partitionWeight(k.(string))})
+		return true
+	})
+	sort.Slice(credits, func(i, j int) bool { return credits[i].partition < credits[j].partition })
+
+	for len(credits) > 0 {
+		next := credits[:0]
+		for _, c := range credits {
+			size := q.partitionBatchSize(c.partition)
+			max := q.partitionCapacity(c.partition, size)
+			if max == 0 /* Partition is at its concurrency limit */ {
+				continue
+			}
+			if max < 0 || max > size {
+				max = size
+			}
+			tasks := c.pq.maybePop(size, wait, max)
+			if len(tasks) == 0 {
+				continue
+			}
+			q.partitionLogger(c.partition).Trace(fmt.Sprintf("popped tasks, tasks: %v, credits: %v", len(tasks), c.n))
+			q.process(tasks, size)
+			if c.n--; c.n > 0 {
+				next = append(next, c)
+			}
+		}
+		credits = next
+	}
+}
@@ -4,15 +4,10 @@ import (
 	"fmt"
 	"github.com/patrickmn/go-cache"
 	"github.com/rs/zerolog/log"
-	"sync/atomic"
+	"sync"
 	"time"
 )
 
-const (
-	locked   = 1
-	unlocked = 0
-)
-
 var (
 	DefaultLevel2CacheExpiration  = time.Hour * 6
 	DefaultCachePreUpdateDuration = time.Second * 5
@@ -32,7 +27,14 @@ type FailOverCache struct {
 	// Enabled when level 1 cache expiration is longer than DefaultCachePreUpdateDuration.
 	// When enabled and cache TTL is less than DefaultCachePreUpdateDuration, cache will be refreshed
 	enablePreRefresh bool
-	lock             int64 // Cache pre-refresh atomic lock
+	mu               sync.Mutex          // Protects inflight
+	inflight         map[string]*refresh // In-flight refreshes by key, either triggered by pre-refresh or cache miss
+}
+
+// refresh an in-flight cache refresh
+type refresh struct {
+	done chan struct{} // Closed when refresh finishes
+	err  error         // Refresh error, available after done is closed
 }
 
 // NewFailOverCache instantiates a fail-over cache
@@ -44,7 +46,7 @@ func NewFailOverCache(exp1, exp2 time.Duration) *FailOverCache {
 		l1:               cache.New(exp1, time.Minute),
 		l2:               cache.New(exp2, time.Minute),
 		enablePreRefresh: false,
-		lock:             unlocked,
+		inflight:         make(map[string]*refresh),
 	}
 	if exp1.Seconds() > float64(DefaultCachePreUpdateDuration/time.Second) {
 		c.enablePreRefresh = true
@@ -63,21 +65,29 @@ func (c *FailOverCache) Get(key string, fn RefreshFunc) (v interface{}, err erro
 		// 1.1 If hit, check whether it is possible to update the cache before expiration
 		update := c.enablePreRefresh && exp.After(time.Now()) &&
 			exp.Sub(time.Now()) < DefaultCachePreUpdateDuration
-		if update && c.tryLock() {
-			go func() {
-				defer c.unlock()
-				if err = c.refreshCache(key, fn); err == nil {
-					log.Trace().Str("key", key).Msg("updated cache before expiration")
-				}
-			}()
+		if update {
+			// Skip when the key is being refreshed
+			if r, ok := c.acquire(key); ok {
+				go func() {
+					if c.doRefresh(key, fn, r) == nil {
+						log.Trace().Str("key", key).Msg("updated cache before expiration")
+					}
+				}()
+			}
 		}
 
 		// 1.2 Return the cached value
 		return cached, nil
 	}
 
-	// 2. Cache miss, refresh the cache by calling fn
-	if err = c.refreshCache(key, fn); err != nil {
+	// 2. Cache miss, refresh the cache by calling fn, or wait for the in-flight refresh of the same key
+	if r, ok := c.acquire(key); ok {
+		err = c.doRefresh(key, fn, r)
+	} else {
+		<-r.done
+		err = r.err
+	}
+	if err != nil {
 		// 2.1 Refreshing cache failed, return level 2 cache as a fallback
 		log.Warn().Str("key", key).Err(err).Msg("error refreshing cache, using fail over cache")
 		cached, hit = c.l2.Get(key)
@@ -112,12 +122,27 @@ func (c *FailOverCache) refreshCache(key string, fn RefreshFunc) error {
 	return nil
 }
 
-// tryLock tries to acquire atomic lock, returns true if locked, otherwise false
-func (c *FailOverCache) tryLock() (ok bool) {
-	return atomic.CompareAndSwapInt64(&c.lock, unlocked, locked)
+// acquire returns the in-flight refresh of key, and true if the refresh is newly created. Caller must
+// call doRefresh when true is returned, otherwise wait for the refresh to finish if necessary
+func (c *FailOverCache) acquire(key string) (*refresh, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r, ok := c.inflight[key]; ok {
+		return r, false
+	}
+	r := &refresh{done: make(chan struct{})}
+	c.inflight[key] = r
+	return r, true
 }
 
-// unlock unlocks atomic lock
-func (c *FailOverCache) unlock() {
-	atomic.StoreInt64(&c.lock, unlocked)
+// doRefresh refreshes cache of key, notifies waiters of r when finished
+func (c *FailOverCache) doRefresh(key string, fn RefreshFunc, r *refresh) error {
+	r.err = c.refreshCache(key, fn)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(r.done)
+	return r.err
 }
@@ -3,6 +3,8 @@ package caching
 import (
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -195,3 +197,41 @@ func TestFailOverCache_Get(t *testing.T) {
 		}
 	}
 }
+
+func TestFailOverCache_Get_CoalesceRefresh(t *testing.T) {
+	var calls int64
+	fn := func(key string) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(time.Millisecond * 500)
+		return value, nil
+	}
+	cache := NewFailOverCache(time.Second*6, DefaultLevel2CacheExpiration)
+
+	// 1. Key is about to expire, a pre-refresh is triggered in background
+	cache.l1.Set(key, value, time.Second)
+	if _, err := cache.Get(key, fn); err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+
+	// 2. Key expired before pre-refresh finishes, cold misses must wait for the in-flight refresh
+	cache.l1.Delete(key)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := cache.Get(key, fn)
+			if err != nil || v != value {
+				t.Errorf("expecting value == %v, got %v (error: %v)", value, v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("expecting refresh function to be called once, got %v", n)
+	}
+	if len(cache.inflight) != 0 {
+		t.Fatalf("expecting no in-flight refresh, got %v", len(cache.inflight))
+	}
+}
@@ -2,10 +2,13 @@ package ffmpeg
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"fmt"
 	llq "github.com/emirpasic/gods/queues/linkedlistqueue"
+	"github.com/fsnotify/fsnotify"
 	"github.com/mykube-run/kindling/pkg/retry"
 	"github.com/mykube-run/kindling/pkg/utils"
 	"github.com/rs/zerolog/log"
@@ -15,14 +18,35 @@ import (
 	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 )
 
+// SEIRegex matches SEI info (JSON) in SEI fragments by default, see CommonOptions.SEIPattern
 var SEIRegex, _ = regexp.Compile(`{".+([0-9]|}|]|")}`)
 
+// ShowInfoRegex matches frame number & PTS time printed by showinfo filter, e.g.
+// [Parsed_showinfo_2 @ 0x7f8b5c] n:   3 pts: 768000 pts_time:3       duration:...
+var ShowInfoRegex = regexp.MustCompile(`Parsed_showinfo.*\sn:\s*(\d+)\s+pts:\s*-?\d+\s+pts_time:\s*(-?[0-9.]+)`)
+
+// ReconnectRegex matches reconnecting messages printed by FFmpeg, e.g.
+// [https @ 0x55d0c0] Will reconnect at 1048576 in 0 second(s), error=Input/output error.
+var ReconnectRegex = regexp.MustCompile(`(?i)will reconnect at|reconnecting`)
+
+// SilenceRegex matches silence boundaries printed by silencedetect filter, e.g.
+// [silencedetect @ 0x55d0c0] silence_start: 1.536
+// [silencedetect @ 0x55d0c0] silence_end: 3.2 | silence_duration: 1.664
+var SilenceRegex = regexp.MustCompile(`silencedetect.*\ssilence_(start|end):\s*(-?[0-9.]+)`)
+
+// unsafeArgRegex matches command arguments that must be quoted, i.e. containing characters other than letters,
+// digits and a few characters having no special meaning to shell
+var unsafeArgRegex = regexp.MustCompile(`[^A-Za-z0-9_@%+=:,./-]`)
+
 const (
 	space  = " "
 	common = "-hide_banner"
@@ -43,6 +67,9 @@ const (
 	// filterEveryNFrm instructs FFmpeg to capture frames every n
 	// See: https://ffmpeg.org/ffmpeg-all.html#select_002c-aselect
 	filterEveryNFrm = "select=not(mod(n\\,%v))"
+	// filterFps instructs FFmpeg to output frames at a constant rate, duplicating or dropping frames as needed
+	// See: https://ffmpeg.org/ffmpeg-all.html#fps-1
+	filterFps = "fps=%v"
 	// filterDebug instructs FFmpeg to print frame number & time on every captured images, used for debug purpose
 	// See: https://ffmpeg.org/ffmpeg-all.html#drawtext-1
 	// NOTE: fontconfig must be installed on Linux, otherwise this error will occur:
@@ -57,25 +84,135 @@ const (
 	//		Failed to inject frame into filter network: No such file or directory
 	//		Error while processing the decoded data for stream #0:0
 	filterDebug = `drawtext=fontsize=45:fontcolor=yellow:borderw=1:bordercolor=red:text=%{frame_num} %{pts\\:hms}`
+	// filterDedup instructs FFmpeg to drop frames that do not differ greatly from the previous frame
+	// See: https://ffmpeg.org/ffmpeg-all.html#mpdecimate
+	filterDedup = "mpdecimate"
+	// filterShowInfo instructs FFmpeg to print frame info (including frame number & PTS) at info log level
+	// See: https://ffmpeg.org/ffmpeg-all.html#showinfo
+	filterShowInfo = "showinfo"
+	// filterSpectrum instructs FFmpeg to render the whole audio input into a single spectrogram picture
+	// See: https://ffmpeg.org/ffmpeg-all.html#showspectrumpic
+	filterSpectrum = "showspectrumpic=s=%vx%v:legend=%v"
+	// Default spectrogram size
+	defaultSpectrogramWidth  = 1024
+	defaultSpectrogramHeight = 512
+	// filterSprite instructs FFmpeg to scale selected frames and lay them out in a grid, see filterInterval
+	// See: https://ffmpeg.org/ffmpeg-all.html#tile-1
+	filterSprite = "scale=%v:-1,tile=%vx%v"
+	// filterGIFScale & filterGIFPalette instruct FFmpeg to generate an optimized palette from the scaled frames
+	// then use it to encode GIF (palettegen/paletteuse), which is much better than the default 256 color palette
+	// See: https://ffmpeg.org/ffmpeg-all.html#palettegen-1
+	filterGIFScale   = "fps=%v,scale=%v:-1:flags=lanczos"
+	filterGIFPalette = "split[s0][s1];[s0]palettegen[p];[s1][p]paletteuse"
+	// Default GIF options
+	defaultGIFFPS   = 10
+	defaultGIFWidth = 320
+	// Default sprite layout
+	defaultSpriteColumns    = 5
+	defaultSpriteRows       = 5
+	defaultSpriteThumbWidth = 160
+	// Timestamp fixing options, generates missing PTS for input, shifts output timestamps to start from 0
+	// NOTE: -fflags is an input option while -avoid_negative_ts is an output option
+	genPts          = "-fflags +genpts"
+	avoidNegativeTs = "-avoid_negative_ts make_zero"
+	// filterVAAPI scales frames decoded by VAAPI on GPU, then downloads them for software filters and encoders
+	// See: https://trac.ffmpeg.org/wiki/Hardware/VAAPI
+	filterVAAPI      = "scale_vaapi=%v"
+	filterHWDownload = "hwdownload,format=nv12"
+	// Default quality (-qscale:v) of captured images, ranging from 1 (best) to 31 (worst)
+	defaultImageQuality = 1
+	// filterSilence instructs FFmpeg to print boundaries of audio quieter than noise (in dB) for at least d seconds
+	// See: https://ffmpeg.org/ffmpeg-all.html#silencedetect
+	filterSilence = "silencedetect=noise=%vdB:d=%v"
+	// Default silence detection options
+	defaultSilenceNoise       = -30
+	defaultSilenceMinDuration = 0.5
+	// filterLoudnorm normalizes audio loudness to target integrated loudness (I), with true peak (TP) and
+	// loudness range (LRA) recommended by EBU R128. See: https://ffmpeg.org/ffmpeg-all.html#loudnorm
+	filterLoudnorm    = "loudnorm=I=%v:TP=-1.5:LRA=11"
+	defaultTargetLUFS = -16
+	// HLS segments are named like other outputs (see FilePath2Index), key frames are forced at segment boundaries
+	// when transcoding, so that segments are cut at the target duration. See: https://ffmpeg.org/ffmpeg-all.html#hls-2
+	forceKeyFrames            = "expr:gte(t,n_forced*%v)"
+	defaultHLSSegmentDuration = 6
+	defaultHLSPlaylistName    = "index.m3u8"
+	// Default transcoding encoders, producing H.264 & AAC media playable almost everywhere
+	defaultVideoCodec = "libx264"
+	defaultAudioCodec = "aac"
+	// filterScale resizes frames, a dimension of -2 keeps aspect ratio while being divisible by 2 (required by
+	// most encoders). See: https://ffmpeg.org/ffmpeg-all.html#scale-1
+	filterScale = "scale=%v:%v"
+	// Write progress info to stdout periodically
+	progress = "-progress pipe:1"
 	// Stream probing options
 	probe = "-show_streams -show_format -of json"
+	// Interval of scanning output directory, catches files missed by coalesced file events
+	scanInterval = time.Millisecond * 500
+	// Interval of reading output queue when it's empty, see Outputs
+	readInterval = time.Millisecond * 10
 )
 
+// seiWaitTimeout is the maximum duration of waiting for the SEI fragment of an output, the output is enqueued
+// without SEI info after that, so that a missing SEI fragment does not block the output pipeline
+var seiWaitTimeout = time.Second * 5
+
+// seiBufferSize is the buffer size of the channel returned by SEIChannel
+const seiBufferSize = 1024
+
+// subtitleEncoders maps supported subtitle formats to FFmpeg subtitle encoders (-c:s)
+var subtitleEncoders = map[string]string{
+	SubtitleFormatSRT:    "srt",
+	SubtitleFormatWebVTT: "webvtt",
+}
+
 type Command struct {
-	cmd *exec.Cmd      // The underlying command instance
-	q   *llq.Queue     // Output buffer queue
-	opt *CommonOptions // Command options
-	mod OutputModifier // Output modifier
+	mu  sync.Mutex      // Protects fields written by FFmpeg stderr parser, e.g. pts
+	cmd *exec.Cmd       // The underlying command instance
+	q   *llq.Queue      // Output buffer queue
+	opt *CommonOptions  // Command options
+	mod OutputModifier  // Output modifier
+	ctx context.Context // Command context, FFmpeg process is terminated when it's done
+
+	copt  *CaptureOptions   // Capture options, available when capturing images
+	sopt  *SliceOptions     // Slice options, available when slicing audio segments
+	hopt  *HLSOptions       // HLS options, available when transcoding into HLS
+	info  *StreamInfo       // Probed input media stream info, lazily populated
+	pts   map[int64]float64 // Captured frame PTS time parsed from showinfo, keyed by frame number starting from 0
+	epoch int               // Number of reconnects parsed from FFmpeg stderr, see Output.Epoch
+	prog  Progress          // Progress parsed from FFmpeg stdout, available when ReportProgress is enabled
+	aead  cipher.AEAD       // Output content cipher, available when EncryptionKey is set
+	sei   *regexp.Regexp    // SEI info pattern compiled from CommonOptions.SEIPattern, SEIRegex is used when nil
+	sets  map[string]string // Capture set names keyed by output directory, available under MultiCapture
 
 	// Since FFmpeg may exit in a very short time, judging by finished may cause several captured/sliced files being ignored.
 	// By Comparing lastQueued & lastIndex, we are able to know whether all files are enqueued
-	lastQueued       int64       // The newest file index that was enqueued
-	lastIndex        int64       // 为了兼容之前单个处理的，这里先不做更改
-	lastCaptureIndex int64       // 截帧最后一个下标
-	lastSliceIndex   int64       // 语音切片最后一个片段的下标
-	existingFileC    chan string // existing file name channel
+	lastQueued       int64         // The newest file index that was enqueued
+	lastIndex        int64         // 为了兼容之前单个处理的，这里先不做更改
+	lastCaptureIndex int64         // 截帧最后一个下标
+	lastSliceIndex   int64         // 语音切片最后一个片段的下标
+	existingFileC    chan string   // existing file name channel
+	exitC            chan struct{} // Closed when FFmpeg process exits
+	closeC           chan struct{} // Closed when Command is closed
+	closeOnce        sync.Once     // Ensures closeC is closed only once
+
+	outC    chan OutputResult // Output channel returned by Outputs
+	outOnce sync.Once         // Ensures outputs are delivered by only one goroutine
+
+	release     func()    // Releases the concurrent process slot, see acquireProcess
+	releaseOnce sync.Once // Ensures the slot is released only once
+
+	stderr *stderrWriter // Stderr of the latest FFmpeg process, see Stderr
+
+	parsed map[string]bool // Output files already enqueued under CommonOptions.FilenameParser, protected by mu
+
+	seiC      chan SEIEvent // SEI event channel returned by SEIChannel, protected by mu
+	seiSent   int64         // The newest SEI fragment index whose events were delivered, protected by mu
+	seiClosed bool          // Whether seiC is closed, protected by mu
 
 	closed        bool      // If the Command is closed, caller shall not read from output queue anymore
+	used          bool      // Whether an operation (e.g. Capture) was called, a Command is single-use, see use
+	draining      bool      // If the Command is draining, new output files are not enqueued anymore, see Drain, protected by mu
+	noOutput      bool      // Whether FFmpeg succeeded without producing any output, see ProducedNoOutput
 	started       bool      // Whether FFmpeg process is started, will be set to true after successfully called cmd.Start
 	finished      bool      // Whether FFmpeg process is finished, will only be set to true when FFmpeg exit with code 0
 	ffmpegExit    bool      // ffmpeg进程是否退出
@@ -83,13 +220,23 @@ type Command struct {
 	finishedSlice bool      // Whether FFmpeg process is finished, will only be set to true when FFmpeg exit with code 0
 	finishedAt    time.Time // The time when FFmpeg is finished
 	err           error     // The error that FFmpeg returned - parsed error for known issues, otherwise "exit status code - message", e.g.: exit status 1 - HTTP 404...
+	captureErr    error     // The error occurred in capture branch under SliceAndCapture, protected by mu
+	sliceErr      error     // The error occurred in slice branch under SliceAndCapture, protected by mu
 
 	stats OutputStats // Output statistics
 }
 
 type OutputModifier func(*Output)
 
-// NewCommand creates a new FFmpeg command instance
+// OutputResult an output or an error delivered by Command.Outputs
+type OutputResult struct {
+	Output *Output // Output, nil when Err is not nil
+	Err    error   // Command error, the last result delivered before the channel is closed
+}
+
+// NewCommand creates a new FFmpeg command instance. A Command is single-use, i.e. only one operation (e.g. Capture,
+// Slice) can be called on it, ErrCommandAlreadyUsed is returned when it's reused or called after Close, create a
+// new Command for every operation instead. Probing is the exception, see ProbeStreams
 func NewCommand() *Command {
 	c := &Command{
 		cmd:              nil,
@@ -99,6 +246,10 @@ func NewCommand() *Command {
 		lastCaptureIndex: math.MaxInt64,
 		lastSliceIndex:   math.MaxInt64,
 		existingFileC:    make(chan string),
+		exitC:            make(chan struct{}),
+		closeC:           make(chan struct{}),
+		pts:              make(map[int64]float64),
+		seiSent:          -1,
 		closed:           false,
 		started:          false,
 		finished:         false,
@@ -111,15 +262,87 @@ func NewCommand() *Command {
 //  1. The output directory MUST BE EMPTY. Command iterates files in output directory to
 //     determine the last index after FFmpeg process finishes, any other files may cause Command block (unable to exit)
 func (c *Command) Capture(opt *CaptureOptions) error {
+	return c.CaptureContext(context.Background(), opt)
+}
+
+// CaptureContext is like Capture but terminates FFmpeg process when ctx is done, see SliceAndCaptureContext
+func (c *Command) CaptureContext(ctx context.Context, opt *CaptureOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	c.ctx = ctx
+	c.opt = &opt.CommonOptions
+	c.copt = opt
+	c.resolveSeekMode(&opt.CommonOptions)
+	if opt.Mode == CaptureModeSampled {
+		if err := c.resolveSamplePositions(opt); err != nil {
+			c.markError(err)
+			return err
+		}
+	} else if opt.DetectVFR {
+		opt.FramePts = c.detectVFR()
+	}
 	cmd := ParseCaptureCommand(opt)
 	fn := func(o *Output) {
 		o.Type = OutputTypeImage
 		o.Suffix = opt.Suffix
 		o.Position = utils.GetImagePosition(o.Index, opt.Rate)
-		o.Second = utils.GetImageSecond(o.Index, opt.Rate)
+		o.Second = utils.GetImageSecondFrom(o.Index, opt.Rate, opt.StartTime)
+		if opt.Mode == CaptureModeSampled {
+			if o.Index > 0 && o.Index <= int64(len(opt.SamplePositions)) /* Index starts from 1 */ {
+				o.Second = opt.SamplePositions[o.Index-1]
+				o.Position = int64(o.Second)
+			}
+		} else if opt.DedupFrames || opt.FramePts {
+			c.useFramePts(o)
+		}
+		if opt.EmbedMetadata {
+			c.embedMetadata(opt, o)
+		}
 	}
 	c.mod = fn
+	return c.process(&opt.CommonOptions, cmd)
+}
+
+// MultiCapture captures specified input media into several capture sets in a single FFmpeg process, outputs are
+// tagged with the name of their capture set (Output.Set). Output.Last is only set on the last output of the last set
+// NOTE:
+//  1. Output directories MUST BE EMPTY, see Capture
+//  2. Output.Index is the index within the capture set
+func (c *Command) MultiCapture(opt *MultiCaptureOptions) error {
+	return c.MultiCaptureContext(context.Background(), opt)
+}
+
+// MultiCaptureContext is like MultiCapture but terminates FFmpeg process when ctx is done, see SliceAndCaptureContext
+func (c *Command) MultiCaptureContext(ctx context.Context, opt *MultiCaptureOptions) error {
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	if err := c.use(); err != nil {
+		return err
+	}
+	c.ctx = ctx
 	c.opt = &opt.CommonOptions
+	c.sets = make(map[string]string)
+	sets := make(map[string]*CaptureOptions)
+	opt.CaptureSetDirs = opt.CaptureSetDirs[:0]
+	for i := range opt.Sets {
+		set := &opt.Sets[i]
+		c.sets[set.OutputDir] = set.Name
+		sets[set.Name] = &set.CaptureOptions
+		opt.CaptureSetDirs = append(opt.CaptureSetDirs, set.OutputDir)
+	}
+	c.resolveSeekMode(&opt.CommonOptions)
+
+	cmd := ParseMultiCaptureCommand(opt)
+	fn := func(o *Output) {
+		set := sets[o.Set]
+		o.Type = OutputTypeImage
+		o.Suffix = set.Suffix
+		o.Position = utils.GetImagePosition(o.Index, set.Rate)
+		o.Second = utils.GetImageSecondFrom(o.Index, set.Rate, opt.StartTime)
+	}
+	c.mod = fn
 	return c.process(&opt.CommonOptions, cmd)
 }
 
@@ -128,15 +351,32 @@ func (c *Command) Capture(opt *CaptureOptions) error {
 //  1. The output directory MUST BE EMPTY. Command iterates files in output directory to
 //     determine the last index after FFmpeg process finishes, any other files may cause Command block (unable to exit)
 func (c *Command) Slice(opt *SliceOptions) error {
-	/* Work around: FFmpeg slices speech fragments starting from 0, with zero we may lose the first fragment event */
-	c.lastQueued = -1
+	return c.SliceContext(context.Background(), opt)
+}
+
+// SliceContext is like Slice but terminates FFmpeg process when ctx is done, see SliceAndCaptureContext
+func (c *Command) SliceContext(ctx context.Context, opt *SliceOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	c.ctx = ctx
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	/* FFmpeg slices speech fragments starting from StartNumber, no fragment is enqueued yet */
+	c.lastQueued = int64(opt.StartNumber) - 1
+	c.opt = &opt.CommonOptions
+	if opt.SkipReencodeIfMatch {
+		opt.CopyAudio = c.audioMatches(opt)
+	}
+	c.resolveSeekMode(&opt.CommonOptions)
 	cmd := ParseSliceCommand(opt)
 	fn := func(o *Output) {
 		o.Type = OutputTypeAudioSegment
 		o.Suffix = opt.Suffix
-		o.Second = utils.GetSegmentStart(o.Index, opt.FragmentDuration)
+		o.Second = utils.GetSegmentStartFrom(o.Index-int64(opt.StartNumber), opt.FragmentDuration, opt.StartTime)
 	}
-	c.opt = &opt.CommonOptions
+	c.sopt = opt
 	if opt.DecodeSEI {
 		opt.CommonOptions.DecodeSEI = true
 		opt.CommonOptions.SEIOutputDir = opt.SEIOutputDir
@@ -152,6 +392,21 @@ func (c *Command) Slice(opt *SliceOptions) error {
 //     determine the last index after FFmpeg process finishes, any other files may cause Command block (unable to exit)
 //  2. The input source must have both video and voice streams
 func (c *Command) SliceAndCapture(opt *SliceAndCaptureOptions) error {
+	return c.SliceAndCaptureContext(context.Background(), opt)
+}
+
+// SliceAndCaptureContext is like SliceAndCapture but sends SIGTERM to FFmpeg process group when ctx is
+// cancelled or its deadline expires. Unlike Close, outputs are not removed, files already produced are
+// still readable through ReadOutput, after which ReadOutput returns an error wrapping ctx.Err(), e.g.:
+//
+//	if errors.Is(err, context.DeadlineExceeded) {
+//		// timed out
+//	}
+func (c *Command) SliceAndCaptureContext(ctx context.Context, opt *SliceAndCaptureOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	c.ctx = ctx
 	/* Work around: FFmpeg slices speech fragments starting from 0, with zero we may lose the first fragment event */
 	c.lastQueued = -1
 	c.opt = &opt.CommonOptions
@@ -161,6 +416,7 @@ func (c *Command) SliceAndCapture(opt *SliceAndCaptureOptions) error {
 		opt.CommonOptions.SEIFragmentSuffix = opt.SEIFragmentSuffix
 	}
 	opt.CommonOptions.SliceAndCapture = true
+	opt.CommonOptions.OnBranchError = opt.OnBranchError
 	// 切片和截帧参数必须有一个
 	if opt.SliceOptions == nil && opt.CaptureOptions == nil {
 		return fmt.Errorf("SliceOptions CaptureOptions cannot be nil in the same time")
@@ -173,6 +429,10 @@ func (c *Command) SliceAndCapture(opt *SliceAndCaptureOptions) error {
 			}
 			opt.CommonOptions.CaptureOutputDir = opt.CaptureOptions.CommonOptions.OutputDir
 			opt.CommonOptions.HasVideo = true
+			c.copt = opt.CaptureOptions
+			if opt.CaptureOptions.DetectVFR {
+				opt.CaptureOptions.FramePts = c.detectVFR()
+			}
 		} else {
 			return fmt.Errorf("CaptureOptions cannot be nil")
 		}
@@ -184,7 +444,11 @@ func (c *Command) SliceAndCapture(opt *SliceAndCaptureOptions) error {
 				return fmt.Errorf("SliceOptions.Suffix and SliceOptions.OutputDir must not be empty")
 			}
 			opt.CommonOptions.SliceOutputDir = opt.SliceOptions.CommonOptions.OutputDir
+			if err := opt.SliceOptions.validate(); err != nil {
+				return err
+			}
 			opt.CommonOptions.HasSpeech = true
+			c.sopt = opt.SliceOptions
 		} else {
 			return fmt.Errorf("SliceOptions cannot be nil")
 		}
@@ -196,13 +460,19 @@ func (c *Command) SliceAndCapture(opt *SliceAndCaptureOptions) error {
 		case opt.SliceOptions.Suffix:
 			{
 				o.Type = OutputTypeAudioSegment
-				o.Second = utils.GetSegmentStart(o.Index, opt.FragmentDuration)
+				o.Second = utils.GetSegmentStartFrom(o.Index-int64(opt.SliceOptions.StartNumber), opt.FragmentDuration, opt.StartTime)
 			}
 		case opt.CaptureOptions.Suffix:
 			{
 				o.Type = OutputTypeImage
 				o.Position = utils.GetImagePosition(o.Index, opt.Rate)
-				o.Second = utils.GetImageSecond(o.Index, opt.Rate)
+				o.Second = utils.GetImageSecondFrom(o.Index, opt.Rate, opt.StartTime)
+				if opt.CaptureOptions.DedupFrames || opt.CaptureOptions.FramePts {
+					c.useFramePts(o)
+				}
+				if opt.CaptureOptions.EmbedMetadata {
+					c.embedMetadata(opt.CaptureOptions, o)
+				}
 			}
 		}
 	}
@@ -210,6 +480,444 @@ func (c *Command) SliceAndCapture(opt *SliceAndCaptureOptions) error {
 	return c.process(&opt.CommonOptions, cmd)
 }
 
+// Remux changes the container of specified input media without re-encoding (-c copy), the remuxed file
+// is delivered through the output queue as a single Output with Last set to true.
+// NOTE:
+//  1. The output directory MUST BE EMPTY
+//  2. ErrCodecNotSupported is returned when the target container can not hold the source codecs
+func (c *Command) Remux(opt *RemuxOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	if opt.Suffix == "" {
+		return fmt.Errorf("RemuxOptions.Suffix must not be empty")
+	}
+	cmd := ParseRemuxCommand(opt)
+	fn := func(o *Output) {
+		o.Type = OutputTypeMedia
+		o.Suffix = opt.Suffix
+	}
+	c.mod = fn
+	c.opt = &opt.CommonOptions
+	return c.process(&opt.CommonOptions, cmd)
+}
+
+// Transcode transcodes (and resizes) specified input media into a single media file, which is delivered through the
+// output queue as a single Output of OutputTypeMedia with Last set to true. The transcoded media is probed for its
+// duration, see OutputStats.MediaDuration. Like ProbeStreams, Transcode blocks until FFmpeg exits.
+// NOTE:
+//  1. The output directory MUST BE EMPTY, a temporary one is created under TempDir when not set
+//  2. Suffix defaults to mp4
+func (c *Command) Transcode(opt *TranscodeOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	if opt.Suffix == "" {
+		opt.Suffix = "mp4"
+	}
+	if err := opt.resolveTempOutputDir(); err != nil {
+		return err
+	}
+	cmd := ParseTranscodeCommand(opt)
+	c.opt = &opt.CommonOptions
+	defer c.removeDir(opt.OutputDir)
+	if err := c.processwait(&opt.CommonOptions, cmd); err != nil {
+		return err
+	}
+
+	fn := fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix)
+	byt, err := ioutil.ReadFile(fn)
+	if err != nil {
+		c.markError(err)
+		return fmt.Errorf("error reading transcoded media: %w", err)
+	}
+	popt := c.probeOptions()
+	popt.Uri, popt.IsFile, popt.IsStream, popt.Proxy = fn, true, false, ""
+	if st, err := c.ProbeStreams(popt); err != nil {
+		log.Warn().Err(err).Str("mediaId", opt.MediaId).Msg("error probing transcoded media")
+	} else if dur, err := st.Format.GetDuration(); err == nil {
+		c.stats.MediaDuration = dur
+	}
+	c.finishWith(&Output{
+		Type:    OutputTypeMedia,
+		Content: byt,
+		Suffix:  opt.Suffix,
+		Second:  opt.StartTime,
+	})
+	return nil
+}
+
+// ExtractSubtitles extracts an embedded subtitle stream (see SubtitleOptions.StreamIndex) of specified input media
+// into a subtitle file, which is delivered through the output queue as a single Output of OutputTypeSubtitle with
+// Last set to true. Input media is probed for subtitle streams first, ErrNoStream is returned when there is none.
+// Like Transcode, ExtractSubtitles blocks until FFmpeg exits.
+// NOTE:
+//  1. Not available for streams and InputReader, which can not be probed beforehand
+//  2. Format defaults to SubtitleFormatWebVTT, Suffix is set to Format
+func (c *Command) ExtractSubtitles(opt *SubtitleOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	if opt.Format == "" {
+		opt.Format = SubtitleFormatWebVTT
+	}
+	if _, ok := subtitleEncoders[opt.Format]; !ok {
+		return fmt.Errorf("unsupported subtitle format: %v", opt.Format)
+	}
+	if !opt.probeable() {
+		return fmt.Errorf("subtitles can not be extracted from streams and InputReader")
+	}
+	opt.Suffix = opt.Format
+	if err := opt.resolveTempOutputDir(); err != nil {
+		return err
+	}
+	c.opt = &opt.CommonOptions
+
+	st, err := c.ProbeStreams(c.probeOptions())
+	if err != nil {
+		c.markError(err)
+		return fmt.Errorf("error probing subtitle streams: %w", err)
+	}
+	c.info = st
+	n := 0
+	for _, v := range st.Streams {
+		if v.CodecType == "subtitle" {
+			n++
+		}
+	}
+	if n == 0 {
+		c.markError(ErrNoStream)
+		return ErrNoStream
+	}
+	if opt.StreamIndex < 0 || opt.StreamIndex >= n {
+		err = fmt.Errorf("subtitle stream %v not found, media has %v subtitle stream(s)", opt.StreamIndex, n)
+		c.markError(err)
+		return err
+	}
+
+	cmd := ParseSubtitleCommand(opt)
+	defer c.removeDir(opt.OutputDir)
+	if err = c.processwait(&opt.CommonOptions, cmd); err != nil {
+		return err
+	}
+	byt, err := ioutil.ReadFile(fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix))
+	if err != nil {
+		c.markError(err)
+		return fmt.Errorf("error reading extracted subtitles: %w", err)
+	}
+	c.finishWith(&Output{
+		Type:    OutputTypeSubtitle,
+		Content: byt,
+		Suffix:  opt.Suffix,
+		Second:  opt.StartTime,
+	})
+	return nil
+}
+
+// HLS transcodes specified input media (e.g. RTMP stream) into HLS segments for browser playback. Every segment is
+// delivered through the output queue as an Output of OutputTypeMediaSegment, followed by the updated playlist as an
+// Output of OutputTypePlaylist having the same Index. The final playlist is the last output.
+// NOTE:
+//  1. The output directory MUST BE EMPTY, see Capture
+//  2. Suffix defaults to ts, playlist entries refer to segments by file name, e.g. 000000000000.ts
+func (c *Command) HLS(opt *HLSOptions) error {
+	return c.HLSContext(context.Background(), opt)
+}
+
+// HLSContext is like HLS but terminates FFmpeg process when ctx is done, see SliceAndCaptureContext
+func (c *Command) HLSContext(ctx context.Context, opt *HLSOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	c.ctx = ctx
+	/* Work around: FFmpeg writes HLS segments starting from 0, see SliceContext */
+	c.lastQueued = -1
+	if opt.Suffix == "" {
+		opt.Suffix = "ts"
+	}
+	opt.Playlist = opt.playlist()
+	cmd := ParseHLSCommand(opt)
+	fn := func(o *Output) {
+		o.Type = OutputTypeMediaSegment
+		o.Suffix = opt.Suffix
+		o.Second = utils.GetSegmentStartFrom(o.Index, opt.segmentDuration(), opt.StartTime)
+	}
+	c.mod = fn
+	c.opt = &opt.CommonOptions
+	c.hopt = opt
+	return c.process(&opt.CommonOptions, cmd)
+}
+
+// Spectrogram renders audio stream of specified input media into a spectrogram image, the image is delivered
+// through the output queue as a single Output of OutputTypeImage with Tag set to OutputTagSpectrogram.
+// NOTE:
+//  1. The output directory MUST BE EMPTY
+//  2. Suffix defaults to png
+func (c *Command) Spectrogram(opt *SpectrogramOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	if opt.Suffix == "" {
+		opt.Suffix = "png"
+	}
+	cmd := ParseSpectrogramCommand(opt)
+	fn := func(o *Output) {
+		o.Type = OutputTypeImage
+		o.Suffix = opt.Suffix
+		o.Tag = OutputTagSpectrogram
+		o.Second = float64(opt.Start)
+	}
+	c.mod = fn
+	c.opt = &opt.CommonOptions
+	return c.process(&opt.CommonOptions, cmd)
+}
+
+// TIFF captures images like Capture, then assembles them into a single multi-page TIFF, which is delivered
+// through the output queue as a single Output of OutputTypeImage with Last set to true. Since the TIFF can only be
+// assembled after all images are captured, TIFF blocks until FFmpeg exits like ProbeStreams.
+// NOTE: The output directory MUST BE EMPTY, a temporary one is created under TempDir when not set
+func (c *Command) TIFF(opt *TIFFOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	if err := opt.resolveTempOutputDir(); err != nil {
+		return err
+	}
+	cmd := ParseTIFFCommand(opt)
+	c.opt = &opt.CommonOptions
+	c.copt = &opt.CaptureOptions
+	defer c.removeDir(opt.OutputDir)
+	if err := c.processwait(&opt.CommonOptions, cmd); err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(opt.OutputDir)
+	if err != nil {
+		c.markError(err)
+		return fmt.Errorf("error reading ffmpeg output directory: %w", err)
+	}
+	pages := make([][]byte, 0, len(files))
+	for _, f := range files /* sorted by file name, i.e. index */ {
+		byt, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", opt.OutputDir, f.Name()))
+		if err != nil {
+			c.markError(err)
+			return fmt.Errorf("error reading captured image: %w", err)
+		}
+		pages = append(pages, byt)
+	}
+	byt, err := assembleTIFF(pages)
+	if err != nil {
+		c.markError(err)
+		return fmt.Errorf("error assembling TIFF: %w", err)
+	}
+
+	c.finishWith(&Output{
+		Type:    OutputTypeImage,
+		Content: byt,
+		Suffix:  opt.Suffix,
+	})
+	return nil
+}
+
+// GIF converts a time range of specified input media into an animated GIF, using a generated palette for quality.
+// The animation is delivered through the output queue as a single Output of OutputTypeAnimation with Last set to
+// true. Like ProbeStreams, GIF blocks until FFmpeg exits.
+// NOTE:
+//  1. The output directory MUST BE EMPTY, a temporary one is created under TempDir when not set
+//  2. Suffix defaults to gif, animated WebP is produced when Suffix is webp
+func (c *Command) GIF(opt *GIFOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	if opt.Suffix == "" {
+		opt.Suffix = "gif"
+	}
+	if err := opt.resolveTempOutputDir(); err != nil {
+		return err
+	}
+	cmd := ParseGIFCommand(opt)
+	c.opt = &opt.CommonOptions
+	defer c.removeDir(opt.OutputDir)
+	if err := c.processwait(&opt.CommonOptions, cmd); err != nil {
+		return err
+	}
+
+	byt, err := ioutil.ReadFile(fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix))
+	if err != nil {
+		c.markError(err)
+		return fmt.Errorf("error reading animation: %w", err)
+	}
+	c.finishWith(&Output{
+		Type:    OutputTypeAnimation,
+		Content: byt,
+		Suffix:  opt.Suffix,
+		Second:  opt.StartTime,
+	})
+	return nil
+}
+
+// FirstFrame captures a single frame of specified input media at CommonOptions.StartTime (default to the first
+// frame), the image is read from FFmpeg stdout and returned directly. Unlike Capture, neither output directory
+// nor output queue is involved, and FirstFrame blocks until FFmpeg exits.
+// NOTE: Suffix defaults to jpg, png is also supported. Rate, Mode and MaxFrames are ignored
+func (c *Command) FirstFrame(opt *CaptureOptions) ([]byte, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+	if opt.Suffix == "" {
+		opt.Suffix = "jpg"
+	}
+	cmd := ParseFirstFrameCommand(opt)
+	c.opt = &opt.CommonOptions
+	c.copt = opt
+	if err := opt.validateInput(); err != nil {
+		c.markError(err)
+		return nil, err
+	}
+
+	if err := c.acquireProcess(); err != nil {
+		c.markError(err)
+		return nil, err
+	}
+
+	log.Info().Str("cmd", cmd).Str("mediaId", opt.MediaId).Msg("starting ffmpeg process")
+	ow := new(bytes.Buffer)
+	c.stats.Start = time.Now()
+	err := c.execwait(cmd, ow)
+	c.stats.End = time.Now()
+	c.releaseProcess()
+	if err != nil {
+		c.markError(err)
+		return nil, err
+	}
+	if ow.Len() == 0 {
+		err = fmt.Errorf("no frame captured")
+		c.markError(err)
+		return nil, err
+	}
+	c.stats.Output, c.stats.Bytes = 1, int64(ow.Len())
+	c.stats.ImageCount, c.stats.ImageBytes = 1, int64(ow.Len())
+	c.finished = true
+	c.finishedAt = time.Now()
+	return ow.Bytes(), nil
+}
+
+// DetectSilence detects silent intervals of specified input media with silencedetect filter, e.g. to find
+// speech/non-speech boundaries. Like probing, there is no file output and DetectSilence blocks until FFmpeg exits.
+// NOTE:
+//  1. Noise defaults to -30 (dB), MinDuration defaults to 0.5 (seconds)
+//  2. SilenceInterval.End is -1 when the silence lasts until the end of input and FFmpeg does not report its end
+func (c *Command) DetectSilence(opt *SilenceOptions) ([]SilenceInterval, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+	if opt.Noise == 0 {
+		opt.Noise = defaultSilenceNoise
+	}
+	if opt.MinDuration <= 0 {
+		opt.MinDuration = defaultSilenceMinDuration
+	}
+	cmd := ParseSilenceCommand(opt)
+	c.opt = &opt.CommonOptions
+	if err := opt.validateInput(); err != nil {
+		c.markError(err)
+		return nil, err
+	}
+
+	// Timestamps restart from 0 after input seeking, see useFramePts
+	offset := 0.0
+	if !opt.IsStream {
+		offset = opt.StartTime
+	}
+	intervals := make([]SilenceInterval, 0)
+	hdl := func(line string) {
+		m := SilenceRegex.FindStringSubmatch(line)
+		if len(m) != 3 {
+			return
+		}
+		sec, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			return
+		}
+		sec += offset
+		n := len(intervals)
+		switch {
+		case m[1] == "start":
+			intervals = append(intervals, SilenceInterval{Start: sec, End: -1})
+		case n > 0 && intervals[n-1].End == -1:
+			intervals[n-1].End = sec
+		}
+	}
+
+	log.Info().Str("cmd", cmd).Str("mediaId", opt.MediaId).Msg("starting ffmpeg process")
+	c.stats.Start = time.Now()
+	err := c.execwaitContext(c.context(), cmd, ioutil.Discard, c.newStderrWriter(hdl))
+	c.stats.End = time.Now()
+	if err != nil {
+		c.markError(err)
+		return nil, err
+	}
+	c.finished = true
+	c.finishedAt = time.Now()
+	return intervals, nil
+}
+
+// Sprite assembles evenly spaced frames of specified input media into a single sprite sheet image, the image is
+// delivered through the output queue as a single Output of OutputTypeImage with Tag set to OutputTagSprite and Last
+// set to true. Like ProbeStreams, Sprite blocks until FFmpeg exits.
+// NOTE:
+//  1. The output directory MUST BE EMPTY
+//  2. Suffix defaults to jpg
+//  3. Media is probed to get its duration when Interval is not specified, which is required for streams
+func (c *Command) Sprite(opt *SpriteOptions) error {
+	if err := c.use(); err != nil {
+		return err
+	}
+	if opt.Suffix == "" {
+		opt.Suffix = "jpg"
+	}
+	c.opt = &opt.CommonOptions
+	if opt.Interval <= 0 {
+		if !opt.probeable() {
+			err := fmt.Errorf("SpriteOptions.Interval must be specified for streams and InputReader")
+			c.markError(err)
+			return err
+		}
+		st, err := c.ProbeStreams(c.probeOptions())
+		if err != nil {
+			c.markError(err)
+			return fmt.Errorf("error probing media duration: %w", err)
+		}
+		c.info = st
+		dur, err := st.GetVideoDuration()
+		if err != nil {
+			c.markError(err)
+			return fmt.Errorf("error getting media duration: %w", err)
+		}
+		cols, rows := spriteLayout(opt)
+		opt.Interval = dur / float64(cols*rows)
+	}
+
+	cmd := ParseSpriteCommand(opt)
+	defer c.removeDir(opt.OutputDir)
+	if err := c.processwait(&opt.CommonOptions, cmd); err != nil {
+		return err
+	}
+
+	byt, err := ioutil.ReadFile(fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix))
+	if err != nil {
+		c.markError(err)
+		return fmt.Errorf("error reading sprite sheet: %w", err)
+	}
+	c.finishWith(&Output{
+		Type:    OutputTypeImage,
+		Content: byt,
+		Suffix:  opt.Suffix,
+		Tag:     OutputTagSprite,
+	})
+	return nil
+}
+
 // ReadOutput reads output from the underlying queue, also indicates whether all output are read.
 // NOTE: Must break on finished and error in a for loop, e.g.:
 //
@@ -246,33 +954,128 @@ func (c *Command) ReadOutput() (o *Output, err error, ok bool, finished bool) {
 	return nil, nil, false, false
 }
 
+// Outputs returns a channel delivering outputs, which is an alternative to ReadOutput, e.g.:
+//
+//	for res := range cmd.Outputs() {
+//		if res.Err != nil {
+//			fmt.Println(res.Err)
+//			break
+//		}
+//		fmt.Printf("[%v]: bytes: %v\n", res.Output.Index, len(res.Output.Content))
+//	}
+//
+// The channel is closed when FFmpeg process finished and all outputs are delivered, right after an error
+// is delivered, or when the Command is closed. Do not mix Outputs with ReadOutput.
+func (c *Command) Outputs() <-chan OutputResult {
+	c.outOnce.Do(func() {
+		c.outC = make(chan OutputResult)
+		go c.deliverOutputs()
+	})
+	return c.outC
+}
+
+// deliverOutputs reads outputs from the underlying queue, sends them to outC until finished
+func (c *Command) deliverOutputs() {
+	defer close(c.outC)
+	for !c.closed {
+		o, err, ok, finished := c.ReadOutput()
+		if err != nil {
+			select {
+			case c.outC <- OutputResult{Err: err}:
+			case <-c.closeC:
+			}
+			return
+		}
+		if finished {
+			return
+		}
+		if !ok {
+			time.Sleep(readInterval)
+			continue
+		}
+		select {
+		case c.outC <- OutputResult{Output: o}:
+		case <-c.closeC:
+			return
+		}
+	}
+}
+
 // ProbeStreams probes media stream info
 // NOTE:
 //  1. Will retry once on connection timeout for both file and stream
 //  2. Will retry several times when RetryStreamOnError is enabled for stream
+//  3. Will retry several times when MaxRetry is set for non-stream media (e.g. file url), except for definitive
+//     errors that can not be resolved by retrying, e.g. ErrUrlNotFound
+//  4. Stops retrying once Deadline is exceeded, the running FFprobe process is terminated as well
+//  5. Unlike other operations, probing is available before and while other operations run, until the Command is closed
 func (c *Command) ProbeStreams(opt *ProbeOptions) (st *StreamInfo, err error) {
+	if c.closed {
+		return nil, ErrCommandAlreadyUsed
+	}
+	ctx := c.context()
+	if opt.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.Deadline)
+		defer cancel()
+	}
+
 	if opt.IsStream && opt.RetryStreamOnError {
 		fn := func() error {
-			st, err = c.probe(opt)
+			st, err = c.probe(ctx, opt)
 			return err
 		}
-		err = retry.WithInterval(fn, opt.MaxRetry, opt.RetryInterval)
+		err = retry.WithIntervalContext(ctx, fn, opt.MaxRetry, opt.RetryInterval)
+		return
+	}
+	if !opt.IsStream && opt.MaxRetry > 0 {
+		fn := func() error {
+			st, err = c.probe(ctx, opt)
+			if isDefinitive(err) /* Stop retrying, err is returned as is */ {
+				return nil
+			}
+			return err
+		}
+		_ = retry.WithIntervalContext(ctx, fn, opt.MaxRetry, opt.RetryInterval)
 		return
 	}
 
 	// No retry is required
-	return c.probe(opt)
+	return c.probe(ctx, opt)
+}
+
+// ProbeStreamsContext is like ProbeStreams but terminates FFprobe process and stops retrying when ctx is done
+func (c *Command) ProbeStreamsContext(ctx context.Context, opt *ProbeOptions) (*StreamInfo, error) {
+	c.ctx = ctx
+	return c.ProbeStreams(opt)
+}
+
+// ProbeChapters probes chapter markers of media
+func (c *Command) ProbeChapters(opt *ProbeOptions) ([]Chapter, error) {
+	return c.ProbeChaptersContext(context.Background(), opt)
+}
+
+// ProbeChaptersContext is like ProbeChapters but terminates FFprobe process when ctx is done
+func (c *Command) ProbeChaptersContext(ctx context.Context, opt *ProbeOptions) ([]Chapter, error) {
+	c.ctx = ctx
+	popt := *opt
+	popt.IncludeChapters = true
+	st, err := c.ProbeStreams(&popt)
+	if err != nil {
+		return nil, err
+	}
+	return st.Chapters, nil
 }
 
-func (c *Command) probe(opt *ProbeOptions) (st *StreamInfo, err error) {
+func (c *Command) probe(ctx context.Context, opt *ProbeOptions) (st *StreamInfo, err error) {
 	cmd := ParseProbeCommand(opt)
 	ow := new(bytes.Buffer) // Stdout writer
-	err = c.execwait(cmd, ow)
-	if err == ErrConnectionTimeout {
+	err = c.execwaitContext(ctx, cmd, ow, newStderrWriter(nil, DefaultStderrLimit))
+	if err == ErrConnectionTimeout && ctx.Err() == nil {
 		// Retry on connection timeout, note that here we must reset ow
 		// otherwise there may be some obsolete message remaining in ow causing JSON unmarshal error
 		ow = new(bytes.Buffer)
-		err = c.execwait(cmd, ow)
+		err = c.execwaitContext(ctx, cmd, ow, newStderrWriter(nil, DefaultStderrLimit))
 	}
 	if err != nil {
 		return
@@ -296,6 +1099,8 @@ func (c *Command) Stats() OutputStats {
 // Close kills FFmpeg process, removes watcher and deletes output directory
 func (c *Command) Close() error {
 	c.closed = true
+	c.closeOnce.Do(func() { close(c.closeC) })
+	c.closeSEI()
 	if c.started {
 		close(c.existingFileC)
 		if !(c.finished || c.err != nil) {
@@ -309,6 +1114,11 @@ func (c *Command) Close() error {
 		if err := os.RemoveAll(c.opt.OutputDir); err != nil {
 			log.Err(err).Msg("error deleting output directory")
 		}
+		for _, dir := range c.opt.CaptureSetDirs {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Err(err).Msg("error deleting capture set output directory")
+			}
+		}
 		if c.opt.SEIOutputDir != "" {
 			if err := os.RemoveAll(c.opt.SEIOutputDir); err != nil {
 				log.Err(err).Msg("error deleting SEI output directory")
@@ -320,17 +1130,277 @@ func (c *Command) Close() error {
 	return nil
 }
 
+// Drain gracefully closes the Command: FFmpeg process is terminated and new output files are not enqueued anymore,
+// while ReadOutput (or Outputs) keeps returning already enqueued outputs until the queue is empty or timeout
+// elapses, then the Command is closed. Returns an error when outputs are discarded due to timeout.
+// NOTE: Drain blocks, outputs must be read in another goroutine
+func (c *Command) Drain(timeout time.Duration) error {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+	if c.started && !(c.finished || c.err != nil) {
+		if err := c.kill(c.cmd); err != nil {
+			log.Err(err).Msg("error killing ffmpeg process")
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !c.q.Empty() && time.Now().Before(deadline) {
+		time.Sleep(readInterval)
+	}
+	n := c.q.Size()
+	_ = c.Close()
+	if n > 0 {
+		return fmt.Errorf("%v outputs discarded after draining for %v", n, timeout)
+	}
+	return nil
+}
+
+// EffectiveOptions returns capture options FFmpeg runs with after defaults and automatic decisions are resolved,
+// e.g. LogLevel raised for DedupFrames, Suffix defaulted by FirstFrame or forced by TIFF, frame PTS tracking for VFR
+// sources (see CaptureOptions.UsesFramePts), input options shared by SliceAndCapture. This helps explaining outputs,
+// e.g. an unexpected number of captured images.
+// Returns false when no image is captured by the command, only available after the command is started
+func (c *Command) EffectiveOptions() (CaptureOptions, bool) {
+	if c.copt == nil || c.opt == nil {
+		return CaptureOptions{}, false
+	}
+	opt := *c.copt
+	if c.opt.SliceAndCapture /* Input options are shared by both branches */ {
+		opt.Uri, opt.LogLevel, opt.HWAccel, opt.HWAccelDevice = c.opt.Uri, c.opt.LogLevel, c.opt.HWAccel, c.opt.HWAccelDevice
+	}
+	opt.LogLevel = opt.GetLogLevel()
+	return opt, true
+}
+
+// ExpectedOutputCount predicts the number of outputs Capture, Slice or SliceAndCapture will produce, which can be
+// used to validate completeness and detect truncated processing. The input media is probed on the first call, and is
+// restricted by StartTime & Duration.
+// NOTE:
+//  1. Returns false for streams, or when media duration (frame count under CaptureModeByFrame) is unknown
+//  2. Only available after Capture, Slice or SliceAndCapture is called
+func (c *Command) ExpectedOutputCount() (int, bool) {
+	if c.opt == nil || !c.opt.probeable() || (c.copt == nil && c.sopt == nil) {
+		return 0, false
+	}
+	if c.info == nil {
+		st, err := c.ProbeStreams(c.probeOptions())
+		if err != nil {
+			log.Err(err).Str("mediaId", c.opt.MediaId).Msg("error probing media for expected output count")
+			return 0, false
+		}
+		c.info = st
+	}
+
+	n := 0
+	if c.copt != nil {
+		cnt := expectedCaptureCountOf(c.info, c.copt, c.opt)
+		if cnt < 0 {
+			return 0, false
+		}
+		n += cnt
+	}
+	if c.sopt != nil {
+		dur, err := c.info.GetAudioDuration()
+		if err != nil {
+			return 0, false
+		}
+		n += utils.GetExpectedSegmentCount(spanOf(dur, c.opt), c.sopt.FragmentDuration)
+	}
+	return n, true
+}
+
+// ExpectedCaptureCount predicts the number of images Capture will produce for input media lasting duration seconds,
+// i.e. ceil(duration*Rate) capped by MaxFrames, e.g. for pre-allocating buffers or showing progress before capturing.
+// Returns -1 when it's unknown:
+//  1. For streams, whose duration is unknown
+//  2. When duration is not positive
+//  3. Under CaptureModeByFrame, which depends on frame count, see ExpectedCaptureCountOf
+//
+// SampleCount is returned under CaptureModeSampled
+func ExpectedCaptureCount(duration float64, opt *CaptureOptions) int {
+	if opt.IsStream || duration <= 0 || opt.Mode == CaptureModeByFrame {
+		return -1
+	}
+	if opt.Mode == CaptureModeSampled {
+		return opt.SampleCount
+	}
+	return capMaxFrames(utils.GetExpectedImageCount(duration, opt.Rate), opt)
+}
+
+// ExpectedCaptureCountOf is like ExpectedCaptureCount but takes media info returned by ProbeStreams, video duration
+// is used by default, while frame count (divided by Frame) is used under CaptureModeByFrame. Media is restricted by
+// StartTime & Duration. Returns -1 when it's unknown, e.g. for streams, or when media has no video stream
+func ExpectedCaptureCountOf(st *StreamInfo, opt *CaptureOptions) int {
+	return expectedCaptureCountOf(st, opt, &opt.CommonOptions)
+}
+
+// expectedCaptureCountOf is like ExpectedCaptureCountOf, but media is restricted by StartTime & Duration of rng, e.g.
+// input options of SliceAndCapture shared by both branches
+func expectedCaptureCountOf(st *StreamInfo, opt *CaptureOptions, rng *CommonOptions) int {
+	if opt.IsStream || st == nil {
+		return -1
+	}
+	idx, ok := st.HasVideoStream()
+	if !ok {
+		return -1
+	}
+	dur, err := st.GetVideoDuration()
+	if opt.Mode == CaptureModeByFrame {
+		frames, err2 := st.Streams[idx].GetFrames()
+		if err2 != nil {
+			return -1
+		}
+		if err == nil {
+			frames = scaleFrames(frames, spanOf(dur, rng), dur)
+		}
+		return capMaxFrames(utils.GetExpectedFrameCount(frames, opt.Frame), opt)
+	}
+	if err != nil {
+		return -1
+	}
+	return ExpectedCaptureCount(spanOf(dur, rng), opt)
+}
+
+// spanOf returns the duration in seconds to be processed of media lasting dur seconds, i.e. restricted by StartTime &
+// Duration of opt
+func spanOf(dur float64, opt *CommonOptions) float64 {
+	span := dur - opt.StartTime
+	if opt.Duration > 0 && opt.Duration < span {
+		span = opt.Duration
+	}
+	if span < 0 {
+		return 0
+	}
+	return span
+}
+
+// scaleFrames returns the number of frames within span seconds of media having frames frames and lasting dur seconds
+func scaleFrames(frames int64, span, dur float64) int64 {
+	if dur <= 0 || span >= dur {
+		return frames
+	}
+	return int64(math.Ceil(float64(frames) * span / dur))
+}
+
+// capMaxFrames caps expected capture count n by MaxFrames
+func capMaxFrames(n int, opt *CaptureOptions) int {
+	if opt.MaxFrames > 0 && n > opt.MaxFrames {
+		return opt.MaxFrames
+	}
+	return n
+}
+
+// OutputDirs returns resolved output directories of the command keyed by label (e.g. OutputDirCapture), so that
+// outputs can be located when PreserveOutput is enabled. Only available after the command is started.
+// Under MultiCapture, directories of capture sets are keyed by OutputDirCapture/<set name>, e.g. capture/dense
+func (c *Command) OutputDirs() map[string]string {
+	dirs := make(map[string]string)
+	if c.opt == nil {
+		return dirs
+	}
+	switch {
+	case c.opt.SliceAndCapture:
+		if c.opt.HasVideo {
+			dirs[OutputDirCapture] = c.opt.CaptureOutputDir
+		}
+		if c.opt.HasSpeech {
+			dirs[OutputDirSlice] = c.opt.SliceOutputDir
+		}
+	case len(c.opt.CaptureSetDirs) > 0:
+		for dir, set := range c.sets {
+			dirs[OutputDirCapture+"/"+set] = dir
+		}
+	case c.copt != nil:
+		dirs[OutputDirCapture] = c.opt.OutputDir
+	case c.sopt != nil:
+		dirs[OutputDirSlice] = c.opt.OutputDir
+	case c.hopt != nil:
+		dirs[OutputDirHLS] = c.opt.OutputDir
+	default:
+		dirs[OutputDirMedia] = c.opt.OutputDir
+	}
+	if c.opt.DecodeSEI {
+		dirs[OutputDirSEI] = c.opt.SEIOutputDir
+	}
+	for k, v := range dirs {
+		if v == "" /* e.g. FirstFrame */ {
+			delete(dirs, k)
+		}
+	}
+	return dirs
+}
+
 // IsFinished testifies whether the command is finished
 func (c *Command) IsFinished() bool {
 	ok := c.finished /* command process finished */
 	return ok
 }
 
+// ProducedNoOutput returns whether FFmpeg succeeded without producing any output, e.g. capturing a 0 duration or
+// corrupt input, which distinguishes an empty result from a non-empty one once finished. Also see
+// CommonOptions.ErrorOnNoOutput
+func (c *Command) ProducedNoOutput() bool {
+	return c.noOutput
+}
+
 // Error returns command error
 func (c *Command) Error() error {
 	return c.err
 }
 
+// Stderr returns stderr of FFmpeg process (the last CommonOptions.StderrLimit bytes), e.g. to find out the cause of
+// an unknown error, which is available while FFmpeg is running and after it exits. Stderr of probing is not included
+func (c *Command) Stderr() string {
+	c.mu.Lock()
+	ew := c.stderr
+	c.mu.Unlock()
+	if ew == nil {
+		return ""
+	}
+	return ew.String()
+}
+
+// CaptureError returns the error occurred in capture branch under SliceAndCapture.
+// Errors returned by FFmpeg process are not branch specific, see Error
+func (c *Command) CaptureError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.captureErr
+}
+
+// SliceError returns the error occurred in slice branch under SliceAndCapture.
+// Errors returned by FFmpeg process are not branch specific, see Error
+func (c *Command) SliceError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sliceErr
+}
+
+// use marks the Command as used, a Command is single-use, operations except probing can only be called once
+// and never after Close. Returns ErrCommandAlreadyUsed otherwise, in which case the Command is left untouched
+func (c *Command) use() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.used || c.closed {
+		return ErrCommandAlreadyUsed
+	}
+	c.used = true
+	return nil
+}
+
+// accepting returns whether new outputs should be enqueued
+func (c *Command) accepting() bool {
+	return !c.closed && !c.isDraining()
+}
+
+// isDraining returns whether Drain is called
+func (c *Command) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
 // IsClosed returns whether the command is closed
 func (c *Command) IsClosed() bool {
 	return c.closed
@@ -353,6 +1423,17 @@ func (c *Command) LastSliceIndex() int64 {
 
 // process processes cmd
 func (c *Command) process(opt *CommonOptions, cmd string) (err error) {
+	if err = opt.validateInput(); err != nil {
+		c.markError(err)
+		return err
+	}
+	if opt.SEIPattern != "" {
+		if c.sei, err = regexp.Compile(opt.SEIPattern); err != nil {
+			err = fmt.Errorf("invalid SEI pattern: %w", err)
+			c.markError(err)
+			return err
+		}
+	}
 	// 如果语音切片和图片都输出的话创建 SliceOutputDir 和 CaptureOutputDir
 	// 在开始前先把目录清除干净
 	if opt.SliceAndCapture {
@@ -372,6 +1453,14 @@ func (c *Command) process(opt *CommonOptions, cmd string) (err error) {
 				return fmt.Errorf("error creating ffmpeg capture output directory: %w", err)
 			}
 		}
+	} else if len(opt.CaptureSetDirs) > 0 {
+		for _, dir := range opt.CaptureSetDirs {
+			os.RemoveAll(dir)
+			if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+				c.markError(err)
+				return fmt.Errorf("error creating ffmpeg capture set output directory: %w", err)
+			}
+		}
 	} else {
 		os.RemoveAll(opt.OutputDir)
 		err = os.MkdirAll(opt.OutputDir, os.ModePerm)
@@ -388,11 +1477,27 @@ func (c *Command) process(opt *CommonOptions, cmd string) (err error) {
 			return fmt.Errorf("error creating ffmpeg SEI output directory: %w", err)
 		}
 	}
+	if err = c.initCipher(opt); err != nil {
+		return err
+	}
+	if err = c.context().Err(); err != nil {
+		err = fmt.Errorf("ffmpeg process cancelled: %w", err)
+		c.markError(err)
+		return err
+	}
+	if err = c.acquireProcess(); err != nil {
+		c.markError(err)
+		return err
+	}
+	if opt.ReportProgress {
+		c.initProgress()
+	}
 	go func() {
 		c.startWatching()
 	}()
 	c.cmd, err = c.exec(cmd)
 	if err != nil {
+		c.releaseProcess()
 		c.markError(err)
 		return err
 	}
@@ -407,6 +1512,109 @@ func (c *Command) process(opt *CommonOptions, cmd string) (err error) {
 	return nil
 }
 
+// processwait creates output directory, runs cmd and blocks until FFmpeg exits, used by outputs that can only
+// be read after FFmpeg finishes, see finishWith
+func (c *Command) processwait(opt *CommonOptions, cmd string) (err error) {
+	if err = opt.validateInput(); err != nil {
+		c.markError(err)
+		return err
+	}
+	_ = os.RemoveAll(opt.OutputDir)
+	if err = os.MkdirAll(opt.OutputDir, os.ModePerm); err != nil {
+		c.markError(err)
+		return fmt.Errorf("error creating ffmpeg output directory: %w", err)
+	}
+	if err = c.initCipher(opt); err != nil {
+		return err
+	}
+
+	if err = c.acquireProcess(); err != nil {
+		c.markError(err)
+		return err
+	}
+
+	log.Info().Str("cmd", cmd).Str("mediaId", opt.MediaId).Msg("starting ffmpeg process")
+	c.stats.Start = time.Now()
+	err = c.execwait(cmd, ioutil.Discard)
+	c.stats.End = time.Now()
+	c.releaseProcess()
+	if err != nil {
+		c.markError(err)
+		return err
+	}
+	return nil
+}
+
+// initCipher initializes output content cipher when EncryptionKey is set, so that an invalid key is reported
+// before FFmpeg starts
+func (c *Command) initCipher(opt *CommonOptions) (err error) {
+	if len(opt.EncryptionKey) == 0 {
+		return nil
+	}
+	if c.aead, err = newOutputCipher(opt.EncryptionKey); err != nil {
+		c.markError(err)
+	}
+	return err
+}
+
+// finishWith enqueues o as the only and last output, marks command as finished
+func (c *Command) finishWith(o *Output) {
+	o.Last = true
+	c.enqueue(c.opt, o)
+	c.lastIndex = o.Index
+	c.finished = true
+	c.finishedAt = time.Now()
+}
+
+// probeOptions returns probe options for the input media of current command
+func (c *Command) probeOptions() *ProbeOptions {
+	return probeOptionsOf(c.opt)
+}
+
+// probeOptionsOf returns probe options for the input media of opt
+func probeOptionsOf(opt *CommonOptions) *ProbeOptions {
+	return &ProbeOptions{
+		Uri:             opt.Uri,
+		IsStream:        opt.IsStream,
+		IsFile:          opt.IsFile,
+		Proxy:           opt.Proxy,
+		LogLevel:        opt.LogLevel,
+		DockerCommand:   opt.DockerCommand,
+		FFprobePath:     opt.FFprobePath,
+		ProbeSize:       opt.ProbeSize,
+		AnalyzeDuration: opt.AnalyzeDuration,
+	}
+}
+
+// resolveSamplePositions probes input media and resolves SampleCount seek positions evenly spread across it under
+// CaptureModeSampled, each position is the middle of its share, so that neither the very beginning (often a black
+// frame) nor the end (which may not be seekable) is sampled
+func (c *Command) resolveSamplePositions(opt *CaptureOptions) error {
+	if opt.SampleCount <= 0 {
+		return fmt.Errorf("CaptureOptions.SampleCount must be positive under CaptureModeSampled")
+	}
+	if !opt.probeable() {
+		return fmt.Errorf("CaptureModeSampled is not available for streams and InputReader")
+	}
+	dur, err := c.getVideoDuration(c.probeOptions())
+	if err != nil {
+		return fmt.Errorf("error probing media for sampled capture: %w", err)
+	}
+	start, end := opt.StartTime, dur
+	if opt.Duration > 0 && start+opt.Duration < end {
+		end = start + opt.Duration
+	}
+	if start >= end {
+		return fmt.Errorf("CommonOptions.StartTime (%v) exceeds media duration (%v)", start, dur)
+	}
+	step := (end - start) / float64(opt.SampleCount)
+	opt.SamplePositions = make([]float64, opt.SampleCount)
+	for i := range opt.SamplePositions {
+		opt.SamplePositions[i] = math.Round((start+step*(float64(i)+0.5))*1000) / 1000
+	}
+	return nil
+}
+
 // getVideoDuration returns video duration
 func (c *Command) getVideoDuration(opt *ProbeOptions) (dur float64, err error) {
 	st, err := c.ProbeStreams(opt)
@@ -418,21 +1626,122 @@ func (c *Command) getVideoDuration(opt *ProbeOptions) (dur float64, err error) {
 		return 0, fmt.Errorf("resource has no video stream")
 	}
 
-	dur, err = st.Streams[idx].GetDuration()
-	if err != nil {
-		return 0, fmt.Errorf("can not get video duration: %v", err)
+	dur, err = st.Streams[idx].GetDuration()
+	if err != nil {
+		return 0, fmt.Errorf("can not get video duration: %v", err)
+	}
+	return
+}
+
+// handleStderrLine parses FFmpeg stderr line while FFmpeg is running
+func (c *Command) handleStderrLine(line string) {
+	if ReconnectRegex.MatchString(line) {
+		c.mu.Lock()
+		c.epoch++
+		c.mu.Unlock()
+		log.Warn().Str("line", line).Msg("ffmpeg reconnecting")
+		return
+	}
+	if m := ShowInfoRegex.FindStringSubmatch(line); len(m) == 3 {
+		n, err1 := strconv.ParseInt(m[1], 10, 0)
+		sec, err2 := strconv.ParseFloat(m[2], 0)
+		if err1 == nil && err2 == nil {
+			c.mu.Lock()
+			c.pts[n] = sec
+			c.mu.Unlock()
+		}
+	}
+}
+
+// currentEpoch returns the number of reconnects so far
+func (c *Command) currentEpoch() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// detectVFR probes input media, returns whether its video stream has variable frame rate
+func (c *Command) detectVFR() bool {
+	if !c.opt.probeable() {
+		return false
+	}
+	if c.info == nil {
+		st, err := c.ProbeStreams(c.probeOptions())
+		if err != nil {
+			log.Warn().Err(err).Str("mediaId", c.opt.MediaId).Msg("error probing media frame rate")
+			return false
+		}
+		c.info = st
+	}
+	idx, ok := c.info.HasVideoStream()
+	if !ok || !c.info.Streams[idx].IsVFR() {
+		return false
+	}
+	log.Info().Str("avgFrameRate", c.info.Streams[idx].AvgFrameRate).Str("rFrameRate", c.info.Streams[idx].RFrameRate).
+		Str("mediaId", c.opt.MediaId).Msg("variable frame rate detected, using frame PTS as captured second")
+	return true
+}
+
+// audioMatches probes input media, returns whether its audio stream already matches Coding, SamplingFrequency
+// and Channels of slice options, i.e. whether it can be copied without re-encoding
+func (c *Command) audioMatches(opt *SliceOptions) bool {
+	if !opt.probeable() || opt.Normalize {
+		return false
+	}
+	if c.info == nil {
+		st, err := c.ProbeStreams(c.probeOptions())
+		if err != nil {
+			log.Warn().Err(err).Str("mediaId", opt.MediaId).Msg("error probing media audio stream")
+			return false
+		}
+		c.info = st
+	}
+	idx, ok := c.info.HasAudioStream()
+	if !ok {
+		return false
+	}
+	s := c.info.Streams[idx]
+	if s.CodecName != opt.Coding || s.SampleRate != strconv.Itoa(opt.SamplingFrequency) || s.Channels != opt.Channels {
+		return false
+	}
+	log.Info().Str("codec", s.CodecName).Str("sampleRate", s.SampleRate).Int("channels", s.Channels).
+		Str("mediaId", opt.MediaId).Msg("audio stream matches slice options, copying instead of re-encoding")
+	return true
+}
+
+// useFramePts populates captured image's second with actual frame PTS time parsed from showinfo,
+// keeps the value calculated from index when frame info is not found
+func (c *Command) useFramePts(o *Output) {
+	// Captured image index starts from 1 while frame number starts from 0
+	n := o.Index - 1
+	c.mu.Lock()
+	sec, ok := c.pts[n]
+	delete(c.pts, n)
+	c.mu.Unlock()
+	if !ok {
+		log.Warn().Int64("index", o.Index).Msg("frame PTS not found, using second calculated from index")
+		return
 	}
-	return
+	if c.opt != nil && !c.opt.IsStream /* Timestamps start from 0 after input seeking */ {
+		sec += c.opt.StartTime
+	}
+	o.Second = sec
+	o.Position = int64(sec)
 }
 
 // exec creates a new process through exec.Command, wait for it to finish in a goroutine
 func (c *Command) exec(params string) (*exec.Cmd, error) {
-	ow := new(bytes.Buffer)
-	ew := new(bytes.Buffer)
-	cmd := exec.Command("/bin/bash", "-c", params)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	ow := newStderrWriter(nil, c.stderrLimit())
+	if c.opt != nil && c.opt.ReportProgress {
+		ow = newStderrWriter(c.handleProgressLine, c.stderrLimit())
+	}
+	ew := c.newStderrWriter(c.handleStderrLine)
+	cmd := shellCommand(params)
 	cmd.Stdout = ow
 	cmd.Stderr = ew
+	if c.opt != nil && c.opt.InputReader != nil {
+		cmd.Stdin = c.opt.InputReader
+	}
 
 	if err := cmd.Start(); err != nil {
 		return nil, err
@@ -441,24 +1750,45 @@ func (c *Command) exec(params string) (*exec.Cmd, error) {
 	c.started = true
 
 	go func() {
+		select {
+		case <-c.context().Done():
+			// Mark error before killing, so that it's not overwritten by the error of terminated process
+			c.markError(fmt.Errorf("ffmpeg process cancelled: %w", c.context().Err()))
+			if err := c.kill(cmd); err != nil {
+				log.Err(err).Msg("error killing ffmpeg process on context done")
+			}
+		case <-c.exitC:
+		}
+	}()
+
+	go func() {
+		defer c.closeSEI()
 		err := cmd.Wait()
+		c.releaseProcess()
 		c.ffmpegExit = true
+		close(c.exitC)
 		c.stats.End = time.Now()
 		log.Trace().Err(err).Msg("ffmpeg process finished")
+		if c.isDraining() /* Terminated by Drain, remaining output files are discarded */ {
+			c.finished = true
+			c.finishedAt = time.Now()
+			return
+		}
 
 		err = convertError(err, ew.String())
-		if err != nil && err != ErrStreamClosed {
+		if err != nil && !isWarning(err) {
 			c.markError(err)
 			log.Err(err).Msg("ffmpeg process error")
 			return
 		}
+		c.handleSEIFiles(true)
 		c.markFinished()
 
 		// there may still be warning messages
 		if ew.Len() != 0 {
 			log.Warn().Msg(ew.String())
 		}
-		if ow.Len() != 0 {
+		if ow.Len() != 0 && !c.opt.ReportProgress {
 			log.Info().Msg(ow.String())
 		}
 	}()
@@ -466,17 +1796,61 @@ func (c *Command) exec(params string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
+// context returns command context, defaults to context.Background
+func (c *Command) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 // execwait creates a new process through exec.Command, blocks until it finishes
 func (c *Command) execwait(params string, w io.Writer) (err error) {
-	ew := new(bytes.Buffer)
-	cmd := exec.Command("/bin/bash", "-c", params)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return c.execwaitContext(c.context(), params, w, c.newStderrWriter(nil))
+}
+
+// newStderrWriter creates a stderr writer of FFmpeg process, which is kept as the latest stderr, see Stderr
+func (c *Command) newStderrWriter(hdl func(line string)) *stderrWriter {
+	ew := newStderrWriter(hdl, c.stderrLimit())
+	c.mu.Lock()
+	c.stderr = ew
+	c.mu.Unlock()
+	return ew
+}
+
+// stderrLimit returns the maximum bytes of stderr kept in memory, see CommonOptions.StderrLimit
+func (c *Command) stderrLimit() int {
+	if c.opt != nil && c.opt.StderrLimit > 0 {
+		return c.opt.StderrLimit
+	}
+	return DefaultStderrLimit
+}
+
+// execwaitContext is like execwait, terminates the process when ctx is done. Stderr is written into ew, whose line
+// handler (optional) is called on every stderr line while the process is running
+func (c *Command) execwaitContext(ctx context.Context, params string, w io.Writer, ew *stderrWriter) (err error) {
+	cmd := shellCommand(params)
 	cmd.Stdout = w
 	cmd.Stderr = ew
+	if c.opt != nil && c.opt.InputReader != nil {
+		cmd.Stdin = c.opt.InputReader
+	}
 	if err = cmd.Start(); err != nil {
 		return
 	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = terminate(cmd)
+		case <-done:
+		}
+	}()
 	if err = cmd.Wait(); err != nil {
+		if e := ctx.Err(); e != nil {
+			return fmt.Errorf("ffmpeg process cancelled: %w", e)
+		}
 		return convertError(err, ew.String())
 	}
 
@@ -493,7 +1867,7 @@ func (c *Command) kill(cmd *exec.Cmd) error {
 		return fmt.Errorf("process not found or already stopped")
 	}
 
-	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	err := terminate(cmd)
 	if err != nil {
 		return err
 	}
@@ -509,25 +1883,183 @@ func (c *Command) markError(err error) {
 	return
 }
 
-// startWatching creates output directory and start watching file changes
+// markBranchError records error of the branch writing outputs into dir. Under SliceAndCapture the
+// error is handled according to OnBranchError, otherwise it is recorded as command error
+func (c *Command) markBranchError(dir string, err error) {
+	if !c.opt.SliceAndCapture {
+		c.markError(err)
+		return
+	}
+	c.mu.Lock()
+	switch dir {
+	case c.opt.CaptureOutputDir:
+		if c.captureErr == nil {
+			c.captureErr = err
+		}
+	case c.opt.SliceOutputDir:
+		if c.sliceErr == nil {
+			c.sliceErr = err
+		}
+	}
+	c.mu.Unlock()
+
+	switch c.opt.OnBranchError {
+	case OnBranchErrorContinue:
+		if c.captureAlive() || c.sliceAlive() {
+			log.Warn().Err(err).Str("dir", dir).Str("mediaId", c.opt.MediaId).
+				Msg("branch error, continue processing the other branch")
+			return
+		}
+		c.markError(err)
+	case OnBranchErrorFailFast:
+		c.markError(err)
+		if !c.ffmpegExit {
+			if e := c.kill(c.cmd); e != nil {
+				log.Err(e).Msg("error killing ffmpeg process")
+			}
+		}
+	default:
+		c.markError(err)
+	}
+}
+
+// captureAlive returns whether capture branch is running without error under SliceAndCapture
+func (c *Command) captureAlive() bool {
+	return c.opt.HasVideo && c.CaptureError() == nil
+}
+
+// sliceAlive returns whether slice branch is running without error under SliceAndCapture
+func (c *Command) sliceAlive() bool {
+	return c.opt.HasSpeech && c.SliceError() == nil
+}
+
+// startWatching watches output directories, handles new files on file events until FFmpeg exits. Output
+// directories are also scanned every scanInterval (or WatchInterval) in case that any file event is missed
 func (c *Command) startWatching() {
-	// Iterate over output directory until command closed
+	dirs := []string{c.opt.OutputDir}
+	if len(c.opt.CaptureSetDirs) > 0 {
+		dirs = c.opt.CaptureSetDirs
+	}
+	if c.opt.SliceAndCapture {
+		dirs = dirs[:0]
+		if c.opt.HasVideo {
+			dirs = append(dirs, c.opt.CaptureOutputDir)
+		}
+		if c.opt.HasSpeech {
+			dirs = append(dirs, c.opt.SliceOutputDir)
+		}
+	}
+
+	// One watcher per directory, file events are handled in this goroutine one at a time
+	evtC := make(chan fileEvent)
+	stopC := make(chan struct{})
+	defer close(stopC)
+	for _, dir := range dirs {
+		w, err := newDirWatcher(dir, evtC, stopC)
+		if err != nil {
+			log.Warn().Err(err).Str("dir", dir).Msg("error watching output directory, fallback to scanning")
+			continue
+		}
+		defer w.Close()
+	}
+	if c.opt.DecodeSEI && c.opt.SEIOutputDir != "" {
+		if w, err := newDirWatcher(c.opt.SEIOutputDir, evtC, stopC); err != nil {
+			log.Warn().Err(err).Str("dir", c.opt.SEIOutputDir).Msg("error watching SEI output directory, fallback to scanning")
+		} else {
+			defer w.Close()
+		}
+	}
+
+	interval := scanInterval
+	if c.opt.WatchInterval > 0 {
+		interval = c.opt.WatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for !c.ffmpegExit && c.err == nil {
-		// 如果切片和截帧的话，那么返回这两个目录中切片生成的文件
-		if c.opt.SliceAndCapture {
-			if c.opt.HasVideo {
-				c.handleNewFile(c.opt.CaptureOutputDir)
+		select {
+		case <-c.exitC:
+			return
+		case evt := <-evtC:
+			if c.opt.DecodeSEI && evt.dir == c.opt.SEIOutputDir {
+				c.handleSEIFiles(false)
+			} else if c.branchAlive(evt.dir) {
+				c.handleFileEvent(evt.name, evt.dir)
 			}
-			if c.opt.HasSpeech {
-				c.handleNewFile(c.opt.SliceOutputDir)
+		case <-ticker.C:
+			if c.opt.DecodeSEI {
+				c.handleSEIFiles(false)
+			}
+			for _, dir := range dirs {
+				if c.branchAlive(dir) {
+					c.handleNewFile(dir)
+				}
 			}
-		} else {
-			c.handleNewFile(c.opt.OutputDir)
 		}
 	}
 }
 
+// branchAlive returns whether outputs in dir should still be handled
+func (c *Command) branchAlive(dir string) bool {
+	if !c.opt.SliceAndCapture {
+		return true
+	}
+	switch dir {
+	case c.opt.CaptureOutputDir:
+		return c.captureAlive()
+	case c.opt.SliceOutputDir:
+		return c.sliceAlive()
+	}
+	return false
+}
+
+// fileEvent a file created in watched directory
+type fileEvent struct {
+	dir  string // Watched directory
+	name string // File base name
+}
+
+// newDirWatcher creates a fsnotify.Watcher watching dir, forwards file creation events to evtC until stopC is closed
+func newDirWatcher(dir string, evtC chan<- fileEvent, stopC <-chan struct{}) (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = w.Add(dir); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case evt, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if evt.Op&fsnotify.Create != fsnotify.Create {
+					continue
+				}
+				select {
+				case evtC <- fileEvent{dir: dir, name: filepath.Base(evt.Name)}:
+				case <-stopC:
+					return
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warn().Err(err).Str("dir", dir).Msg("output directory watcher error")
+			}
+		}
+	}()
+	return w, nil
+}
+
 func (c *Command) handleNewFile(dir string) bool {
+	if c.opt.FilenameParser != nil {
+		c.handleParsedFiles(dir)
+		return false
+	}
 	var (
 		err   error
 		files []os.DirEntry
@@ -536,13 +2068,16 @@ func (c *Command) handleNewFile(dir string) bool {
 	)
 	files, err = os.ReadDir(dir)
 	if err != nil {
-		c.markError(err)
+		c.markBranchError(dir, err)
 		return true
 	}
 	for _, e := range files {
+		if !c.indexed(e.Name()) {
+			continue
+		}
 		index, err = utils.FilePath2Index(e.Name())
 		if err != nil {
-			c.markError(err)
+			c.markBranchError(dir, err)
 			return true
 		}
 		if index != -1 && index > max {
@@ -555,12 +2090,19 @@ func (c *Command) handleNewFile(dir string) bool {
 
 // handleFileEvent handles file event
 func (c *Command) handleFileEvent(name string, dir string) {
+	if c.opt.FilenameParser != nil {
+		c.handleParsedFiles(dir)
+		return
+	}
+	if !c.indexed(name) {
+		return
+	}
 	// 1. Parse current output file index
 	idx, err := utils.FilePath2Index(name)
 	suffix := utils.FilePath2Suffix(name)
 	if err != nil {
 		log.Err(err).Str("file", name).Msg("error converting file path to index")
-		c.markError(err)
+		c.markBranchError(dir, err)
 		return
 	}
 	if idx <= 0 {
@@ -579,7 +2121,7 @@ func (c *Command) handleFileEvent(name string, dir string) {
 	)
 	byt, prev, err = readPreviousFile(dir, suffix, idx)
 	if err != nil {
-		c.markError(err)
+		c.markBranchError(dir, err)
 		return
 	}
 	if len(byt) <= 0 {
@@ -590,18 +2132,25 @@ func (c *Command) handleFileEvent(name string, dir string) {
 
 	// 3. When SEI is required, try to read previous SEI file
 	if c.opt.DecodeSEI {
+		deadline := time.Now().Add(seiWaitTimeout)
 		for {
 			sei, prevSEI, err = readPreviousFile(c.opt.SEIOutputDir, c.opt.SEIFragmentSuffix, idx)
 			if len(sei) > 0 {
 				seiInfo, err = c.decodeSEIInfo(sei)
 				if err != nil {
 					log.Error().Str("file", prevSEI).Err(err).Msg("error decoding SEI info")
-					c.markError(err)
+					c.markBranchError(dir, err)
 					return
 				}
+				c.sendSEI(idx-1, seiInfo)
+				break
+			}
+			if time.Now().After(deadline) || !c.accepting() {
+				log.Warn().Int64("index", idx-1).Str("dir", c.opt.SEIOutputDir).Str("mediaId", c.opt.MediaId).
+					Msg("SEI fragment not found in time, output is enqueued without SEI info")
 				break
 			}
-			time.Sleep(5 * time.Nanosecond)
+			time.Sleep(c.opt.GetWatchInterval())
 		}
 	}
 
@@ -612,10 +2161,15 @@ func (c *Command) handleFileEvent(name string, dir string) {
 		Last:    false, // 在此阶段一定没有结束
 		SEIInfo: seiInfo,
 		Suffix:  suffix,
+		Epoch:   c.currentEpoch(),
+		Set:     c.sets[dir],
 	}
 	c.mod(o) /* modify the output, populate any necessary info */
-	if !c.closed {
+	if c.accepting() {
 		c.enqueue(c.opt, o)
+		if pl := c.readPlaylist(o.Index); pl != nil {
+			c.enqueue(c.opt, pl)
+		}
 	}
 
 	// 5. Clean up processed files
@@ -623,12 +2177,109 @@ func (c *Command) handleFileEvent(name string, dir string) {
 	c.remove(prevSEI)
 }
 
+// parsedFile an output file named by CommonOptions.FilenameParser
+type parsedFile struct {
+	name   string
+	index  int64
+	second float64
+}
+
+// parsedFiles returns output files in dir parsed by CommonOptions.FilenameParser sorted by index, files that are not
+// outputs or already enqueued are excluded
+func (c *Command) parsedFiles(dir string) ([]parsedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := make([]parsedFile, 0, len(entries))
+	for _, e := range entries {
+		if c.parsed[filepath.Join(dir, e.Name())] {
+			continue
+		}
+		if idx, sec, ok := c.opt.FilenameParser(e.Name()); ok {
+			files = append(files, parsedFile{name: e.Name(), index: idx, second: sec})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].index < files[j].index })
+	return files, nil
+}
+
+// handleParsedFiles enqueues output files named by CommonOptions.FilenameParser, all files but the one with the
+// greatest index are complete, see FilenameParser
+func (c *Command) handleParsedFiles(dir string) {
+	files, err := c.parsedFiles(dir)
+	if err != nil {
+		c.markBranchError(dir, err)
+		return
+	}
+	for i := 0; i < len(files)-1; i++ {
+		if err = c.enqueueParsedFile(dir, files[i], false); err != nil {
+			c.markBranchError(dir, err)
+			return
+		}
+	}
+}
+
+// enqueueParsedFile reads and enqueues an output file named by CommonOptions.FilenameParser
+func (c *Command) enqueueParsedFile(dir string, f parsedFile, last bool) error {
+	fn := filepath.Join(dir, f.name)
+	byt, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return fmt.Errorf("error reading output file: %w", err)
+	}
+	if len(byt) <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	if c.parsed == nil {
+		c.parsed = make(map[string]bool)
+	}
+	c.parsed[fn] = true
+	c.mu.Unlock()
+
+	o := &Output{
+		Content: byt,
+		Index:   f.index,
+		Last:    last,
+		Suffix:  utils.FilePath2Suffix(f.name),
+		Epoch:   c.currentEpoch(),
+		Set:     c.sets[dir],
+	}
+	c.mod(o)
+	o.Second = f.second
+	if c.accepting() {
+		c.enqueue(c.opt, o)
+	}
+	c.remove(fn)
+	return nil
+}
+
 // enqueue pushes output file into queue
 func (c *Command) enqueue(opt *CommonOptions, o *Output) {
+	if c.aead != nil {
+		if err := encryptOutput(c.aead, o); err != nil /* Plain content must never be delivered */ {
+			log.Err(err).Int64("index", o.Index).Str("mediaId", opt.MediaId).Msg("failed to encrypt ffmpeg output file")
+			c.markError(err)
+			o.Content = nil
+		}
+	}
 	c.q.Enqueue(o)
 	c.lastQueued += 1
 	c.stats.Output += 1
 	c.stats.Bytes += int64(len(o.Content))
+	switch o.Type {
+	case OutputTypeImage:
+		c.stats.ImageCount += 1
+		c.stats.ImageBytes += int64(len(o.Content))
+	case OutputTypeAudioSegment:
+		c.stats.SegmentCount += 1
+		c.stats.SegmentBytes += int64(len(o.Content))
+	default:
+		c.stats.OtherCount += 1
+		c.stats.OtherBytes += int64(len(o.Content))
+	}
 	log.Trace().Int64("index", o.Index).Int("bytes", len(o.Content)).
 		Float64("second", o.Second).Int64("position", o.Position).
 		Str("mediaId", opt.MediaId).Msg("enqueued ffmpeg output file")
@@ -655,7 +2306,7 @@ func (c *Command) markFinished() {
 		err   error
 	)
 	if c.opt.SliceAndCapture {
-		if c.opt.HasVideo {
+		if c.captureAlive() {
 			defer c.removeDir(c.opt.CaptureOutputDir)
 			files, err = os.ReadDir(c.opt.CaptureOutputDir)
 			if err != nil {
@@ -670,7 +2321,7 @@ func (c *Command) markFinished() {
 		} else {
 			c.finishCapture = true
 		}
-		if c.opt.HasSpeech {
+		if c.sliceAlive() {
 			defer c.removeDir(c.opt.SliceOutputDir)
 			files, err = os.ReadDir(c.opt.SliceOutputDir)
 			if err != nil {
@@ -685,6 +2336,18 @@ func (c *Command) markFinished() {
 		} else {
 			c.finishedSlice = true
 		}
+	} else if len(c.opt.CaptureSetDirs) > 0 {
+		for _, dir := range c.opt.CaptureSetDirs {
+			defer c.removeDir(dir)
+			files, err = os.ReadDir(dir)
+			if err != nil {
+				log.Err(err).Str("dir", dir).Msg("failed to read output directory")
+				continue
+			}
+			if err = c.enqueueRemainingFiles(files, OutputTypeImage, dir); err != nil {
+				c.markError(err)
+			}
+		}
 	} else {
 		defer c.removeDir(c.opt.OutputDir)
 		files, err = os.ReadDir(c.opt.OutputDir)
@@ -698,6 +2361,14 @@ func (c *Command) markFinished() {
 			c.markError(err)
 		}
 	}
+	if c.stats.Output == 0 && c.err == nil {
+		c.noOutput = true
+		log.Warn().Str("mediaId", c.opt.MediaId).Msg("ffmpeg finished without producing any output")
+		if c.opt.ErrorOnNoOutput {
+			c.markError(ErrNoOutputProduced)
+			return
+		}
+	}
 	c.finished = true
 	c.finishedAt = time.Now()
 	log.Info().Int64("lastSliceIndex", c.lastSliceIndex).Int64("lastCapturedIndex", c.lastCaptureIndex).
@@ -705,6 +2376,9 @@ func (c *Command) markFinished() {
 }
 
 func (c *Command) enqueueRemainingFiles(files []os.DirEntry, typ int, dir string) (err error) {
+	if c.opt.FilenameParser != nil {
+		return c.enqueueRemainingParsedFiles(typ, dir)
+	}
 	var (
 		last         bool
 		lastCaptured bool
@@ -717,7 +2391,11 @@ func (c *Command) enqueueRemainingFiles(files []os.DirEntry, typ int, dir string
 			maxIndex = idx
 		}
 	}
+	final := c.readPlaylist(maxIndex)
 	for _, f := range files {
+		if !c.indexed(f.Name()) {
+			continue
+		}
 		idx, _ := utils.FilePath2Index(f.Name())
 		suffix := utils.FilePath2Suffix(f.Name())
 		byt, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", dir, f.Name()))
@@ -741,6 +2419,12 @@ func (c *Command) enqueueRemainingFiles(files []os.DirEntry, typ int, dir string
 		} else {
 			last = idx == maxIndex
 		}
+		if c.sets[dir] != "" /* Only the last output of the last capture set is the last one */ {
+			last = last && dir == c.opt.CaptureSetDirs[len(c.opt.CaptureSetDirs)-1]
+		}
+		if final != nil /* The final playlist is the last output under HLS */ {
+			last = false
+		}
 		o := &Output{
 			Content:      byt,
 			Index:        idx,
@@ -748,13 +2432,58 @@ func (c *Command) enqueueRemainingFiles(files []os.DirEntry, typ int, dir string
 			LastCaptured: lastCaptured,
 			LastSliced:   lastSlice,
 			Suffix:       suffix,
+			Epoch:        c.currentEpoch(),
+			Set:          c.sets[dir],
 		}
 		c.mod(o)
-		if !c.closed {
+		if c.accepting() {
 			c.enqueue(c.opt, o)
 		}
 		c.remove(fmt.Sprintf("%s/%s", dir, f.Name()))
 	}
+	if final != nil && c.accepting() {
+		final.Last = true
+		c.enqueue(c.opt, final)
+	}
+	if c.opt.SliceAndCapture {
+		switch typ {
+		case OutputTypeAudioSegment:
+			c.lastSliceIndex = maxIndex
+			c.finishedSlice = true
+		case OutputTypeImage:
+			c.lastCaptureIndex = maxIndex
+			c.finishCapture = true
+		}
+	} else {
+		c.lastIndex = maxIndex
+	}
+	return nil
+}
+
+// indexed returns whether name is an indexed output file, i.e. not the HLS playlist or its temporary file
+// enqueueRemainingParsedFiles is like enqueueRemainingFiles, but for output files named by CommonOptions.FilenameParser
+func (c *Command) enqueueRemainingParsedFiles(typ int, dir string) error {
+	files, err := c.parsedFiles(dir)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		last := i == len(files)-1
+		if c.opt.SliceAndCapture {
+			last = last && ((typ == OutputTypeImage && c.finishedSlice) || (typ == OutputTypeAudioSegment && c.finishCapture))
+		}
+		if c.sets[dir] != "" {
+			last = last && dir == c.opt.CaptureSetDirs[len(c.opt.CaptureSetDirs)-1]
+		}
+		if err = c.enqueueParsedFile(dir, f, last); err != nil {
+			return err
+		}
+	}
+
+	var maxIndex int64
+	if len(files) > 0 {
+		maxIndex = files[len(files)-1].index
+	}
 	if c.opt.SliceAndCapture {
 		switch typ {
 		case OutputTypeAudioSegment:
@@ -764,25 +2493,148 @@ func (c *Command) enqueueRemainingFiles(files []os.DirEntry, typ int, dir string
 			c.lastCaptureIndex = maxIndex
 			c.finishCapture = true
 		}
-	} else {
-		c.lastIndex = maxIndex
+	} else {
+		c.lastIndex = maxIndex
+	}
+	return nil
+}
+
+func (c *Command) indexed(name string) bool {
+	return c.opt.Playlist == "" || !strings.HasPrefix(name, c.opt.Playlist)
+}
+
+// readPlaylist reads current HLS playlist as an output following segment idx, returns nil when not under HLS
+// or the playlist is not written yet
+func (c *Command) readPlaylist(idx int64) *Output {
+	if c.opt.Playlist == "" {
+		return nil
+	}
+	byt, err := ioutil.ReadFile(filepath.Join(c.opt.OutputDir, c.opt.Playlist))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Err(err).Str("mediaId", c.opt.MediaId).Msg("error reading HLS playlist")
+		}
+		return nil
+	}
+	if len(byt) <= 0 {
+		return nil
+	}
+	return &Output{
+		Type:    OutputTypePlaylist,
+		Index:   idx,
+		Content: byt,
+		Suffix:  utils.FilePath2Suffix(c.opt.Playlist),
+		Epoch:   c.currentEpoch(),
+	}
+}
+
+// decodeSEIInfo decodes SEI info from raw content
+func (c *Command) decodeSEIInfo(byt []byte) ([]string, error) {
+	re := SEIRegex
+	if c.sei != nil {
+		re = c.sei
+	}
+	all := re.FindAll(byt, -1)
+	result := make([]string, 0)
+	for _, match := range all {
+		mp := make(map[string]interface{})
+		err := json.Unmarshal(match, &mp)
+		if err != nil {
+			continue
+		}
+		result = append(result, string(match))
+	}
+	return result, nil
+}
+
+// SEIChannel returns a channel delivering SEI info as soon as SEI fragments are decoded, independent of media outputs,
+// e.g. for real-time metadata processing. Available when DecodeSEI is enabled, SEI info is still attached to
+// Output.SEIInfo as well. The channel is closed when FFmpeg process exits or the Command is closed.
+// NOTE:
+//  1. Call SEIChannel before starting the operation (e.g. Slice), SEI fragments decoded before are not delivered
+//  2. The channel is buffered, events are dropped when it's full, read it in another goroutine
+func (c *Command) SEIChannel() <-chan SEIEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seiC == nil {
+		c.seiC = make(chan SEIEvent, seiBufferSize)
+		if c.seiClosed {
+			close(c.seiC)
+		}
+	}
+	return c.seiC
+}
+
+// sendSEI delivers decoded SEI info of fragment idx to SEIChannel, fragments already delivered are ignored
+func (c *Command) sendSEI(idx int64, info []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seiC == nil || c.seiClosed || idx <= c.seiSent {
+		return
+	}
+	c.seiSent = idx
+	for _, v := range info {
+		select {
+		case c.seiC <- SEIEvent{Index: idx, Info: v, Epoch: c.epoch}:
+		default:
+			log.Warn().Int64("index", idx).Str("mediaId", c.opt.MediaId).Msg("SEI channel is full, SEI event is dropped")
+		}
+	}
+}
+
+// handleSEIFiles decodes SEI fragments not delivered yet and sends them to SEIChannel. The newest fragment may still
+// being written, it's handled only when all is true, e.g. after FFmpeg exits
+func (c *Command) handleSEIFiles(all bool) {
+	c.mu.Lock()
+	subscribed, sent := c.seiC != nil && !c.seiClosed, c.seiSent
+	c.mu.Unlock()
+	if !subscribed || !c.opt.DecodeSEI {
+		return
+	}
+
+	entries, err := os.ReadDir(c.opt.SEIOutputDir)
+	if err != nil {
+		log.Warn().Err(err).Str("dir", c.opt.SEIOutputDir).Msg("error reading SEI output directory")
+		return
+	}
+	indexes := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		if utils.FilePath2Suffix(e.Name()) != c.opt.SEIFragmentSuffix {
+			continue
+		}
+		if idx, err := utils.FilePath2Index(e.Name()); err == nil && idx > sent {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	if !all && len(indexes) > 0 {
+		indexes = indexes[:len(indexes)-1]
+	}
+	for _, idx := range indexes {
+		byt, _, err := readPreviousFile(c.opt.SEIOutputDir, c.opt.SEIFragmentSuffix, idx+1)
+		if err != nil || len(byt) == 0 /* e.g. removed after being attached to the media output */ {
+			continue
+		}
+		info, err := c.decodeSEIInfo(byt)
+		if err != nil {
+			log.Error().Int64("index", idx).Err(err).Msg("error decoding SEI info")
+			continue
+		}
+		c.sendSEI(idx, info)
 	}
-	return nil
 }
 
-// decodeSEIInfo decodes SEI info from raw content
-func (c *Command) decodeSEIInfo(byt []byte) ([]string, error) {
-	all := SEIRegex.FindAll(byt, -1)
-	result := make([]string, 0)
-	for _, match := range all {
-		mp := make(map[string]interface{})
-		err := json.Unmarshal(match, &mp)
-		if err != nil {
-			continue
-		}
-		result = append(result, string(match))
+// closeSEI closes the channel returned by SEIChannel
+func (c *Command) closeSEI() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seiClosed {
+		return
+	}
+	c.seiClosed = true
+	if c.seiC != nil {
+		close(c.seiC)
 	}
-	return result, nil
 }
 
 // completeRead tries to read a just created file that may still being writen
@@ -834,8 +2686,15 @@ func readPreviousFile(dir string, suffix string, idx int64) ([]byte, string, err
 
 // ParseCaptureCommand parses capture command string
 func ParseCaptureCommand(opt *CaptureOptions) string {
+	if opt.Mode == CaptureModeSampled {
+		return parseSampledCaptureCommand(opt)
+	}
 	cmd := make([]string, 0)
 
+	if opt.DedupFrames || opt.FramePts {
+		opt.LogLevel = showInfoLogLevel(opt.GetLogLevel())
+	}
+	opt.HWFrames = opt.HWAccel == HWAccelVAAPI
 	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
 		cmd = append(cmd, com)
 	}
@@ -847,6 +2706,31 @@ func ParseCaptureCommand(opt *CaptureOptions) string {
 	return strings.Join(cmd, space)
 }
 
+// parseSampledCaptureCommand parses capture command string under CaptureModeSampled: input is opened once per
+// sample position with a fast seek, and every input is mapped to a single frame output named after its index
+func parseSampledCaptureCommand(opt *CaptureOptions) string {
+	com := opt.CommonOptions
+	com.StartTime, com.Duration = 0, 0 // Seek options are placed before every input instead
+	cmd := []string{ParseCommonOptions(&com, "ffmpeg", false)}
+	for _, pos := range opt.SamplePositions {
+		cmd = append(cmd, quoteArgs(opt.ExtraInputArgs)...)
+		cmd = append(cmd, "-ss", fmt.Sprintf("%v", pos), "-i", quote(opt.Uri))
+	}
+	for i := range opt.SamplePositions {
+		cmd = append(cmd, "-map", fmt.Sprintf("%d:v:0", i), "-frames:v", "1", "-f", "image2")
+		cmd = append(cmd, parseImageQualityOptions(opt)...)
+		if opt.Size != "" {
+			cmd = append(cmd, "-s", opt.Size)
+		}
+		cmd = append(cmd, opt.OutputArgs...)
+		cmd = append(cmd, quoteArgs(opt.ExtraOutputArgs)...)
+		// Indexes start from 1 like image2 sequences, see handleFileEvent
+		cmd = append(cmd, fmt.Sprintf("%s/%012d.%s", opt.OutputDir, i+1, opt.Suffix))
+	}
+	cmd = append(cmd, "-y")
+	return strings.Join(cmd, space)
+}
+
 // ParseSliceCommand parses slice command string
 func ParseSliceCommand(opt *SliceOptions) string {
 	cmd := make([]string, 0)
@@ -867,10 +2751,34 @@ func ParseSliceAndCaptureCommand(opt *SliceAndCaptureOptions) string {
 
 	cmd := make([]string, 0)
 
+	if opt.HasVideo && (opt.CaptureOptions.DedupFrames || opt.CaptureOptions.FramePts) {
+		opt.CommonOptions.LogLevel = showInfoLogLevel(opt.CommonOptions.GetLogLevel())
+	}
+	if opt.HasVideo && opt.CommonOptions.HWAccel == HWAccelVAAPI {
+		opt.CommonOptions.HWFrames = true
+		opt.CaptureOptions.HWAccel, opt.CaptureOptions.HWFrames = opt.CommonOptions.HWAccel, true
+	}
 	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
 		cmd = append(cmd, com)
 	}
 
+	// Input is shared while each branch has its own output, streams are seeked by output options of each branch
+	if opt.CaptureOptions != nil {
+		opt.CaptureOptions.StartTime, opt.CaptureOptions.Duration = opt.CommonOptions.StartTime, opt.CommonOptions.Duration
+		opt.CaptureOptions.IsStream = opt.CommonOptions.IsStream
+	}
+	if opt.SliceOptions != nil {
+		opt.SliceOptions.StartTime, opt.SliceOptions.Duration = opt.CommonOptions.StartTime, opt.CommonOptions.Duration
+		opt.SliceOptions.IsStream = opt.CommonOptions.IsStream
+	}
+	if opt.CommonOptions.FixTimestamps {
+		if opt.CaptureOptions != nil {
+			opt.CaptureOptions.FixTimestamps = true
+		}
+		if opt.SliceOptions != nil {
+			opt.SliceOptions.FixTimestamps = true
+		}
+	}
 	opt.Suffixes = append(opt.Suffixes, opt.CaptureOptions.Suffix)
 	if opt.HasVideo {
 		if capturedCmd := ParseCaptureOptions(opt.CaptureOptions); capturedCmd != "" {
@@ -888,17 +2796,197 @@ func ParseSliceAndCaptureCommand(opt *SliceAndCaptureOptions) string {
 	return strings.Join(cmd, space)
 }
 
+// ParseMultiCaptureCommand parses multi capture command string, every capture set is an output of the same input
+func ParseMultiCaptureCommand(opt *MultiCaptureOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	// Input is shared while each set has its own output, streams are seeked by output options of each set
+	for i := range opt.Sets {
+		set := &opt.Sets[i].CaptureOptions
+		set.StartTime, set.Duration = opt.StartTime, opt.Duration
+		set.IsStream, set.FixTimestamps = opt.IsStream, opt.FixTimestamps
+		if capturedCmd := ParseCaptureOptions(set); capturedCmd != "" {
+			cmd = append(cmd, capturedCmd)
+		}
+	}
+
+	return strings.Join(cmd, space)
+}
+
+// ParseRemuxCommand parses remux command string
+func ParseRemuxCommand(opt *RemuxOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	if remuxCmd := ParseRemuxOptions(opt); remuxCmd != "" {
+		cmd = append(cmd, remuxCmd)
+	}
+
+	return strings.Join(cmd, space)
+}
+
+// ParseTranscodeCommand parses transcode command string
+func ParseTranscodeCommand(opt *TranscodeOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	if transcodeCmd := ParseTranscodeOptions(opt); transcodeCmd != "" {
+		cmd = append(cmd, transcodeCmd)
+	}
+
+	return strings.Join(cmd, space)
+}
+
+// ParseSubtitleCommand parses subtitle extraction command string
+func ParseSubtitleCommand(opt *SubtitleOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	if subCmd := ParseSubtitleOptions(opt); subCmd != "" {
+		cmd = append(cmd, subCmd)
+	}
+
+	return strings.Join(cmd, space)
+}
+
+// ParseHLSCommand parses HLS command string
+func ParseHLSCommand(opt *HLSOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	if hlsCmd := ParseHLSOptions(opt); hlsCmd != "" {
+		cmd = append(cmd, hlsCmd)
+	}
+
+	return strings.Join(cmd, space)
+}
+
+// ParseSpectrogramCommand parses spectrogram command string
+func ParseSpectrogramCommand(opt *SpectrogramOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	if spectrogramCmd := ParseSpectrogramOptions(opt); spectrogramCmd != "" {
+		cmd = append(cmd, spectrogramCmd)
+	}
+
+	return strings.Join(cmd, space)
+}
+
+// ParseTIFFCommand parses TIFF command string, images are captured as single page TIFF files
+func ParseTIFFCommand(opt *TIFFOptions) string {
+	opt.Suffix = "tiff"
+	opt.OutputArgs = nil
+	if opt.Compression != "" {
+		opt.OutputArgs = append(opt.OutputArgs, "-compression_algo", opt.Compression)
+	}
+	return ParseCaptureCommand(&opt.CaptureOptions)
+}
+
+// ParseFirstFrameCommand parses first frame command string
+func ParseFirstFrameCommand(opt *CaptureOptions) string {
+	cmd := make([]string, 0)
+
+	com := opt.CommonOptions
+	com.ReportProgress = false // Stdout is occupied by the captured image
+	if c := ParseCommonOptions(&com, "ffmpeg", true); c != "" {
+		cmd = append(cmd, c)
+	}
+
+	cmd = append(cmd, parseSeekOptions(&opt.CommonOptions, false)...)
+	codec := "mjpeg"
+	if opt.Suffix == "png" {
+		codec = "png"
+	}
+	cmd = append(cmd, "-frames:v", "1")
+	if opt.Size != "" {
+		cmd = append(cmd, "-s", opt.Size)
+	}
+	cmd = append(cmd, "-f", "image2pipe", "-c:v", codec)
+	cmd = append(cmd, parseImageQualityOptions(opt)...)
+	cmd = append(cmd, "pipe:1")
+	return strings.Join(cmd, space)
+}
+
+// ParseSilenceCommand parses silence detection command string
+func ParseSilenceCommand(opt *SilenceOptions) string {
+	cmd := make([]string, 0)
+
+	com := opt.CommonOptions
+	com.ReportProgress = false
+	com.LogLevel = showInfoLogLevel(com.GetLogLevel()) // silencedetect prints at info log level
+	if c := ParseCommonOptions(&com, "ffmpeg", true); c != "" {
+		cmd = append(cmd, c)
+	}
+
+	cmd = append(cmd, parseSeekOptions(&opt.CommonOptions, false)...)
+	cmd = append(cmd, "-vn", "-af", fmt.Sprintf(filterSilence, opt.Noise, opt.MinDuration), "-f", "null", "-")
+	return strings.Join(cmd, space)
+}
+
+// ParseGIFCommand parses GIF command string
+func ParseGIFCommand(opt *GIFOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	if gifCmd := ParseGIFOptions(opt); gifCmd != "" {
+		cmd = append(cmd, gifCmd)
+	}
+
+	return strings.Join(cmd, space)
+}
+
+// ParseSpriteCommand parses sprite command string
+func ParseSpriteCommand(opt *SpriteOptions) string {
+	cmd := make([]string, 0)
+
+	if com := ParseCommonOptions(&opt.CommonOptions, "ffmpeg", true); com != "" {
+		cmd = append(cmd, com)
+	}
+
+	if spriteCmd := ParseSpriteOptions(opt); spriteCmd != "" {
+		cmd = append(cmd, spriteCmd)
+	}
+
+	return strings.Join(cmd, space)
+}
+
 // ParseProbeCommand parses probe command string
 func ParseProbeCommand(opt *ProbeOptions) string {
 	cmd := make([]string, 0)
 
 	commonOpt := &CommonOptions{
-		Uri:           opt.Uri,
-		IsStream:      opt.IsStream,
-		IsFile:        opt.IsFile,
-		Proxy:         opt.Proxy,
-		LogLevel:      opt.LogLevel,
-		DockerCommand: opt.DockerCommand,
+		Uri:             opt.Uri,
+		IsStream:        opt.IsStream,
+		IsFile:          opt.IsFile,
+		Proxy:           opt.Proxy,
+		LogLevel:        opt.LogLevel,
+		DockerCommand:   opt.DockerCommand,
+		FFprobePath:     opt.FFprobePath,
+		ProbeSize:       opt.ProbeSize,
+		AnalyzeDuration: opt.AnalyzeDuration,
 	}
 
 	if com := ParseCommonOptions(commonOpt, "ffprobe", true); com != "" {
@@ -906,25 +2994,39 @@ func ParseProbeCommand(opt *ProbeOptions) string {
 	}
 
 	cmd = append(cmd, probe)
+	if opt.IncludeChapters {
+		cmd = append(cmd, "-show_chapters")
+	}
 
 	return strings.Join(cmd, space)
 }
 
 // ParseSliceOptions parses slice options string
 func ParseSliceOptions(opt *SliceOptions) string {
-	cmd := make([]string, 0)
+	cmd := parseSeekOptions(&opt.CommonOptions, false)
 
 	if opt.DisableVideo && !opt.DecodeSEI {
 		cmd = append(cmd, "-vn")
 	}
-	if opt.Coding != "" {
-		cmd = append(cmd, "-c:a", opt.Coding)
-	}
-	if opt.SamplingFrequency != 0 {
-		cmd = append(cmd, "-ar", fmt.Sprintf("%v", opt.SamplingFrequency))
+	if opt.Normalize {
+		lufs := opt.TargetLUFS
+		if lufs == 0 {
+			lufs = defaultTargetLUFS
+		}
+		cmd = append(cmd, "-af", quote(fmt.Sprintf(filterLoudnorm, lufs)))
 	}
-	if opt.Channels != 0 {
-		cmd = append(cmd, "-ac", fmt.Sprintf("%v", opt.Channels))
+	if opt.CopyAudio {
+		cmd = append(cmd, "-c:a", "copy")
+	} else {
+		if opt.Coding != "" {
+			cmd = append(cmd, "-c:a", opt.Coding)
+		}
+		if opt.SamplingFrequency != 0 {
+			cmd = append(cmd, "-ar", fmt.Sprintf("%v", opt.SamplingFrequency))
+		}
+		if opt.Channels != 0 {
+			cmd = append(cmd, "-ac", fmt.Sprintf("%v", opt.Channels))
+		}
 	}
 	if opt.Format != "" {
 		cmd = append(cmd, "-f", opt.Format)
@@ -932,9 +3034,19 @@ func ParseSliceOptions(opt *SliceOptions) string {
 	if opt.FragmentDuration != 0 {
 		cmd = append(cmd, "-segment_time", fmt.Sprintf("%v", opt.FragmentDuration))
 	}
+	if opt.StartNumber > 0 {
+		cmd = append(cmd, "-segment_start_number", strconv.Itoa(opt.StartNumber))
+	}
+	if opt.FixTimestamps {
+		cmd = append(cmd, avoidNegativeTs)
+	}
+	cmd = append(cmd, quoteArgs(opt.ExtraOutputArgs)...)
 	cmd = append(cmd, fmt.Sprintf("%s/%%012d.%s", opt.OutputDir, opt.Suffix))
 	if opt.DecodeSEI {
 		cmd = append(cmd, "-c copy -f segment -segment_time", fmt.Sprintf("%v", opt.FragmentDuration))
+		if opt.StartNumber > 0 /* SEI fragments are numbered the same as speech fragments */ {
+			cmd = append(cmd, "-segment_start_number", strconv.Itoa(opt.StartNumber))
+		}
 		cmd = append(cmd, fmt.Sprintf("%s/%%012d.%s", opt.SEIOutputDir, opt.SEIFragmentSuffix))
 	}
 	cmd = append(cmd, "-y")
@@ -942,37 +3054,261 @@ func ParseSliceOptions(opt *SliceOptions) string {
 	return strings.Join(cmd, space)
 }
 
+// ParseRemuxOptions parses remux options string
+func ParseRemuxOptions(opt *RemuxOptions) string {
+	cmd := make([]string, 0)
+
+	cmd = append(cmd, "-c", "copy")
+	if opt.Format != "" {
+		cmd = append(cmd, "-f", opt.Format)
+	}
+	if opt.FixTimestamps {
+		cmd = append(cmd, avoidNegativeTs)
+	}
+	// Remux produces exactly one file, named after index 0 so that it can be read as the last output
+	cmd = append(cmd, fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix), "-y")
+	return strings.Join(cmd, space)
+}
+
+// ParseTranscodeOptions parses transcode options string
+func ParseTranscodeOptions(opt *TranscodeOptions) string {
+	cmd := parseSeekOptions(&opt.CommonOptions, false)
+
+	vc, ac := opt.VideoCodec, opt.AudioCodec
+	if vc == "" {
+		vc = defaultVideoCodec
+	}
+	if ac == "" {
+		ac = defaultAudioCodec
+	}
+	if opt.Width > 0 || opt.Height > 0 {
+		w, h := opt.Width, opt.Height
+		if w <= 0 {
+			w = -2
+		}
+		if h <= 0 {
+			h = -2
+		}
+		cmd = append(cmd, "-vf", quote(fmt.Sprintf(filterScale, w, h)))
+	}
+	cmd = append(cmd, "-c:v", vc)
+	if opt.CRF > 0 {
+		cmd = append(cmd, "-crf", fmt.Sprintf("%v", opt.CRF))
+	}
+	if opt.Preset != "" {
+		cmd = append(cmd, "-preset", opt.Preset)
+	}
+	cmd = append(cmd, "-c:a", ac)
+	if opt.FixTimestamps {
+		cmd = append(cmd, avoidNegativeTs)
+	}
+	// Transcoded media is exactly one file, named after index 0 so that it can be read as the last output
+	cmd = append(cmd, fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix), "-y")
+	return strings.Join(cmd, space)
+}
+
+// ParseSubtitleOptions parses subtitle extraction options string
+func ParseSubtitleOptions(opt *SubtitleOptions) string {
+	cmd := make([]string, 0)
+
+	cmd = append(cmd, "-map", fmt.Sprintf("0:s:%d", opt.StreamIndex))
+	cmd = append(cmd, "-c:s", subtitleEncoders[opt.Format])
+	// Subtitles are extracted into exactly one file, named after index 0 so that it can be read as the last output
+	cmd = append(cmd, fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix), "-y")
+	return strings.Join(cmd, space)
+}
+
+// ParseHLSOptions parses HLS options string
+func ParseHLSOptions(opt *HLSOptions) string {
+	cmd := parseSeekOptions(&opt.CommonOptions, false)
+
+	dur := opt.segmentDuration()
+	if opt.Copy {
+		cmd = append(cmd, "-c", "copy")
+	} else {
+		cmd = append(cmd, "-c:v", "libx264", "-c:a", "aac", "-force_key_frames", quote(fmt.Sprintf(forceKeyFrames, dur)))
+	}
+	if opt.FixTimestamps {
+		cmd = append(cmd, avoidNegativeTs)
+	}
+	cmd = append(cmd, "-f", "hls", "-hls_time", fmt.Sprintf("%v", dur), "-hls_list_size", fmt.Sprintf("%v", opt.ListSize))
+	cmd = append(cmd, "-hls_segment_filename", fmt.Sprintf("%s/%%012d.%s", opt.OutputDir, opt.Suffix))
+	cmd = append(cmd, fmt.Sprintf("%s/%s", opt.OutputDir, opt.playlist()), "-y")
+	return strings.Join(cmd, space)
+}
+
+// ParseSpectrogramOptions parses spectrogram options string
+func ParseSpectrogramOptions(opt *SpectrogramOptions) string {
+	cmd := make([]string, 0)
+
+	if opt.Start > 0 {
+		cmd = append(cmd, "-ss", fmt.Sprintf("%v", opt.Start))
+	}
+	if opt.Duration > 0 {
+		cmd = append(cmd, "-t", fmt.Sprintf("%v", opt.Duration))
+	}
+	w, h := opt.Width, opt.Height
+	if w <= 0 {
+		w = defaultSpectrogramWidth
+	}
+	if h <= 0 {
+		h = defaultSpectrogramHeight
+	}
+	legend := 0
+	if opt.Legend {
+		legend = 1
+	}
+	af := fmt.Sprintf(filterSpectrum, w, h, legend)
+	if opt.Color != "" {
+		af += ":color=" + opt.Color
+	}
+	// showspectrumpic turns audio into video, which can not be done by a simple filter graph (-af/-vf)
+	cmd = append(cmd, "-lavfi", quote(af), "-frames:v", "1", "-f", "image2")
+	// Spectrogram produces exactly one image, named after index 0 so that it can be read as the last output
+	cmd = append(cmd, fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix), "-y")
+	return strings.Join(cmd, space)
+}
+
+// ParseGIFOptions parses GIF options string
+func ParseGIFOptions(opt *GIFOptions) string {
+	cmd := parseSeekOptions(&opt.CommonOptions, false)
+
+	fps, w := opt.FPS, opt.Width
+	if fps <= 0 {
+		fps = defaultGIFFPS
+	}
+	if w <= 0 {
+		w = defaultGIFWidth
+	}
+	vf := fmt.Sprintf(filterGIFScale, fps, w)
+	if opt.Suffix != "webp" /* WebP is not limited to a 256 color palette */ {
+		vf += "," + filterGIFPalette
+	}
+	cmd = append(cmd, "-vf", quote(vf), "-an", "-loop", fmt.Sprintf("%v", opt.Loop))
+	// Animation is exactly one file, named after index 0 so that it can be read as the last output
+	cmd = append(cmd, fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix), "-y")
+	return strings.Join(cmd, space)
+}
+
+// ParseSpriteOptions parses sprite options string
+func ParseSpriteOptions(opt *SpriteOptions) string {
+	cmd := make([]string, 0)
+
+	cols, rows := spriteLayout(opt)
+	w := opt.ThumbWidth
+	if w <= 0 {
+		w = defaultSpriteThumbWidth
+	}
+	vf := fmt.Sprintf(filterInterval, opt.Interval) + "," + fmt.Sprintf(filterSprite, w, cols, rows)
+	cmd = append(cmd,
+		"-vf", quote(vf),
+		"-vsync", "vfr", // frames not selected must not be duplicated
+		"-frames:v", "1",
+		"-f", "image2",
+		"-qscale:v", "1",
+		"-qmin", "1",
+	)
+	// Sprite produces exactly one image, named after index 0 so that it can be read as the last output
+	cmd = append(cmd, fmt.Sprintf("%s/%012d.%s", opt.OutputDir, 0, opt.Suffix), "-y")
+	return strings.Join(cmd, space)
+}
+
+// spriteLayout returns columns and rows of sprite sheet
+func spriteLayout(opt *SpriteOptions) (int, int) {
+	cols, rows := opt.Columns, opt.Rows
+	if cols <= 0 {
+		cols = defaultSpriteColumns
+	}
+	if rows <= 0 {
+		rows = defaultSpriteRows
+	}
+	return cols, rows
+}
+
 // ParseCaptureOptions parses capture options string
 func ParseCaptureOptions(opt *CaptureOptions) string {
-	cmd := make([]string, 0)
+	cmd := parseSeekOptions(&opt.CommonOptions, false)
 
 	if opt.MaxFrames > 0 /* limit maximum number of captured images */ {
 		cmd = append(cmd,
 			"-t", fmt.Sprintf("%vs", utils.GetMaxFrameLimit(opt.MaxFrames, opt.Rate)))
 	}
 	vf := fmt.Sprintf(filterInterval, 1/opt.Rate) /* capture according to specified interval */
-	if opt.Mode == CaptureModeByFrame {
+	switch opt.Mode {
+	case CaptureModeByFrame:
 		vf = fmt.Sprintf(filterEveryNFrm, opt.Frame) /* capture according to specified frame */
+	case CaptureModeExactFps:
+		vf = fmt.Sprintf(filterFps, opt.Rate) /* capture at exact time points */
 	}
 	if opt.Debug {
 		vf = filterDebug + "," + vf
 	}
+	size := opt.Size
+	if opt.HWFrames /* VAAPI frames must be downloaded before being processed by software filters */ {
+		hw := filterHWDownload
+		if size != "" {
+			hw = fmt.Sprintf(filterVAAPI, strings.Replace(size, "x", ":", 1)) + "," + hw
+			size = ""
+		}
+		vf = hw + "," + vf
+	}
+	if opt.DedupFrames /* Drop similar frames before drawing debug info or selecting */ {
+		vf = filterDedup + "," + vf
+	}
+	if opt.DedupFrames || opt.FramePts {
+		// Print info of captured frames for PTS
+		vf = vf + "," + filterShowInfo
+		// Dropped frames must not be duplicated to keep a constant frame rate, so that frame number of
+		// showinfo matches captured image index
+		cmd = append(cmd, "-vsync", "vfr")
+	}
 	cmd = append(
 		cmd,
-		"-vf", fmt.Sprintf("'%v'", vf),
+		"-vf", quote(vf),
 		"-r", fmt.Sprintf("%v", opt.Rate),
 		"-f", "image2", // output format
-		"-qscale:v", "1", // image quality options
-		"-qmin", "1", // image quality options
 	)
-	if opt.Size != "" /* specify captured image size */ {
-		cmd = append(cmd, "-s", opt.Size)
+	cmd = append(cmd, parseImageQualityOptions(opt)...)
+	if size != "" /* specify captured image size */ {
+		cmd = append(cmd, "-s", size)
 	}
+	if opt.FixTimestamps {
+		cmd = append(cmd, avoidNegativeTs)
+	}
+	cmd = append(cmd, opt.OutputArgs...)
+	cmd = append(cmd, quoteArgs(opt.ExtraOutputArgs)...)
 	cmd = append(cmd, fmt.Sprintf("%s/%%012d.%s", opt.OutputDir, opt.Suffix), "-y")
 	return strings.Join(cmd, space)
 }
 
+// parseImageQualityOptions returns image quality options of captured images
+func parseImageQualityOptions(opt *CaptureOptions) []string {
+	q := opt.Quality
+	if q <= 0 {
+		q = defaultImageQuality
+	}
+	cmd := []string{"-qscale:v", fmt.Sprintf("%v", q), "-qmin", "1"}
+	if opt.PixelFormat != "" {
+		cmd = append(cmd, "-pix_fmt", opt.PixelFormat)
+	}
+	if opt.PNGCompression > 0 && opt.Suffix == "png" {
+		cmd = append(cmd, "-compression_level", fmt.Sprintf("%v", opt.PNGCompression))
+	}
+	return cmd
+}
+
+// showInfoLogLevel raises log level to info when needed, so that frame info printed by showinfo is available
+func showInfoLogLevel(lv string) string {
+	switch lv {
+	case "quiet", "panic", "fatal", "error", "warning":
+		return "info"
+	}
+	return lv
+}
+
 // ParseCommonOptions returns a command options string
+// NOTE: When HWAccel is set, FFmpeg falls back to software decoding if the codec is not supported by the hardware,
+// but fails with ErrHWAccelUnavailable if the device itself is not available
 func ParseCommonOptions(opt *CommonOptions, command string, withUri bool) string {
 
 	cmd := make([]string, 0)
@@ -981,31 +3317,99 @@ func ParseCommonOptions(opt *CommonOptions, command string, withUri bool) string
 
 	cmd = append(cmd, common, "-loglevel", opt.GetLogLevel())
 
+	if opt.ReportProgress {
+		cmd = append(cmd, progress)
+	}
+
 	if opt.IsStream /* Only append tw_timeout options for streams */ {
 		cmd = append(cmd, fmt.Sprintf(rwTimeout, opt.GetIOTimeout()*1000000))
 	}
 
-	if !(opt.IsFile || opt.IsStream) /* Only append reconnect & proxy options for video/audio url */ {
+	if !(opt.IsFile || opt.IsStream || opt.InputReader != nil) /* Only append reconnect & proxy options for video/audio url */ {
 		cmd = append(cmd, reconnect)
 		if opt.Proxy != "" {
 			cmd = append(cmd, "-http_proxy", opt.HttpProxy())
 		}
 	}
 
+	if opt.FixTimestamps {
+		cmd = append(cmd, genPts)
+	}
+	if opt.HWAccel != "" && command == "ffmpeg" {
+		cmd = append(cmd, "-hwaccel", opt.HWAccel)
+		if opt.HWAccelDevice != "" {
+			cmd = append(cmd, "-hwaccel_device", opt.HWAccelDevice)
+		}
+		if opt.HWFrames {
+			cmd = append(cmd, "-hwaccel_output_format", opt.HWAccel)
+		}
+	}
+	if opt.ProbeSize != "" {
+		cmd = append(cmd, "-probesize", opt.ProbeSize)
+	}
+	if opt.AnalyzeDuration != "" {
+		cmd = append(cmd, "-analyzeduration", opt.AnalyzeDuration)
+	}
+
+	if command == "ffmpeg" {
+		if opt.ReadRealtime {
+			cmd = append(cmd, "-re")
+		}
+		cmd = append(cmd, parseSeekOptions(opt, true)...)
+	}
 	if withUri {
-		cmd = append(cmd, "-i", fmt.Sprintf("'%v'", opt.Uri))
+		cmd = append(cmd, quoteArgs(opt.ExtraInputArgs)...)
+	}
+	switch {
+	case withUri && opt.InputReader != nil:
+		cmd = append(cmd, "-i", "pipe:0")
+	case withUri:
+		cmd = append(cmd, "-i", quote(opt.Uri))
 	}
 
 	return strings.Join(cmd, space)
 }
 
+// parseSeekOptions returns -ss & -t options of the segment to process. Input seeking (placed before -i) is fast
+// for files, but unreliable for streams, which are seeked by output options (placed after -i) instead, see SeekMode
+func parseSeekOptions(opt *CommonOptions, input bool) []string {
+	cmd := make([]string, 0)
+	if input == opt.seekOnOutput() {
+		return cmd
+	}
+	if opt.StartTime > 0 {
+		cmd = append(cmd, "-ss", fmt.Sprintf("%v", opt.StartTime))
+	}
+	if opt.Duration > 0 {
+		cmd = append(cmd, "-t", fmt.Sprintf("%v", opt.Duration))
+	}
+	return cmd
+}
+
+// quoteArgs quotes arguments containing whitespace or shell special characters, see quote
+func quoteArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for _, v := range args {
+		if v == "" || unsafeArgRegex.MatchString(v) {
+			v = quote(v)
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
 // ParseCommandWithoutArguments returns a command string without arguments
 func ParseCommandWithoutArguments(opt *CommonOptions, command string) []string {
 
 	cmd := make([]string, 0)
-	if opt.DockerCommand != "" {
+	switch {
+	case opt.DockerCommand != "":
 		cmd = append(cmd, opt.DockerCommand)
-	} else {
+	case command == "ffmpeg" && opt.FFmpegPath != "":
+		cmd = append(cmd, opt.FFmpegPath)
+	case command == "ffprobe" && opt.FFprobePath != "":
+		cmd = append(cmd, opt.FFprobePath)
+	default:
 		cmd = append(cmd, command)
 	}
 	return cmd
@@ -1,10 +1,22 @@
 package ffmpeg
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/mykube-run/kindling/pkg/utils"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -63,6 +75,1447 @@ func TestParseCaptureCommand(t *testing.T) {
 	}
 }
 
+func TestParseCaptureCommand_ExactFps(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpeg",
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		Rate: 0.5,
+		Mode: CaptureModeExactFps,
+	}
+	cmd := ParseCaptureCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mp4' -vf 'fps=0.5' -r 0.5 -f image2 -qscale:v 1 -qmin 1 /tmp/ffmpeg-test/%012d.jpeg -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestParseCaptureCommand_HWAccel(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:           "/tmp/sample.mp4",
+			OutputDir:     "/tmp/ffmpeg-test",
+			Suffix:        "jpeg",
+			IsFile:        true,
+			LogLevel:      "warning",
+			HWAccel:       HWAccelCUDA,
+			HWAccelDevice: "0",
+		},
+		Rate: 0.5,
+		Size: "640x360",
+	}
+	cmd := ParseCaptureCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -hwaccel cuda -hwaccel_device 0 -i '/tmp/sample.mp4' -vf 'select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,2)' -r 0.5 -f image2 -qscale:v 1 -qmin 1 -s 640x360 /tmp/ffmpeg-test/%012d.jpeg -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// VAAPI frames are scaled on GPU
+	opt.HWAccel = HWAccelVAAPI
+	opt.HWAccelDevice = "/dev/dri/renderD128"
+	cmd = ParseCaptureCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -hwaccel vaapi -hwaccel_device /dev/dri/renderD128 -hwaccel_output_format vaapi -i '/tmp/sample.mp4' -vf 'scale_vaapi=640:360,hwdownload,format=nv12,select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,2)' -r 0.5 -f image2 -qscale:v 1 -qmin 1 /tmp/ffmpeg-test/%012d.jpeg -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	msg := "No device available for decoder: device type cuda needed for codec h264"
+	if err := convertError(fmt.Errorf("exit status 1"), msg); err != ErrHWAccelUnavailable {
+		t.Fatalf("expecting ErrHWAccelUnavailable, got %v", err)
+	}
+}
+
+func TestParseRemuxCommand(t *testing.T) {
+	opt := &RemuxOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mkv",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "mp4",
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		Format: "mp4",
+	}
+	cmd := ParseRemuxCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mkv' -c copy -f mp4 /tmp/ffmpeg-test/000000000000.mp4 -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	msg := "Could not find tag for codec pcm_s16le in stream #1, codec not currently supported in container"
+	if err := convertError(fmt.Errorf("exit status 1"), msg); err != ErrCodecNotSupported {
+		t.Fatalf("expecting ErrCodecNotSupported, got %v", err)
+	}
+}
+
+func TestCommand_Transcode(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-transcode"
+	opt := &TranscodeOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mkv",
+			OutputDir: dir,
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		Height: 720,
+		CRF:    23,
+		Preset: "veryfast",
+	}
+	opt.Suffix = "mp4"
+	cmd := ParseTranscodeCommand(opt)
+	expected := "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mkv' -vf 'scale=-2:720' -c:v libx264 -crf 23 " +
+		"-preset veryfast -c:a aac /tmp/ffmpeg-test-transcode/000000000000.mp4 -y"
+	if cmd != expected {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Simulates FFmpeg writing the transcoded media, as well as FFprobe printing its duration
+	opt.DockerCommand = fmt.Sprintf(`printf media > %s/000000000000.mp4; echo '{"format":{"duration":"12.5"}}' #`, dir)
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Transcode(opt); err != nil {
+		t.Fatal(err)
+	}
+	o, err, ok, _ := c.ReadOutput()
+	if err != nil || !ok {
+		t.Fatalf("expecting an output, got error: %v", err)
+	}
+	if o.Type != OutputTypeMedia || !o.Last || string(o.Content) != "media" {
+		t.Fatalf("unexpected output: %+v", o)
+	}
+	if st := c.Stats(); st.MediaDuration != 12.5 || st.OtherCount != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestCommand_ExtractSubtitles(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-subtitles"
+	opt := &SubtitleOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mkv",
+			OutputDir: dir,
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		StreamIndex: 1,
+		Format:      SubtitleFormatSRT,
+	}
+	opt.Suffix = opt.Format
+	cmd := ParseSubtitleCommand(opt)
+	expected := "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mkv' -map 0:s:1 -c:s srt " +
+		"/tmp/ffmpeg-test-subtitles/000000000000.srt -y"
+	if cmd != expected {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Simulates FFprobe printing stream info, as well as FFmpeg writing the subtitle file
+	run := func(streams string, opt *SubtitleOptions) (*Command, error) {
+		opt.DockerCommand = fmt.Sprintf(`printf 'WEBVTT' > %s/000000000000.vtt 2>/dev/null; echo '{"streams":[%s]}' #`, dir, streams)
+		c := NewCommand()
+		return c, c.ExtractSubtitles(opt)
+	}
+	video, sub := `{"codec_type":"video"}`, `{"codec_type":"subtitle"}`
+	c, err := run(video, &SubtitleOptions{CommonOptions: CommonOptions{Uri: "/tmp/sample.mkv", OutputDir: dir, IsFile: true}})
+	c.Close()
+	if err != ErrNoStream {
+		t.Fatalf("expecting ErrNoStream, got %v", err)
+	}
+	c, err = run(video+","+sub, &SubtitleOptions{CommonOptions: CommonOptions{Uri: "/tmp/sample.mkv", OutputDir: dir, IsFile: true}, StreamIndex: 1})
+	c.Close()
+	if err == nil {
+		t.Fatalf("expecting error extracting a non-existing subtitle stream")
+	}
+
+	c, err = run(video+","+sub, &SubtitleOptions{CommonOptions: CommonOptions{Uri: "/tmp/sample.mkv", OutputDir: dir, IsFile: true}})
+	defer c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err, ok, _ := c.ReadOutput()
+	if err != nil || !ok {
+		t.Fatalf("expecting an output, got error: %v", err)
+	}
+	if o.Type != OutputTypeSubtitle || !o.Last || o.Suffix != SubtitleFormatWebVTT || string(o.Content) != "WEBVTT" {
+		t.Fatalf("unexpected output: %+v", o)
+	}
+	if idx, ok := c.info.HasSubtitleStream(); !ok || idx != 1 {
+		t.Fatalf("expecting subtitle stream #1, got %v, %v", idx, ok)
+	}
+}
+
+func TestCommand_HLS(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-hls"
+	opt := &HLSOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "rtmp://localhost/live/test",
+			OutputDir: dir,
+			Suffix:    "ts",
+			IsStream:  true,
+			LogLevel:  "warning",
+		},
+		SegmentDuration: 4,
+		ListSize:        5,
+	}
+	cmd := ParseHLSCommand(opt)
+	expected := "ffmpeg -hide_banner -loglevel warning -rw_timeout 2000000 -i 'rtmp://localhost/live/test' " +
+		"-c:v libx264 -c:a aac -force_key_frames 'expr:gte(t,n_forced*4)' -f hls -hls_time 4 -hls_list_size 5 " +
+		"-hls_segment_filename /tmp/ffmpeg-test-hls/%012d.ts /tmp/ffmpeg-test-hls/index.m3u8 -y"
+	if cmd != expected {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Simulates FFmpeg writing 3 segments, updating playlist (through a temporary file) after each segment
+	opt.DockerCommand = fmt.Sprintf("for i in 0 1 2; do printf seg$i > %[1]s/00000000000$i.ts; "+
+		"printf '#EXTM3U' > %[1]s/index.m3u8.tmp; mv %[1]s/index.m3u8.tmp %[1]s/index.m3u8; sleep 0.2; done; "+
+		"printf '#EXTM3U #EXT-X-ENDLIST' > %[1]s/index.m3u8 #", dir)
+	c := NewCommand()
+	defer c.Close()
+	if err := c.HLS(opt); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		segments []string
+		last     *Output
+	)
+	for res := range c.Outputs() {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		switch res.Output.Type {
+		case OutputTypeMediaSegment:
+			segments = append(segments, string(res.Output.Content))
+		case OutputTypePlaylist:
+			if res.Output.Suffix != "m3u8" {
+				t.Fatalf("unexpected playlist suffix: %v", res.Output.Suffix)
+			}
+		default:
+			t.Fatalf("unexpected output type: %v", res.Output.Type)
+		}
+		if last != nil && last.Last {
+			t.Fatalf("expecting no output after the last one")
+		}
+		last = res.Output
+	}
+	assert.Equal(t, []string{"seg0", "seg1", "seg2"}, segments)
+	if last == nil || !last.Last || last.Type != OutputTypePlaylist || !strings.Contains(string(last.Content), "#EXT-X-ENDLIST") {
+		t.Fatalf("expecting the final playlist to be the last output, got %+v", last)
+	}
+	if dirs := c.OutputDirs(); dirs[OutputDirHLS] != dir {
+		t.Fatalf("unexpected output directories: %v", dirs)
+	}
+}
+
+func TestParseCommand_ExtraArgs(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:             "/tmp/sample.mp4",
+			OutputDir:       "/tmp/ffmpeg-test",
+			Suffix:          "jpg",
+			IsFile:          true,
+			LogLevel:        "warning",
+			ExtraInputArgs:  []string{"-threads", "2"},
+			ExtraOutputArgs: []string{"-map", "0:v:0", "-metadata", "title=a b"},
+		},
+		Rate: 1,
+	}
+	cmd := ParseCaptureCommand(opt)
+	expected := "ffmpeg -hide_banner -loglevel warning -threads 2 -i '/tmp/sample.mp4' " +
+		"-vf 'select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,1)' -r 1 -f image2 -qscale:v 1 -qmin 1 " +
+		"-map 0:v:0 -metadata 'title=a b' /tmp/ffmpeg-test/%012d.jpg -y"
+	if cmd != expected {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	sopt := NewDefaultSliceOptions()
+	sopt.Uri = "/tmp/sample.mp4"
+	sopt.OutputDir = "/tmp/ffmpeg-test"
+	sopt.IsFile = true
+	sopt.ExtraOutputArgs = []string{"-vsync", "vfr"}
+	cmd = ParseSliceCommand(sopt)
+	if !strings.HasSuffix(cmd, "-segment_time 10 -vsync vfr /tmp/ffmpeg-test/%012d.wav -y") {
+		t.Fatalf("expecting extra output args right before output file, got: %v", cmd)
+	}
+}
+
+func TestParseCommand_ReadRealtime(t *testing.T) {
+	// Capturing a file as if it were a live stream, frames are produced at the native frame rate instead of instantly
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:          "/tmp/sample.mp4",
+			OutputDir:    "/tmp/ffmpeg-test",
+			Suffix:       "jpg",
+			IsFile:       true,
+			LogLevel:     "warning",
+			StartTime:    5,
+			ReadRealtime: true,
+		},
+		Rate: 1,
+	}
+	cmd := ParseCaptureCommand(opt)
+	if !strings.HasPrefix(cmd, "ffmpeg -hide_banner -loglevel warning -re -ss 5 -i '/tmp/sample.mp4' ") {
+		t.Fatalf("expecting -re before -i, got: %v", cmd)
+	}
+
+	// Probing reads as fast as possible
+	popt := &ProbeOptions{Uri: opt.Uri, IsFile: true, LogLevel: "warning"}
+	if cmd = ParseProbeCommand(popt); strings.Contains(cmd, "-re") {
+		t.Fatalf("expecting no -re for probing, got: %v", cmd)
+	}
+}
+
+func TestParseCommand_FixTimestamps(t *testing.T) {
+	opt := NewDefaultSliceOptions()
+	opt.Uri = "/tmp/sample.flv"
+	opt.OutputDir = "/tmp/ffmpeg-test"
+	opt.IsFile = true
+	opt.FixTimestamps = true
+	cmd := ParseSliceCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -fflags +genpts -i '/tmp/sample.flv' -vn -c:a pcm_s16le -ar 16000 -ac 1 -f segment -segment_time 10 -avoid_negative_ts make_zero /tmp/ffmpeg-test/%012d.wav -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	ropt := &RemuxOptions{
+		CommonOptions: CommonOptions{
+			Uri:           "/tmp/sample.flv",
+			OutputDir:     "/tmp/ffmpeg-test",
+			Suffix:        "mp4",
+			IsFile:        true,
+			FixTimestamps: true,
+		},
+	}
+	cmd = ParseRemuxCommand(ropt)
+	if cmd != "ffmpeg -hide_banner -loglevel error -fflags +genpts -i '/tmp/sample.flv' -c copy -avoid_negative_ts make_zero /tmp/ffmpeg-test/000000000000.mp4 -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestCommand_Drain(t *testing.T) {
+	start := func(dir string) *Command {
+		opt := &CaptureOptions{
+			CommonOptions: CommonOptions{
+				Uri:       "/tmp/sample.mp4",
+				OutputDir: dir,
+				Suffix:    "jpg",
+				IsFile:    true,
+				// Simulates FFmpeg capturing 4 images then hanging, the last image is never enqueued
+				DockerCommand: fmt.Sprintf("for i in 1 2 3 4; do printf x > %s/00000000000$i.jpg; sleep 0.1; done; sleep 5 #", dir),
+			},
+			Rate: 1,
+		}
+		cmd := NewCommand()
+		if err := cmd.Capture(opt); err != nil {
+			t.Fatal(err)
+		}
+		for cmd.Stats().Output < 3 {
+			time.Sleep(time.Millisecond * 10)
+		}
+		return cmd
+	}
+
+	// Enqueued outputs are still readable while draining
+	dir := "/tmp/ffmpeg-test-drain"
+	cmd := start(dir)
+	readC := make(chan int)
+	go func() {
+		n := 0
+		for !cmd.IsClosed() {
+			if _, _, ok, _ := cmd.ReadOutput(); ok {
+				n++
+				time.Sleep(time.Millisecond * 50) // Slow consumer
+			}
+		}
+		readC <- n
+	}()
+	begin := time.Now()
+	if err := cmd.Drain(time.Second); err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("expecting Drain to return once drained, took %v", elapsed)
+	}
+	if n := <-readC; n != 3 {
+		t.Fatalf("expecting 3 outputs read, got %v", n)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expecting output directory to be removed, got %v", err)
+	}
+
+	// Outputs are discarded on timeout
+	cmd = start(dir)
+	if err := cmd.Drain(time.Millisecond * 100); err == nil {
+		t.Fatalf("expecting error on drain timeout, got nil")
+	}
+}
+
+func TestCommand_AlreadyUsed(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-used"
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:           "/tmp/sample.mp4",
+			OutputDir:     dir,
+			Suffix:        "jpg",
+			IsFile:        true,
+			DockerCommand: "sleep 1 #",
+		},
+		Rate: 1,
+	}
+	cmd := NewCommand()
+	if err := cmd.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	another := &CaptureOptions{CommonOptions: CommonOptions{Uri: "/tmp/another.mp4", OutputDir: "/tmp/ffmpeg-test-another"}}
+	if err := cmd.Capture(another); !errors.Is(err, ErrCommandAlreadyUsed) {
+		t.Fatalf("expecting ErrCommandAlreadyUsed, got %v", err)
+	}
+	// The running command must be left untouched
+	if cmd.opt.Uri != opt.Uri || cmd.Error() != nil {
+		t.Fatalf("expecting running command not to be affected, uri: %v, error: %v", cmd.opt.Uri, cmd.Error())
+	}
+
+	_ = cmd.Close()
+	if _, err := cmd.ProbeStreams(&ProbeOptions{Uri: opt.Uri, IsFile: true}); !errors.Is(err, ErrCommandAlreadyUsed) {
+		t.Fatalf("expecting ErrCommandAlreadyUsed probing after Close, got %v", err)
+	}
+}
+
+func TestCommand_MultiCapture(t *testing.T) {
+	dense, sparse := "/tmp/ffmpeg-test-multi-dense", "/tmp/ffmpeg-test-multi-sparse"
+	opt := &MultiCaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:      "/tmp/sample.mp4",
+			IsFile:   true,
+			LogLevel: "warning",
+		},
+		Sets: []CaptureSet{
+			{Name: "dense", CaptureOptions: CaptureOptions{CommonOptions: CommonOptions{OutputDir: dense, Suffix: "jpg"}, Rate: 1}},
+			{Name: "sparse", CaptureOptions: CaptureOptions{CommonOptions: CommonOptions{OutputDir: sparse, Suffix: "png"}, Mode: CaptureModeByFrame, Frame: 250}},
+		},
+	}
+	cmd := ParseMultiCaptureCommand(opt)
+	expected := "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mp4' " +
+		"-vf 'select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,1)' -r 1 -f image2 -qscale:v 1 -qmin 1 /tmp/ffmpeg-test-multi-dense/%012d.jpg -y " +
+		"-vf 'select=not(mod(n\\,250))' -r 0 -f image2 -qscale:v 1 -qmin 1 /tmp/ffmpeg-test-multi-sparse/%012d.png -y"
+	if cmd != expected {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Simulates FFmpeg writing 3 dense images and 2 sparse images
+	opt.DockerCommand = fmt.Sprintf("for i in 1 2 3; do printf x > %s/00000000000$i.jpg; done; for i in 1 2; do printf xx > %s/00000000000$i.png; done #", dense, sparse)
+	c := NewCommand()
+	defer c.Close()
+	if err := c.MultiCapture(opt); err != nil {
+		t.Fatal(err)
+	}
+	counts, last := make(map[string]int), 0
+	for {
+		o, err, ok, finished := c.ReadOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished {
+			break
+		}
+		if !ok {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		counts[o.Set]++
+		if o.Last {
+			last++
+		}
+		if (o.Set == "dense") != (o.Suffix == "jpg") {
+			t.Fatalf("unexpected output of set '%v': %v", o.Set, o.Suffix)
+		}
+	}
+	if counts["dense"] != 3 || counts["sparse"] != 2 || last != 1 {
+		t.Fatalf("unexpected outputs: %v, last: %v", counts, last)
+	}
+	if dirs := c.OutputDirs(); dirs["capture/dense"] != dense || dirs["capture/sparse"] != sparse {
+		t.Fatalf("unexpected output directories: %v", dirs)
+	}
+
+	opt.Sets[1].Name = "dense"
+	if err := NewCommand().MultiCapture(opt); err == nil {
+		t.Fatalf("expecting error on duplicated capture set")
+	}
+}
+
+func TestCommand_EffectiveOptions(t *testing.T) {
+	if _, ok := NewCommand().EffectiveOptions(); ok {
+		t.Fatalf("expecting no effective options before capturing")
+	}
+
+	out := `{"streams": [{"index": 0, "codec_type": "video", "avg_frame_rate": "25/1", "r_frame_rate": "30/1"}], "format": {}}`
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: "/tmp/ffmpeg-test-effective",
+			Suffix:    "jpg",
+			IsFile:    true,
+			LogLevel:  "warning",
+			// Simulates FFprobe reporting a VFR source, FFmpeg exits without output
+			DockerCommand: fmt.Sprintf("echo '%s' #", out),
+		},
+		Rate:      1,
+		DetectVFR: true,
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	eff, ok := cmd.EffectiveOptions()
+	if !ok {
+		t.Fatalf("expecting effective options")
+	}
+	if !eff.UsesFramePts() || eff.LogLevel != "info" || eff.Rate != 1 {
+		t.Fatalf("expecting frame PTS to be used with log level raised to info, got %v, %v", eff.UsesFramePts(), eff.LogLevel)
+	}
+}
+
+func TestCommand_Stats(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-stats"
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: dir,
+			Suffix:    "jpg",
+			IsFile:    true,
+			// Simulates FFmpeg writing captured images
+			DockerCommand: fmt.Sprintf("for i in 1 2 3; do printf xx > %s/00000000000$i.jpg; done #", dir),
+		},
+		Rate: 1,
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err, _, finished := cmd.ReadOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	st := cmd.Stats()
+	if st.ImageCount != 3 || st.ImageBytes != 6 || st.SegmentCount != 0 || st.SegmentBytes != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if st.Output != st.ImageCount+st.SegmentCount+st.OtherCount || st.Bytes != st.ImageBytes+st.SegmentBytes+st.OtherBytes {
+		t.Fatalf("expecting totals to equal to the sum of each type: %+v", st)
+	}
+}
+
+func TestCommand_OutputDirs(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-output-dirs"
+	defer os.RemoveAll(dir)
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:            "/tmp/sample.mp4",
+			OutputDir:      dir,
+			Suffix:         "jpg",
+			IsFile:         true,
+			PreserveOutput: true,
+			// Simulates FFmpeg writing captured images
+			DockerCommand: fmt.Sprintf("for i in 1 2 3; do printf x > %s/00000000000$i.jpg; done #", dir),
+		},
+		Rate: 1,
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err, _, finished := cmd.ReadOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	dirs := cmd.OutputDirs()
+	if len(dirs) != 1 || dirs[OutputDirCapture] != dir {
+		t.Fatalf("unexpected output dirs: %v", dirs)
+	}
+	files, err := os.ReadDir(dirs[OutputDirCapture])
+	if err != nil || len(files) != 3 {
+		t.Fatalf("expecting 3 preserved outputs in %v, got %v (%v)", dir, len(files), err)
+	}
+}
+
+func TestCommand_ProbeChapters(t *testing.T) {
+	opt := &ProbeOptions{
+		Uri:             "/tmp/podcast.m4a",
+		IsFile:          true,
+		LogLevel:        "error",
+		IncludeChapters: true,
+	}
+	if cmd := ParseProbeCommand(opt); !strings.HasSuffix(cmd, "-show_streams -show_format -of json -show_chapters") {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	out := `{"chapters": [{"id": 0, "time_base": "1/1000", "start": 0, "start_time": "0.000000", "end": 5000, "end_time": "5.000000", "tags": {"title": "Intro"}}], "streams": [], "format": {}}`
+	opt.DockerCommand = fmt.Sprintf("echo '%s' #", out)
+	chapters, err := NewCommand().ProbeChapters(opt)
+	if err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	if len(chapters) != 1 || chapters[0].Title() != "Intro" {
+		t.Fatalf("unexpected chapters: %+v", chapters)
+	}
+	if end, _ := chapters[0].GetEndTime(); end != 5 {
+		t.Fatalf("expecting chapter end time 5, got %v", end)
+	}
+
+	// Probing is terminated when ctx is done
+	opt.DockerCommand = "sleep 5 #"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if _, err = NewCommand().ProbeChaptersContext(ctx, opt); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestParseCommand_Seek(t *testing.T) {
+	opt := NewDefaultSliceOptions()
+	opt.Uri = "/tmp/sample.flv"
+	opt.OutputDir = "/tmp/ffmpeg-test"
+	opt.IsFile = true
+	opt.StartTime = 30
+	opt.Duration = 12.5
+	cmd := ParseSliceCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -ss 30 -t 12.5 -i '/tmp/sample.flv' -vn -c:a pcm_s16le -ar 16000 -ac 1 -f segment -segment_time 10 /tmp/ffmpeg-test/%012d.wav -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Streams are seeked by output options
+	opt.Uri = "rtmp://localhost/live/test"
+	opt.IsFile = false
+	opt.IsStream = true
+	cmd = ParseSliceCommand(opt)
+	if !strings.Contains(cmd, "-i 'rtmp://localhost/live/test' -ss 30 -t 12.5 -vn") {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	if sec := utils.GetImageSecondFrom(3, 0.5, 30); sec != 34 {
+		t.Fatalf("expecting image second 34, got %v", sec)
+	}
+	if sec := utils.GetSegmentStartFrom(2, 10, 30); sec != 50 {
+		t.Fatalf("expecting segment start 50, got %v", sec)
+	}
+}
+
+func TestCommand_SliceSeek(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-slice-seek"
+	opt := NewDefaultSliceOptions()
+	opt.Uri, opt.OutputDir = "/tmp/sample.flv", dir
+	opt.IsFile, opt.StartTime, opt.Duration = true, 30, 25
+	// Simulates FFmpeg slicing 3 fragments from second 30
+	opt.DockerCommand = fmt.Sprintf(`for i in 0 1 2; do printf x > %s/00000000000$i.wav; sleep 0.05; done; sleep 0.5 #`, dir)
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Slice(opt); err != nil {
+		t.Fatal(err)
+	}
+	outputs := collectOutputs(t, c)
+	for i, sec := range map[int64]float64{0: 30, 1: 40, 2: 50} {
+		if o := outputs[i]; o == nil || o.Second != sec {
+			t.Fatalf("unexpected output %v: %+v", i, o)
+		}
+	}
+
+	// Simulates FFprobe printing info of a 100 seconds media, only 25 seconds of which are sliced
+	opt.DockerCommand = `echo '{"streams":[{"codec_type":"audio","duration":"100"}]}' #`
+	if n, ok := c.ExpectedOutputCount(); !ok || n != 3 {
+		t.Fatalf("expecting 3 outputs within range, got %v, %v", n, ok)
+	}
+}
+
+// collectOutputs reads outputs of c until it finishes, outputs are indexed by Output.Index
+func collectOutputs(t *testing.T, c *Command) map[int64]*Output {
+	t.Helper()
+	outputs := make(map[int64]*Output)
+	for {
+		o, err, ok, finished := c.ReadOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished {
+			return outputs
+		}
+		if !ok {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		outputs[o.Index] = o
+	}
+}
+
+func TestParseSliceCommand_Normalize(t *testing.T) {
+	opt := NewDefaultSliceOptions()
+	opt.Uri = "/tmp/sample.mp4"
+	opt.OutputDir = "/tmp/ffmpeg-test"
+	opt.IsFile = true
+	opt.Normalize = true
+	cmd := ParseSliceCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mp4' -vn -af 'loudnorm=I=-16:TP=-1.5:LRA=11' -c:a pcm_s16le -ar 16000 -ac 1 -f segment -segment_time 10 /tmp/ffmpeg-test/%012d.wav -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	opt.TargetLUFS = -23
+	if cmd = ParseSliceCommand(opt); !strings.Contains(cmd, "-af 'loudnorm=I=-23:TP=-1.5:LRA=11'") {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	opt.DecodeSEI = true
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Slice(opt); err == nil || !strings.Contains(err.Error(), "DecodeSEI") {
+		t.Fatalf("expecting Normalize & DecodeSEI to be rejected, got %v", err)
+	}
+}
+
+func TestCommand_SliceSkipReencodeIfMatch(t *testing.T) {
+	slice := func(stream string) (*Command, *SliceOptions) {
+		opt := NewDefaultSliceOptions()
+		opt.Uri = "/tmp/sample.wav"
+		opt.OutputDir = "/tmp/ffmpeg-test-slice-copy"
+		opt.IsFile = true
+		opt.SkipReencodeIfMatch = true
+		// Simulates FFprobe printing stream info, FFmpeg does not produce any fragment
+		opt.DockerCommand = fmt.Sprintf(`echo '{"streams":[%s]}' #`, stream)
+		c := NewCommand()
+		if err := c.Slice(opt); err != nil {
+			t.Fatal(err)
+		}
+		return c, opt
+	}
+
+	c, opt := slice(`{"codec_type":"audio","codec_name":"pcm_s16le","sample_rate":"16000","channels":1}`)
+	defer c.Close()
+	if cmd := c.cmd.String(); !opt.CopyAudio || !strings.Contains(cmd, "-vn -c:a copy -f segment") || strings.Contains(cmd, "-ar") {
+		t.Fatalf("expecting audio stream to be copied: %v", cmd)
+	}
+
+	c, opt = slice(`{"codec_type":"audio","codec_name":"aac","sample_rate":"44100","channels":2}`)
+	defer c.Close()
+	if cmd := c.cmd.String(); opt.CopyAudio || !strings.Contains(cmd, "-c:a pcm_s16le -ar 16000 -ac 1") {
+		t.Fatalf("expecting audio stream to be re-encoded: %v", cmd)
+	}
+}
+
+func TestParseCommand_InputReader(t *testing.T) {
+	opt := NewDefaultSliceOptions()
+	opt.InputReader = strings.NewReader("media content")
+	opt.OutputDir = "/tmp/ffmpeg-test"
+	cmd := ParseSliceCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -i pipe:0 -vn -c:a pcm_s16le -ar 16000 -ac 1 -f segment -segment_time 10 /tmp/ffmpeg-test/%012d.wav -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	opt.Proxy = "localhost:8080"
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Slice(opt); err == nil || !strings.Contains(err.Error(), "InputReader") {
+		t.Fatalf("expecting InputReader & Proxy to be rejected, got %v", err)
+	}
+}
+
+func TestConvertError_NonMonotonicDTS(t *testing.T) {
+	msg := "[mp4 @ 0x5581] Application provided invalid, non monotonically increasing dts to muxer in stream 0: 1024 >= 512"
+	err := convertError(fmt.Errorf("exit status 1"), msg)
+	if err != ErrNonMonotonicDTS {
+		t.Fatalf("expecting ErrNonMonotonicDTS, got %v", err)
+	}
+	if !isWarning(err) {
+		t.Fatalf("expecting ErrNonMonotonicDTS to be a warning")
+	}
+
+	// The real error must not be hidden by the DTS warning
+	msg += "\nServer returned 404 Not Found"
+	if err = convertError(fmt.Errorf("exit status 1"), msg); err != ErrUrlNotFound {
+		t.Fatalf("expecting ErrUrlNotFound, got %v", err)
+	}
+	if isWarning(err) {
+		t.Fatalf("expecting ErrUrlNotFound not to be a warning")
+	}
+}
+
+func TestConvertError(t *testing.T) {
+	cases := []struct {
+		msg string
+		err error
+	}{
+		{"av_interleaved_write_frame(): No space left on device", ErrDiskFull},
+		{"/data/out/000000000001.jpg: Permission denied", ErrPermissionDenied},
+		{"Unknown encoder 'libx264'", ErrUnsupportedCodec},
+		{"Decoder (codec av1) not found for input stream #0:0", ErrUnsupportedCodec},
+		{"server returned 404 not found", ErrUrlNotFound}, // Matched case-insensitively
+	}
+	for _, c := range cases {
+		if err := convertError(fmt.Errorf("exit status 1"), c.msg); err != c.err {
+			t.Fatalf("expecting %v for %q, got %v", c.err, c.msg, err)
+		}
+	}
+}
+
+func TestCommand_Epoch(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-epoch"
+	_ = os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := NewCommand()
+	cmd.opt = &CommonOptions{OutputDir: dir}
+	cmd.mod = func(o *Output) {}
+	produce := func() *Output {
+		for i := 0; i < 2; i++ {
+			fn := fmt.Sprintf("%s/%012d.wav", dir, i)
+			if err := os.WriteFile(fn, []byte("segment"), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd.handleFileEvent(fmt.Sprintf("%012d.wav", 1), dir)
+		v, ok := cmd.q.Dequeue()
+		if !ok {
+			t.Fatalf("expecting an output")
+		}
+		return v.(*Output)
+	}
+
+	o1 := produce()
+	cmd.handleStderrLine("[https @ 0x55d0c0] Will reconnect at 1048576 in 0 second(s), error=Input/output error.")
+	// Indices restart from 0 after reconnecting
+	o2 := produce()
+	if o1.Index != o2.Index {
+		t.Fatalf("expecting index to be reset, got %v and %v", o1.Index, o2.Index)
+	}
+	if o1.Epoch != 0 || o2.Epoch != 1 {
+		t.Fatalf("expecting epochs to be 0 and 1, got %v and %v", o1.Epoch, o2.Epoch)
+	}
+}
+
+func TestParseCommand_BinaryPath(t *testing.T) {
+	opt := &RemuxOptions{
+		CommonOptions: CommonOptions{
+			Uri:         "/tmp/sample.mkv",
+			OutputDir:   "/tmp/ffmpeg-test",
+			Suffix:      "mp4",
+			IsFile:      true,
+			FFmpegPath:  "/usr/local/bin/ffmpeg",
+			FFprobePath: "/usr/local/bin/ffprobe",
+		},
+	}
+	cmd := ParseRemuxCommand(opt)
+	if cmd != "/usr/local/bin/ffmpeg -hide_banner -loglevel error -i '/tmp/sample.mkv' -c copy /tmp/ffmpeg-test/000000000000.mp4 -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	popt := &ProbeOptions{
+		Uri:         "/tmp/sample.mkv",
+		IsFile:      true,
+		FFprobePath: "/usr/local/bin/ffprobe",
+	}
+	cmd = ParseProbeCommand(popt)
+	if cmd != "/usr/local/bin/ffprobe -hide_banner -loglevel error -i '/tmp/sample.mkv' -show_streams -show_format -of json" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// DockerCommand takes precedence
+	opt.DockerCommand = "docker run --rm jrottenberg/ffmpeg"
+	cmd = ParseRemuxCommand(opt)
+	if !strings.HasPrefix(cmd, "docker run --rm jrottenberg/ffmpeg -hide_banner") {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	cmd := shellCommand("echo " + quote("kindling"))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	if !strings.Contains(string(out), "kindling") {
+		t.Fatalf("unexpected output: %v", string(out))
+	}
+
+	// Long running process can be terminated
+	cmd = shellCommand("ping -n 30 127.0.0.1 || sleep 30")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err = terminate(cmd); err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expecting process to be terminated")
+	}
+}
+
+func TestCommand_Progress(t *testing.T) {
+	opt := &RemuxOptions{
+		CommonOptions: CommonOptions{
+			Uri:            "/tmp/sample.mkv",
+			OutputDir:      "/tmp/ffmpeg-test",
+			Suffix:         "mp4",
+			IsFile:         true,
+			ReportProgress: true,
+		},
+	}
+	cmd := ParseRemuxCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel error -progress pipe:1 -i '/tmp/sample.mkv' -c copy /tmp/ffmpeg-test/000000000000.mp4 -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	c := NewCommand()
+	c.prog = Progress{TotalDuration: time.Second * 10, Percent: 0}
+	for _, line := range []string{"frame=120", "fps=48.00", "out_time_us=2500000", "speed=1.92x", "progress=continue"} {
+		c.handleProgressLine(line)
+	}
+	p := c.Progress()
+	if p.Frame != 120 || p.FPS != 48 || p.Speed != 1.92 || p.CurrentTime != time.Millisecond*2500 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+	if p.Percent != 25 || p.Finished {
+		t.Fatalf("expecting 25%% progress, got %+v", p)
+	}
+	c.handleProgressLine("progress=end")
+	if p = c.Progress(); p.Percent != 100 || !p.Finished {
+		t.Fatalf("expecting progress to be finished, got %+v", p)
+	}
+
+	// Live streams have no known duration
+	c = NewCommand()
+	c.opt = &CommonOptions{IsStream: true}
+	c.initProgress()
+	c.handleProgressLine("out_time_ms=2500000")
+	if p = c.Progress(); p.Percent != -1 || p.CurrentTime != time.Millisecond*2500 {
+		t.Fatalf("expecting -1 percent for streams, got %+v", p)
+	}
+}
+
+func TestParseSpectrogramCommand(t *testing.T) {
+	opt := &SpectrogramOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.wav",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "png",
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		Width:  640,
+		Height: 320,
+		Color:  "viridis",
+	}
+	cmd := ParseSpectrogramCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.wav' -lavfi 'showspectrumpic=s=640x320:legend=0:color=viridis' -frames:v 1 -f image2 /tmp/ffmpeg-test/000000000000.png -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Per-slice spectrogram with default size
+	opt = &SpectrogramOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.wav",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "png",
+			IsFile:    true,
+		},
+		Legend:   true,
+		Start:    20,
+		Duration: 10,
+	}
+	cmd = ParseSpectrogramCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel error -i '/tmp/sample.wav' -ss 20 -t 10 -lavfi 'showspectrumpic=s=1024x512:legend=1' -frames:v 1 -f image2 /tmp/ffmpeg-test/000000000000.png -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestParseSpriteCommand(t *testing.T) {
+	opt := &SpriteOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpg",
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		Columns:    4,
+		Rows:       3,
+		ThumbWidth: 320,
+		Interval:   2.5,
+	}
+	cmd := ParseSpriteCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mp4' -vf 'select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,2.5),scale=320:-1,tile=4x3' -vsync vfr -frames:v 1 -f image2 -qscale:v 1 -qmin 1 /tmp/ffmpeg-test/000000000000.jpg -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestParseTIFFCommand(t *testing.T) {
+	opt := &TIFFOptions{
+		CaptureOptions: CaptureOptions{
+			CommonOptions: CommonOptions{
+				Uri:       "/tmp/sample.mp4",
+				OutputDir: "/tmp/ffmpeg-test",
+				IsFile:    true,
+				LogLevel:  "warning",
+			},
+			Rate: 1,
+		},
+		Compression: "lzw",
+	}
+	cmd := ParseTIFFCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -i '/tmp/sample.mp4' -vf 'select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,1)' -r 1 -f image2 -qscale:v 1 -qmin 1 -compression_algo lzw /tmp/ffmpeg-test/%012d.tiff -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestCommand_TIFF(t *testing.T) {
+	opt := &TIFFOptions{
+		CaptureOptions: CaptureOptions{
+			CommonOptions: CommonOptions{
+				Uri:       TestUrlVideo,
+				OutputDir: "/tmp/ffmpeg-test-tiff",
+				MediaId:   "test",
+				LogLevel:  "error",
+			},
+			Rate:      1,
+			MaxFrames: 3,
+			Size:      "180x320",
+		},
+		Compression: "deflate",
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.TIFF(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err, ok, _ := cmd.ReadOutput()
+	if err != nil || !ok {
+		t.Fatalf("expecting an output, got error %v", err)
+	}
+	if !o.Last {
+		t.Fatalf("expecting the TIFF to be the last output")
+	}
+	n, err := tiffPageCount(o.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expecting 3 pages, got %v", n)
+	}
+	if _, _, _, finished := cmd.ReadOutput(); !finished {
+		t.Fatalf("expecting command to be finished")
+	}
+}
+
+func TestParseCaptureCommand_Quality(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpg",
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		Rate:           1,
+		Quality:        5,
+		PixelFormat:    "yuvj420p",
+		PNGCompression: 9,
+	}
+	cmd := ParseCaptureCommand(opt)
+	if !strings.Contains(cmd, "-f image2 -qscale:v 5 -qmin 1 -pix_fmt yuvj420p /tmp/ffmpeg-test/%012d.jpg") {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// PNG compression level is only available for png
+	opt.Suffix = "png"
+	cmd = ParseCaptureCommand(opt)
+	if !strings.Contains(cmd, "-pix_fmt yuvj420p -compression_level 9 /tmp/ffmpeg-test/%012d.png") {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestParseFirstFrameCommand(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:            "/tmp/sample.mp4",
+			Suffix:         "jpg",
+			IsFile:         true,
+			LogLevel:       "warning",
+			StartTime:      3,
+			ReportProgress: true,
+		},
+		Size: "640x360",
+	}
+	cmd := ParseFirstFrameCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -ss 3 -i '/tmp/sample.mp4' -frames:v 1 -s 640x360 -f image2pipe -c:v mjpeg -qscale:v 1 -qmin 1 pipe:1" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestCommand_FirstFrame(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       TestUrlVideo,
+			MediaId:   "test",
+			LogLevel:  "error",
+			StartTime: 1,
+		},
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	byt, err := cmd.FirstFrame(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byt) < 2 || byt[0] != 0xFF || byt[1] != 0xD8 /* JPEG SOI marker */ {
+		t.Fatalf("expecting a JPEG image, got %v bytes", len(byt))
+	}
+}
+
+func TestParseSilenceCommand(t *testing.T) {
+	opt := &SilenceOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.wav",
+			IsFile:    true,
+			LogLevel:  "warning",
+			StartTime: 3,
+		},
+		Noise:       -35,
+		MinDuration: 0.8,
+	}
+	cmd := ParseSilenceCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel info -ss 3 -i '/tmp/sample.wav' -vn -af silencedetect=noise=-35dB:d=0.8 -f null -" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestCommand_DetectSilence(t *testing.T) {
+	opt := &SilenceOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.wav",
+			IsFile:    true,
+			StartTime: 10,
+			// Simulates FFmpeg printing silencedetect results
+			DockerCommand: `for l in 'silence_start: 0' 'silence_end: 1.5 | silence_duration: 1.5' 'silence_start: 4.25'; do echo "[silencedetect @ 0x55d0c0] $l" >&2; done #`,
+		},
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	intervals, err := cmd.DetectSilence(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SilenceInterval{{Start: 10, End: 11.5}, {Start: 14.25, End: -1}}
+	assert.Equal(t, expected, intervals)
+	if opt.Noise != -30 || opt.MinDuration != 0.5 {
+		t.Fatalf("expecting default noise -30 and minimum duration 0.5, got %v, %v", opt.Noise, opt.MinDuration)
+	}
+}
+
+func TestCommand_TempDir(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-tempdir"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	record := dir + "-record"
+	defer os.Remove(record)
+	opt := &GIFOptions{
+		CommonOptions: CommonOptions{
+			Uri:     "/tmp/sample.mp4",
+			IsFile:  true,
+			TempDir: dir,
+			// Simulates FFmpeg writing the animation into the temporary output directory, records the directory
+			DockerCommand: fmt.Sprintf(`d=$(ls -d %s/ffmpeg-*); echo $d > %s; printf gif > $d/000000000000.gif #`, dir, record),
+		},
+	}
+	c := NewCommand()
+	defer c.Close()
+	if err := c.GIF(opt); err != nil {
+		t.Fatal(err)
+	}
+	byt, _ := os.ReadFile(record)
+	if used := strings.TrimSpace(string(byt)); used == "" || used != opt.OutputDir || !strings.HasPrefix(used, dir+"/") {
+		t.Fatalf("expecting temporary output directory under %v, got %q (OutputDir: %v)", dir, used, opt.OutputDir)
+	}
+	o, err, ok, _ := c.ReadOutput()
+	if err != nil || !ok || string(o.Content) != "gif" {
+		t.Fatalf("expecting the animation, got %+v, error: %v", o, err)
+	}
+	if _, err = os.Stat(opt.OutputDir); !os.IsNotExist(err) {
+		t.Fatalf("expecting temporary output directory to be removed, got %v", err)
+	}
+}
+
+func TestParseGIFCommand(t *testing.T) {
+	opt := &GIFOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: "/tmp/ffmpeg-test",
+			IsFile:    true,
+			LogLevel:  "warning",
+			Suffix:    "gif",
+			StartTime: 5,
+			Duration:  2.5,
+		},
+		FPS:   12,
+		Width: 480,
+	}
+	cmd := ParseGIFCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -ss 5 -t 2.5 -i '/tmp/sample.mp4' -vf 'fps=12,scale=480:-1:flags=lanczos,split[s0][s1];[s0]palettegen[p];[s1][p]paletteuse' -an -loop 0 /tmp/ffmpeg-test/000000000000.gif -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	opt.Suffix = "webp"
+	opt.Loop = 3
+	cmd = ParseGIFCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel warning -ss 5 -t 2.5 -i '/tmp/sample.mp4' -vf 'fps=12,scale=480:-1:flags=lanczos' -an -loop 3 /tmp/ffmpeg-test/000000000000.webp -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestCommand_GIF(t *testing.T) {
+	opt := &GIFOptions{
+		CommonOptions: CommonOptions{
+			Uri:       TestUrlVideo,
+			OutputDir: "/tmp/ffmpeg-test-gif",
+			MediaId:   "test",
+			LogLevel:  "error",
+			StartTime: 1,
+			Duration:  2,
+		},
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.GIF(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err, ok, _ := cmd.ReadOutput()
+	if err != nil || !ok {
+		t.Fatalf("expecting an output, got error %v", err)
+	}
+	if o.Type != OutputTypeAnimation || !o.Last || !strings.HasPrefix(string(o.Content), "GIF89a") {
+		t.Fatalf("unexpected animation output: type %v, last %v", o.Type, o.Last)
+	}
+}
+
+func TestCommand_Sprite(t *testing.T) {
+	opt := &SpriteOptions{
+		CommonOptions: CommonOptions{
+			Uri:       TestUrlVideo,
+			OutputDir: "/tmp/ffmpeg-test-sprite",
+			Suffix:    "jpg",
+			MediaId:   "test",
+			LogLevel:  "error",
+		},
+		Columns: 5,
+		Rows:    5,
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Sprite(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	var outputs []*Output
+	for res := range cmd.Outputs() {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		outputs = append(outputs, res.Output)
+	}
+	if len(outputs) != 1 {
+		t.Fatalf("expecting exactly 1 output, got %v", len(outputs))
+	}
+	if o := outputs[0]; o.Tag != OutputTagSprite || !o.Last || len(o.Content) == 0 {
+		t.Fatalf("unexpected sprite output: tag %v, last %v, bytes %v", o.Tag, o.Last, len(o.Content))
+	}
+}
+
+func TestCommand_SpriteFinishedOnExit(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-sprite-exit"
+	opt := &SpriteOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: dir,
+			IsFile:    true,
+			// Simulates FFmpeg writing the sprite sheet then exiting
+			DockerCommand: fmt.Sprintf("printf sprite > %s/000000000000.jpg #", dir),
+		},
+		Interval: 10,
+	}
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Sprite(opt); err != nil {
+		t.Fatal(err)
+	}
+	if !cmd.IsFinished() {
+		t.Fatalf("expecting command to be finished once Sprite returns")
+	}
+	o, err, ok, _ := cmd.ReadOutput()
+	if err != nil || !ok || o.Tag != OutputTagSprite || !o.Last || string(o.Content) != "sprite" {
+		t.Fatalf("unexpected sprite output: %+v, ok %v, error %v", o, ok, err)
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expecting output directory to be removed, got %v", err)
+	}
+
+	// Probing error is marked as command error
+	opt.Interval = 0
+	opt.DockerCommand = "exit 1 #"
+	cmd = NewCommand()
+	defer cmd.Close()
+	if err = cmd.Sprite(opt); err == nil {
+		t.Fatalf("expecting error probing media duration")
+	}
+	if cmd.Error() == nil {
+		t.Fatalf("expecting probing error to be marked")
+	}
+}
+
+func TestParseProbeCommand_ProbeSize(t *testing.T) {
+	opt := &ProbeOptions{
+		Uri:             "rtmp://sample.com/stream",
+		IsStream:        true,
+		LogLevel:        "error",
+		ProbeSize:       "10000000",
+		AnalyzeDuration: "10000000",
+	}
+	cmd := ParseProbeCommand(opt)
+	if cmd != "ffprobe -hide_banner -loglevel error -rw_timeout 2000000 -probesize 10000000 -analyzeduration 10000000 -i 'rtmp://sample.com/stream' -show_streams -show_format -of json" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	copt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:             "rtmp://sample.com/stream",
+			OutputDir:       "/tmp/ffmpeg-test",
+			Suffix:          "jpeg",
+			IsStream:        true,
+			ProbeSize:       "10000000",
+			AnalyzeDuration: "10000000",
+		},
+		Rate: 1,
+	}
+	cmd = ParseCaptureCommand(copt)
+	i := strings.Index(cmd, " -i ")
+	if p := strings.Index(cmd, "-probesize 10000000"); p < 0 || p > i {
+		t.Fatalf("expecting -probesize before -i: %v", cmd)
+	}
+	if p := strings.Index(cmd, "-analyzeduration 10000000"); p < 0 || p > i {
+		t.Fatalf("expecting -analyzeduration before -i: %v", cmd)
+	}
+}
+
+func TestParseCaptureCommand_DedupFrames(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "rtmp://sample.com/stream",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpeg",
+			IsStream:  true,
+			LogLevel:  "warning",
+		},
+		Rate:        0.5,
+		DedupFrames: true,
+	}
+	cmd := ParseCaptureCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel info -rw_timeout 2000000 -i 'rtmp://sample.com/stream' -vsync vfr -vf 'mpdecimate,select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,2),showinfo' -r 0.5 -f image2 -qscale:v 1 -qmin 1 /tmp/ffmpeg-test/%012d.jpeg -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	c := NewCommand()
+	c.handleStderrLine("[Parsed_showinfo_2 @ 0x55d5c8a3c0c0] n:   3 pts: 768000 pts_time:7.5     duration:512")
+	o := &Output{Index: 4, Second: 6}
+	c.useFramePts(o)
+	if o.Second != 7.5 {
+		t.Fatalf("expecting second to be 7.5, got %v", o.Second)
+	}
+}
+
+func TestStream_GetBitRate(t *testing.T) {
+	st := new(StreamInfo)
+	err := json.Unmarshal([]byte(`{"streams":[{"codec_type":"video","bit_rate":"2500000"},{"codec_type":"audio","bit_rate":"N/A"}],"format":{"bit_rate":"2628000"}}`), st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br, err := st.Streams[0].GetBitRate(); err != nil || br != 2500000 {
+		t.Fatalf("expecting video bit rate 2500000, got %v, %v", br, err)
+	}
+	if _, err := st.Streams[1].GetBitRate(); err == nil {
+		t.Fatalf("expecting error on unavailable bit rate")
+	}
+	if br, err := st.Format.GetBitRate(); err != nil || br != 2628000 {
+		t.Fatalf("expecting format bit rate 2628000, got %v, %v", br, err)
+	}
+	if _, err := (&Format{BitRate: "2.5M"}).GetBitRate(); err == nil {
+		t.Fatalf("expecting error on invalid bit rate")
+	}
+}
+
+func TestStream_IsVFR(t *testing.T) {
+	cases := []struct {
+		avg, r string
+		vfr    bool
+	}{
+		{"30000/1001", "30000/1001", false},
+		{"2997/100", "30000/1001", false}, // Average frame rate of a CFR source is slightly off
+		{"1793/75", "60/1", true},         // Screen recording
+		{"0/0", "30/1", false},            // Unknown average frame rate
+	}
+	for _, v := range cases {
+		s := Stream{AvgFrameRate: v.avg, RFrameRate: v.r}
+		if s.IsVFR() != v.vfr {
+			t.Fatalf("expecting IsVFR to be %v for avg_frame_rate %v, r_frame_rate %v", v.vfr, v.avg, v.r)
+		}
+	}
+
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpeg",
+			IsFile:    true,
+			LogLevel:  "warning",
+		},
+		Rate: 0.5,
+	}
+	opt.FramePts = true
+	cmd := ParseCaptureCommand(opt)
+	if cmd != "ffmpeg -hide_banner -loglevel info -i '/tmp/sample.mp4' -vsync vfr -vf 'select=isnan(prev_selected_t)+gte(t-prev_selected_t\\,2),showinfo' -r 0.5 -f image2 -qscale:v 1 -qmin 1 /tmp/ffmpeg-test/%012d.jpeg -y" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Second of VFR source is populated from frame PTS instead of index
+	c := NewCommand()
+	c.opt = &opt.CommonOptions
+	c.handleStderrLine("[Parsed_showinfo_1 @ 0x55d5c8a3c0c0] n:   1 pts: 269312 pts_time:2.104   duration:512")
+	o := &Output{Index: 2, Second: utils.GetImageSecond(2, opt.Rate)}
+	c.useFramePts(o)
+	if o.Second != 2.104 {
+		t.Fatalf("expecting second to be 2.104, got %v", o.Second)
+	}
+}
+
 func TestCommand_SliceAndCapture(t *testing.T) {
 
 	opt0 := CommonOptions{
@@ -309,6 +1762,93 @@ func TestCommand_SliceAndCaptureIsSametimeOutput_Stream(t *testing.T) {
 	}
 }
 
+func TestCommand_SliceAndCapture_OnBranchErrorContinue(t *testing.T) {
+	opt := &SliceAndCaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:      TestUrlSpeechAndVideo,
+			LogLevel: "warning",
+		},
+		CaptureOptions: &CaptureOptions{
+			CommonOptions: CommonOptions{
+				Suffix:    "jpeg",
+				OutputDir: "/tmp/ffmpeg-test/video",
+			},
+			Rate: 0.5,
+			Size: "1024x576",
+		},
+		SliceOptions: &SliceOptions{
+			CommonOptions: CommonOptions{
+				Suffix:    "wav",
+				OutputDir: "/tmp/ffmpeg-test/speech",
+			},
+			DisableVideo:      true,
+			Coding:            "pcm_s16le",
+			SamplingFrequency: 16000,
+			Channels:          1,
+			Format:            "segment",
+			FragmentDuration:  10,
+		},
+		HasSpeechStream: true,
+		HasImageStream:  true,
+		OnBranchError:   OnBranchErrorContinue,
+	}
+
+	cmd := NewCommand()
+	defer cmd.Close()
+
+	err := cmd.SliceAndCapture(opt)
+	if err != nil {
+		t.Fatalf("should be able to slice and capture, got error: %v", err)
+	}
+	// Break the slice branch with a file that can not be parsed into index
+	if err = os.WriteFile("/tmp/ffmpeg-test/speech/invalid.wav", []byte("invalid"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	images := 0
+	for {
+		o, err, ok, finished := cmd.ReadOutput()
+		if err != nil {
+			t.Fatalf("expecting no command error, got %v", err)
+		}
+		if finished {
+			break
+		}
+		if ok && o.Type == OutputTypeImage {
+			images++
+		}
+	}
+	if cmd.SliceError() == nil {
+		t.Fatalf("expecting slice branch error")
+	}
+	if cmd.CaptureError() != nil {
+		t.Fatalf("expecting no capture branch error, got %v", cmd.CaptureError())
+	}
+	assert.Equal(t, 25, images)
+}
+
+// Run with -race, branch errors are recorded by the watcher goroutine while read by callers
+func TestCommand_BranchErrorConcurrentAccess(t *testing.T) {
+	c := NewCommand()
+	c.opt = &CommonOptions{}
+	c.opt.SliceAndCapture, c.opt.HasVideo, c.opt.HasSpeech = true, true, true
+	c.opt.CaptureOutputDir, c.opt.SliceOutputDir = "/tmp/ffmpeg-test/video", "/tmp/ffmpeg-test/speech"
+	c.opt.OnBranchError = OnBranchErrorContinue
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.markBranchError(c.opt.CaptureOutputDir, fmt.Errorf("capture error"))
+	}()
+	for c.CaptureError() == nil {
+		_ = c.captureAlive()
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	if c.captureAlive() || !c.sliceAlive() || c.SliceError() != nil {
+		t.Fatalf("expecting only capture branch to fail")
+	}
+}
+
 func TestCommand_SliceAndCapture_OnlyVideo(t *testing.T) {
 
 	opt0 := CommonOptions{
@@ -490,86 +2030,373 @@ func TestCommand_ProbeStreams(t *testing.T) {
 	log.Info().Float64("duration", dur).Msg("duration from format")
 }
 
-func TestCommand_ProbeStreams_RetryOnNoStream(t *testing.T) {
-	zerolog.SetGlobalLevel(zerolog.TraceLevel)
-	opt := &ProbeOptions{
-		Uri:                TestUrlInvalidData,
-		IsStream:           true,
-		IsFile:             false,
-		LogLevel:           "error",
-		RetryStreamOnError: true,
-		RetryInterval:      time.Second * 5,
-		MaxRetry:           2,
+func TestCommand_ProbeStreams_RetryOnNoStream(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	opt := &ProbeOptions{
+		Uri:                TestUrlInvalidData,
+		IsStream:           true,
+		IsFile:             false,
+		LogLevel:           "error",
+		RetryStreamOnError: true,
+		RetryInterval:      time.Second * 5,
+		MaxRetry:           2,
+	}
+
+	cmd := NewCommand()
+	defer cmd.Close()
+
+	start := time.Now()
+	_, err := cmd.ProbeStreams(opt)
+	if err == nil {
+		t.Fatalf("expecting non-nil error, got nil")
+	}
+	if time.Now().Sub(start).Seconds() < 10 {
+		t.Fatalf("should be retried")
+	}
+}
+
+func TestCommand_ProbeStreams_RetryFile(t *testing.T) {
+	fn := "/tmp/ffmpeg-test-probe-file-attempts"
+	_ = os.Remove(fn)
+	defer os.Remove(fn)
+	opt := &ProbeOptions{
+		Uri:           "https://example.com/sample.mp4",
+		LogLevel:      "error",
+		RetryInterval: time.Millisecond * 10,
+		MaxRetry:      3,
+		// Simulates a transient DNS failure on the first attempt
+		DockerCommand: fmt.Sprintf(`echo x >> %s; if [ $(wc -l < %s) -lt 2 ]; then `+
+			`echo 'Failed to resolve hostname example.com: Temporary failure in name resolution' >&2; exit 1; fi; `+
+			`echo '{"format":{"duration":"12.5"}}' #`, fn, fn),
+	}
+	st, err := NewCommand().ProbeStreams(opt)
+	if err != nil {
+		t.Fatalf("expecting probing to succeed after retrying, got %v", err)
+	}
+	if st.Format.Duration != "12.5" {
+		t.Fatalf("unexpected format: %+v", st.Format)
+	}
+
+	// Definitive errors are not retried
+	_ = os.Remove(fn)
+	opt.DockerCommand = fmt.Sprintf("echo x >> %s; echo 'Server returned 404 Not Found' >&2; exit 1 #", fn)
+	if _, err = NewCommand().ProbeStreams(opt); err != ErrUrlNotFound {
+		t.Fatalf("expecting ErrUrlNotFound, got %v", err)
+	}
+	byt, _ := os.ReadFile(fn)
+	if n := strings.Count(string(byt), "x"); n != 1 {
+		t.Fatalf("expecting exactly 1 attempt on definitive error, got %v", n)
+	}
+}
+
+func TestCommand_ProbeStreams_Deadline(t *testing.T) {
+	fn := "/tmp/ffmpeg-test-probe-attempts"
+	_ = os.Remove(fn)
+	defer os.Remove(fn)
+	opt := &ProbeOptions{
+		Uri:                TestUrlStream,
+		IsStream:           true,
+		LogLevel:           "error",
+		RetryStreamOnError: true,
+		RetryInterval:      time.Millisecond * 200,
+		MaxRetry:           10,
+		Deadline:           time.Millisecond * 500,
+		// Simulates a failing FFprobe process, records every attempt
+		DockerCommand: fmt.Sprintf("echo x >> %s; exit 1 #", fn),
+	}
+
+	start := time.Now()
+	_, err := NewCommand().ProbeStreams(opt)
+	if err == nil {
+		t.Fatalf("expecting non-nil error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expecting probing to stop within deadline, took %v", elapsed)
+	}
+	byt, _ := os.ReadFile(fn)
+	if n := strings.Count(string(byt), "x"); n == 0 || n > 4 {
+		t.Fatalf("expecting retrying to stop before all retries are exhausted, got %v attempts", n)
+	}
+}
+
+func TestCommand_Capture(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:            TestUrlVideo,
+			OutputDir:      "/tmp/ffmpeg-test",
+			Suffix:         "jpg",
+			MediaId:        "test",
+			IsStream:       false,
+			IsFile:         false,
+			PreserveOutput: false,
+			Proxy:          "",
+			LogLevel:       "error",
+			DockerCommand:  "",
+		},
+		Rate:      1,
+		MaxFrames: 0,
+		Size:      "360x640",
+		Mode:      CaptureModeByInterval,
+		Frame:     1,
+		Debug:     false,
+	}
+
+	c := ParseCaptureCommand(opt)
+	if !strings.Contains(c, "reconnect") {
+		t.Fatalf("expecting reconnect in cmd string")
+	}
+
+	cmd := NewCommand()
+	defer cmd.Close()
+
+	var cnt int64 = 0
+	if err := cmd.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		o, err, ok, finished := cmd.ReadOutput()
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		if finished {
+			fmt.Println("closed")
+			fmt.Printf("stats: captured: %v, bytes: %v\n", cmd.stats.Output, cmd.stats.Bytes)
+			if cmd.Stats().Output != 11 {
+				t.Fatalf("expecting output to be 11, got %v", cmd.Stats().Output)
+			}
+			break
+		}
+		if ok {
+			cnt += 1
+			fmt.Printf("[%v]: bytes: %v\n", o.Index, len(o.Content))
+		}
+	}
+}
+
+func TestCommand_Outputs(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       TestUrlVideo,
+			OutputDir: "/tmp/ffmpeg-test-outputs",
+			Suffix:    "jpg",
+			MediaId:   "test",
+			LogLevel:  "error",
+		},
+		Rate: 1,
+		Size: "360x640",
+		Mode: CaptureModeByInterval,
+	}
+
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	cnt := 0
+	for res := range cmd.Outputs() {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		cnt += 1
+		fmt.Printf("[%v]: bytes: %v\n", res.Output.Index, len(res.Output.Content))
+	}
+	if cnt != 11 {
+		t.Fatalf("expecting output to be 11, got %v", cnt)
+	}
+
+	// Closing the command also closes the channel
+	cmd2 := NewCommand()
+	if err := cmd2.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	outputs := cmd2.Outputs()
+	<-outputs
+	_ = cmd2.Close()
+	done := make(chan struct{})
+	go func() {
+		for range outputs {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expecting output channel to be closed")
+	}
+}
+
+func TestCommand_CaptureContext(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       TestUrlStream,
+			OutputDir: "/tmp/ffmpeg-test-ctx",
+			Suffix:    "jpg",
+			MediaId:   "test",
+			IsStream:  true,
+			LogLevel:  "error",
+		},
+		Rate: 1,
+		Mode: CaptureModeByInterval,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.CaptureContext(ctx, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for {
+		_, err, _, finished := cmd.ReadOutput()
+		if err != nil {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expecting context.DeadlineExceeded, got %v", err)
+			}
+			break
+		}
+		if finished {
+			t.Fatalf("expecting ffmpeg process to be terminated by context")
+		}
+		if time.Since(start) > time.Second*10 {
+			t.Fatalf("expecting ffmpeg process to be terminated in time")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, err := os.Stat(opt.OutputDir); err != nil {
+		t.Fatalf("expecting output directory to be preserved after context done, got %v", err)
+	}
+}
+
+func TestExpectedCaptureCount(t *testing.T) {
+	opt := &CaptureOptions{Rate: 0.5}
+	if n := ExpectedCaptureCount(9.5, opt); n != 5 {
+		t.Fatalf("expecting 5 images, got %v", n)
+	}
+	opt.MaxFrames = 3
+	if n := ExpectedCaptureCount(9.5, opt); n != 3 {
+		t.Fatalf("expecting 3 images capped by MaxFrames, got %v", n)
+	}
+	opt.IsStream = true
+	if n := ExpectedCaptureCount(9.5, opt); n != -1 {
+		t.Fatalf("expecting -1 for streams, got %v", n)
+	}
+
+	st := &StreamInfo{Streams: []Stream{{CodecType: "video", Duration: "10.0", Frames: "250"}}}
+	opt = &CaptureOptions{Mode: CaptureModeByFrame, Frame: 100}
+	if n := ExpectedCaptureCount(10, opt); n != -1 {
+		t.Fatalf("expecting -1 without frame count, got %v", n)
+	}
+	if n := ExpectedCaptureCountOf(st, opt); n != 3 {
+		t.Fatalf("expecting 3 images by frame count, got %v", n)
+	}
+	opt = &CaptureOptions{Rate: 2}
+	if n := ExpectedCaptureCountOf(st, opt); n != 20 {
+		t.Fatalf("expecting 20 images by duration, got %v", n)
+	}
+	if n := ExpectedCaptureCountOf(&StreamInfo{Streams: []Stream{{CodecType: "audio"}}}, opt); n != -1 {
+		t.Fatalf("expecting -1 for media without video stream, got %v", n)
+	}
+
+	// Media is restricted by StartTime & Duration
+	opt.StartTime, opt.Duration = 2, 5
+	if n := ExpectedCaptureCountOf(st, opt); n != 10 {
+		t.Fatalf("expecting 10 images within range, got %v", n)
+	}
+	opt = &CaptureOptions{CommonOptions: CommonOptions{StartTime: 5}, Mode: CaptureModeByFrame, Frame: 100}
+	if n := ExpectedCaptureCountOf(st, opt); n != 2 {
+		t.Fatalf("expecting 2 images by frame count within range, got %v", n)
+	}
+}
+
+func TestCommand_ExpectedOutputCount(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       TestUrlVideo,
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpg",
+			MediaId:   "test",
+			LogLevel:  "error",
+		},
+		Rate: 1,
+		Size: "360x640",
+		Mode: CaptureModeByInterval,
 	}
 
 	cmd := NewCommand()
 	defer cmd.Close()
+	if err := cmd.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	expected, ok := cmd.ExpectedOutputCount()
+	if !ok {
+		t.Fatalf("expecting a predicted output count")
+	}
 
-	start := time.Now()
-	_, err := cmd.ProbeStreams(opt)
-	if err == nil {
-		t.Fatalf("expecting non-nil error, got nil")
+	for {
+		_, err, _, finished := cmd.ReadOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished {
+			break
+		}
 	}
-	if time.Now().Sub(start).Seconds() < 10 {
-		t.Fatalf("should be retried")
+	if cmd.Stats().Output != expected {
+		t.Fatalf("expecting output to be %v, got %v", expected, cmd.Stats().Output)
 	}
 }
 
-func TestCommand_Capture(t *testing.T) {
-	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+func TestCommand_Capture_DedupFrames(t *testing.T) {
+	// Prepare a 10s clip of repeated frames
+	fn := "/tmp/ffmpeg-static.mp4"
+	if err := exec.Command("ffmpeg", "-f", "lavfi", "-i", "color=c=red:s=320x240:d=10", fn, "-y").Run(); err != nil {
+		t.Fatalf("error preparing static clip: %v", err)
+	}
+	defer os.Remove(fn)
+
 	opt := &CaptureOptions{
 		CommonOptions: CommonOptions{
-			Uri:            TestUrlVideo,
-			OutputDir:      "/tmp/ffmpeg-test",
-			Suffix:         "jpg",
-			MediaId:        "test",
-			IsStream:       false,
-			IsFile:         false,
-			PreserveOutput: false,
-			Proxy:          "",
-			LogLevel:       "error",
-			DockerCommand:  "",
+			Uri:       fn,
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpg",
+			MediaId:   "test",
+			IsFile:    true,
+			LogLevel:  "error",
 		},
-		Rate:      1,
-		MaxFrames: 0,
-		Size:      "360x640",
-		Mode:      CaptureModeByInterval,
-		Frame:     1,
-		Debug:     false,
-	}
-
-	c := ParseCaptureCommand(opt)
-	if !strings.Contains(c, "reconnect") {
-		t.Fatalf("expecting reconnect in cmd string")
+		Rate:        1,
+		DedupFrames: true,
 	}
 
 	cmd := NewCommand()
 	defer cmd.Close()
-
-	var cnt int64 = 0
 	if err := cmd.Capture(opt); err != nil {
 		t.Fatal(err)
 	}
 
+	prev := -1.0
 	for {
 		o, err, ok, finished := cmd.ReadOutput()
 		if err != nil {
-			t.Error(err)
-			break
+			t.Fatal(err)
 		}
 		if finished {
-			fmt.Println("closed")
-			fmt.Printf("stats: captured: %v, bytes: %v\n", cmd.stats.Output, cmd.stats.Bytes)
-			if cmd.Stats().Output != 11 {
-				t.Fatalf("expecting output to be 11, got %v", cmd.Stats().Output)
-			}
 			break
 		}
 		if ok {
-			cnt += 1
-			fmt.Printf("[%v]: bytes: %v\n", o.Index, len(o.Content))
+			if o.Second <= prev {
+				t.Fatalf("expecting increasing second, got %v after %v", o.Second, prev)
+			}
+			prev = o.Second
 		}
 	}
+	if cmd.Stats().Output >= 10 {
+		t.Fatalf("expecting repeated frames to be dropped, got %v outputs", cmd.Stats().Output)
+	}
 }
 
 func TestCommand_Capture_ByFrame(t *testing.T) {
@@ -726,6 +2553,80 @@ func TestCommand_Slice(t *testing.T) {
 	}
 }
 
+func TestCommand_SliceWithSEI_Missing(t *testing.T) {
+	timeout := seiWaitTimeout
+	seiWaitTimeout = time.Millisecond * 200
+	defer func() { seiWaitTimeout = timeout }()
+
+	dir, seiDir := "/tmp/ffmpeg-test-sei-missing", "/tmp/ffmpeg-test-sei-missing-sei"
+	opt := NewDefaultSliceOptions()
+	opt.OutputDir, opt.SEIOutputDir, opt.SEIFragmentSuffix = dir, seiDir, "flv"
+	opt.DecodeSEI, opt.IsFile, opt.WatchInterval = true, true, time.Millisecond*5
+	// Simulates FFmpeg slicing 3 fragments, while only the SEI fragment of the first one is written
+	opt.DockerCommand = fmt.Sprintf(`printf '{"a":1}' > %s/000000000000.flv; for i in 0 1 2; do printf x > %s/00000000000$i.wav; sleep 0.05; done; sleep 1 #`, seiDir, dir)
+
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Slice(opt); err != nil {
+		t.Fatal(err)
+	}
+	outputs := make(map[int64]*Output)
+	for {
+		o, err, ok, finished := cmd.ReadOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished {
+			break
+		}
+		if !ok {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		outputs[o.Index] = o
+	}
+	if len(outputs) != 3 {
+		t.Fatalf("expecting 3 outputs, got %v", len(outputs))
+	}
+	if len(outputs[0].SEIInfo) != 1 || len(outputs[1].SEIInfo) != 0 {
+		t.Fatalf("unexpected SEI info: %v, %v", outputs[0].SEIInfo, outputs[1].SEIInfo)
+	}
+}
+
+func TestCommand_SEIPattern(t *testing.T) {
+	c := NewCommand()
+	if n := len(mustDecodeSEI(t, c, `{"a":1}<x>42</x>`)); n != 1 {
+		t.Fatalf("expecting JSON SEI info to be matched by default, got %v", n)
+	}
+
+	// JSON ending with a boolean is not matched by SEIRegex
+	if n := len(mustDecodeSEI(t, c, `<x>{"live":true}</x>`)); n != 0 {
+		t.Fatalf("expecting SEI info not to be matched by default, got %v", n)
+	}
+	c.sei = regexp.MustCompile(`{"[^{}]+}`)
+	if info := mustDecodeSEI(t, c, `<x>{"live":true}</x>`); len(info) != 1 || info[0] != `{"live":true}` {
+		t.Fatalf("expecting SEI info to be matched by custom pattern, got %v", info)
+	}
+
+	opt := NewDefaultSliceOptions()
+	opt.OutputDir, opt.SEIOutputDir, opt.SEIFragmentSuffix = "/tmp/ffmpeg-test-sei-pattern", "/tmp/ffmpeg-test-sei-pattern-sei", "flv"
+	opt.DecodeSEI, opt.IsFile, opt.DockerCommand = true, true, "true #"
+	opt.SEIPattern = `{"a":(`
+	c = NewCommand()
+	defer c.Close()
+	if err := c.Slice(opt); err == nil || !strings.Contains(err.Error(), "invalid SEI pattern") {
+		t.Fatalf("expecting invalid SEI pattern error, got %v", err)
+	}
+}
+
+func mustDecodeSEI(t *testing.T, c *Command, content string) []string {
+	info, err := c.decodeSEIInfo([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
 func TestCommand_SliceWithSEI(t *testing.T) {
 	opt := &SliceOptions{
 		CommonOptions: CommonOptions{
@@ -1045,3 +2946,447 @@ func maxConsecutiveOccurrences(arr []string) int {
 	}
 	return maxCount
 }
+
+func TestSetMaxConcurrent(t *testing.T) {
+	SetMaxConcurrent(1)
+	defer SetMaxConcurrent(runtime.GOMAXPROCS(0))
+
+	capture := func(i int) (*Command, time.Duration, error) {
+		opt := &CaptureOptions{
+			CommonOptions: CommonOptions{
+				Uri:           "/tmp/sample.mp4",
+				MediaId:       "concurrent",
+				OutputDir:     fmt.Sprintf("/tmp/ffmpeg-test-concurrent-%v", i),
+				IsFile:        true,
+				DockerCommand: "sleep 0.5 #",
+			},
+			Rate: 1,
+		}
+		c := NewCommand()
+		start := time.Now()
+		err := c.Capture(opt)
+		return c, time.Since(start), err
+	}
+	c1, _, err := capture(1)
+	defer c1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, elapsed, err := capture(2)
+	defer c2.Close()
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(time.Millisecond*300), "expecting the second process to wait for the first one")
+
+	SetMaxConcurrent(0)
+	c3, elapsed, err := capture(3)
+	defer c3.Close()
+	assert.Nil(t, err)
+	assert.Less(t, int64(elapsed), int64(time.Millisecond*300), "expecting no limit")
+}
+
+func TestCommand_ProducedNoOutput(t *testing.T) {
+	capture := func(errorOnNoOutput bool, script string) (*Command, error) {
+		dir := "/tmp/ffmpeg-test-no-output"
+		opt := &CaptureOptions{
+			CommonOptions: CommonOptions{
+				Uri:             "/tmp/empty.mp4",
+				MediaId:         "no-output",
+				OutputDir:       dir,
+				Suffix:          "jpg",
+				IsFile:          true,
+				ErrorOnNoOutput: errorOnNoOutput,
+				DockerCommand:   fmt.Sprintf(script, dir),
+			},
+			Rate: 1,
+		}
+		c := NewCommand()
+		if err := c.Capture(opt); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		for res := range c.Outputs() {
+			err = res.Err
+		}
+		return c, err
+	}
+	// Simulates FFmpeg capturing a zero-frame input, which exits with 0
+	empty := `echo 'Output file is empty, nothing was encoded' >&2; true %s #`
+
+	c, err := capture(false, empty)
+	defer c.Close()
+	if err != nil || !c.IsFinished() || !c.ProducedNoOutput() {
+		t.Fatalf("expecting to finish without output, got error: %v, finished: %v", err, c.IsFinished())
+	}
+
+	c, err = capture(true, empty)
+	defer c.Close()
+	if err != ErrNoOutputProduced || !c.ProducedNoOutput() {
+		t.Fatalf("expecting ErrNoOutputProduced, got %v", err)
+	}
+
+	c, err = capture(true, `printf x > %s/000000000001.jpg #`)
+	defer c.Close()
+	if err != nil || c.ProducedNoOutput() {
+		t.Fatalf("expecting an output, got error: %v", err)
+	}
+}
+
+func TestCommand_Stderr(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:         "/tmp/sample.mp4",
+			MediaId:     "stderr",
+			OutputDir:   "/tmp/ffmpeg-test-stderr",
+			IsFile:      true,
+			StderrLimit: 1024,
+			// Simulates FFmpeg writing a long log into stderr before failing with an unknown error
+			DockerCommand: "yes 0123456789 | head -c 110000 >&2; echo weird failure >&2; exit 1 #",
+		},
+		Rate: 1,
+	}
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for res := range c.Outputs() {
+		err = res.Err
+	}
+	if err == nil || !strings.HasSuffix(err.Error(), "weird failure\n") {
+		t.Fatalf("expecting the tail of stderr in error, got %v", err)
+	}
+	if len(err.Error()) > 1100 {
+		t.Fatalf("expecting stderr in error to be bounded, got %v bytes", len(err.Error()))
+	}
+	stderr := c.Stderr()
+	if len(stderr) != 1024 || !strings.HasSuffix(stderr, "0123456789\nweird failure\n") {
+		t.Fatalf("expecting the last 1024 bytes of stderr, got %v bytes: %q", len(stderr), stderr)
+	}
+}
+
+func TestCommand_CaptureSampled(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-sampled"
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/long.mp4",
+			MediaId:   "sampled",
+			OutputDir: dir,
+			Suffix:    "jpg",
+			IsFile:    true,
+			// Simulates FFprobe printing info of a 1 hour video, and FFmpeg writing 5 single frame images
+			DockerCommand: fmt.Sprintf(`echo '{"streams":[{"codec_type":"video","duration":"3600"}]}'; mkdir -p %s; `+
+				`for i in 1 2 3 4 5; do printf '\377\330\377\331' > %s/00000000000$i.jpg; done #`, dir, dir),
+		},
+		Mode:        CaptureModeSampled,
+		SampleCount: 5,
+	}
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	cmd := c.cmd.String()
+	assert.Equal(t, 5, strings.Count(cmd, "-frames:v 1"), cmd)
+	for i, pos := range []string{"360", "1080", "1800", "2520", "3240"} {
+		assert.Contains(t, cmd, fmt.Sprintf("-ss %s -i '/tmp/long.mp4'", pos))
+		assert.Contains(t, cmd, fmt.Sprintf("-map %d:v:0", i))
+	}
+
+	seconds := make([]float64, 0)
+	for res := range c.Outputs() {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		seconds = append(seconds, res.Output.Second)
+	}
+	assert.Equal(t, []float64{360, 1080, 1800, 2520, 3240}, seconds)
+	assert.Equal(t, 5, ExpectedCaptureCount(3600, opt))
+
+	opt = &CaptureOptions{CommonOptions: CommonOptions{Uri: "rtmp://localhost/live", IsStream: true}, Mode: CaptureModeSampled, SampleCount: 5}
+	c = NewCommand()
+	defer c.Close()
+	assert.Error(t, c.Capture(opt), "expecting sampled capture to be rejected for streams")
+}
+
+func TestCommand_FilenameParser(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-filename-parser"
+	// Timestamped names (in milliseconds) produced by another tool
+	re := regexp.MustCompile(`^cam-(\d+)\.jpg$`)
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: dir,
+			Suffix:    "jpg",
+			IsFile:    true,
+			DockerCommand: fmt.Sprintf(`for ts in 1700000000000 1700000001250 1700000002500; do echo $ts > %s/cam-$ts.jpg; sleep 0.05; done; `+
+				`echo note > %s/notes.txt #`, dir, dir),
+			FilenameParser: func(name string) (int64, float64, bool) {
+				m := re.FindStringSubmatch(name)
+				if m == nil {
+					return 0, 0, false
+				}
+				ms, err := strconv.ParseInt(m[1], 10, 64)
+				return ms, float64(ms-1700000000000) / 1000, err == nil
+			},
+		},
+		Rate: 1,
+	}
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	outputs := make([]*Output, 0)
+	for res := range c.Outputs() {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		outputs = append(outputs, res.Output)
+	}
+	seconds := make([]float64, 0)
+	for _, o := range outputs {
+		assert.Equal(t, fmt.Sprintf("%d\n", o.Index), string(o.Content))
+		seconds = append(seconds, o.Second)
+	}
+	// Outputs are ordered by index, which is not required to be contiguous
+	assert.Equal(t, []float64{0, 1.25, 2.5}, seconds)
+	assert.True(t, outputs[len(outputs)-1].Last)
+}
+
+func TestCommand_SEIChannel(t *testing.T) {
+	dir, seiDir := "/tmp/ffmpeg-test-sei-channel", "/tmp/ffmpeg-test-sei-channel-sei"
+	opt := NewDefaultSliceOptions()
+	opt.OutputDir, opt.SEIOutputDir, opt.SEIFragmentSuffix = dir, seiDir, "flv"
+	opt.DecodeSEI, opt.IsFile, opt.WatchInterval = true, true, time.Millisecond*5
+	// Simulates FFmpeg writing SEI fragments more frequently than media fragments: 3 SEI fragments are written
+	// before the only audio segment
+	opt.DockerCommand = fmt.Sprintf(`for i in 0 1 2; do printf '{"a":'$i'}\n{"b":'$i'}' > %s/00000000000$i.flv; sleep 0.1; done; sleep 0.5; printf x > %s/000000000000.wav #`, seiDir, dir)
+
+	cmd := NewCommand()
+	defer cmd.Close()
+	seiC := cmd.SEIChannel()
+	if err := cmd.Slice(opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// SEI info of completed fragments arrives before any media output is produced
+	events := make([]SEIEvent, 0)
+	timeout := time.After(time.Millisecond * 500)
+	for len(events) < 4 {
+		select {
+		case evt := <-seiC:
+			events = append(events, evt)
+		case <-timeout:
+			t.Fatalf("expecting SEI events of fragment 0 & 1 to be delivered before media outputs, got %v", events)
+		}
+	}
+	if o, _, ok, _ := cmd.ReadOutput(); ok {
+		t.Fatalf("expecting no media output yet, got output %v", o.Index)
+	}
+	for i, evt := range events {
+		if expected := fmt.Sprintf(`{"%s":%v}`, []string{"a", "b"}[i%2], i/2); evt.Index != int64(i/2) || evt.Info != expected {
+			t.Fatalf("unexpected SEI event %v: %+v, expecting %v", i, evt, expected)
+		}
+	}
+
+	// The last SEI fragment is delivered after FFmpeg exits, then the channel is closed
+	for evt := range seiC {
+		events = append(events, evt)
+	}
+	if len(events) != 6 || events[5].Index != 2 || events[5].Info != `{"b":2}` {
+		t.Fatalf("expecting SEI events of all 3 fragments, got %v", events)
+	}
+}
+
+func TestParseCaptureCommand_SeekMode(t *testing.T) {
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "https://cdn.sample.com/sample.mp4",
+			OutputDir: "/tmp/ffmpeg-test",
+			Suffix:    "jpeg",
+			LogLevel:  "warning",
+			StartTime: 60,
+			Duration:  10,
+		},
+		Rate: 0.5,
+	}
+	for _, mode := range []int{SeekModeInput, SeekModeAuto} {
+		opt.SeekMode = mode
+		if cmd := ParseCaptureCommand(opt); !strings.Contains(cmd, "-ss 60 -t 10 -i 'https://cdn.sample.com/sample.mp4' -vf") {
+			t.Fatalf("expecting input seeking under mode %v, got %v", mode, cmd)
+		}
+	}
+
+	opt.SeekMode = SeekModeOutput
+	if cmd := ParseCaptureCommand(opt); !strings.Contains(cmd, "-i 'https://cdn.sample.com/sample.mp4' -ss 60 -t 10 -vf") {
+		t.Fatalf("expecting output seeking, got %v", cmd)
+	}
+
+	// Falls back to output seeking under SeekModeAuto
+	opt.SeekMode, opt.OutputSeek = SeekModeAuto, true
+	if cmd := ParseCaptureCommand(opt); !strings.Contains(cmd, "-i 'https://cdn.sample.com/sample.mp4' -ss 60 -t 10 -vf") {
+		t.Fatalf("expecting output seeking on fallback, got %v", cmd)
+	}
+}
+
+func TestCommand_ResolveSeekMode(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1024)
+	ranged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "sample.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ranged.Close()
+	full := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer full.Close()
+
+	for uri, expected := range map[string]bool{ranged.URL: false, full.URL: true} {
+		opt := &CommonOptions{Uri: uri, StartTime: 60, SeekMode: SeekModeAuto}
+		NewCommand().resolveSeekMode(opt)
+		if opt.OutputSeek != expected {
+			t.Fatalf("expecting output seeking to be %v for %v", expected, uri)
+		}
+	}
+
+	// Range requests are not checked unless under SeekModeAuto
+	opt := &CommonOptions{Uri: full.URL, StartTime: 60}
+	NewCommand().resolveSeekMode(opt)
+	if opt.OutputSeek {
+		t.Fatalf("expecting input seeking under SeekModeInput")
+	}
+}
+
+func TestCommand_SliceStartNumber(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-slice-start-number"
+	opt := NewDefaultSliceOptions()
+	opt.Uri, opt.OutputDir = "/tmp/sample.mp4", dir
+	opt.IsFile, opt.WatchInterval, opt.StartNumber = true, time.Millisecond*5, 5
+	if cmd := ParseSliceCommand(opt); !strings.Contains(cmd, "-segment_time 10 -segment_start_number 5 "+dir) {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+
+	// Simulates FFmpeg slicing 3 fragments numbered from 5
+	opt.DockerCommand = fmt.Sprintf(`for i in 5 6 7; do printf x > %s/00000000000$i.wav; sleep 0.05; done; sleep 0.5 #`, dir)
+	cmd := NewCommand()
+	defer cmd.Close()
+	if err := cmd.Slice(opt); err != nil {
+		t.Fatal(err)
+	}
+	outputs := make(map[int64]*Output)
+	for {
+		o, err, ok, finished := cmd.ReadOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished {
+			break
+		}
+		if !ok {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		outputs[o.Index] = o
+	}
+	if len(outputs) != 3 {
+		t.Fatalf("expecting 3 outputs, got %v", len(outputs))
+	}
+	for i, sec := range map[int64]float64{5: 0, 6: 10, 7: 20} {
+		if o := outputs[i]; o == nil || o.Second != sec {
+			t.Fatalf("unexpected output %v: %+v", i, o)
+		}
+	}
+
+	opt.StartNumber = -1
+	if err := NewCommand().Slice(opt); err == nil {
+		t.Fatalf("expecting negative StartNumber to be rejected")
+	}
+
+	// SliceAndCapture with audio only
+	opt.StartNumber, opt.WatchInterval = 5, 0
+	sc := &SliceAndCaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:           "/tmp/sample.mp4",
+			IsFile:        true,
+			StartTime:     30,
+			WatchInterval: time.Millisecond * 5,
+			DockerCommand: opt.DockerCommand,
+		},
+		SliceOptions:    opt,
+		CaptureOptions:  &CaptureOptions{CommonOptions: CommonOptions{Suffix: "jpg", OutputDir: dir + "-images"}},
+		HasSpeechStream: true,
+	}
+	c := NewCommand()
+	defer c.Close()
+	if err := c.SliceAndCapture(sc); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := c.cmd.String(); !strings.Contains(cmd, "-segment_start_number 5") {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+	outputs = collectOutputs(t, c)
+	if len(outputs) != 3 {
+		t.Fatalf("expecting 3 outputs, got %v", len(outputs))
+	}
+	for i, sec := range map[int64]float64{5: 30, 6: 40, 7: 50} {
+		if o := outputs[i]; o == nil || o.Second != sec {
+			t.Fatalf("unexpected output %v: %+v", i, o)
+		}
+	}
+}
+
+func TestCommand_Plan(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-plan"
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			OutputDir: dir,
+			Suffix:    "jpg",
+			IsFile:    true,
+			// Simulates FFprobe printing info of a 6 seconds 1280x720 video, and FFmpeg capturing it at 0.5 fps
+			DockerCommand: fmt.Sprintf(`echo '{"streams":[{"codec_type":"video","width":1280,"height":720,"avg_frame_rate":"25/1","duration":"6"}]}'; `+
+				`mkdir -p %s; for i in 1 2 3; do printf '\377\330\377\331' > %s/00000000000$i.jpg; done #`, dir, dir),
+		},
+		Rate: 0.5,
+		Size: "640x360",
+	}
+	c := NewCommand()
+	defer c.Close()
+	p, err := c.Plan(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Plan{Duration: 6, Span: 6, Rate: 0.5, Width: 640, Height: 360, Count: 3, Bytes: 3 * 640 * 360}, p)
+	if err := c.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for res := range c.Outputs() {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		n++
+	}
+	assert.Equal(t, p.Count, n, "expecting estimated count to match actual outputs")
+
+	// Partial capture under CaptureModeByFrame
+	opt.StartTime, opt.Duration, opt.Mode, opt.Frame, opt.Size = 10, 10, CaptureModeByFrame, 50, ""
+	opt.DockerCommand = `echo '{"streams":[{"codec_type":"video","width":1280,"height":720,"avg_frame_rate":"25/1","nb_frames":"750","duration":"30"}]}' #`
+	p, err = NewCommand().Plan(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Plan{Duration: 30, Span: 10, Rate: 0.5, Width: 1280, Height: 720, Count: 5, Bytes: 5 * 1280 * 720}, p)
+
+	// MaxFrames caps the count of the span rather than the whole media
+	opt.StartTime, opt.Duration, opt.Frame, opt.MaxFrames = 0, 15, 1, 100
+	opt.DockerCommand = `echo '{"streams":[{"codec_type":"video","avg_frame_rate":"25/1","nb_frames":"1000","duration":"30"}]}' #`
+	if p, err = NewCommand().Plan(opt); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 100, p.Count)
+
+	opt.IsStream = true
+	_, err = NewCommand().Plan(opt)
+	assert.Error(t, err, "expecting plan to be rejected for streams")
+}
@@ -0,0 +1,43 @@
+package ffmpeg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// newOutputCipher creates an AES-GCM cipher used to encrypt output content, key must be 16, 24 or 32 bytes
+// long to select AES-128, AES-192 or AES-256
+func newOutputCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptOutput encrypts output content in place with a random nonce, which is exposed as Output.IV
+func encryptOutput(aead cipher.AEAD, o *Output) error {
+	iv := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return fmt.Errorf("error generating IV: %w", err)
+	}
+	o.Content = aead.Seal(o.Content[:0], iv, o.Content, nil)
+	o.IV = iv
+	return nil
+}
+
+// DecryptOutput decrypts content of an Output encrypted with CommonOptions.EncryptionKey, returns an error when
+// the key is wrong or the content has been tampered with
+func DecryptOutput(key []byte, o *Output) ([]byte, error) {
+	aead, err := newOutputCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.IV) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid IV size %v", len(o.IV))
+	}
+	return aead.Open(nil, o.IV, o.Content, nil)
+}
@@ -0,0 +1,41 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecryptOutput(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	content := []byte("captured image content")
+	c := NewCommand()
+	defer c.Close()
+	opt := &CommonOptions{MediaId: "test", EncryptionKey: key}
+	if err := c.initCipher(opt); err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	c.enqueue(opt, &Output{Index: 1, Content: append([]byte{}, content...)})
+	v, ok := c.q.Dequeue()
+	if !ok {
+		t.Fatalf("expecting an output")
+	}
+	o := v.(*Output)
+	if len(o.IV) == 0 || bytes.Contains(o.Content, content) {
+		t.Fatalf("expecting output content to be encrypted")
+	}
+
+	byt, err := DecryptOutput(key, o)
+	if err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	if !bytes.Equal(byt, content) {
+		t.Fatalf("expecting decrypted content %q, got %q", content, byt)
+	}
+
+	if _, err = DecryptOutput([]byte("fedcba9876543210fedcba9876543210"), o); err == nil {
+		t.Fatalf("expecting error decrypting with a wrong key")
+	}
+	if err = c.initCipher(&CommonOptions{EncryptionKey: []byte("short")}); err == nil {
+		t.Fatalf("expecting error initializing cipher with an invalid key")
+	}
+}
@@ -16,6 +16,14 @@ var (
 	ErrOOMKilled             = fmt.Errorf("OOM_KILLED")               // OOM killed
 	ErrNoStream              = fmt.Errorf("NO_STREAM")                // No stream/does not contain any stream
 	ErrStreamClosed          = fmt.Errorf("STREAM_CLOSED")            // Stream closed. This may be a normal result instead of a REAL ERROR
+	ErrCodecNotSupported     = fmt.Errorf("CODEC_NOT_SUPPORTED")      // Target container can not hold source codecs (remux)
+	ErrHWAccelUnavailable    = fmt.Errorf("HWACCEL_UNAVAILABLE")      // Hardware acceleration device is not available
+	ErrDiskFull              = fmt.Errorf("DISK_FULL")                // No space left on output device
+	ErrPermissionDenied      = fmt.Errorf("PERMISSION_DENIED")        // Permission denied reading input or writing output
+	ErrUnsupportedCodec      = fmt.Errorf("UNSUPPORTED_CODEC")        // Encoder or decoder is not available in FFmpeg build
+	ErrNonMonotonicDTS       = fmt.Errorf("NON_MONOTONIC_DTS")        // Source has non-monotonic DTS. This is a WARNING rather than a REAL ERROR
+	ErrCommandAlreadyUsed    = fmt.Errorf("COMMAND_ALREADY_USED")     // Command is single-use, it was already used or closed
+	ErrNoOutputProduced      = fmt.Errorf("NO_OUTPUT_PRODUCED")       // FFmpeg succeeded without any output, e.g. "Output file is empty, nothing was encoded"
 )
 
 var errs = []knownError{
@@ -77,6 +85,53 @@ var errs = []knownError{
 		// Stream server closed
 		ErrStreamClosed, "Input/output error",
 	},
+	{
+		// Remuxing into a container that does not support the codec, e.g.
+		// Could not find tag for codec pcm_s16le in stream #1, codec not currently supported in container
+		ErrCodecNotSupported, "codec not currently supported in container",
+	},
+	{
+		// Hardware device can not be opened, e.g.
+		// No device available for decoder: device type cuda needed for codec h264
+		ErrHWAccelUnavailable, "No device available",
+	},
+	{
+		ErrDiskFull, "No space left on device",
+	},
+	{
+		ErrPermissionDenied, "Permission denied",
+	},
+	{
+		// Encoder not compiled into FFmpeg, e.g. Unknown encoder 'libx264'
+		ErrUnsupportedCodec, "Unknown encoder",
+	},
+	{
+		ErrUnsupportedCodec, "Decoder not found",
+	},
+	{
+		// Decoder not compiled into FFmpeg, e.g. Decoder (codec av1) not found for input stream #0:0
+		ErrUnsupportedCodec, "not found for input stream",
+	},
+	{
+		// Must be the last one, since the warning may be printed before the real error, e.g.
+		// Application provided invalid, non monotonically increasing dts to muxer in stream 0: 1024 >= 512
+		ErrNonMonotonicDTS, "non monotonically increasing dts",
+	},
+}
+
+// isWarning returns whether err is a known FFmpeg error that does not indicate a failure
+func isWarning(err error) bool {
+	return err == ErrStreamClosed || err == ErrNonMonotonicDTS
+}
+
+// isDefinitive returns whether err is a known FFmpeg error that can not be resolved by retrying, e.g. url not found
+func isDefinitive(err error) bool {
+	switch err {
+	case ErrInvalidUrl, ErrUrlExpiredOrForbidden, ErrUrlNotFound, ErrInvalidData, ErrNoStream, ErrPermissionDenied,
+		ErrUnsupportedCodec:
+		return true
+	}
+	return false
 }
 
 type knownError struct {
@@ -84,13 +139,15 @@ type knownError struct {
 	Message string
 }
 
-// convertError converts error from FFmpeg error message
+// convertError converts error from FFmpeg error message, messages are matched case-insensitively since they
+// may vary between FFmpeg builds
 func convertError(err error, msg string) error {
 	if err == nil {
 		return nil
 	}
+	lower := strings.ToLower(msg)
 	for _, e := range errs {
-		if strings.Contains(msg, e.Message) {
+		if strings.Contains(lower, strings.ToLower(e.Message)) {
 			return e.Error
 		}
 	}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package ffmpeg
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand creates a command running params through bash, in a new process group so that
+// FFmpeg and its children (e.g. docker) can be terminated together
+func shellCommand(params string) *exec.Cmd {
+	cmd := exec.Command("/bin/bash", "-c", params)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// terminate sends SIGTERM to the process group of cmd
+func terminate(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// quote quotes a command argument for bash
+func quote(v interface{}) string {
+	return fmt.Sprintf("'%v'", v)
+}
@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package ffmpeg
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// shellCommand creates a command running params through cmd.exe. The command line is passed as is,
+// since cmd.exe does not follow the argument escaping rules used by os/exec
+func shellCommand(params string) *exec.Cmd {
+	cmd := exec.Command("cmd.exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine:       "/C " + params,
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+	return cmd
+}
+
+// terminate kills the process tree of cmd, falls back to killing the process only
+func terminate(cmd *exec.Cmd) error {
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", pid).Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// quote quotes a command argument for cmd.exe, which does not recognize single quotes
+func quote(v interface{}) string {
+	return fmt.Sprintf(`"%v"`, v)
+}
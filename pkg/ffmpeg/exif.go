@@ -0,0 +1,141 @@
+package ffmpeg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const (
+	exifHeader         = "Exif\x00\x00"        // APP1 identifier, followed by a TIFF header
+	exifUserCommentID  = "ASCII\x00\x00\x00"   // Character code of UserComment
+	exifDateTimeLayout = "2006:01:02 15:04:05" // EXIF date time format
+	exifMaxSegmentSize = 0xffff                // Maximum JPEG segment size (including length field)
+)
+
+// EXIF tags written by embedExif
+const (
+	exifTagImageDescription = 0x010e // ASCII, IFD0
+	exifTagExifIFDPointer   = 0x8769 // LONG, IFD0, offset of Exif IFD
+	exifTagDateTimeOriginal = 0x9003 // ASCII, Exif IFD
+	exifTagUserComment      = 0x9286 // UNDEFINED, Exif IFD
+)
+
+// EXIF field types
+const (
+	exifTypeASCII     = 2
+	exifTypeLong      = 4
+	exifTypeUndefined = 7
+)
+
+// exifMetadata capture metadata embedded into captured JPEG images, see CaptureOptions.EmbedMetadata
+type exifMetadata struct {
+	Uri        string    // Source media, written as ImageDescription
+	CapturedAt time.Time // Capture time, written as DateTimeOriginal
+	Comment    string    // Other capture info, e.g. frame second, written as UserComment
+}
+
+// exifEntry an IFD entry, value is placed in IFD when it fits in 4 bytes, otherwise in the data area following IFD
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// embedMetadata embeds capture metadata of o into JPEG content as EXIF, content that is not a JPEG is left untouched
+func (c *Command) embedMetadata(opt *CaptureOptions, o *Output) {
+	if !isJPEG(o.Content) {
+		return
+	}
+	md := exifMetadata{
+		Uri:        opt.Uri,
+		CapturedAt: time.Now(),
+		Comment: fmt.Sprintf("mediaId=%s;index=%d;second=%v;position=%d;epoch=%d",
+			opt.MediaId, o.Index, o.Second, o.Position, o.Epoch),
+	}
+	byt, err := embedExif(o.Content, md)
+	if err != nil {
+		log.Warn().Err(err).Int64("index", o.Index).Str("mediaId", opt.MediaId).Msg("error embedding capture metadata")
+		return
+	}
+	o.Content = byt
+}
+
+// embedExif inserts an APP1 segment holding EXIF metadata right after SOI of a JPEG image
+func embedExif(jpeg []byte, md exifMetadata) ([]byte, error) {
+	if !isJPEG(jpeg) {
+		return nil, fmt.Errorf("not a JPEG image")
+	}
+	tiff := buildExifTIFF(md)
+	size := 2 + len(exifHeader) + len(tiff)
+	if size > exifMaxSegmentSize {
+		return nil, fmt.Errorf("EXIF segment too large (%v bytes)", size)
+	}
+
+	out := make([]byte, 0, len(jpeg)+2+size)
+	out = append(out, 0xff, 0xd8, 0xff, 0xe1, byte(size>>8), byte(size))
+	out = append(out, exifHeader...)
+	out = append(out, tiff...)
+	return append(out, jpeg[2:]...), nil
+}
+
+// buildExifTIFF builds big-endian TIFF structure of EXIF metadata, IFD0 is followed by Exif IFD
+func buildExifTIFF(md exifMetadata) []byte {
+	bo := binary.BigEndian
+	ifd0 := []exifEntry{
+		exifASCII(exifTagImageDescription, md.Uri),
+		{tag: exifTagExifIFDPointer, typ: exifTypeLong, count: 1, value: make([]byte, 4)},
+	}
+	sub := []exifEntry{
+		exifASCII(exifTagDateTimeOriginal, md.CapturedAt.Format(exifDateTimeLayout)),
+		{tag: exifTagUserComment, typ: exifTypeUndefined, count: uint32(len(exifUserCommentID) + len(md.Comment)),
+			value: []byte(exifUserCommentID + md.Comment)},
+	}
+
+	// Exif IFD is placed right after IFD0, whose size does not depend on the pointer value
+	size := len(buildExifIFD(ifd0, tiffHeaderSize))
+	bo.PutUint32(ifd0[1].value, uint32(tiffHeaderSize+size))
+
+	out := []byte{'M', 'M', 0, 42, 0, 0, 0, tiffHeaderSize}
+	out = append(out, buildExifIFD(ifd0, tiffHeaderSize)...)
+	return append(out, buildExifIFD(sub, uint32(tiffHeaderSize+size))...)
+}
+
+// buildExifIFD builds an IFD (without next IFD) starting at offset, followed by values not fitting in entries
+func buildExifIFD(entries []exifEntry, offset uint32) []byte {
+	bo := binary.BigEndian
+	data := offset + 2 + uint32(len(entries))*tiffEntrySize + 4
+	ifd := make([]byte, 2, data-offset)
+	bo.PutUint16(ifd, uint16(len(entries)))
+	values := make([]byte, 0)
+	for _, e := range entries {
+		entry := make([]byte, tiffEntrySize)
+		bo.PutUint16(entry[0:], e.tag)
+		bo.PutUint16(entry[2:], e.typ)
+		bo.PutUint32(entry[4:], e.count)
+		if len(e.value) <= 4 {
+			copy(entry[8:], e.value)
+		} else {
+			bo.PutUint32(entry[8:], data+uint32(len(values)))
+			values = append(values, e.value...)
+			if len(values)%2 == 1 /* Values are word aligned */ {
+				values = append(values, 0)
+			}
+		}
+		ifd = append(ifd, entry...)
+	}
+	ifd = append(ifd, 0, 0, 0, 0) // No next IFD
+	return append(ifd, values...)
+}
+
+// isJPEG returns whether byt starts with JPEG SOI marker
+func isJPEG(byt []byte) bool {
+	return len(byt) >= 2 && byt[0] == 0xff && byt[1] == 0xd8
+}
+
+// exifASCII creates a NUL terminated ASCII entry
+func exifASCII(tag uint16, v string) exifEntry {
+	return exifEntry{tag: tag, typ: exifTypeASCII, count: uint32(len(v) + 1), value: append([]byte(v), 0)}
+}
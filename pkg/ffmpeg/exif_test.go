@@ -0,0 +1,98 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand_CaptureEmbedMetadata(t *testing.T) {
+	dir := "/tmp/ffmpeg-test-exif"
+	opt := &CaptureOptions{
+		CommonOptions: CommonOptions{
+			Uri:       "/tmp/sample.mp4",
+			MediaId:   "exif",
+			OutputDir: dir,
+			Suffix:    "jpg",
+			IsFile:    true,
+			// Simulates FFmpeg writing 2 minimal JPEG images (SOI & EOI)
+			DockerCommand: fmt.Sprintf(`for i in 1 2; do printf '\377\330\377\331' > %s/00000000000$i.jpg; done #`, dir),
+		},
+		Rate:          0.5,
+		EmbedMetadata: true,
+	}
+	c := NewCommand()
+	defer c.Close()
+	if err := c.Capture(opt); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for res := range c.Outputs() {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		o := res.Output
+		tags := readExifTags(t, o.Content)
+		if tags[exifTagImageDescription] != opt.Uri {
+			t.Fatalf("unexpected ImageDescription: %v", tags[exifTagImageDescription])
+		}
+		if _, err := time.Parse(exifDateTimeLayout, tags[exifTagDateTimeOriginal]); err != nil {
+			t.Fatalf("unexpected DateTimeOriginal: %v", tags[exifTagDateTimeOriginal])
+		}
+		comment := fmt.Sprintf("mediaId=exif;index=%d;second=%v;", o.Index, o.Second)
+		if !strings.HasPrefix(tags[exifTagUserComment], exifUserCommentID+comment) {
+			t.Fatalf("unexpected UserComment: %q", tags[exifTagUserComment])
+		}
+		if !bytes.HasSuffix(o.Content, []byte{0xff, 0xd9}) {
+			t.Fatalf("expecting original image content to be preserved")
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expecting 2 outputs, got %v", n)
+	}
+
+	if _, err := embedExif([]byte("\x89PNG"), exifMetadata{}); err == nil {
+		t.Fatalf("expecting error embedding EXIF into a PNG image")
+	}
+}
+
+// readExifTags reads ASCII & UNDEFINED tags of IFD0 and Exif IFD from the APP1 segment following SOI
+func readExifTags(t *testing.T, jpeg []byte) map[uint16]string {
+	if len(jpeg) < 4 || jpeg[2] != 0xff || jpeg[3] != 0xe1 {
+		t.Fatalf("expecting an APP1 segment after SOI")
+	}
+	size := int(binary.BigEndian.Uint16(jpeg[4:]))
+	seg := jpeg[6 : 4+size]
+	if !bytes.HasPrefix(seg, []byte(exifHeader)) {
+		t.Fatalf("expecting EXIF header")
+	}
+	tiff := seg[len(exifHeader):]
+	bo := binary.BigEndian
+	tags := make(map[uint16]string)
+	ifds := []uint32{bo.Uint32(tiff[4:])}
+	for len(ifds) > 0 {
+		ifd := ifds[0]
+		ifds = ifds[1:]
+		n := uint32(bo.Uint16(tiff[ifd:]))
+		for i := uint32(0); i < n; i++ {
+			entry := tiff[ifd+2+i*tiffEntrySize:]
+			tag, typ, count := bo.Uint16(entry), bo.Uint16(entry[2:]), bo.Uint32(entry[4:])
+			switch {
+			case tag == exifTagExifIFDPointer:
+				ifds = append(ifds, bo.Uint32(entry[8:]))
+			case typ == exifTypeASCII || typ == exifTypeUndefined:
+				v := entry[8 : 8+count]
+				if count > 4 {
+					off := bo.Uint32(entry[8:])
+					v = tiff[off : off+count]
+				}
+				tags[tag] = strings.TrimRight(string(v), "\x00")
+			}
+		}
+	}
+	return tags
+}
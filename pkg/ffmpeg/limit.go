@@ -0,0 +1,56 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+var (
+	processMu  sync.Mutex                                   // Protects processSem
+	processSem = make(chan struct{}, runtime.GOMAXPROCS(0)) // Semaphore limiting concurrent FFmpeg processes, nil means no limit
+)
+
+// SetMaxConcurrent sets the maximum number of FFmpeg processes run by Commands at the same time (package level),
+// defaults to GOMAXPROCS, n <= 0 means no limit. Commands exceeding the limit wait for a running process to exit
+// before starting FFmpeg, which prevents processes from being OOM killed (see ErrOOMKilled) under burst load.
+// The new limit applies to processes started afterwards, running processes are not affected
+func SetMaxConcurrent(n int) {
+	processMu.Lock()
+	defer processMu.Unlock()
+	if n <= 0 {
+		processSem = nil
+		return
+	}
+	processSem = make(chan struct{}, n)
+}
+
+// acquireProcess blocks until a FFmpeg process is allowed to start, or command context is done or command is closed.
+// The acquired slot is released by releaseProcess
+func (c *Command) acquireProcess() error {
+	processMu.Lock()
+	sem := processSem
+	processMu.Unlock()
+	if sem == nil {
+		return nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		c.release = func() { <-sem }
+		return nil
+	case <-c.context().Done():
+		return fmt.Errorf("ffmpeg process cancelled: %w", c.context().Err())
+	case <-c.closeC:
+		return fmt.Errorf("ffmpeg process cancelled: command closed")
+	}
+}
+
+// releaseProcess releases the slot acquired by acquireProcess, it's safe to be called more than once
+func (c *Command) releaseProcess() {
+	c.releaseOnce.Do(func() {
+		if c.release != nil {
+			c.release()
+		}
+	})
+}
@@ -2,6 +2,10 @@ package ffmpeg
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -10,33 +14,141 @@ import (
 const (
 	OutputTypeImage        = 1 // Output as image
 	OutputTypeAudioSegment = 2 // Output as audio segment
+	OutputTypeMedia        = 3 // Output as a single media file, e.g. remuxed video
+	OutputTypeAnimation    = 4 // Output as a single animated image, e.g. GIF, WebP
+	OutputTypeMediaSegment = 5 // Output as a media segment of a stream, e.g. HLS .ts segment
+	OutputTypePlaylist     = 6 // Output as a playlist of media segments, e.g. HLS .m3u8 playlist
+	OutputTypeSubtitle     = 7 // Output as a subtitle file, e.g. SRT, WebVTT
+)
+
+const (
+	OutputTagSpectrogram = "spectrogram" // Output image is an audio spectrogram
+	OutputTagSprite      = "sprite"      // Output image is a sprite sheet (thumbnail mosaic)
+)
+
+const (
+	OutputDirCapture = "capture" // Directory of captured images
+	OutputDirSlice   = "slice"   // Directory of sliced audio segments
+	OutputDirSEI     = "sei"     // Directory of SEI fragments
+	OutputDirMedia   = "media"   // Directory of single file outputs, e.g. remuxed video, GIF, sprite sheet
+	OutputDirHLS     = "hls"     // Directory of HLS segments & playlist
 )
 
 const (
 	CaptureModeByInterval = iota // Capture by duration (every n seconds), default value
 	CaptureModeByFrame           // Capture by every n frame
+	// CaptureModeExactFps captures by duration like CaptureModeByInterval, but frames are evenly spaced at exact
+	// time points (fps filter). Frames are duplicated (or dropped) as needed, e.g. the same frame may be captured
+	// several times from low frame rate sources
+	CaptureModeExactFps
+	// CaptureModeSampled captures CaptureOptions.SampleCount frames evenly spread across input media (or the range
+	// specified by StartTime & Duration), each by an independent fast seek (-ss before -i) and a single frame
+	// extraction, which is far faster than decoding the whole input for long videos, e.g. quick content checks.
+	// Frames are keyframe accurate, Output.Second is the seek position. Not available for streams and InputReader
+	CaptureModeSampled
+)
+
+const (
+	OnBranchErrorStop     = iota // Stop reading outputs of both branches on any branch error, default value
+	OnBranchErrorFailFast        // Stop reading outputs and kill FFmpeg process on any branch error
+	OnBranchErrorContinue        // Keep the healthy branch running, the error is only reported by CaptureError/SliceError
+)
+
+const (
+	// SeekModeInput seeks non-stream input by input options (-ss before -i), which is fast, but relies on range
+	// requests for remote files, default value
+	SeekModeInput  = iota
+	SeekModeOutput // Seek by output options (-ss after -i), input is read from the beginning
+	// SeekModeAuto checks whether remote (HTTP) input honors range requests before starting, seeks by output options
+	// with a warning when it does not, e.g. servers responding 200 with the full content instead of 206
+	SeekModeAuto
+)
+
+const (
+	HWAccelCUDA  = "cuda"  // NVIDIA CUDA (NVDEC)
+	HWAccelVAAPI = "vaapi" // Video Acceleration API, frames are scaled by scale_vaapi when capturing
+	HWAccelQSV   = "qsv"   // Intel Quick Sync Video
+)
+
+const (
+	SubtitleFormatSRT    = "srt" // SubRip subtitle
+	SubtitleFormatWebVTT = "vtt" // WebVTT subtitle
 )
 
 const (
 	DefaultIOTimeout = 2 // Default to 2 seconds
+	// DefaultStderrLimit is the default maximum bytes of FFmpeg stderr (and stdout) kept in memory, see
+	// CommonOptions.StderrLimit
+	DefaultStderrLimit = 64 << 10
+	// DefaultWatchInterval is the default interval of waiting for SEI fragments, see CommonOptions.WatchInterval
+	DefaultWatchInterval = time.Millisecond * 20
+	// vfrTolerance is the relative difference between average & real base frame rate tolerated by Stream.IsVFR,
+	// since average frame rate of a constant frame rate source may be slightly off, e.g. 2997/100 & 30000/1001
+	vfrTolerance = 0.01
 )
 
+// FilenameParser parses index and second of an output file from its name, ok is false when the file is not an
+// output. Index is used to order outputs (not required to be contiguous), second overrides Output.Second.
+// Files are enqueued once a file with greater index appears (or the process exits), the file with the greatest
+// index is considered being written. SEI fragments are not available, neither is playlist under HLS
+type FilenameParser func(name string) (index int64, second float64, ok bool)
+
 // CommonOptions common options for FFmpeg command
 type CommonOptions struct {
-	Uri               string // Video, speech, stream url or file path
-	OutputDir         string // Output directory
-	Suffix            string // Output file suffix, e.g. jpg, png, wav
-	SEIOutputDir      string // SEI fragment output directory
-	SEIFragmentSuffix string // SEI fragment suffix
-	MediaId           string // Media id
-	IsStream          bool   // Whether the media is a stream
-	IsFile            bool   // Whether the media is a local file
-	DecodeSEI         bool   // Whether to decode SEI
-	PreserveOutput    bool   // Whether to preserve outputs (not deleting output), not recommended for production usage
-	Proxy             string // HTTP proxy
-	LogLevel          string // FFmpeg log level
-	DockerCommand     string // FFmpeg docker command
-	IOTimeout         int    // Timeout for FFmpeg IO operations in seconds
+	Uri               string  // Video, speech, stream url or file path
+	OutputDir         string  // Output directory
+	Suffix            string  // Output file suffix, e.g. jpg, png, wav
+	SEIOutputDir      string  // SEI fragment output directory
+	SEIFragmentSuffix string  // SEI fragment suffix
+	SEIPattern        string  // Regular expression matching SEI info (JSON) in SEI fragments, default to SEIRegex
+	MediaId           string  // Media id
+	IsStream          bool    // Whether the media is a stream
+	IsFile            bool    // Whether the media is a local file
+	DecodeSEI         bool    // Whether to decode SEI
+	PreserveOutput    bool    // Whether to preserve outputs (not deleting output), not recommended for production usage
+	Proxy             string  // HTTP proxy
+	LogLevel          string  // FFmpeg log level
+	DockerCommand     string  // FFmpeg docker command
+	FFmpegPath        string  // FFmpeg binary path, e.g. /usr/local/bin/ffmpeg, default to ffmpeg on PATH. DockerCommand takes precedence
+	FFprobePath       string  // FFprobe binary path, e.g. /usr/local/bin/ffprobe, default to ffprobe on PATH. DockerCommand takes precedence
+	IOTimeout         int     // Timeout for FFmpeg IO operations in seconds
+	ProbeSize         string  // Input probe size in bytes (-probesize), see ProbeOptions.ProbeSize
+	AnalyzeDuration   string  // Input analyze duration in microseconds (-analyzeduration), see ProbeOptions.AnalyzeDuration
+	FixTimestamps     bool    // Regenerate missing PTS and shift timestamps to start from zero, for sources with broken timestamps
+	ReadRealtime      bool    // Read input at its native frame rate (-re), e.g. processing a file as if it were a live stream
+	ReportProgress    bool    // Whether to report progress (-progress pipe:1), see Command.Progress. Media is probed before starting
+	ErrorOnNoOutput   bool    // Whether to report ErrNoOutputProduced when FFmpeg succeeds without any output, see Command.ProducedNoOutput
+	StartTime         float64 // Start second of the segment to process (-ss), default to 0
+	Duration          float64 // Duration in seconds of the segment to process (-t), default to 0 (until the end of input)
+	HWAccel           string  // Hardware acceleration method for decoding (-hwaccel), e.g. HWAccelCUDA, see NOTE of ParseCommonOptions
+	HWAccelDevice     string  // Hardware acceleration device (-hwaccel_device), e.g. 0 for cuda, /dev/dri/renderD128 for vaapi
+	EncryptionKey     []byte  // AES key (16, 24 or 32 bytes) to encrypt output content with AES-GCM, see Output.IV & DecryptOutput
+
+	// InputReader reads input media from reader (-i pipe:0) instead of Uri, e.g. media already in memory.
+	// Can not be used with Proxy, input media is not probed (see ReportProgress, CaptureOptions.DetectVFR)
+	InputReader io.Reader
+	// WatchInterval is the interval of polling output files, i.e. waiting for SEI fragments (default to
+	// DefaultWatchInterval) and scanning output directories in case that any file event is missed (default to 500ms)
+	WatchInterval time.Duration
+	// TempDir is the directory where intermediate files go, default to the system temp directory. Operations producing
+	// a single output after FFmpeg exits (TIFF, GIF, Transcode) write intermediate files into a unique directory
+	// created under TempDir when OutputDir is not set, e.g. for containers whose only writable mount is TempDir
+	TempDir string
+	// ExtraInputArgs and ExtraOutputArgs are FFmpeg options not covered by typed options, e.g. -threads 2, which are
+	// placed right before input (-i) and right before output file of Capture & Slice respectively. Every element is a
+	// single argument, arguments containing whitespace or shell special characters are quoted. Under SliceAndCapture
+	// and MultiCapture, ExtraOutputArgs of every branch (or capture set) apply to its own output
+	ExtraInputArgs  []string
+	ExtraOutputArgs []string
+	// StderrLimit is the maximum bytes of FFmpeg stderr kept in memory (default to DefaultStderrLimit), only the last
+	// StderrLimit bytes are kept, so that long-running streams do not balloon memory, see Command.Stderr
+	StderrLimit int
+	// FilenameParser parses output files with names other than FFmpeg's %012d convention (see utils.FilePath2Index),
+	// e.g. timestamped files produced by another tool (see DockerCommand), default to FilePath2Index
+	FilenameParser FilenameParser
+	// SeekMode decides where StartTime & Duration are placed for non-stream input, one of SeekModeInput (default),
+	// SeekModeOutput & SeekModeAuto. Streams are always seeked by output options
+	SeekMode int
 
 	options
 }
@@ -49,6 +161,54 @@ type options struct {
 	CaptureOutputDir string   // image output dir
 	HasSpeech        bool     // image output dir
 	HasVideo         bool     // image output dir
+	OnBranchError    int      // How to handle a branch error under SliceAndCapture
+	OutputArgs       []string // Extra output options placed right before output file, e.g. encoder options
+	HWFrames         bool     // Keep decoded frames in hardware memory (-hwaccel_output_format), filters must support them
+	FramePts         bool     // Track PTS of captured frames (showinfo), set for VFR sources, see CaptureOptions.DetectVFR
+	CaptureSetDirs   []string // Output directories of capture sets under MultiCapture, in the order of sets
+	Playlist         string   // Playlist file name under HLS, which is written into OutputDir but is not an indexed output
+	CopyAudio        bool     // Copy audio stream instead of re-encoding when slicing, see SliceOptions.SkipReencodeIfMatch
+
+	SamplePositions []float64 // Seek positions in seconds under CaptureModeSampled, resolved by Command.Capture
+
+	OutputSeek bool // Seek by output options since remote input does not honor range requests, see SeekModeAuto
+}
+
+// validateInput validates input related options
+func (opt *CommonOptions) validateInput() error {
+	if opt.InputReader != nil && opt.Proxy != "" {
+		return fmt.Errorf("CommonOptions.InputReader can not be used with Proxy, which only applies to media urls")
+	}
+	return nil
+}
+
+// resolveTempOutputDir creates a unique output directory under TempDir when OutputDir is not set, see TempDir
+func (opt *CommonOptions) resolveTempOutputDir() error {
+	if opt.OutputDir != "" {
+		return nil
+	}
+	if opt.TempDir != "" {
+		if err := os.MkdirAll(opt.TempDir, os.ModePerm); err != nil {
+			return fmt.Errorf("error creating temporary directory: %w", err)
+		}
+	}
+	dir, err := ioutil.TempDir(opt.TempDir, "ffmpeg-")
+	if err != nil {
+		return fmt.Errorf("error creating temporary output directory: %w", err)
+	}
+	opt.OutputDir = dir
+	return nil
+}
+
+// probeable returns whether input media can be probed before processing. Streams are not probed,
+// while InputReader can only be read once
+func (opt *CommonOptions) probeable() bool {
+	return !opt.IsStream && opt.InputReader == nil
+}
+
+// seekOnOutput returns whether StartTime & Duration are placed after input (-i), see SeekMode
+func (opt *CommonOptions) seekOnOutput() bool {
+	return opt.IsStream || opt.SeekMode == SeekModeOutput || opt.OutputSeek
 }
 
 // HttpProxy returns a valid HTTP proxy address prefixed with scheme
@@ -68,6 +228,14 @@ func (opt *CommonOptions) GetLogLevel() string {
 	return "error"
 }
 
+// GetWatchInterval returns a valid WatchInterval value default to DefaultWatchInterval
+func (opt *CommonOptions) GetWatchInterval() time.Duration {
+	if opt.WatchInterval <= 0 {
+		return DefaultWatchInterval
+	}
+	return opt.WatchInterval
+}
+
 // GetIOTimeout returns a valid IOTimeout value default to DefaultIOTimeout
 func (opt *CommonOptions) GetIOTimeout() int {
 	if opt.IOTimeout <= 0 {
@@ -87,6 +255,68 @@ type CaptureOptions struct {
 	Debug     bool // Enable debug mode (print frame number & time point on captured images)
 	Mode      int  // Capture mode, default to CaptureModeByInterval
 	Frame     int  // Capture every n frame, available under CaptureModeByFrame
+
+	SampleCount int // Number of frames to capture, available under CaptureModeSampled
+
+	// Image quality options, the defaults produce the best quality (and largest) images
+	Quality        int    // JPEG quality (-qscale:v) ranging from 1 (best) to 31 (worst), default to 1
+	PixelFormat    string // Pixel format (-pix_fmt), e.g. yuvj420p, default to FFmpeg's choice
+	PNGCompression int    // PNG compression level (-compression_level) ranging from 1 to 9 when Suffix is png, default to FFmpeg's default
+
+	// DedupFrames drops frames that are visually similar to the previous one (mpdecimate) before capturing,
+	// which reduces outputs for mostly-static feeds. Output.Second is populated from the actual frame PTS,
+	// FFmpeg log level is raised to info (if lower) in order to read frame info.
+	DedupFrames bool
+	// DetectVFR probes input media before capturing, Output.Second of a variable frame rate (VFR) source (see
+	// Stream.IsVFR) is populated from the actual frame PTS like DedupFrames. Not available for streams.
+	DetectVFR bool
+	// EmbedMetadata embeds capture metadata into captured JPEG images as EXIF, so that images are self-describing:
+	// Uri as ImageDescription, capture time as DateTimeOriginal, and media id, index, frame second & position as
+	// UserComment (e.g. mediaId=m1;index=3;second=1.5;position=1;epoch=0). Images of other formats are untouched
+	EmbedMetadata bool
+}
+
+// CaptureSet a named set of capture options under MultiCaptureOptions. Input related options (e.g. Uri, StartTime)
+// of its CommonOptions are ignored, MultiCaptureOptions.CommonOptions are used instead
+type CaptureSet struct {
+	Name string // Capture set name, which is populated to Output.Set
+	CaptureOptions
+}
+
+// MultiCaptureOptions options for capturing images into several capture sets in a single FFmpeg process, e.g. a
+// dense one per second capture and a sparse one every 250 frames, so that the input is decoded only once. Each set
+// has its own OutputDir, Suffix, Rate, Mode, Size, etc.
+// NOTE: DedupFrames and DetectVFR are not available in capture sets
+type MultiCaptureOptions struct {
+	CommonOptions
+	Sets []CaptureSet
+}
+
+// validate validates multi capture options
+func (opt *MultiCaptureOptions) validate() error {
+	if len(opt.Sets) == 0 {
+		return fmt.Errorf("MultiCaptureOptions.Sets must not be empty")
+	}
+	names, dirs := make(map[string]bool), make(map[string]bool)
+	for _, set := range opt.Sets {
+		if set.Name == "" || set.Suffix == "" || set.OutputDir == "" {
+			return fmt.Errorf("CaptureSet.Name, Suffix and OutputDir must not be empty")
+		}
+		if names[set.Name] || dirs[set.OutputDir] {
+			return fmt.Errorf("CaptureSet.Name and OutputDir must be unique, got duplicated set '%v'", set.Name)
+		}
+		if set.DedupFrames || set.DetectVFR {
+			return fmt.Errorf("CaptureSet.DedupFrames and DetectVFR are not available, got set '%v'", set.Name)
+		}
+		names[set.Name], dirs[set.OutputDir] = true, true
+	}
+	return nil
+}
+
+// UsesFramePts returns whether Output.Second of captured images is populated from the actual frame PTS, which is the
+// case when DedupFrames is set or a VFR source is detected (see DetectVFR)
+func (opt *CaptureOptions) UsesFramePts() bool {
+	return opt.DedupFrames || opt.FramePts
 }
 
 // SliceOptions options for slicing audio segments
@@ -100,6 +330,31 @@ type SliceOptions struct {
 	Channels          int    // Audio channels
 	Format            string // Audio format
 	FragmentDuration  int    // Sliced fragment duration in seconds
+
+	// Normalize normalizes loudness of sliced fragments (EBU R128, single-pass loudnorm) to TargetLUFS,
+	// e.g. for consistent ASR input volume. Can not be used with DecodeSEI, whose fragments are copied
+	Normalize  bool
+	TargetLUFS float64 // Target integrated loudness in LUFS, default to -16
+
+	// SkipReencodeIfMatch probes input media before slicing, the audio stream is copied (-c:a copy) instead of being
+	// re-encoded when it already matches Coding, SamplingFrequency and Channels, e.g. 16kHz mono pcm_s16le audio,
+	// which is much faster. Not available for streams and InputReader, or when Normalize is enabled
+	SkipReencodeIfMatch bool
+
+	// StartNumber is the number of the first sliced fragment (-segment_start_number), i.e. Output.Index of the first
+	// fragment, default to 0
+	StartNumber int
+}
+
+// validate validates slice options
+func (opt *SliceOptions) validate() error {
+	if opt.StartNumber < 0 {
+		return fmt.Errorf("SliceOptions.StartNumber must not be negative")
+	}
+	if opt.Normalize && opt.DecodeSEI {
+		return fmt.Errorf("SliceOptions.Normalize can not be used with DecodeSEI, stream copy can not be filtered")
+	}
+	return nil
 }
 
 func NewDefaultSliceOptions() *SliceOptions {
@@ -117,6 +372,106 @@ func NewDefaultSliceOptions() *SliceOptions {
 	}
 }
 
+// RemuxOptions options for changing media container without re-encoding
+type RemuxOptions struct {
+	CommonOptions
+	Format string // Output container format, e.g. mp4, matroska. Guessed from Suffix by FFmpeg when empty
+}
+
+// SpectrogramOptions options for rendering audio into a spectrogram image (showspectrumpic)
+type SpectrogramOptions struct {
+	CommonOptions
+	Width  int    // Spectrogram width, default to 1024
+	Height int    // Spectrogram height, default to 512
+	Color  string // Color mode, e.g. intensity, rainbow, viridis, default to FFmpeg's default (intensity)
+	Legend bool   // Whether to draw legend (axes & color bar) around the spectrogram
+
+	// Start and Duration restrict the spectrogram to a time range of the input (in seconds), e.g. setting
+	// Start to n*FragmentDuration and Duration to FragmentDuration renders the spectrogram of the n-th slice
+	Start    int // Start second, default to 0
+	Duration int // Duration in seconds, default to 0 (until the end of input)
+}
+
+// TIFFOptions options for capturing images into a single multi-page TIFF
+type TIFFOptions struct {
+	CaptureOptions
+	Compression string // TIFF compression, available options: packbits (default), raw, lzw, deflate
+}
+
+// GIFOptions options for converting a time range of input media into an animated GIF (or WebP when Suffix is webp),
+// the time range is specified by CommonOptions.StartTime and CommonOptions.Duration
+type GIFOptions struct {
+	CommonOptions
+	FPS   int // Frame rate, default to 10
+	Width int // Width, height is scaled proportionally, default to 320
+	Loop  int // Number of loops (-loop), 0 means infinite loop (default), -1 means no loop (GIF only)
+}
+
+// SpriteOptions options for assembling evenly spaced frames into a single sprite sheet (contact sheet) image
+type SpriteOptions struct {
+	CommonOptions
+	Columns    int     // Number of thumbnails per row, default to 5
+	Rows       int     // Number of thumbnails per column, default to 5
+	ThumbWidth int     // Thumbnail width, height is scaled proportionally, default to 160
+	Interval   float64 // Interval between thumbnails in seconds, default to media duration divided by Columns*Rows
+}
+
+// TranscodeOptions options for transcoding (and resizing) input media into a single media file, e.g. 720p H.264 mp4
+type TranscodeOptions struct {
+	CommonOptions
+	VideoCodec string // Video encoder (-c:v), default to libx264
+	AudioCodec string // Audio encoder (-c:a), default to aac
+	Width      int    // Output width, scaled proportionally to Height when not set (0), default to source width
+	Height     int    // Output height, scaled proportionally to Width when not set (0), default to source height
+	CRF        int    // Constant rate factor (-crf), lower is better quality, default to encoder's default, e.g. 23 for libx264
+	Preset     string // Encoder preset (-preset), e.g. veryfast, default to encoder's default, e.g. medium for libx264
+}
+
+// SubtitleOptions options for extracting an embedded subtitle stream of input media into a subtitle file
+type SubtitleOptions struct {
+	CommonOptions
+	StreamIndex int    // Index among subtitle streams (-map 0:s:<index>), default to 0 (the first subtitle stream)
+	Format      string // Subtitle format, SubtitleFormatSRT or SubtitleFormatWebVTT, default to SubtitleFormatWebVTT
+}
+
+// HLSOptions options for transcoding input media (e.g. RTMP stream) into HLS segments & playlist for browser playback
+type HLSOptions struct {
+	CommonOptions
+	SegmentDuration int    // Target segment duration in seconds (-hls_time), default to 6
+	ListSize        int    // Maximum number of playlist entries (-hls_list_size), default to 0 (all segments)
+	PlaylistName    string // Playlist file name written into OutputDir, default to index.m3u8
+	Copy            bool   // Copy streams without re-encoding (-c copy), otherwise encoded into H.264 & AAC
+}
+
+// segmentDuration returns target segment duration, default to 6 seconds
+func (opt *HLSOptions) segmentDuration() int {
+	if opt.SegmentDuration <= 0 {
+		return defaultHLSSegmentDuration
+	}
+	return opt.SegmentDuration
+}
+
+// playlist returns playlist file name, default to index.m3u8
+func (opt *HLSOptions) playlist() string {
+	if opt.PlaylistName == "" {
+		return defaultHLSPlaylistName
+	}
+	return opt.PlaylistName
+}
+
+// SilenceOptions options for detecting silent intervals of audio (silencedetect)
+type SilenceOptions struct {
+	CommonOptions
+	Noise       float64 // Noise threshold in dB, audio quieter than it is considered silent, default to -30
+	MinDuration float64 // Minimum silence duration in seconds, default to 0.5
+}
+
+// SilenceInterval a silent interval detected by DetectSilence, in seconds
+type SilenceInterval struct {
+	Start float64 // Silence start second
+	End   float64 // Silence end second, -1 when the silence lasts until the end of input
+}
+
 // Output captured image or sliced audio segment
 type Output struct {
 	Type         int      // Output file type
@@ -127,12 +482,34 @@ type Output struct {
 	LastSliced   bool     // Whether output file is the last fragment/image
 	LastCaptured bool     // Whether output file is the last fragment/image
 	SEIInfo      []string // SEI info
+	Tag          string   // Output tag further describing the content, e.g. OutputTagSpectrogram
+	Epoch        int      // Number of reconnects before the output is produced, Index may restart from 0 in a new epoch
+	IV           []byte   // Nonce used to encrypt Content, available when CommonOptions.EncryptionKey is set
+	Set          string   // Name of the capture set producing the output, available under MultiCapture
 
 	// Captured image
 	Position int64   // Capture frame position (at n-th second)
 	Second   float64 // Capture frame or audio segment segment second
 }
 
+// SEIEvent a SEI info decoded from a SEI fragment, delivered by Command.SEIChannel
+type SEIEvent struct {
+	Index int64  // Index of the SEI fragment, the same as Output.Index of the media output covering the same period
+	Info  string // SEI info, e.g. JSON matched by SEIRegex
+	Epoch int    // Number of reconnects before the SEI fragment is produced, see Output.Epoch
+}
+
+// Progress FFmpeg processing progress
+type Progress struct {
+	CurrentTime   time.Duration // Processed media time
+	TotalDuration time.Duration // Media duration, 0 when unknown (e.g. live streams)
+	Percent       float64       // Processed percentage ranging from 0 to 100, -1 when TotalDuration is unknown
+	Speed         float64       // Processing speed relative to playback speed, e.g. 2.5 means 2.5x
+	FPS           float64       // Processing frames per second
+	Frame         int64         // Number of processed frames
+	Finished      bool          // Whether FFmpeg has reported the end of progress
+}
+
 // ProbeOptions stream probing options
 type ProbeOptions struct {
 	Uri                string        // Video, speech, stream url or file path
@@ -141,9 +518,21 @@ type ProbeOptions struct {
 	Proxy              string        // HTTP proxy
 	RetryStreamOnError bool          // Whether to retry probing stream on error when uri is a stream
 	RetryInterval      time.Duration // Interval between retries
-	MaxRetry           int           // Number of maximum retries
+	MaxRetry           int           // Number of maximum retries, applies to streams with RetryStreamOnError and non-stream media
 	LogLevel           string        // FFmpeg log level
 	DockerCommand      string        // FFmpeg docker command
+	FFprobePath        string        // FFprobe binary path, default to ffprobe on PATH. DockerCommand takes precedence
+	IncludeChapters    bool          // Whether to probe chapter markers (-show_chapters), see StreamInfo.Chapters
+
+	// Deadline is the overall time budget of probing, including all retries. Retrying stops once it's exceeded even if
+	// retries remain, default to 0 (no deadline)
+	Deadline time.Duration
+
+	// ProbeSize and AnalyzeDuration control how much data FFmpeg reads to detect input streams, defaults to 5000000
+	// (bytes) and 5000000 (microseconds). Streams starting with sparse keyframes may be falsely reported as
+	// ErrNoStream with the defaults, in which case 10000000 (or higher) is recommended for both options.
+	ProbeSize       string // Input probe size in bytes (-probesize)
+	AnalyzeDuration string // Input analyze duration in microseconds (-analyzeduration)
 }
 
 type SliceAndCaptureOptions struct {
@@ -152,6 +541,7 @@ type SliceAndCaptureOptions struct {
 	*CaptureOptions
 	HasSpeechStream bool
 	HasImageStream  bool
+	OnBranchError   int // How to handle an error of the capture or slice branch, default to OnBranchErrorStop
 }
 
 // HttpProxy returns a valid HTTP proxy address prefixed with scheme
@@ -178,12 +568,23 @@ type OutputStats struct {
 	Duration int64     // Process time
 	Output   int       // Number of captured images or sliced audio segments
 	Bytes    int64     // Number of output file length
+
+	// Statistics by output type, sum of which equals to Output & Bytes
+	ImageCount   int   // Number of images (OutputTypeImage)
+	ImageBytes   int64 // Length of images
+	SegmentCount int   // Number of audio segments (OutputTypeAudioSegment)
+	SegmentBytes int64 // Length of audio segments
+	OtherCount   int   // Number of other outputs, e.g. OutputTypeMedia, OutputTypeAnimation
+	OtherBytes   int64 // Length of other outputs
+
+	MediaDuration float64 // Duration in seconds of the transcoded media probed after Transcode, 0 when unknown
 }
 
 // StreamInfo media stream info
 type StreamInfo struct {
-	Streams []Stream `json:"streams"` // Media streams, in the most common cases #0 is video, #1 is audio
-	Format  Format   `json:"format"`  // Media format
+	Streams  []Stream  `json:"streams"`  // Media streams, in the most common cases #0 is video, #1 is audio
+	Format   Format    `json:"format"`   // Media format
+	Chapters []Chapter `json:"chapters"` // Chapter markers, only available when ProbeOptions.IncludeChapters is enabled
 }
 
 // HasVideoStream returns whether the media has video stream and its stream index
@@ -206,6 +607,16 @@ func (st *StreamInfo) HasAudioStream() (int, bool) {
 	return 0, false
 }
 
+// HasSubtitleStream returns whether the media has subtitle stream and its stream index
+func (st *StreamInfo) HasSubtitleStream() (int, bool) {
+	for idx, v := range st.Streams {
+		if v.CodecType == "subtitle" {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
 // GetVideoDuration tries to acquire media duration from stream, otherwise from format
 func (st *StreamInfo) GetVideoDuration() (float64, error) {
 	idx, ok := st.HasVideoStream()
@@ -243,8 +654,11 @@ type Stream struct {
 	StartTime          string `json:"start_time"`
 	Duration           string `json:"duration"`
 	AvgFrameRate       string `json:"avg_frame_rate"`
+	RFrameRate         string `json:"r_frame_rate"`
 	Frames             string `json:"nb_frames"`
 	SampleRate         string `json:"sample_rate"`
+	Channels           int    `json:"channels"`
+	BitRate            string `json:"bit_rate"`
 }
 
 // GetDuration gets stream's duration
@@ -257,31 +671,97 @@ func (s *Stream) GetFrames() (int64, error) {
 	return strconv.ParseInt(s.Frames, 10, 0)
 }
 
+// GetBitRate gets stream's bit rate in bits per second, not available for some containers (e.g. matroska),
+// see Format.GetBitRate
+func (s *Stream) GetBitRate() (int64, error) {
+	return parseBitRate(s.BitRate)
+}
+
 // GetFrameRate gets stream's frame rate
 func (s *Stream) GetFrameRate() (float64, error) {
-	spl := strings.Split(s.AvgFrameRate, "/")
+	return parseFrameRate("avg_frame_rate", s.AvgFrameRate)
+}
+
+// GetRealFrameRate gets stream's real base frame rate (r_frame_rate), the lowest frame rate with which all
+// timestamps can be represented accurately
+func (s *Stream) GetRealFrameRate() (float64, error) {
+	return parseFrameRate("r_frame_rate", s.RFrameRate)
+}
+
+// IsVFR returns whether the stream has variable frame rate, i.e. its average frame rate differs from real base
+// frame rate. Returns false when any of the frame rates is unknown
+func (s *Stream) IsVFR() bool {
+	avg, err := s.GetFrameRate()
+	if err != nil {
+		return false
+	}
+	r, err := s.GetRealFrameRate()
+	if err != nil {
+		return false
+	}
+	return math.Abs(avg-r) > r*vfrTolerance
+}
+
+// parseFrameRate parses frame rate in the form of <numerator>/<denominator>, e.g. 30000/1001
+func parseFrameRate(name, v string) (float64, error) {
+	spl := strings.Split(v, "/")
 	if len(spl) != 2 {
-		return 0, fmt.Errorf("invalid avg_frame_rate: %v", s.AvgFrameRate)
+		return 0, fmt.Errorf("invalid %v: %v", name, v)
 	}
 	if spl[1] == "0" {
-		return 0, fmt.Errorf("invalid avg_frame_rate (denominator = 0): %v", s.AvgFrameRate)
+		return 0, fmt.Errorf("invalid %v (denominator = 0): %v", name, v)
 	}
 	num, err := strconv.ParseInt(spl[0], 10, 0)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing numerator: %v, avg_frame_rate: %v", err, s.AvgFrameRate)
+		return 0, fmt.Errorf("error parsing numerator: %v, %v: %v", err, name, v)
 	}
 	den, err := strconv.ParseInt(spl[1], 10, 0)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing denominator: %v, avg_frame_rate: %v", err, s.AvgFrameRate)
+		return 0, fmt.Errorf("error parsing denominator: %v, %v: %v", err, name, v)
 	}
 	return float64(num) / float64(den), nil
 }
 
+// parseBitRate parses bit rate in bits per second, which is N/A or missing when unknown
+func parseBitRate(v string) (int64, error) {
+	if v == "" || v == "N/A" {
+		return 0, fmt.Errorf("bit_rate not available")
+	}
+	br, err := strconv.ParseInt(v, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bit_rate: %v, %v", v, err)
+	}
+	return br, nil
+}
+
 // GetStartTime gets stream's start time
 func (s *Stream) GetStartTime() (float64, error) {
 	return strconv.ParseFloat(s.StartTime, 0)
 }
 
+// Chapter media chapter marker, e.g. podcast chapters
+type Chapter struct {
+	ID        int64             `json:"id"`
+	StartTime string            `json:"start_time"`
+	EndTime   string            `json:"end_time"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// GetStartTime gets chapter's start time in seconds
+func (c *Chapter) GetStartTime() (float64, error) {
+	return strconv.ParseFloat(c.StartTime, 0)
+}
+
+// GetEndTime gets chapter's end time in seconds
+func (c *Chapter) GetEndTime() (float64, error) {
+	return strconv.ParseFloat(c.EndTime, 0)
+}
+
+// Title returns chapter's title, empty when not tagged
+func (c *Chapter) Title() string {
+	return c.Tags["title"]
+}
+
 // Format media format
 type Format struct {
 	FormatName string `json:"format_name"`
@@ -298,6 +778,11 @@ func (f *Format) GetDuration() (float64, error) {
 	return strconv.ParseFloat(f.Duration, 0)
 }
 
+// GetBitRate gets media's overall bit rate in bits per second
+func (f *Format) GetBitRate() (int64, error) {
+	return parseBitRate(f.BitRate)
+}
+
 // GetSize gets media file size in bytes
 func (f *Format) GetSize() (int64, error) {
 	return strconv.ParseInt(f.Size, 10, 0)
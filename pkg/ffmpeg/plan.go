@@ -0,0 +1,59 @@
+package ffmpeg
+
+import "fmt"
+
+// Plan a pre-flight summary of capturing input media, e.g. for previewing "this will produce ~N thumbnails over M
+// minutes" before capturing, see Command.Plan
+type Plan struct {
+	Duration float64 // Duration in seconds of input media
+	Span     float64 // Duration in seconds to be captured, i.e. Duration restricted by StartTime & CommonOptions.Duration
+	Rate     float32 // Effective capture rate, also derived under CaptureModeByFrame & CaptureModeSampled
+	Width    int     // Width of captured images, Size or source resolution
+	Height   int     // Height of captured images, Size or source resolution
+	Count    int     // Estimated number of captured images, see ExpectedCaptureCount
+	Bytes    int64   // Estimated total size in bytes of captured images, an upper bound, see EstimateResources
+}
+
+// Plan probes input media and computes the plan of capturing it with opt, without starting FFmpeg. Count is capped by
+// MaxFrames, under CaptureModeByFrame it's proportional to Span when only part of input media is captured.
+// Returns an error for streams and InputReader, whose duration is unknown
+func (c *Command) Plan(opt *CaptureOptions) (Plan, error) {
+	if !opt.probeable() {
+		return Plan{}, fmt.Errorf("Plan is not available for streams and InputReader")
+	}
+	st, err := c.ProbeStreams(probeOptionsOf(&opt.CommonOptions))
+	if err != nil {
+		return Plan{}, fmt.Errorf("error probing media for plan: %w", err)
+	}
+	idx, ok := st.HasVideoStream()
+	if !ok {
+		return Plan{}, fmt.Errorf("resource has no video stream")
+	}
+	dur, err := st.GetVideoDuration()
+	if err != nil {
+		return Plan{}, fmt.Errorf("can not get video duration: %v", err)
+	}
+
+	p := Plan{Duration: dur, Span: spanOf(dur, &opt.CommonOptions), Rate: opt.Rate}
+	if p.Span <= 0 {
+		return Plan{}, fmt.Errorf("CommonOptions.StartTime (%v) exceeds media duration (%v)", opt.StartTime, dur)
+	}
+	p.Width, p.Height = outputResolution(opt.Size, st.Streams[idx].Width, st.Streams[idx].Height)
+
+	switch opt.Mode {
+	case CaptureModeByFrame:
+		p.Count = ExpectedCaptureCountOf(st, opt)
+		if fps, err := st.Streams[idx].GetFrameRate(); err == nil && opt.Frame > 0 {
+			p.Rate = float32(fps / float64(opt.Frame))
+		}
+	case CaptureModeSampled:
+		p.Count = ExpectedCaptureCount(p.Span, opt)
+		p.Rate = float32(float64(opt.SampleCount) / p.Span)
+	default:
+		p.Count = ExpectedCaptureCount(p.Span, opt)
+	}
+	if p.Count > 0 {
+		p.Bytes = int64(p.Count) * int64(p.Width) * int64(p.Height) * outputBytesPerPixel(opt.Suffix)
+	}
+	return p, nil
+}
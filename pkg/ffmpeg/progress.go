@@ -0,0 +1,90 @@
+package ffmpeg
+
+import (
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress returns current processing progress, only available when ReportProgress is enabled
+func (c *Command) Progress() Progress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.prog
+}
+
+// initProgress probes total duration of the input media before FFmpeg starts
+func (c *Command) initProgress() {
+	c.mu.Lock()
+	c.prog = Progress{Percent: -1}
+	c.mu.Unlock()
+	if !c.opt.probeable() {
+		return
+	}
+
+	st, err := c.ProbeStreams(c.probeOptions())
+	if err != nil {
+		log.Warn().Err(err).Str("mediaId", c.opt.MediaId).Msg("error probing media duration for progress")
+		return
+	}
+	c.info = st
+	dur, err := st.Format.GetDuration()
+	if err != nil || dur <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.prog.TotalDuration = time.Duration(dur * float64(time.Second))
+	c.prog.Percent = 0
+	c.mu.Unlock()
+}
+
+// handleProgressLine parses a key=value line printed by -progress, e.g.
+//
+//	frame=120
+//	fps=48.00
+//	out_time_us=4800000
+//	speed=1.92x
+//	progress=continue
+func (c *Command) handleProgressLine(line string) {
+	kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+	if len(kv) != 2 {
+		return
+	}
+	k, v := kv[0], strings.TrimSpace(kv[1])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch k {
+	case "frame":
+		if n, err := strconv.ParseInt(v, 10, 0); err == nil {
+			c.prog.Frame = n
+		}
+	case "fps":
+		if f, err := strconv.ParseFloat(v, 0); err == nil {
+			c.prog.FPS = f
+		}
+	case "out_time_us", "out_time_ms":
+		// NOTE: out_time_ms is also in microseconds, see https://trac.ffmpeg.org/ticket/7345
+		if us, err := strconv.ParseInt(v, 10, 0); err == nil && us >= 0 {
+			c.prog.CurrentTime = time.Duration(us) * time.Microsecond
+			if c.prog.TotalDuration > 0 {
+				c.prog.Percent = float64(c.prog.CurrentTime) / float64(c.prog.TotalDuration) * 100
+				if c.prog.Percent > 100 {
+					c.prog.Percent = 100
+				}
+			}
+		}
+	case "speed":
+		if f, err := strconv.ParseFloat(strings.TrimSuffix(v, "x"), 0); err == nil {
+			c.prog.Speed = f
+		}
+	case "progress":
+		if v == "end" {
+			c.prog.Finished = true
+			if c.prog.TotalDuration > 0 {
+				c.prog.Percent = 100
+			}
+		}
+	}
+}
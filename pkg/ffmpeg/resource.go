@@ -0,0 +1,75 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+)
+
+const (
+	processBaseMemory   = 64 << 20 // Memory of a FFmpeg process regardless of input, i.e. binary, codecs & IO buffers
+	decoderFrameBuffers = 16       // Decoded frames buffered by decoder & filter graph, i.e. H.264 DPB (up to 16) & threads
+	maxAutoThreads      = 16       // FFmpeg caps the automatic number of decoding threads at 16
+)
+
+// ResourceEstimate a rough resource footprint of a capture command, see EstimateResources
+type ResourceEstimate struct {
+	Memory  int64 // Expected peak memory in bytes, including FFmpeg process and outputs buffered in Command
+	Threads int   // Expected number of FFmpeg threads
+}
+
+// EstimateResources estimates the resource footprint of capturing a source of width x height with opt, while
+// at most queued outputs are buffered in Command (i.e. enqueued but not read by caller yet). It's a heuristic for
+// packing commands within a node budget (e.g. along with SetMaxConcurrent) before they get OOM killed, see
+// ErrOOMKilled. Decoded frames are counted as YUV 4:2:0, captured images as 1 byte per pixel for JPEG and 3 bytes
+// per pixel for PNG at output resolution (Size, default to source resolution).
+// NOTE: queued <= 0 is treated as 1, i.e. outputs are read as soon as they are enqueued
+func EstimateResources(opt *CaptureOptions, width, height, queued int) ResourceEstimate {
+	if queued <= 0 {
+		queued = 1
+	}
+	ow, oh := outputResolution(opt.Size, width, height)
+
+	frames := int64(width) * int64(height) * 3 / 2 * decoderFrameBuffers
+	outputs := int64(ow) * int64(oh) * outputBytesPerPixel(opt.Suffix) * int64(queued)
+	return ResourceEstimate{
+		Memory:  processBaseMemory + frames + outputs,
+		Threads: estimateThreads(&opt.CommonOptions),
+	}
+}
+
+// outputResolution returns the resolution of captured images, i.e. size in the form of <width>x<height>, otherwise
+// source resolution
+func outputResolution(size string, width, height int) (int, int) {
+	var w, h int
+	if _, err := fmt.Sscanf(size, "%dx%d", &w, &h); err == nil && w > 0 && h > 0 {
+		return w, h
+	}
+	return width, height
+}
+
+// outputBytesPerPixel returns the estimated size per pixel of a captured image, 1 byte for JPEG and 3 bytes for PNG.
+// It's an upper bound rather than the actual compressed size
+func outputBytesPerPixel(suffix string) int64 {
+	if suffix == "png" {
+		return 3
+	}
+	return 1
+}
+
+// estimateThreads returns the number of threads specified by -threads in ExtraInputArgs, otherwise the number of
+// threads FFmpeg picks automatically (number of CPUs + 1, at most maxAutoThreads)
+func estimateThreads(opt *CommonOptions) int {
+	for i, v := range opt.ExtraInputArgs {
+		if v == "-threads" && i+1 < len(opt.ExtraInputArgs) {
+			if n, err := strconv.Atoi(opt.ExtraInputArgs[i+1]); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	n := runtime.NumCPU() + 1
+	if n > maxAutoThreads {
+		n = maxAutoThreads
+	}
+	return n
+}
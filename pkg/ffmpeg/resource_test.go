@@ -0,0 +1,37 @@
+package ffmpeg
+
+import "testing"
+
+func TestEstimateResources(t *testing.T) {
+	opt := &CaptureOptions{Rate: 1}
+	hd := EstimateResources(opt, 1280, 720, 10)
+	fhd := EstimateResources(opt, 1920, 1080, 10)
+	if fhd.Memory <= hd.Memory {
+		t.Fatalf("expecting estimate to scale with resolution, got %v (720p) & %v (1080p)", hd.Memory, fhd.Memory)
+	}
+	more := EstimateResources(opt, 1920, 1080, 100)
+	if want := int64(1920 * 1080 * 90); more.Memory-fhd.Memory != want {
+		t.Fatalf("expecting %v more bytes for 90 more queued outputs, got %v", want, more.Memory-fhd.Memory)
+	}
+	if EstimateResources(opt, 1920, 1080, 0) != EstimateResources(opt, 1920, 1080, 1) {
+		t.Fatalf("expecting queued <= 0 to be treated as 1")
+	}
+
+	opt.Size = "320x180"
+	small := EstimateResources(opt, 1920, 1080, 100)
+	if small.Memory >= more.Memory {
+		t.Fatalf("expecting smaller outputs with Size, got %v & %v", small.Memory, more.Memory)
+	}
+	opt.Suffix = "png"
+	if png := EstimateResources(opt, 1920, 1080, 100); png.Memory <= small.Memory {
+		t.Fatalf("expecting larger PNG outputs, got %v & %v", png.Memory, small.Memory)
+	}
+
+	if hd.Threads < 2 || hd.Threads > maxAutoThreads {
+		t.Fatalf("unexpected automatic threads: %v", hd.Threads)
+	}
+	opt.ExtraInputArgs = []string{"-threads", "3"}
+	if n := EstimateResources(opt, 1920, 1080, 1).Threads; n != 3 {
+		t.Fatalf("expecting 3 threads, got %v", n)
+	}
+}
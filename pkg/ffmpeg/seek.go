@@ -0,0 +1,68 @@
+package ffmpeg
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// rangeCheckTimeout is the maximum duration of checking whether remote input honors range requests, see SeekModeAuto
+var rangeCheckTimeout = time.Second * 5
+
+// resolveSeekMode checks whether remote input honors range requests under SeekModeAuto when StartTime is set, input
+// is seeked by output options when it does not. Input is seeked by input options as usual when the check fails
+func (c *Command) resolveSeekMode(opt *CommonOptions) {
+	if opt.SeekMode != SeekModeAuto || opt.StartTime <= 0 || !opt.probeable() {
+		return
+	}
+	if !strings.HasPrefix(opt.Uri, "http://") && !strings.HasPrefix(opt.Uri, "https://") {
+		return
+	}
+	ok, err := rangeSupported(c.context(), opt)
+	if err != nil {
+		log.Warn().Err(err).Str("mediaId", opt.MediaId).Msg("error checking range request support, seek by input options")
+		return
+	}
+	if !ok {
+		log.Warn().Str("uri", opt.Uri).Str("mediaId", opt.MediaId).
+			Msg("input does not honor range requests, seek by output options instead")
+		opt.OutputSeek = true
+	}
+}
+
+// rangeSupported requests the first byte of remote input, returns whether the server responds 206 Partial Content
+func rangeSupported(ctx context.Context, opt *CommonOptions) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, rangeCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opt.Uri, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	client := &http.Client{}
+	if opt.Proxy != "" {
+		proxy, err := url.Parse(opt.HttpProxy())
+		if err != nil {
+			return false, fmt.Errorf("invalid proxy: %w", err)
+		}
+		client.Transport = &http.Transport{Proxy: http.ProxyURL(proxy)}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return true, nil
+	case http.StatusOK:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+}
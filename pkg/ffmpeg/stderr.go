@@ -0,0 +1,61 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"sync"
+)
+
+// stderrWriter buffers FFmpeg stderr output, calls line handler on every complete line, so that
+// messages can be parsed while FFmpeg is still running
+type stderrWriter struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer      // Stderr content, the last max bytes when max is set
+	max  int               // Maximum bytes kept in buf, older content is discarded, 0 means no limit
+	line []byte            // Incomplete line waiting for a line break
+	hdl  func(line string) // Line handler, optional
+}
+
+func newStderrWriter(hdl func(line string), max int) *stderrWriter {
+	return &stderrWriter{hdl: hdl, max: max}
+}
+
+// Write implements io.Writer
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	if w.max > 0 && w.buf.Len() > w.max {
+		// Discarded content is reclaimed when buffer grows, so that buffer size is bounded by about 2*max
+		w.buf.Next(w.buf.Len() - w.max)
+	}
+	if w.hdl == nil {
+		return len(p), nil
+	}
+	for _, b := range p {
+		// FFmpeg uses carriage return to refresh stats line
+		if b == '\n' || b == '\r' {
+			if len(w.line) > 0 {
+				w.hdl(string(w.line))
+				w.line = w.line[:0]
+			}
+			continue
+		}
+		w.line = append(w.line, b)
+	}
+	return len(p), nil
+}
+
+// String returns buffered stderr content
+func (w *stderrWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// Len returns the length of buffered stderr content
+func (w *stderrWriter) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Len()
+}
@@ -0,0 +1,145 @@
+package ffmpeg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	tiffHeaderSize = 8  // Byte order (2), magic number 42 (2), first IFD offset (4)
+	tiffEntrySize  = 12 // Tag (2), type (2), count (4), value or value offset (4)
+)
+
+// TIFF tags whose values are offsets into the file, they must be rebased together with IFD offsets
+var tiffOffsetTags = map[uint16]bool{
+	273: true, // StripOffsets
+	288: true, // FreeOffsets
+	324: true, // TileOffsets
+	513: true, // JPEGInterchangeFormat
+}
+
+// tiffTypeSizes sizes in bytes of TIFF field types
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// assembleTIFF concatenates TIFF files (single page files written by FFmpeg) into a multi-page TIFF by
+// appending files one after another, rebasing their offsets and linking their IFDs
+func assembleTIFF(pages [][]byte) ([]byte, error) {
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no TIFF page to assemble")
+	}
+	bo, err := tiffByteOrder(pages[0])
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, tiffHeaderSize)
+	copy(out, pages[0][:tiffHeaderSize])
+	next := uint32(4) // Position of the pointer to be linked with the next IFD, starts from the header
+	for i, page := range pages {
+		pbo, err := tiffByteOrder(page)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TIFF page #%v: %w", i, err)
+		}
+		if pbo != bo {
+			return nil, fmt.Errorf("invalid TIFF page #%v: byte order mismatch", i)
+		}
+		// Page content (without header) is appended at pos, so that an offset o is moved to o + delta
+		pos := uint32(len(out))
+		delta := pos - tiffHeaderSize
+		out = append(out, page[tiffHeaderSize:]...)
+
+		ifd := bo.Uint32(page[4:8])
+		for ifd != 0 {
+			ifd += delta
+			bo.PutUint32(out[next:], ifd)
+			if next, err = rebaseIFD(out, ifd, delta, bo); err != nil {
+				return nil, fmt.Errorf("invalid TIFF page #%v: %w", i, err)
+			}
+			ifd = bo.Uint32(out[next:])
+		}
+	}
+	return out, nil
+}
+
+// rebaseIFD adds delta to offsets in the IFD located at ifd, returns the position of the next IFD pointer
+func rebaseIFD(b []byte, ifd, delta uint32, bo binary.ByteOrder) (uint32, error) {
+	if uint64(ifd)+2 > uint64(len(b)) {
+		return 0, fmt.Errorf("IFD offset out of range")
+	}
+	n := uint32(bo.Uint16(b[ifd:]))
+	end := ifd + 2 + n*tiffEntrySize
+	if uint64(end)+4 > uint64(len(b)) {
+		return 0, fmt.Errorf("IFD entries out of range")
+	}
+	for i := uint32(0); i < n; i++ {
+		e := ifd + 2 + i*tiffEntrySize
+		tag, typ, cnt := bo.Uint16(b[e:]), bo.Uint16(b[e+2:]), bo.Uint32(b[e+4:])
+		size := tiffTypeSizes[typ] * cnt
+
+		// Values longer than 4 bytes are stored elsewhere, the entry holds an offset instead
+		val := e + 8
+		if size > 4 {
+			bo.PutUint32(b[val:], bo.Uint32(b[val:])+delta)
+			val = bo.Uint32(b[val:])
+			if uint64(val)+uint64(size) > uint64(len(b)) {
+				return 0, fmt.Errorf("value of tag %v out of range", tag)
+			}
+		}
+		if !tiffOffsetTags[tag] {
+			continue
+		}
+		for j := uint32(0); j < cnt; j++ {
+			switch typ {
+			case 3: // SHORT
+				p := val + j*2
+				bo.PutUint16(b[p:], bo.Uint16(b[p:])+uint16(delta))
+			case 4: // LONG
+				p := val + j*4
+				bo.PutUint32(b[p:], bo.Uint32(b[p:])+delta)
+			}
+		}
+	}
+	return end, nil
+}
+
+// tiffPageCount returns the number of pages (IFDs) in a TIFF file
+func tiffPageCount(b []byte) (int, error) {
+	bo, err := tiffByteOrder(b)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for ifd := bo.Uint32(b[4:8]); ifd != 0; n++ {
+		if uint64(ifd)+2 > uint64(len(b)) {
+			return 0, fmt.Errorf("IFD offset out of range")
+		}
+		end := uint64(ifd) + 2 + uint64(bo.Uint16(b[ifd:]))*tiffEntrySize
+		if end+4 > uint64(len(b)) {
+			return 0, fmt.Errorf("IFD entries out of range")
+		}
+		ifd = bo.Uint32(b[end:])
+	}
+	return n, nil
+}
+
+// tiffByteOrder returns the byte order declared in TIFF header
+func tiffByteOrder(b []byte) (binary.ByteOrder, error) {
+	if len(b) < tiffHeaderSize {
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	var bo binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	if bo.Uint16(b[2:4]) != 42 {
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	return bo, nil
+}
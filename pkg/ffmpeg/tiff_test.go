@@ -0,0 +1,90 @@
+package ffmpeg
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// newTestTIFF creates a 1x1 8-bit grayscale TIFF having pixel value v, the image data is placed before IFD
+// so that both image data offset and IFD offset are non-trivial
+func newTestTIFF(v byte) []byte {
+	bo := binary.LittleEndian
+	b := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	data := uint32(len(b))
+	b = append(b, v, 0) // Pixel, padding
+	res := uint32(len(b))
+	b = append(b, make([]byte, 8)...)
+	bo.PutUint32(b[res:], uint32(v)) // XResolution numerator, stored out of IFD (RATIONAL takes 8 bytes)
+	bo.PutUint32(b[res+4:], 1)
+
+	ifd := uint32(len(b))
+	bo.PutUint32(b[4:], ifd)
+	entries := []struct {
+		tag, typ   uint16
+		cnt, value uint32
+	}{
+		{256, 3, 1, 1},    // ImageWidth
+		{257, 3, 1, 1},    // ImageLength
+		{258, 3, 1, 8},    // BitsPerSample
+		{259, 3, 1, 1},    // Compression: none
+		{262, 3, 1, 1},    // PhotometricInterpretation: BlackIsZero
+		{273, 4, 1, data}, // StripOffsets
+		{278, 3, 1, 1},    // RowsPerStrip
+		{279, 4, 1, 1},    // StripByteCounts
+		{282, 5, 1, res},  // XResolution
+	}
+	b = append(b, make([]byte, 2+len(entries)*tiffEntrySize+4)...)
+	bo.PutUint16(b[ifd:], uint16(len(entries)))
+	for i, e := range entries {
+		p := ifd + 2 + uint32(i)*tiffEntrySize
+		bo.PutUint16(b[p:], e.tag)
+		bo.PutUint16(b[p+2:], e.typ)
+		bo.PutUint32(b[p+4:], e.cnt)
+		if e.typ == 3 {
+			bo.PutUint16(b[p+8:], uint16(e.value))
+		} else {
+			bo.PutUint32(b[p+8:], e.value)
+		}
+	}
+	return b
+}
+
+func TestAssembleTIFF(t *testing.T) {
+	pages := [][]byte{newTestTIFF(10), newTestTIFF(20), newTestTIFF(30)}
+	byt, err := assembleTIFF(pages)
+	if err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	n, err := tiffPageCount(byt)
+	if err != nil {
+		t.Fatalf("expecting nil error, got %v", err)
+	}
+	if n != len(pages) {
+		t.Fatalf("expecting %v pages, got %v", len(pages), n)
+	}
+
+	// Every page must point to its own pixel & resolution after offsets are rebased
+	bo := binary.LittleEndian
+	ifd := bo.Uint32(byt[4:])
+	for i, want := range []byte{10, 20, 30} {
+		entries := uint32(bo.Uint16(byt[ifd:]))
+		for j := uint32(0); j < entries; j++ {
+			e := ifd + 2 + j*tiffEntrySize
+			switch bo.Uint16(byt[e:]) {
+			case 273:
+				if px := byt[bo.Uint32(byt[e+8:])]; px != want {
+					t.Fatalf("page #%v: expecting pixel %v, got %v", i, want, px)
+				}
+			case 282:
+				if res := bo.Uint32(byt[bo.Uint32(byt[e+8:]):]); res != uint32(want) {
+					t.Fatalf("page #%v: expecting resolution %v, got %v", i, want, res)
+				}
+			}
+		}
+		ifd = bo.Uint32(byt[ifd+2+entries*tiffEntrySize:])
+	}
+
+	if _, err = assembleTIFF([][]byte{newTestTIFF(10), []byte("not a tiff")}); err == nil {
+		t.Fatalf("expecting error assembling invalid TIFF page")
+	}
+}
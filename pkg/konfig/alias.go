@@ -0,0 +1,49 @@
+package konfig
+
+import "strings"
+
+// applyAliases copies values of old config paths to new paths in parsed config, so that renamed config keys
+// stored by old name still populate renamed fields. Paths are dot separated, e.g. svc_addr -> api.service_xxx_address.
+// Values of new paths take precedence, i.e. an old path is ignored when its new path is present
+func applyAliases(mp map[string]interface{}, aliases map[string]string) {
+	for old, cur := range aliases {
+		v, ok := lookup(mp, strings.Split(old, "."))
+		if !ok {
+			continue
+		}
+		if _, ok = lookup(mp, strings.Split(cur, ".")); ok {
+			continue
+		}
+		assign(mp, strings.Split(cur, "."), v)
+	}
+}
+
+// lookup returns the value located by path segments
+func lookup(v interface{}, segments []string) (interface{}, bool) {
+	for _, seg := range segments {
+		mp, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = mp[seg]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// assign sets the value located by path segments, missing parent maps are created.
+// Does nothing when any parent is not a map
+func assign(mp map[string]interface{}, segments []string, v interface{}) {
+	for _, seg := range segments[:len(segments)-1] {
+		child, ok := mp[seg]
+		if !ok {
+			child = make(map[string]interface{})
+			mp[seg] = child
+		}
+		if mp, ok = child.(map[string]interface{}); !ok {
+			return
+		}
+	}
+	mp[segments[len(segments)-1]] = v
+}
@@ -0,0 +1,53 @@
+package konfig
+
+import "hash/fnv"
+
+// canaryBuckets is the number of buckets keys are hashed into by CanaryValue, i.e. the granularity of fraction
+const canaryBuckets = 10000
+
+// CanaryValue returns config value for key in a blue/green manner: after a config update, the new config is returned
+// for fraction (ranging from 0 to 1) of keys, and the config before the update is returned for the others, until
+// Promote is called. Keys are hashed deterministically, so that the same key (e.g. user id) always gets the same
+// config, and keys getting the new config under a smaller fraction keep getting it under a larger one.
+// Current config is returned when there is no pending update, i.e. before the first update after creation, or after
+// Promote. Updates arriving before Promote are rolled out against the same stable config.
+// NOTE: ConfigProxy.Get is always up-to-date regardless of canary, i.e. CanaryValue only applies to its own callers
+func (m *Manager) CanaryValue(key string, fraction float64) interface{} {
+	m.cmu.RLock()
+	defer m.cmu.RUnlock()
+	if m.stable == nil {
+		return m.proxy.Get()
+	}
+	if canaryBucket(key) < fraction*canaryBuckets {
+		return m.latest.Get()
+	}
+	return m.stable.Get()
+}
+
+// Promote makes the new config universal, i.e. CanaryValue returns current config for all keys until next update
+func (m *Manager) Promote() {
+	m.cmu.Lock()
+	defer m.cmu.Unlock()
+	if m.stable != nil {
+		m.lg.Info("promoted canary config")
+	}
+	m.stable = nil
+}
+
+// rollout records the newly populated config proxy cur, which starts a canary against the previous one unless
+// there is a pending canary already
+func (m *Manager) rollout(cur ConfigProxy) {
+	m.cmu.Lock()
+	defer m.cmu.Unlock()
+	if m.stable == nil {
+		m.stable = m.latest
+	}
+	m.latest = cur
+}
+
+// canaryBucket hashes key into [0, canaryBuckets)
+func canaryBucket(key string) float64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return float64(h.Sum32() % canaryBuckets)
+}
@@ -10,7 +10,9 @@ package konfig
 // 3) Call update handlers one by one
 // 4) Call manager.ConfigProxy.Populate to update existing config
 type ConfigProxy interface {
-	// Get always returns current config value holding by ConfigProxy
+	// Get returns current config value holding by ConfigProxy. Config may be created lazily, i.e. Get may
+	// return nil or a zero value before the first Populate, therefore previous config passed to update handlers
+	// may be nil on the first update. Get is only guaranteed to return a valid config after konfig.New returns
 	Get() interface{}
 	// Populate takes a closure function as input, fills new config data into its config value
 	Populate(func(interface{}) error) error
@@ -24,6 +26,10 @@ type ConfigProxy interface {
 type ConfigUpdateHandler struct {
 	Name   string
 	Handle func(prev, cur interface{}) error
+
+	// HandleUpdate is an alternative to Handle receiving update details, e.g. changed config paths, so that
+	// handlers can act on relevant changes only. Takes precedence over Handle when set
+	HandleUpdate func(u ConfigUpdate) error
 }
 
 // NOOPHandler does nothing on config update
@@ -0,0 +1,68 @@
+package konfig
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigUpdate describes a config update, see ConfigUpdateHandler.HandleUpdate
+type ConfigUpdate struct {
+	Prev    interface{} // Previous config, may be nil on the first update, see ConfigProxy.Get
+	Cur     interface{} // Current config
+	Md5     string      // Md5 of the new config data
+	Changed []string    // Sorted dot separated config paths (by mapstructure tags) changed by the update, see changedPaths
+}
+
+// changedPaths returns sorted dot separated paths of leaf values differing between prev and cur, e.g. db.address.
+// Slices are compared as a whole. Changes under a sensitive path are reported as the sensitive path itself, so that
+// the structure of sensitive values is not revealed
+func changedPaths(prev, cur interface{}, sensitive []string) []string {
+	paths := make([]string, 0)
+	diff(toMap(reflect.ValueOf(prev)), toMap(reflect.ValueOf(cur)), "", &paths)
+
+	seen := make(map[string]bool)
+	out := make([]string, 0, len(paths))
+	for _, p := range paths {
+		for _, s := range sensitive {
+			if p == s || strings.HasPrefix(p, s+".") {
+				p = s
+				break
+			}
+		}
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// diff appends paths of differing values to out, a missing map is treated as an empty one
+func diff(prev, cur interface{}, prefix string, out *[]string) {
+	pm, pok := prev.(map[string]interface{})
+	cm, cok := cur.(map[string]interface{})
+	if (pok || prev == nil) && (cok || cur == nil) && (pok || cok) {
+		for k, v := range cm {
+			diff(pm[k], v, join(prefix, k), out)
+		}
+		for k, v := range pm {
+			if _, ok := cm[k]; !ok {
+				diff(v, nil, join(prefix, k), out)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(prev, cur) && prefix != "" {
+		*out = append(*out, prefix)
+	}
+}
+
+// join joins path prefix and key with a dot
+func join(prefix, k string) string {
+	if prefix == "" {
+		return k
+	}
+	return prefix + "." + k
+}
@@ -0,0 +1,36 @@
+package konfig
+
+import "sync/atomic"
+
+// Healthy returns whether config is in a good state, e.g. for readiness probes: false when config has never been
+// loaded successfully, or the last update failed (e.g. unable to decode, rejected by update handlers). Updates
+// ignored for being unchanged or too frequent (see BootstrapOption.MinimalInterval) do not affect health
+func (m *Manager) Healthy() bool {
+	return atomic.LoadInt32(&m.healthy) == 1
+}
+
+// Healthy returns whether all proxies are healthy, see Manager.Healthy
+func (mm *MultiManager) Healthy() bool {
+	for _, m := range mm.managers {
+		if !m.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// markHealthy records the result of the last update, see Healthy
+func (m *Manager) markHealthy(ok bool) {
+	var v int32
+	if ok {
+		v = 1
+	}
+	atomic.StoreInt32(&m.healthy, v)
+}
+
+// markHealthy marks all proxies healthy or not, e.g. when the whole update is aborted
+func (mm *MultiManager) markHealthy(ok bool) {
+	for _, m := range mm.managers {
+		m.markHealthy(ok)
+	}
+}
@@ -1,6 +1,7 @@
 package konfig
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/mitchellh/mapstructure"
@@ -8,9 +9,16 @@ import (
 	"github.com/mykube-run/kindling/pkg/log"
 	"github.com/mykube-run/kindling/pkg/utils"
 	"gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 )
 
+// SubscriptionBufferSize is the buffer size of channels returned by Manager.Subscribe,
+// values less than 1 are treated as 1
+var SubscriptionBufferSize = 1
+
 type Manager struct {
 	opt      *BootstrapOption
 	src      source.ConfigSource
@@ -18,9 +26,17 @@ type Manager struct {
 	handlers []ConfigUpdateHandler
 	lg       log.Logger
 
+	mu   sync.Mutex         // Protects subs
+	subs []chan interface{} // Subscribed channels
+
+	cmu    sync.RWMutex // Protects stable & latest
+	stable ConfigProxy  // Config before the pending canary, nil when there is no pending canary, see CanaryValue
+	latest ConfigProxy  // Config of the latest update, populated separately from proxy
+
 	unmarshalFn func([]byte, interface{}) error
 	lastUpdate  time.Time
 	lastMd5     string
+	healthy     int32 // Whether the last update succeeded, accessed atomically, see Healthy
 }
 
 // New creates a new Manager instance, which will automatically read BootstrapOption from environment & flags.
@@ -28,6 +44,9 @@ type Manager struct {
 // hdl is a series of custom update handlers, will be called sequentially after Manager is created and when config is changed.
 func New(proxy ConfigProxy, hdl ...ConfigUpdateHandler) (*Manager, error) {
 	opt := NewBootstrapOptionFromEnvFlag()
+	if opt.Logger != nil {
+		opt.Logger.Debug(fmt.Sprintf("effective bootstrap option: %v", opt))
+	}
 	return NewWithOption(proxy, opt, hdl...)
 }
 
@@ -45,6 +64,9 @@ func NewWithOption(proxy ConfigProxy, opt *BootstrapOption, hdl ...ConfigUpdateH
 	if err = m.readAndUpdate(); err != nil {
 		return nil, err
 	}
+	if isNil(proxy.Get()) {
+		return nil, fmt.Errorf("config proxy should return a valid config after being populated")
+	}
 	return m, m.watch()
 }
 
@@ -54,6 +76,55 @@ func (m *Manager) Register(hdl ...ConfigUpdateHandler) *Manager {
 	return m
 }
 
+// Subscribe returns a channel emitting the new config value on every successful update, as an alternative to
+// update handlers. The channel is buffered, the oldest value is dropped when subscriber is not able to keep up,
+// so that update is never blocked. Call Unsubscribe when the channel is no longer used.
+func (m *Manager) Subscribe() <-chan interface{} {
+	size := SubscriptionBufferSize
+	if size < 1 /* Unbuffered channel would never accept the value without blocking, see notify */ {
+		size = 1
+	}
+	c := make(chan interface{}, size)
+	m.mu.Lock()
+	m.subs = append(m.subs, c)
+	m.mu.Unlock()
+	return c
+}
+
+// Unsubscribe removes and closes the channel returned by Subscribe
+func (m *Manager) Unsubscribe(c <-chan interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, v := range m.subs {
+		if v == c {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			close(v)
+			return
+		}
+	}
+}
+
+// notify sends the current config value to all subscribers, drops the oldest value when channel is full
+func (m *Manager) notify(cur interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.subs {
+		for {
+			select {
+			case c <- cur:
+			default:
+				// Channel is full, drop the oldest value and try again
+				select {
+				case <-c:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
 // readAndUpdate is called after Manager is created
 func (m *Manager) readAndUpdate() error {
 	byt, err := m.src.Read()
@@ -79,44 +150,93 @@ func (m *Manager) onUpdate(evt source.Event) error {
 		return nil
 	}
 
-	// Construct a config populate closure function
-	fn, err := m.populateFunc(evt.Data)
+	err := m.update(evt.Md5, evt.Data)
+	observe(m.opt.Observers, evt.Md5, err)
+	return err
+}
+
+// update parses and applies config data
+func (m *Manager) update(md5 string, data []byte) error {
+	tmp, err := parse(m.unmarshalFn, data, m.opt.Aliases)
 	if err != nil {
+		m.markHealthy(false)
 		return fmt.Errorf("error creating config populate function: %w", err)
 	}
+	pu, err := m.prepare(md5, tmp)
+	if err != nil {
+		m.markHealthy(false)
+		return err
+	}
+	return m.commit(pu)
+}
+
+// pendingUpdate a config update populated into a new proxy, which is not applied to the original proxy yet
+type pendingUpdate struct {
+	fn  func(interface{}) error // Config populate closure function
+	cur ConfigProxy             // The new proxy populated with new config
+	u   ConfigUpdate
+}
+
+// prepare populates parsed config data into a new proxy
+func (m *Manager) prepare(md5 string, tmp map[string]interface{}) (*pendingUpdate, error) {
+	// Construct a config populate closure function
+	fn := populateFunc(tmp)
 
 	// Create a new proxy and populate it
 	cur := m.proxy.New()
-	if err = cur.Populate(fn); err != nil {
-		return fmt.Errorf("error populating new config: %w", err)
+	if err := cur.Populate(fn); err != nil {
+		return nil, fmt.Errorf("error populating new config: %w", err)
 	}
+	u := ConfigUpdate{Prev: m.proxy.Get(), Cur: cur.Get(), Md5: md5}
+	u.Changed = changedPaths(u.Prev, u.Cur, m.opt.Sensitive)
+	return &pendingUpdate{fn: fn, cur: cur, u: u}, nil
+}
+
+// commit calls update handlers, then populates the new config back to original proxy
+func (m *Manager) commit(pu *pendingUpdate) (err error) {
+	defer func() { m.markHealthy(err == nil) }()
 
 	// Handle config change
+	u := pu.u
 	for _, hdl := range m.handlers {
-		if err = withRecover(hdl, m.proxy.Get(), cur.Get()); err != nil {
+		if err = withRecover(hdl, u); err != nil {
 			return fmt.Errorf("handler [%s] failed: %w", hdl.Name, err)
 		}
 		m.lg.Trace(fmt.Sprintf("handler [%s] finished", hdl.Name))
 	}
 
 	// Populate the new config back to original config
-	if err = m.proxy.Populate(fn); err != nil {
+	if err = m.proxy.Populate(pu.fn); err != nil {
 		return fmt.Errorf("error populating config: %w", err)
 	}
+	initial := m.lastMd5 == ""
 	m.lastUpdate = time.Now()
-	m.lastMd5 = evt.Md5
-	m.lg.Info(fmt.Sprintf("updated config, md5: %v", m.lastMd5))
+	m.lastMd5 = u.Md5
+	if initial || len(u.Changed) == 0 /* Initial changes are relative to an empty config */ {
+		m.lg.Info(fmt.Sprintf("updated config, md5: %v", m.lastMd5))
+	} else {
+		m.lg.Info(fmt.Sprintf("updated config: %v, md5: %v", strings.Join(u.Changed, ", "), m.lastMd5))
+	}
+	m.rollout(pu.cur)
+	m.notify(m.proxy.Get())
 	return nil
 }
 
-func (m *Manager) populateFunc(byt []byte) (func(interface{}) error, error) {
-	// Unmarshal config bytes into a temporary map, which will be used by mapstructure decoder later
+// parse unmarshals config bytes into a temporary map, which will be used by mapstructure decoder later
+func parse(unmarshalFn func([]byte, interface{}) error, byt []byte, aliases map[string]string) (map[string]interface{}, error) {
 	var tmp map[string]interface{}
-	if err := m.unmarshalFn(byt, &tmp); err != nil {
+	if err := unmarshalFn(byt, &tmp); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %w", err)
 	}
+	if tmp != nil {
+		applyAliases(tmp, aliases)
+	}
+	return tmp, nil
+}
 
-	fn := func(v interface{}) error {
+// populateFunc returns a closure function decoding parsed config into config value
+func populateFunc(tmp map[string]interface{}) func(interface{}) error {
+	return func(v interface{}) error {
 		dc := &mapstructure.DecoderConfig{
 			WeaklyTypedInput: true,
 			ZeroFields:       true, // this must be set to avoid array/map being merged
@@ -128,7 +248,6 @@ func (m *Manager) populateFunc(byt []byte) (func(interface{}) error, error) {
 		}
 		return decoder.Decode(tmp)
 	}
-	return fn, nil
 }
 
 func (m *Manager) watch() error {
@@ -155,8 +274,8 @@ func (m *Manager) watch() error {
 }
 
 func validateParams(proxy ConfigProxy, opt *BootstrapOption) error {
-	if proxy.Get() == nil {
-		return fmt.Errorf("config proxy should always return a valid config")
+	if proxy == nil {
+		return fmt.Errorf("config proxy must be provided")
 	}
 	if opt == nil {
 		return fmt.Errorf("bootstrap option must be provided")
@@ -174,21 +293,56 @@ func newManager(proxy ConfigProxy, opt *BootstrapOption, src source.ConfigSource
 		proxy:    proxy,
 		handlers: hdl,
 		lg:       opt.Logger,
+
+		unmarshalFn: unmarshalFunc(opt.Format),
 	}
-	switch opt.Format {
+	return m
+}
+
+// unmarshalFunc returns unmarshal function of config format, see BootstrapOption.Format
+func unmarshalFunc(format string) func([]byte, interface{}) error {
+	switch format {
 	case "json":
-		m.unmarshalFn = json.Unmarshal
+		return json.Unmarshal
 	case "yaml":
-		m.unmarshalFn = yaml.Unmarshal
+		return yaml.Unmarshal
+	case "auto":
+		return unmarshalAuto
 	}
-	return m
+	return nil
+}
+
+// unmarshalAuto sniffs config format on every read, config starting with '{' or '[' is unmarshalled as JSON,
+// otherwise as YAML. This tolerates format drift of config source, e.g. a JSON config being replaced by YAML
+func unmarshalAuto(byt []byte, v interface{}) error {
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(byt, []byte("\xef\xbb\xbf")) /* UTF-8 BOM */, " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return json.Unmarshal(trimmed, v)
+	}
+	return yaml.Unmarshal(byt, v)
+}
+
+// isNil returns whether v is nil or holds a nil pointer (e.g. a lazily created config)
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
 }
 
-func withRecover(hdl ConfigUpdateHandler, prev, cur interface{}) (err error) {
+func withRecover(hdl ConfigUpdateHandler, u ConfigUpdate) (err error) {
 	defer func() {
 		if re := recover(); re != nil {
 			err = fmt.Errorf("panic during config update: %v", re)
 		}
 	}()
-	return hdl.Handle(prev, cur)
+	if hdl.HandleUpdate != nil {
+		return hdl.HandleUpdate(u)
+	}
+	return hdl.Handle(u.Prev, u.Cur)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/hashicorp/consul/api"
 	"github.com/mykube-run/kindling/pkg/konfig/source"
+	"github.com/mykube-run/kindling/pkg/konfig/testutil"
 	"github.com/nacos-group/nacos-sdk-go/clients"
 	"github.com/nacos-group/nacos-sdk-go/common/constant"
 	"github.com/nacos-group/nacos-sdk-go/vo"
@@ -12,6 +13,8 @@ import (
 	"github.com/rs/zerolog/log"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"os"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -113,6 +116,47 @@ func TestFileManager(t *testing.T) {
 	}
 }
 
+func TestEnvManager(t *testing.T) {
+	interval := source.EnvPollInterval
+	source.EnvPollInterval = time.Millisecond * 100
+	defer func() { source.EnvPollInterval = interval }()
+
+	env := map[string]string{
+		"KCONFIG_TEST_INT":         "42",
+		"KCONFIG_TEST_STR":         "another string",
+		"KCONFIG_TEST_ARR":         "foo",
+		"KCONFIG_TEST_MAP__BAR":    "36",
+		"KCONFIG_TEST_EMBED__INT":  "36",
+		"KCONFIG_TEST_CHILD__INT":  "36",
+		"KCONFIG_TEST_CHILD__STR":  "bar",
+		"KCONFIG_TEST_CHILD":       "conflicts with child paths",
+		"KCONFIG_TEST_EMPTY____OK": "has empty path",
+	}
+	for k, v := range env {
+		_ = os.Setenv(k, v)
+	}
+	defer func() {
+		for k := range env {
+			_ = os.Unsetenv(k)
+		}
+	}()
+
+	// Test creating a new Manager
+	opt := NewBootstrapOption().WithType(source.Env).WithKey("KCONFIG_TEST")
+	if _, err := NewWithOption(Proxy, opt); err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	if v := Proxy.Get().(testConfig); v.IntVal != 42 || v.StrVal != "another string" {
+		t.Fatalf("unexpected config: %+v", v)
+	}
+
+	// Change the config
+	time.Sleep(time.Second * 5)
+	_ = os.Setenv("KCONFIG_TEST_INT", "36")
+	time.Sleep(time.Second)
+	checkConf2(Proxy.Get().(testConfig), t)
+}
+
 func TestConsulManager(t *testing.T) {
 	var (
 		intVal  = 0
@@ -289,6 +333,555 @@ func TestNacosManager(t *testing.T) {
 	}
 }
 
+type secretConfig struct {
+	DB struct {
+		Address  string `mapstructure:"address"`
+		Password string `mapstructure:"password"`
+	} `mapstructure:"db"`
+	Token string `mapstructure:"token"`
+}
+
+type secretProxy struct {
+	c *secretConfig
+}
+
+func (p *secretProxy) Get() interface{} {
+	return *p.c
+}
+
+func (p *secretProxy) Populate(fn func(interface{}) error) error {
+	return fn(p.c)
+}
+
+func (p *secretProxy) New() ConfigProxy {
+	return &secretProxy{c: new(secretConfig)}
+}
+
+func TestManager_RedactedSnapshot(t *testing.T) {
+	fn := "/tmp/kconfig-redact-test.json"
+	_ = os.Remove(fn)
+	conf := `{"db": {"address": "localhost:3306", "password": "secret"}, "token": "secret"}`
+	if err := os.WriteFile(fn, []byte(conf), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn).WithSensitive("db.password", "token", "not.exist")
+	m, err := NewWithOption(&secretProxy{c: new(secretConfig)}, opt)
+	if err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+
+	snapshot := m.RedactedSnapshot().(map[string]interface{})
+	db := snapshot["db"].(map[string]interface{})
+	if db["password"] != RedactedValue {
+		t.Fatalf("expecting db.password to be masked, got %v", db["password"])
+	}
+	if snapshot["token"] != RedactedValue {
+		t.Fatalf("expecting token to be masked, got %v", snapshot["token"])
+	}
+	if db["address"] != "localhost:3306" {
+		t.Fatalf("expecting db.address to be intact, got %v", db["address"])
+	}
+	if m.proxy.Get().(secretConfig).DB.Password != "secret" {
+		t.Fatalf("expecting config value not to be modified")
+	}
+}
+
+// opaque has no exported fields
+type opaque struct {
+	v int
+}
+
+// version implements fmt.Stringer
+type version struct {
+	Major, Minor int
+}
+
+func (v version) String() string {
+	return fmt.Sprintf("v%d.%d", v.Major, v.Minor)
+}
+
+func TestRedact_OpaqueStruct(t *testing.T) {
+	now := time.Now()
+	v := struct {
+		Time    time.Time `mapstructure:"time"`
+		Opaque  opaque    `mapstructure:"opaque"`
+		Version version   `mapstructure:"version"`
+		Secret  string    `mapstructure:"secret"`
+	}{Time: now, Opaque: opaque{v: 1}, Version: version{Major: 1, Minor: 2}, Secret: "secret"}
+
+	snapshot := redact(v, []string{"secret"}).(map[string]interface{})
+	if tm, ok := snapshot["time"].(time.Time); !ok || !tm.Equal(now) {
+		t.Fatalf("expecting time to be kept as time.Time, got %v", snapshot["time"])
+	}
+	if o, ok := snapshot["opaque"].(opaque); !ok || o.v != 1 {
+		t.Fatalf("expecting struct without exported fields to be kept, got %v", snapshot["opaque"])
+	}
+	if fmt.Sprintf("%v", snapshot["version"]) != "v1.2" {
+		t.Fatalf("expecting Stringer to be kept, got %v", snapshot["version"])
+	}
+	if snapshot["secret"] != RedactedValue {
+		t.Fatalf("expecting secret to be masked, got %v", snapshot["secret"])
+	}
+}
+
+func TestManager_Subscribe(t *testing.T) {
+	fn := "/tmp/kconfig-subscribe-test.json"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn)
+	opt.MinimalInterval = 0
+	p := &proxy{c: new(testConfig)}
+	m, err := NewWithOption(p, opt)
+	if err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	c := m.Subscribe()
+	defer m.Unsubscribe(c)
+
+	if err = os.WriteFile(fn, []byte(conf2), os.ModePerm); err != nil {
+		t.Fatalf("error writing new config to the test config file: %v", err)
+	}
+	select {
+	case v := <-c:
+		checkConf2(v.(testConfig), t)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting new config from subscribed channel")
+	}
+
+	// Channels are buffered even if SubscriptionBufferSize is 0, the oldest value is dropped
+	SubscriptionBufferSize = 0
+	defer func() { SubscriptionBufferSize = 1 }()
+	c0 := m.Subscribe()
+	defer m.Unsubscribe(c0)
+	done := make(chan struct{})
+	go func() {
+		m.notify("foo")
+		m.notify("bar")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expecting notify not to be blocked")
+	}
+	if v := <-c0; v != "bar" {
+		t.Fatalf("expecting the latest value, got %v", v)
+	}
+}
+
+// lazyProxy creates config on the first Populate
+type lazyProxy struct {
+	c *testConfig
+}
+
+func (p *lazyProxy) Get() interface{} {
+	if p.c == nil {
+		return nil
+	}
+	return *p.c
+}
+
+func (p *lazyProxy) Populate(fn func(interface{}) error) error {
+	if p.c == nil {
+		p.c = new(testConfig)
+	}
+	return fn(p.c)
+}
+
+func (p *lazyProxy) New() ConfigProxy {
+	return new(lazyProxy)
+}
+
+func TestManager_LazyProxy(t *testing.T) {
+	fn := "/tmp/kconfig-lazy-test.json"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	var prev interface{} = testConfig{}
+	handler := ConfigUpdateHandler{
+		Name: "test",
+		Handle: func(p, cur interface{}) error {
+			prev = p
+			return nil
+		},
+	}
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn)
+	p := new(lazyProxy)
+	if _, err := NewWithOption(p, opt, handler); err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	if prev != nil {
+		t.Fatalf("expecting previous config to be nil on the first update, got %v", prev)
+	}
+	checkConf1(p.Get().(testConfig), t)
+
+	// Zero value config is populated as well
+	zp := &proxy{c: new(testConfig)}
+	if _, err := NewWithOption(zp, opt); err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	checkConf1(zp.Get().(testConfig), t)
+}
+
+func TestManager_AutoFormat(t *testing.T) {
+	fn := "/tmp/kconfig-auto-test.conf"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn)
+	opt.Format = "auto"
+	opt.MinimalInterval = 0
+	p := &proxy{c: new(testConfig)}
+	m, err := NewWithOption(p, opt)
+	if err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	checkConf1(p.Get().(testConfig), t)
+	c := m.Subscribe()
+	defer m.Unsubscribe(c)
+
+	// Config is switched to YAML
+	conf := "int: 36\nstr: another string\narr: foo\nmap:\n  bar: 36\nembed:\n  int: 36\nchild:\n  int: 36\n  str: bar\n"
+	if err = os.WriteFile(fn, []byte(conf), os.ModePerm); err != nil {
+		t.Fatalf("error writing new config to the test config file: %v", err)
+	}
+	select {
+	case v := <-c:
+		checkConf2(v.(testConfig), t)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting new config from subscribed channel")
+	}
+}
+
+func TestManager_Aliases(t *testing.T) {
+	fn := "/tmp/kconfig-alias-test.conf"
+	_ = os.Remove(fn)
+	// Keys stored by old names: "integer" was renamed to "int", "child.string" was renamed to "child.str", while
+	// "text" is ignored since its renamed key "str" is present
+	conf := `{"integer": 42, "str": "foo", "text": "bar", "arr": ["bar", "zee"], "map": {"foo": 42}, "embed": {"int": 42}, "child": {"int": 42, "string": "foo"}}`
+	if err := os.WriteFile(fn, []byte(conf), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn).
+		WithAlias("integer", "int").WithAlias("child.string", "child.str").WithAlias("text", "str")
+	p := &proxy{c: new(testConfig)}
+	if _, err := NewWithOption(p, opt); err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	checkConf1(p.Get().(testConfig), t)
+}
+
+func TestManager_ChangedPaths(t *testing.T) {
+	fn := "/tmp/kconfig-changed-test.json"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	updates := make(chan ConfigUpdate, 2)
+	hdl := ConfigUpdateHandler{
+		Name: "changed",
+		HandleUpdate: func(u ConfigUpdate) error {
+			updates <- u
+			return nil
+		},
+	}
+	// Changes under sensitive paths are reported as the sensitive path itself
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn).WithSensitive("child")
+	opt.MinimalInterval = 0
+	if _, err := NewWithOption(&proxy{c: new(testConfig)}, opt, hdl); err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	u := <-updates
+	if expected := []string{"arr", "child", "embed.int", "int", "map.foo", "str"}; !reflect.DeepEqual(u.Changed, expected) {
+		t.Fatalf("expecting changed paths %v on the initial update, got %v", expected, u.Changed)
+	}
+
+	if err := os.WriteFile(fn, []byte(conf2), os.ModePerm); err != nil {
+		t.Fatalf("error writing new config to the test config file: %v", err)
+	}
+	select {
+	case u = <-updates:
+		if expected := []string{"arr", "child", "embed.int", "int", "map.bar", "map.foo", "str"}; !reflect.DeepEqual(u.Changed, expected) {
+			t.Fatalf("expecting changed paths %v, got %v", expected, u.Changed)
+		}
+		checkConf1(u.Prev.(testConfig), t)
+		checkConf2(u.Cur.(testConfig), t)
+		if u.Md5 == "" {
+			t.Fatalf("expecting md5 of the new config")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting config update to be handled")
+	}
+
+	// Unchanged values are not reported
+	if changed := changedPaths(u.Cur, u.Cur, nil); len(changed) != 0 {
+		t.Fatalf("expecting no changed path, got %v", changed)
+	}
+}
+
+func TestManager_CanaryValue(t *testing.T) {
+	fn := "/tmp/kconfig-canary-test.json"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn)
+	opt.MinimalInterval = 0
+	m, err := NewWithOption(&proxy{c: new(testConfig)}, opt)
+	if err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	// Current config is returned before any update
+	checkConf1(m.CanaryValue("key", 0).(testConfig), t)
+
+	c := m.Subscribe()
+	defer m.Unsubscribe(c)
+	if err = os.WriteFile(fn, []byte(conf2), os.ModePerm); err != nil {
+		t.Fatalf("error writing new config to the test config file: %v", err)
+	}
+	select {
+	case <-c:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting config update to be handled")
+	}
+
+	canary := func(fraction float64) (keys map[string]bool) {
+		keys = make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("user-%v", i)
+			if m.CanaryValue(key, fraction).(testConfig).IntVal == 36 /* conf2 */ {
+				keys[key] = true
+			}
+		}
+		return keys
+	}
+	if n := len(canary(0)); n != 0 {
+		t.Fatalf("expecting no key to get the new config, got %v", n)
+	}
+	if n := len(canary(1)); n != 1000 {
+		t.Fatalf("expecting all keys to get the new config, got %v", n)
+	}
+	small, large := canary(0.1), canary(0.3)
+	if n := len(small); n < 50 || n > 150 {
+		t.Fatalf("expecting about 10%% of keys to get the new config, got %v", n)
+	}
+	if n := len(large); n < 230 || n > 370 {
+		t.Fatalf("expecting about 30%% of keys to get the new config, got %v", n)
+	}
+	for k := range small {
+		if !large[k] {
+			t.Fatalf("expecting key %v to keep getting the new config under a larger fraction", k)
+		}
+	}
+	checkConf2(m.proxy.Get().(testConfig), t)
+
+	m.Promote()
+	if n := len(canary(0)); n != 1000 {
+		t.Fatalf("expecting all keys to get the new config after promotion, got %v", n)
+	}
+}
+
+func TestManager_Healthy(t *testing.T) {
+	fn := "/tmp/kconfig-healthy-test.json"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn)
+	opt.MinimalInterval = 0
+	src, err := NewConfigSource(opt)
+	if err != nil {
+		t.Fatalf("error creating config source: %v", err)
+	}
+	// Updates setting int to 0 are rejected
+	hdl := ConfigUpdateHandler{
+		Name: "validate",
+		HandleUpdate: func(u ConfigUpdate) error {
+			if u.Cur.(testConfig).IntVal == 0 {
+				return fmt.Errorf("int must not be 0")
+			}
+			return nil
+		},
+	}
+	m := newManager(&proxy{c: new(testConfig)}, opt, src, hdl)
+	if m.Healthy() {
+		t.Fatalf("expecting manager to be unhealthy before config is loaded")
+	}
+	if err = m.readAndUpdate(); err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	if !m.Healthy() {
+		t.Fatalf("expecting manager to be healthy after config is loaded")
+	}
+	if err = m.watch(); err != nil {
+		t.Fatalf("error watching config: %v", err)
+	}
+
+	healthy := func(expected bool) {
+		deadline := time.Now().Add(time.Second * 3)
+		for m.Healthy() != expected && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if m.Healthy() != expected {
+			t.Fatalf("expecting healthy to be %v", expected)
+		}
+	}
+	for _, c := range []struct {
+		conf    string
+		healthy bool
+	}{
+		{conf: `{"int": `, healthy: false},   // Unable to decode
+		{conf: conf2, healthy: true},         // Recovered
+		{conf: `{"int": 0}`, healthy: false}, // Rejected by handler
+		{conf: conf1, healthy: true},         // Recovered
+	} {
+		if err = os.WriteFile(fn, []byte(c.conf), os.ModePerm); err != nil {
+			t.Fatalf("error writing new config to the test config file: %v", err)
+		}
+		healthy(c.healthy)
+	}
+}
+
+// childProxy populates childConfig
+type childProxy struct {
+	c *childConfig
+}
+
+func (p *childProxy) Get() interface{} {
+	return *p.c
+}
+
+func (p *childProxy) Populate(fn func(interface{}) error) error {
+	return fn(p.c)
+}
+
+func (p *childProxy) New() ConfigProxy {
+	return &childProxy{c: new(childConfig)}
+}
+
+func TestManager_MultiProxy(t *testing.T) {
+	fn := "/tmp/kconfig-multi-test.json"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn).WithSensitive("child.str")
+	opt.MinimalInterval = 0
+	root, child := &proxy{c: new(testConfig)}, &childProxy{c: new(childConfig)}
+	mm, err := NewMultiProxy(nil, opt, map[string]ConfigProxy{"": root, "child": child})
+	if err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	checkConf1(root.Get().(testConfig), t)
+	if c := child.Get().(childConfig); c.IntVal != 42 || c.StrVal != "foo" {
+		t.Fatalf("unexpected child config: %+v", c)
+	}
+
+	// Handlers are scoped per proxy, sensitive paths are relative to the proxy
+	updates := make(chan ConfigUpdate, 1)
+	mm.Register("child", ConfigUpdateHandler{
+		Name: "child",
+		HandleUpdate: func(u ConfigUpdate) error {
+			updates <- u
+			return nil
+		},
+	})
+	c := mm.Manager("").Subscribe()
+	defer mm.Manager("").Unsubscribe(c)
+	if err = os.WriteFile(fn, []byte(conf2), os.ModePerm); err != nil {
+		t.Fatalf("error writing new config to the test config file: %v", err)
+	}
+	select {
+	case u := <-updates:
+		if expected := []string{"int", "str"}; !reflect.DeepEqual(u.Changed, expected) {
+			t.Fatalf("expecting changed paths %v, got %v", expected, u.Changed)
+		}
+		if cur := u.Cur.(childConfig); cur.IntVal != 36 || cur.StrVal != "bar" {
+			t.Fatalf("unexpected child config: %+v", cur)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting child config update to be handled")
+	}
+	select {
+	case v := <-c:
+		checkConf2(v.(testConfig), t)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("expecting new config from subscribed channel")
+	}
+	if snapshot := mm.Manager("child").RedactedSnapshot().(map[string]interface{}); snapshot["str"] != RedactedValue {
+		t.Fatalf("expecting child.str to be redacted, got %v", snapshot["str"])
+	}
+
+	if _, err = NewMultiProxy(nil, opt, map[string]ConfigProxy{"missing": &childProxy{c: new(childConfig)}}); err == nil {
+		t.Fatalf("expecting error populating proxy from a missing config path")
+	}
+}
+
+func TestManager_MultiProxyHandlerFailure(t *testing.T) {
+	fn := "/tmp/kconfig-multi-failure-test.json"
+	_ = os.Remove(fn)
+	if err := os.WriteFile(fn, []byte(conf1), os.ModePerm); err != nil {
+		t.Fatalf("error writing to the test config file: %v", err)
+	}
+
+	opt := NewBootstrapOption().WithType(source.File).WithKey(fn)
+	opt.MinimalInterval = 0
+	root, child := &proxy{c: new(testConfig)}, &childProxy{c: new(childConfig)}
+	mm, err := NewMultiProxy(nil, opt, map[string]ConfigProxy{"": root, "child": child})
+	if err != nil {
+		t.Fatalf("error initializing manager: %v", err)
+	}
+	lastMd5 := mm.lastMd5
+
+	// The child handler fails once, the root proxy is updated while the child proxy is not
+	failed := false
+	mm.Register("child", ConfigUpdateHandler{
+		Name: "child",
+		HandleUpdate: func(u ConfigUpdate) error {
+			if !failed {
+				failed = true
+				return fmt.Errorf("child handler failed")
+			}
+			return nil
+		},
+	})
+	evt := source.Event{Md5: "multi-failure", Data: []byte(conf2)}
+	if err = mm.onUpdate(evt); err == nil {
+		t.Fatalf("expecting error when child handler failed")
+	}
+	checkConf2(root.Get().(testConfig), t)
+	if c := child.Get().(childConfig); c.IntVal != 42 {
+		t.Fatalf("expecting child config not to be updated, got %+v", c)
+	}
+	if mm.lastMd5 != lastMd5 {
+		t.Fatalf("expecting md5 not to be recorded when any of the proxies failed, got %v", mm.lastMd5)
+	}
+
+	// The same config is applied again instead of being ignored as not changed
+	if err = mm.onUpdate(evt); err != nil {
+		t.Fatalf("expecting config to be applied, got error: %v", err)
+	}
+	if c := child.Get().(childConfig); c.IntVal != 36 || c.StrVal != "bar" {
+		t.Fatalf("expecting child config to be updated, got %+v", c)
+	}
+	if mm.lastMd5 != evt.Md5 {
+		t.Fatalf("expecting md5 to be recorded, got %v", mm.lastMd5)
+	}
+}
+
 func TestNewBootstrapOptionFromEnvFlag1(t *testing.T) {
 	opt := NewBootstrapOptionFromEnvFlag()
 	if opt.Type != "" {
@@ -305,43 +898,78 @@ func TestNewBootstrapOptionFromEnvFlag2(t *testing.T) {
 }
 
 func checkConf1(conf testConfig, t *testing.T) {
-	if conf.IntVal != 42 {
-		t.Fatalf("invalid config before update, int val: %v", conf.IntVal)
-	}
-	if conf.StrVal != "foo" {
-		t.Fatalf("invalid config before update, str val: %v", conf.StrVal)
-	}
-	if len(conf.ArrVal) != 2 || conf.ArrVal[0] != "bar" || conf.ArrVal[1] != "zee" {
-		t.Fatalf("invalid config before update, arr val: %v", conf.ArrVal)
-	}
-	if conf.MapVal == nil || len(conf.MapVal) != 1 || conf.MapVal["foo"] != 42 {
-		t.Fatalf("invalid config before update, map val: %v", conf.MapVal)
-	}
-	if conf.EmbedStruct.IntVal != 42 {
-		t.Fatalf("invalid config before update, embed struct val: %v", conf.EmbedStruct)
-	}
-	if conf.Child.IntVal != 42 || conf.Child.StrVal != "foo" {
-		t.Fatalf("invalid config before update, child val: %v", conf.Child)
+	t.Helper()
+	expected := testConfig{
+		IntVal: 42,
+		StrVal: "foo",
+		ArrVal: []string{"bar", "zee"},
+		MapVal: map[string]int{"foo": 42},
+		Child:  childConfig{IntVal: 42, StrVal: "foo"},
+	}
+	expected.EmbedStruct.IntVal = 42
+	if !testutil.AssertEquals(t, conf, expected) {
+		t.FailNow()
 	}
 }
 
 func checkConf2(conf testConfig, t *testing.T) {
-	if conf.IntVal != 36 {
-		t.Fatalf("invalid config after update, int val: %v", conf.IntVal)
-	}
-	if conf.StrVal != "another string" {
-		t.Fatalf("invalid config after update, str val: %v", conf.StrVal)
-	}
-	if len(conf.ArrVal) != 1 || conf.ArrVal[0] != "foo" {
-		t.Fatalf("invalid config after update, arr val: %v", conf.ArrVal)
+	t.Helper()
+	expected := testConfig{
+		IntVal: 36,
+		StrVal: "another string",
+		ArrVal: []string{"foo"},
+		MapVal: map[string]int{"bar": 36},
+		Child:  childConfig{IntVal: 36, StrVal: "bar"},
+	}
+	expected.EmbedStruct.IntVal = 36
+	if !testutil.AssertEquals(t, conf, expected) {
+		t.FailNow()
 	}
-	if conf.MapVal == nil || len(conf.MapVal) != 1 || conf.MapVal["bar"] != 36 {
-		t.Fatalf("invalid config after update, map val: %v", conf.MapVal)
-	}
-	if conf.EmbedStruct.IntVal != 36 {
-		t.Fatalf("invalid config after update, embed struct val: %v", conf.EmbedStruct)
-	}
-	if conf.Child.IntVal != 36 || conf.Child.StrVal != "bar" {
-		t.Fatalf("invalid config after update, child val: %v", conf.Child)
+}
+
+// recordingObserver records update results
+type recordingObserver struct {
+	mu      sync.Mutex
+	results []string
+}
+
+func (o *recordingObserver) OnUpdate(md5 string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.results = append(o.results, md5)
+}
+
+func (o *recordingObserver) OnUpdateFailure(md5 string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.results = append(o.results, fmt.Sprintf("%s: failed", md5))
+}
+
+func TestManager_Observer(t *testing.T) {
+	obs := new(recordingObserver)
+	opt := NewBootstrapOption().WithType(source.File).WithKey("/tmp/kconfig-observer-test.json").WithObserver(obs)
+	opt.MinimalInterval = 0
+	hdl := ConfigUpdateHandler{
+		Name: "validate",
+		HandleUpdate: func(u ConfigUpdate) error {
+			if u.Cur.(testConfig).IntVal == 0 {
+				return fmt.Errorf("int must not be 0")
+			}
+			return nil
+		},
+	}
+	m := newManager(&proxy{c: new(testConfig)}, opt, nil, hdl)
+	for _, evt := range []source.Event{
+		{Md5: "1", Data: []byte(conf1)},
+		{Md5: "1", Data: []byte(conf1)},        // Unchanged, not observed
+		{Md5: "2", Data: []byte(`{"int": `)},   // Unable to decode
+		{Md5: "3", Data: []byte(`{"int": 0}`)}, // Rejected by handler
+		{Md5: "4", Data: []byte(conf2)},
+	} {
+		_ = m.onUpdate(evt)
+	}
+	expected := []string{"1", "2: failed", "3: failed", "4"}
+	if !reflect.DeepEqual(obs.results, expected) {
+		t.Fatalf("expecting observed results %v, got %v", expected, obs.results)
 	}
 }
@@ -0,0 +1,207 @@
+package konfig
+
+import (
+	"fmt"
+	"github.com/mykube-run/kindling/pkg/konfig/source"
+	"github.com/mykube-run/kindling/pkg/log"
+	"github.com/mykube-run/kindling/pkg/utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MultiManager populates multiple config proxies from one config source, see NewMultiProxy
+type MultiManager struct {
+	opt      *BootstrapOption
+	src      source.ConfigSource
+	lg       log.Logger
+	managers map[string]*Manager // Config path => Manager of the proxy
+	paths    []string            // Sorted config paths, proxies are updated in this order
+
+	unmarshalFn func([]byte, interface{}) error
+	lastUpdate  time.Time
+	lastMd5     string
+}
+
+// NewMultiProxy creates a MultiManager populating multiple independent config proxies from one config source.
+// proxies is keyed by dot separated config path (by mapstructure tags) within the config document, e.g. db,
+// an empty path populates the proxy with the whole document. Config is read and parsed only once per update,
+// all proxies are updated together, and an update is aborted before any handler is called when any proxy fails to
+// populate. A new config source is created from opt when src is nil.
+// Handlers are scoped per proxy, see MultiManager.Register. Sensitive paths are relative to the whole document.
+func NewMultiProxy(src source.ConfigSource, opt *BootstrapOption, proxies map[string]ConfigProxy) (*MultiManager, error) {
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("config proxy must be provided")
+	}
+	for path, proxy := range proxies {
+		if err := validateParams(proxy, opt); err != nil {
+			return nil, fmt.Errorf("invalid config proxy [%s]: %w", path, err)
+		}
+	}
+	if src == nil {
+		var err error
+		if src, err = NewConfigSource(opt); err != nil {
+			return nil, fmt.Errorf("failed to create config source: %w", err)
+		}
+	}
+
+	mm := &MultiManager{
+		opt:         opt,
+		src:         src,
+		lg:          opt.Logger,
+		managers:    make(map[string]*Manager),
+		unmarshalFn: unmarshalFunc(opt.Format),
+	}
+	for path, proxy := range proxies {
+		mm.managers[path] = newManager(proxy, scopedOption(opt, path), src)
+		mm.paths = append(mm.paths, path)
+	}
+	sort.Strings(mm.paths)
+
+	if err := mm.readAndUpdate(); err != nil {
+		return nil, err
+	}
+	for path, m := range mm.managers {
+		if isNil(m.proxy.Get()) {
+			return nil, fmt.Errorf("config proxy [%s] should return a valid config after being populated", path)
+		}
+	}
+	return mm, mm.watch()
+}
+
+// Manager returns the Manager of the proxy populated from path, which can be used to subscribe, take redacted
+// snapshots, etc. Returns nil when there is no such proxy.
+// NOTE: Manager of a MultiManager does not watch config source itself
+func (mm *MultiManager) Manager(path string) *Manager {
+	return mm.managers[path]
+}
+
+// Register registers extra event handlers of the proxy populated from path after creation
+func (mm *MultiManager) Register(path string, hdl ...ConfigUpdateHandler) *MultiManager {
+	if m, ok := mm.managers[path]; ok {
+		m.Register(hdl...)
+	}
+	return mm
+}
+
+// readAndUpdate is called after MultiManager is created
+func (mm *MultiManager) readAndUpdate() error {
+	byt, err := mm.src.Read()
+	if err != nil {
+		return fmt.Errorf("error reading config: %w", err)
+	}
+	evt := source.Event{
+		Md5:  utils.Md5(byt),
+		Data: byt,
+	}
+	return mm.onUpdate(evt)
+}
+
+// onUpdate handles config update event, config is parsed once and then populated into all proxies
+func (mm *MultiManager) onUpdate(evt source.Event) error {
+	// Compare md5 and update time
+	if mm.lastMd5 == evt.Md5 || evt.Data == nil {
+		mm.lg.Trace("config was not changed and will be ignored (having the same md5 or was nil)")
+		return nil
+	}
+	if mm.lastUpdate.Add(mm.opt.MinimalInterval).After(time.Now()) {
+		mm.lg.Warn("config was changed not long ago and will be ignored")
+		return nil
+	}
+
+	err := mm.update(evt.Md5, evt.Data)
+	observe(mm.opt.Observers, evt.Md5, err)
+	return err
+}
+
+// update parses config data once, and applies it to all proxies
+func (mm *MultiManager) update(md5 string, data []byte) error {
+	tmp, err := parse(mm.unmarshalFn, data, mm.opt.Aliases)
+	if err != nil {
+		mm.markHealthy(false)
+		return fmt.Errorf("error creating config populate function: %w", err)
+	}
+
+	// Populate all proxies before applying any of them, so that an invalid config is not partially applied
+	pending := make([]*pendingUpdate, len(mm.paths))
+	for i, path := range mm.paths {
+		sub, err := subConfig(tmp, path)
+		if err != nil {
+			mm.markHealthy(false)
+			return err
+		}
+		if pending[i], err = mm.managers[path].prepare(md5, sub); err != nil {
+			mm.markHealthy(false)
+			return fmt.Errorf("config proxy [%s]: %w", path, err)
+		}
+	}
+	for i, path := range mm.paths {
+		if e := mm.managers[path].commit(pending[i]); e != nil {
+			err = fmt.Errorf("config proxy [%s]: %w", path, e)
+		}
+	}
+	// Md5 is recorded only when all proxies are updated, so that the same config is applied again on next event
+	// (e.g. config source resync) when any of the handlers failed, instead of being ignored as not changed
+	if err != nil {
+		return err
+	}
+	mm.lastUpdate = time.Now()
+	mm.lastMd5 = md5
+	return nil
+}
+
+func (mm *MultiManager) watch() error {
+	eventC, err := mm.src.Watch()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case evt, ok := <-eventC:
+				if !ok {
+					mm.lg.Trace("config manager closed, stop watching")
+					return
+				}
+				if e := mm.onUpdate(evt); e != nil {
+					mm.lg.Error(fmt.Sprintf("update config failed, md5: %v, error: %s", evt.Md5, e))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// subConfig returns parsed config located by dot separated path, empty path returns the whole config
+func subConfig(tmp map[string]interface{}, path string) (map[string]interface{}, error) {
+	if path == "" {
+		return tmp, nil
+	}
+	v, ok := lookup(tmp, strings.Split(path, "."))
+	if !ok {
+		return nil, fmt.Errorf("config path [%s] was not found", path)
+	}
+	sub, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config path [%s] is not an object", path)
+	}
+	return sub, nil
+}
+
+// scopedOption returns a copy of opt for the proxy populated from path, sensitive paths are made relative to path.
+// Aliases are applied to the whole document by MultiManager, thus removed
+func scopedOption(opt *BootstrapOption, path string) *BootstrapOption {
+	cp := *opt
+	cp.Aliases = nil
+	if path == "" {
+		return &cp
+	}
+	cp.Sensitive = nil
+	for _, s := range opt.Sensitive {
+		if strings.HasPrefix(s, path+".") {
+			cp.Sensitive = append(cp.Sensitive, strings.TrimPrefix(s, path+"."))
+		}
+	}
+	return &cp
+}
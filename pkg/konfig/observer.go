@@ -0,0 +1,23 @@
+package konfig
+
+// Observer is notified of config update results, e.g. to export metrics of config health, see
+// BootstrapOption.WithObserver. Updates ignored for being unchanged or too frequent (see
+// BootstrapOption.MinimalInterval) are not observed. Observers are called synchronously, they should return quickly
+type Observer interface {
+	// OnUpdate is called after config with md5 is applied
+	OnUpdate(md5 string)
+	// OnUpdateFailure is called when config with md5 fails to be applied, e.g. unable to decode, rejected by
+	// update handlers
+	OnUpdateFailure(md5 string, err error)
+}
+
+// observe notifies observers of the result of an update
+func observe(observers []Observer, md5 string, err error) {
+	for _, o := range observers {
+		if err != nil {
+			o.OnUpdateFailure(md5, err)
+		} else {
+			o.OnUpdate(md5)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package prometheus exports config update metrics with Prometheus. It's a separate module requiring
+// github.com/prometheus/client_golang, so that konfig itself does not depend on it
+package prometheus
+
+import (
+	prom "github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// Collector implements konfig.Observer, exporting metrics of config updates:
+//   - config_updates_total: number of config updates applied
+//   - config_update_failures_total: number of config updates failed, e.g. unable to decode, rejected by handlers
+//   - config_last_update_timestamp_seconds: unix timestamp of the last config update applied
+//   - config_current_md5: always 1, labeled by md5 of the config currently applied
+//
+// Register it on konfig.BootstrapOption, e.g.:
+//
+//	c, err := prometheus.NewCollector(nil)
+//	opt := konfig.NewBootstrapOptionFromEnvFlag().WithObserver(c)
+type Collector struct {
+	mu  sync.Mutex
+	md5 string // Md5 of the config currently applied
+
+	updates    prom.Counter
+	failures   prom.Counter
+	lastUpdate prom.Gauge
+	current    *prom.GaugeVec
+}
+
+// NewCollector creates a Collector and registers its metrics with reg, prometheus.DefaultRegisterer is used when
+// reg is nil
+func NewCollector(reg prom.Registerer) (*Collector, error) {
+	if reg == nil {
+		reg = prom.DefaultRegisterer
+	}
+	c := &Collector{
+		updates: prom.NewCounter(prom.CounterOpts{
+			Name: "config_updates_total",
+			Help: "Number of config updates applied.",
+		}),
+		failures: prom.NewCounter(prom.CounterOpts{
+			Name: "config_update_failures_total",
+			Help: "Number of config updates failed to be applied.",
+		}),
+		lastUpdate: prom.NewGauge(prom.GaugeOpts{
+			Name: "config_last_update_timestamp_seconds",
+			Help: "Unix timestamp of the last config update applied.",
+		}),
+		current: prom.NewGaugeVec(prom.GaugeOpts{
+			Name: "config_current_md5",
+			Help: "Md5 of the config currently applied, always 1.",
+		}, []string{"md5"}),
+	}
+	for _, m := range []prom.Collector{c.updates, c.failures, c.lastUpdate, c.current} {
+		if err := reg.Register(m); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// OnUpdate implements konfig.Observer
+func (c *Collector) OnUpdate(md5 string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updates.Inc()
+	c.lastUpdate.Set(float64(time.Now().UnixNano()) / 1e9)
+	if c.md5 != "" {
+		c.current.DeleteLabelValues(c.md5)
+	}
+	c.md5 = md5
+	c.current.WithLabelValues(md5).Set(1)
+}
+
+// OnUpdateFailure implements konfig.Observer
+func (c *Collector) OnUpdateFailure(string, error) {
+	c.failures.Inc()
+}
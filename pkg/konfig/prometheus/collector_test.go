@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"fmt"
+	"github.com/mykube-run/kindling/pkg/konfig"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+var _ konfig.Observer = (*Collector)(nil)
+
+func TestCollector(t *testing.T) {
+	reg := prom.NewRegistry()
+	c, err := NewCollector(reg)
+	if err != nil {
+		t.Fatalf("error creating collector: %v", err)
+	}
+
+	start := float64(time.Now().Unix())
+	c.OnUpdate("md5-1")
+	c.OnUpdateFailure("md5-2", fmt.Errorf("invalid config"))
+	c.OnUpdate("md5-3")
+
+	if v := testutil.ToFloat64(c.updates); v != 2 {
+		t.Fatalf("expecting 2 updates, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.failures); v != 1 {
+		t.Fatalf("expecting 1 failure, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.lastUpdate); v < start {
+		t.Fatalf("expecting last update timestamp to be updated, got %v", v)
+	}
+	if n := testutil.CollectAndCount(c.current); n != 1 {
+		t.Fatalf("expecting only the current md5 to be exported, got %v", n)
+	}
+	if v := testutil.ToFloat64(c.current.WithLabelValues("md5-3")); v != 1 {
+		t.Fatalf("expecting current md5 to be md5-3")
+	}
+}
@@ -0,0 +1,111 @@
+package konfig
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// RedactedValue replaces sensitive config values in redacted snapshots
+const RedactedValue = "******"
+
+// RedactedSnapshot returns current config as a map keyed by mapstructure tags, with sensitive paths
+// (see BootstrapOption.Sensitive) masked by RedactedValue. It is safe for logging and debug endpoints.
+func (m *Manager) RedactedSnapshot() interface{} {
+	return redact(m.proxy.Get(), m.opt.Sensitive)
+}
+
+// redact converts v to a map and masks given dot separated paths
+func redact(v interface{}, paths []string) interface{} {
+	snapshot := toMap(reflect.ValueOf(v))
+	for _, p := range paths {
+		mask(snapshot, strings.Split(p, "."))
+	}
+	return snapshot
+}
+
+// mask replaces the value located by path segments with RedactedValue, does nothing when path does not exist
+func mask(v interface{}, segments []string) {
+	mp, ok := v.(map[string]interface{})
+	if !ok || len(segments) == 0 {
+		return
+	}
+	child, ok := mp[segments[0]]
+	if !ok {
+		return
+	}
+	if len(segments) == 1 {
+		mp[segments[0]] = RedactedValue
+		return
+	}
+	mask(child, segments[1:])
+}
+
+var (
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// toMap converts struct (and nested struct, map, slice) values into generic values reflectively,
+// struct fields are keyed by mapstructure tags. Structs implementing fmt.Stringer or encoding.TextMarshaler
+// (e.g. time.Time) and structs without exported fields are kept as they are
+func toMap(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		if t.Implements(stringerType) || t.Implements(textMarshalerType) || !hasExportedField(t) {
+			return v.Interface()
+		}
+		out := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" /* unexported */ {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			out[name] = toMap(v.Field(i))
+		}
+		return out
+	case reflect.Map:
+		out := make(map[string]interface{})
+		iter := v.MapRange()
+		for iter.Next() {
+			out[fmt.Sprintf("%v", iter.Key().Interface())] = toMap(iter.Value())
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		out := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out = append(out, toMap(v.Index(i)))
+		}
+		return out
+	case reflect.Invalid:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
+
+// hasExportedField reports whether struct type t has any exported field
+func hasExportedField(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mykube-run/kindling/pkg/log"
+	"github.com/mykube-run/kindling/pkg/utils"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	EnvPollInterval = time.Second * 10 // Interval of polling environment variables for changes
+	EnvDelimiter    = "__"             // Delimiter of nested config paths in environment variable names
+)
+
+type env struct {
+	lg      log.Logger
+	prefix  string
+	eventC  chan Event
+	done    chan struct{}
+	mu      sync.Mutex // Protects closing & md5
+	closing bool
+	md5     string // Md5 of the config last read or sent
+}
+
+// NewEnvSource creates a config source reading environment variables starting with prefix, e.g. MYAPP. Names are
+// trimmed of the prefix, lower cased and split by EnvDelimiter into nested config paths, e.g. MYAPP_DB__ADDRESS
+// populates db.address. Values are strings, config is read as JSON. Environment variables are polled every
+// EnvPollInterval, since they rarely change at runtime
+func NewEnvSource(prefix string, lg log.Logger) (ConfigSource, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("environment variable prefix not provided")
+	}
+	if !strings.HasSuffix(prefix, "_") {
+		prefix += "_"
+	}
+	s := &env{
+		lg:     lg,
+		prefix: prefix,
+		eventC: make(chan Event, 1),
+		done:   make(chan struct{}),
+	}
+	return s, nil
+}
+
+func (s *env) Read() ([]byte, error) {
+	byt, err := s.read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config from environment variables (%v): %w", s.prefix, err)
+	}
+	s.mu.Lock()
+	s.md5 = utils.Md5(byt)
+	s.mu.Unlock()
+	return byt, nil
+}
+
+func (s *env) Watch() (<-chan Event, error) {
+	go s.watch()
+	return s.eventC, nil
+}
+
+func (s *env) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closing {
+		s.closing = true
+		close(s.done)
+		close(s.eventC)
+	}
+	return nil
+}
+
+func (s *env) watch() {
+	ticker := time.NewTicker(EnvPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.lg.Trace("env watcher has been closed, stop watching")
+			return
+		case <-ticker.C:
+			s.poll()
+		}
+	}
+}
+
+// poll reads environment variables, sends an event when config changes
+func (s *env) poll() {
+	byt, err := s.read()
+	if err != nil {
+		s.lg.Error(fmt.Sprintf("failed to read updated config: %v", err))
+		return
+	}
+	e := Event{
+		Md5:  utils.Md5(byt),
+		Data: byt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		s.lg.Trace("config source is closing, ignore event")
+		return
+	}
+	if e.Md5 == s.md5 {
+		return
+	}
+	select {
+	case s.eventC <- e:
+		s.lg.Trace(fmt.Sprintf("prefix: %v, md5: %v", s.prefix, e.Md5))
+		s.md5 = e.Md5
+	default:
+		// The previous event is not consumed yet, retry on next poll
+	}
+}
+
+// read builds nested config from environment variables starting with prefix and marshals it into JSON. Values at
+// child paths take precedence over the value at their parent path, e.g. MYAPP_DB is ignored when MYAPP_DB__ADDRESS
+// is present
+func (s *env) read() ([]byte, error) {
+	values := make(map[string]string)
+	names := make([]string, 0)
+	for _, v := range os.Environ() {
+		i := strings.Index(v, "=")
+		if i < 0 || !strings.HasPrefix(v[:i], s.prefix) || i == len(s.prefix) {
+			continue
+		}
+		values[v[:i]] = v[i+1:]
+		names = append(names, v[:i])
+	}
+	// Child paths are sorted after their parent path, iterate in reverse order so that they are set first
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	m := make(map[string]interface{})
+	for _, name := range names {
+		path := strings.Split(strings.ToLower(name[len(s.prefix):]), EnvDelimiter)
+		if !setEnvPath(m, path, values[name]) {
+			s.lg.Warn(fmt.Sprintf("ignored environment variable %v having empty path or conflicting with others", name))
+		}
+	}
+	return json.Marshal(m)
+}
+
+// setEnvPath sets value at the nested path of m, returns false when path has empty elements, or conflicts with paths
+// set before (i.e. a value is set at the same or a parent path, or values are set at child paths)
+func setEnvPath(m map[string]interface{}, path []string, value string) bool {
+	for i, k := range path {
+		if k == "" {
+			return false
+		}
+		if i == len(path)-1 {
+			if _, ok := m[k]; ok {
+				return false
+			}
+			m[k] = value
+			return true
+		}
+		switch child := m[k].(type) {
+		case nil:
+			c := make(map[string]interface{})
+			m[k] = c
+			m = c
+		case map[string]interface{}:
+			m = child
+		default:
+			return false
+		}
+	}
+	return false
+}
@@ -22,4 +22,5 @@ const (
 	Etcd   ConfigSourceType = "etcd" // etcd v3
 	Consul ConfigSourceType = "consul"
 	Nacos  ConfigSourceType = "nacos"
+	Env    ConfigSourceType = "env" // environment variables, key is the name prefix, see NewEnvSource
 )
@@ -15,6 +15,8 @@ func NewConfigSource(opt *BootstrapOption) (source.ConfigSource, error) {
 		return source.NewEtcdSource(opt.Addrs, opt.Group, opt.Key, opt.Logger)
 	case source.Nacos:
 		return source.NewNacosSource(opt.Addrs, opt.Namespace, opt.Group, opt.Key, opt.Logger)
+	case source.Env:
+		return source.NewEnvSource(opt.Key, opt.Logger)
 	default:
 		return nil, fmt.Errorf("unsupported config source type: %v", opt.Type)
 	}
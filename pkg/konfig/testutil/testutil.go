@@ -0,0 +1,122 @@
+// Package testutil provides helpers for testing configs managed by konfig
+package testutil
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Getter is the part of konfig.ConfigProxy used by AssertConfigEquals
+type Getter interface {
+	Get() interface{}
+}
+
+// TestingT is the part of testing.TB used by assertions, *testing.T and *testing.B satisfy it
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// AssertConfigEquals asserts that current config of proxy deeply equals to expected, field level differences are
+// reported through t.Errorf. Returns whether the assertion succeeds
+func AssertConfigEquals(t TestingT, proxy Getter, expected interface{}) bool {
+	t.Helper()
+	return AssertEquals(t, proxy.Get(), expected)
+}
+
+// AssertEquals is like AssertConfigEquals, but compares config value actual instead of proxy
+func AssertEquals(t TestingT, actual, expected interface{}) bool {
+	t.Helper()
+	diffs := Diff(actual, expected)
+	if len(diffs) == 0 {
+		return true
+	}
+	t.Errorf("config mismatch:\n\t%v", strings.Join(diffs, "\n\t"))
+	return false
+}
+
+// Diff deeply compares actual with expected, returns field level differences in the form of
+// "<path>: expected <expected>, got <actual>", e.g. "Child.StrVal: expected \"bar\", got \"foo\"".
+// Pointers are dereferenced before comparing, nil and empty slices (or maps) are considered equal
+func Diff(actual, expected interface{}) []string {
+	diffs := make([]string, 0)
+	diff(&diffs, "", reflect.ValueOf(actual), reflect.ValueOf(expected))
+	return diffs
+}
+
+func diff(diffs *[]string, path string, a, e reflect.Value) {
+	a, e = indirect(a), indirect(e)
+	if !a.IsValid() || !e.IsValid() {
+		if a.IsValid() != e.IsValid() {
+			report(diffs, path, a, e)
+		}
+		return
+	}
+	if a.Type() != e.Type() {
+		report(diffs, path, a, e)
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			diff(diffs, join(path, a.Type().Field(i).Name), a.Field(i), e.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		if a.Len() != e.Len() {
+			report(diffs, path, a, e)
+			return
+		}
+		for i := 0; i < a.Len(); i++ {
+			diff(diffs, fmt.Sprintf("%v[%v]", path, i), a.Index(i), e.Index(i))
+		}
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, k := range append(a.MapKeys(), e.MapKeys()...) {
+			keys[fmt.Sprintf("%v", k)] = k
+		}
+		names := make([]string, 0, len(keys))
+		for n := range keys {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			diff(diffs, fmt.Sprintf("%v[%v]", path, n), a.MapIndex(keys[n]), e.MapIndex(keys[n]))
+		}
+	default:
+		if format(a) != format(e) {
+			report(diffs, path, a, e)
+		}
+	}
+}
+
+// indirect dereferences pointers and interfaces, returns an invalid value for nil
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		v = v.Elem()
+	}
+	return v
+}
+
+func report(diffs *[]string, path string, a, e reflect.Value) {
+	if path == "" {
+		path = "<root>"
+	}
+	*diffs = append(*diffs, fmt.Sprintf("%v: expected %v, got %v", path, format(e), format(a)))
+}
+
+func format(v reflect.Value) string {
+	if !v.IsValid() {
+		return "<missing>"
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
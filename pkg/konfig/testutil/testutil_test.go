@@ -0,0 +1,112 @@
+package testutil
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type config struct {
+	IntVal int
+	StrVal string
+	ArrVal []string
+	MapVal map[string]int
+	Child  *childConfig
+}
+
+type childConfig struct {
+	IntVal int
+}
+
+type proxy struct {
+	c config
+}
+
+func (p *proxy) Get() interface{} {
+	return p.c
+}
+
+// recorder records reported errors instead of failing the test
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertConfigEquals(t *testing.T) {
+	p := &proxy{c: config{
+		IntVal: 42,
+		StrVal: "foo",
+		ArrVal: []string{"bar", "zee"},
+		MapVal: map[string]int{"foo": 42},
+		Child:  &childConfig{IntVal: 42},
+	}}
+	expected := config{
+		IntVal: 42,
+		StrVal: "foo",
+		ArrVal: []string{"bar", "zee"},
+		MapVal: map[string]int{"foo": 42},
+		Child:  &childConfig{IntVal: 42},
+	}
+	if !AssertConfigEquals(t, p, expected) {
+		t.Fatalf("expecting configs to be equal")
+	}
+	// Pointers are dereferenced
+	if !AssertConfigEquals(t, p, &expected) {
+		t.Fatalf("expecting config to be equal to pointer of expected config")
+	}
+
+	// Nil and empty slices (or maps) are considered equal
+	p.c.ArrVal, p.c.MapVal = nil, nil
+	expected.ArrVal, expected.MapVal = []string{}, map[string]int{}
+	if !AssertConfigEquals(t, p, expected) {
+		t.Fatalf("expecting nil and empty slices (or maps) to be equal")
+	}
+}
+
+func TestAssertConfigEquals_Mismatch(t *testing.T) {
+	p := &proxy{c: config{
+		IntVal: 42,
+		StrVal: "foo",
+		ArrVal: []string{"bar", "zee"},
+		MapVal: map[string]int{"foo": 42},
+		Child:  &childConfig{IntVal: 42},
+	}}
+	expected := config{
+		IntVal: 36,
+		StrVal: "foo",
+		ArrVal: []string{"bar", "foo"},
+		MapVal: map[string]int{"bar": 36},
+		Child:  &childConfig{IntVal: 36},
+	}
+
+	r := new(recorder)
+	if AssertConfigEquals(r, p, expected) {
+		t.Fatalf("expecting assertion to fail")
+	}
+	if len(r.errors) != 1 {
+		t.Fatalf("expecting 1 error reported, got %v", len(r.errors))
+	}
+	for _, d := range []string{
+		"IntVal: expected 36, got 42",
+		`ArrVal[1]: expected "foo", got "zee"`,
+		"MapVal[bar]: expected 36, got <missing>",
+		"MapVal[foo]: expected <missing>, got 42",
+		"Child.IntVal: expected 36, got 42",
+	} {
+		if !strings.Contains(r.errors[0], d) {
+			t.Fatalf("expecting diff '%v' in report:\n%v", d, r.errors[0])
+		}
+	}
+	if strings.Contains(r.errors[0], "StrVal") {
+		t.Fatalf("expecting equal fields not to be reported:\n%v", r.errors[0])
+	}
+
+	if diffs := Diff(42, "42"); len(diffs) != 1 || diffs[0] != `<root>: expected "42", got 42` {
+		t.Fatalf("unexpected diffs of different types: %v", diffs)
+	}
+}
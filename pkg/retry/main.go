@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"context"
 	"github.com/rs/zerolog/log"
 	"time"
 )
@@ -31,3 +32,22 @@ func WithInterval(fn func() error, max int, interval time.Duration) error {
 	}
 	return err
 }
+
+// WithIntervalContext is like WithInterval, but stops retrying once ctx is done, even if retries remain,
+// the last error of fn is returned in that case
+func WithIntervalContext(ctx context.Context, fn func() error, max int, interval time.Duration) error {
+	mr := max
+	err := fn()
+
+	for err != nil && mr >= 0 {
+		mr -= 1
+		log.Debug().Err(err).Msg("retry func on error")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		err = fn()
+	}
+	return err
+}
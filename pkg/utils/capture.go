@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"math"
 	"path"
 	"strconv"
 	"strings"
@@ -36,11 +37,16 @@ func GetBatchSize(interval float32, fragment int) int {
 }
 
 func GetImageSecond(idx int64, rate float32) float64 {
+	return GetImageSecondFrom(idx, rate, 0)
+}
+
+// GetImageSecondFrom is like GetImageSecond, but capturing starts from second start instead of 0
+func GetImageSecondFrom(idx int64, rate float32, start float64) float64 {
 	if rate == 0 {
-		return 0.0
+		return start
 	}
-	// idx 始终从 1 开始, 我们希望截图时间从 0 秒开始
-	return float64(idx-1) / float64(rate)
+	// idx 始终从 1 开始, 我们希望截图时间从 start 秒开始
+	return start + float64(idx-1)/float64(rate)
 }
 
 func GetImagePosition(idx int64, rate float32) int64 {
@@ -52,10 +58,15 @@ func GetImagePosition(idx int64, rate float32) int64 {
 }
 
 func GetSegmentStart(idx int64, seg int) float64 {
+	return GetSegmentStartFrom(idx, seg, 0)
+}
+
+// GetSegmentStartFrom is like GetSegmentStart, but slicing starts from second start instead of 0
+func GetSegmentStartFrom(idx int64, seg int, start float64) float64 {
 	if seg == 0 {
-		return 0.0
+		return start
 	}
-	return float64(idx) * float64(seg)
+	return start + float64(idx)*float64(seg)
 }
 
 func GetMaxFrameLimit(max int, rate float32) int {
@@ -74,3 +85,27 @@ func FilePath2Index(in string) (int64, error) {
 func FilePath2Suffix(in string) string {
 	return strings.TrimLeft(path.Ext(in), ".")
 }
+
+// GetExpectedImageCount returns the expected number of captured images for media lasting dur seconds
+func GetExpectedImageCount(dur float64, rate float32) int {
+	if dur <= 0 || rate <= 0 {
+		return 0
+	}
+	return int(math.Ceil(dur * float64(rate)))
+}
+
+// GetExpectedFrameCount returns the expected number of captured images when capturing every n frame
+func GetExpectedFrameCount(frames int64, n int) int {
+	if frames <= 0 || n <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(frames) / float64(n)))
+}
+
+// GetExpectedSegmentCount returns the expected number of sliced segments for media lasting dur seconds
+func GetExpectedSegmentCount(dur float64, seg int) int {
+	if dur <= 0 || seg <= 0 {
+		return 0
+	}
+	return int(math.Ceil(dur / float64(seg)))
+}